@@ -2,10 +2,21 @@ package client
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/flynn/go-tuf/data"
 	"github.com/flynn/go-tuf/util"
@@ -21,6 +32,29 @@ type LocalStore interface {
 	// SetMeta persists the given top-level metadata in local storage, the
 	// name taking the same format as the keys returned by GetMeta.
 	SetMeta(name string, meta json.RawMessage) error
+
+	// DeleteMeta deletes the given metadata from local storage, the name
+	// taking the same format as the keys returned by GetMeta. It is not an
+	// error to delete metadata which does not exist.
+	DeleteMeta(name string) error
+}
+
+// StateLocalStore is a LocalStore which can also persist client state which
+// is not metadata, namely the time of the last update made by UpdateIfStale
+// and the minimum root version set with WithMinRootVersion.
+//
+// If the LocalStore passed to NewClient implements StateLocalStore, the state
+// is persisted so that it applies after the client is restarted, otherwise
+// it is only kept in memory. MemoryLocalStore, FileLocalStore and
+// DirLocalStore all implement it, keeping the state apart from the metadata.
+type StateLocalStore interface {
+	LocalStore
+
+	// GetState returns the client state persisted with SetState.
+	GetState() (map[string]json.RawMessage, error)
+
+	// SetState persists the given client state entry.
+	SetState(name string, state json.RawMessage) error
 }
 
 // RemoteStore downloads top-level metadata and target files from a remote
@@ -46,12 +80,72 @@ type RemoteStore interface {
 	GetTarget(path string) (stream io.ReadCloser, size int64, err error)
 }
 
+// ContextRemoteStore is a RemoteStore which supports cancelling downloads
+// using a context.Context.
+//
+// If the RemoteStore passed to NewClient implements this interface, the
+// context given to UpdateContext or DownloadContext is passed to the store
+// so that it can abort in-flight requests.
+type ContextRemoteStore interface {
+	RemoteStore
+
+	// GetMetaContext is like GetMeta but aborts if ctx is cancelled.
+	GetMetaContext(ctx context.Context, name string) (stream io.ReadCloser, size int64, err error)
+
+	// GetTargetContext is like GetTarget but aborts if ctx is cancelled.
+	GetTargetContext(ctx context.Context, path string) (stream io.ReadCloser, size int64, err error)
+}
+
+// MirroredRemoteStore is a RemoteStore which serves files from multiple
+// mirrors (see MultiRemoteStore).
+//
+// If the RemoteStore passed to NewClient implements this interface, metadata
+// which fails verification when downloaded from one mirror is downloaded
+// from the next mirror instead.
+type MirroredRemoteStore interface {
+	RemoteStore
+
+	// Mirrors returns the mirrors in the order they should be tried.
+	Mirrors() []RemoteStore
+}
+
+// RangeRemoteStore is a RemoteStore which can download part of a target
+// file, so that interrupted downloads into a ResumableDestination can be
+// resumed rather than restarted.
+type RangeRemoteStore interface {
+	RemoteStore
+
+	// GetTargetRange is like GetTargetContext but downloads the target
+	// starting at the given byte offset.
+	//
+	// `size` is the size of the remaining data from offset, -1 indicating
+	// an unknown length.
+	//
+	// `err` is ErrRangeNotSupported if the remote cannot serve the file
+	// from the given offset.
+	GetTargetRange(ctx context.Context, path string, offset int64) (stream io.ReadCloser, size int64, err error)
+}
+
 // Client provides methods for fetching updates from a remote repository and
 // downloading remote target files.
 type Client struct {
 	local  LocalStore
 	remote RemoteStore
 
+	// remoteMtx is held for reading while remote is in use, and for
+	// writing while it is replaced (see SetRemoteStore)
+	remoteMtx sync.RWMutex
+
+	// mtx protects the trusted metadata state below (the metadata versions,
+	// targets, expires, localMeta, db, consistentSnapshot, updateStats and
+	// stats), and local while CheckUpdate, ForceUpdate or SetLocalStore
+	// replace it. It is
+	// held for writing by operations which change the state, and for reading
+	// by accessors.
+	//
+	// When both are needed, remoteMtx must be acquired before mtx.
+	mtx sync.RWMutex
+
 	// The following four fields represent the versions of metatdata either
 	// from local storage or from recently downloaded metadata
 	rootVer      int
@@ -59,10 +153,22 @@ type Client struct {
 	snapshotVer  int
 	timestampVer int
 
+	// snapshotJSON is the snapshot.json which snapshotVer was read from,
+	// used to reject a different snapshot.json with the same version
+	snapshotJSON json.RawMessage
+
 	// targets is the list of available targets, either from local storage
 	// or from recently downloaded targets metadata
 	targets data.Files
 
+	// timestampCustom is the custom data in the trusted timestamp.json (see
+	// TimestampCustom)
+	timestampCustom json.RawMessage
+
+	// expires contains the expiry time of each top-level role's metadata,
+	// either from local storage or from recently downloaded metadata
+	expires map[string]time.Time
+
 	// localMeta is the raw metadata from local storage and is used to
 	// check whether remote metadata is present locally
 	localMeta map[string]json.RawMessage
@@ -73,13 +179,455 @@ type Client struct {
 	// consistentSnapshot indicates whether the remote storage is using
 	// consistent snapshots (as specified in root.json)
 	consistentSnapshot bool
+
+	// downloadProgress is called as target data is downloaded (see
+	// SetDownloadProgress)
+	downloadProgress DownloadProgressFunc
+
+	// maxMetaSize is the maximum size of metadata downloaded without a
+	// known length (see SetMaxMetaSize)
+	maxMetaSize int64
+
+	// versionedMeta indicates that the remote storage publishes consistent
+	// snapshots with version-prefixed metadata (see WithConsistentSnapshots)
+	versionedMeta bool
+
+	// retryAttempts and retryBackoff control retrying of failed remote
+	// requests (see WithRetry)
+	retryAttempts int
+	retryBackoff  func(attempt int) time.Duration
+
+	// clock is used to check whether metadata has expired (see WithClock)
+	clock verify.Clock
+
+	// maxRootRotations is the maximum number of root versions a single
+	// update may advance the trusted root by, or 0 if there is no limit
+	// (see WithMaxRootRotations)
+	maxRootRotations int
+
+	// minRootVersion is the lowest root version the client will trust, or 0
+	// if there is no minimum (see WithMinRootVersion)
+	minRootVersion int
+
+	// minRootVersionSaved is whether minRootVersion is known to be saved in
+	// local storage
+	minRootVersionSaved bool
+
+	// lastUpdate is the time of the last successful update made by
+	// UpdateIfStale, which is also persisted if the local store is a
+	// StateLocalStore
+	lastUpdate time.Time
+
+	// maxTargets is the maximum number of targets accepted in a downloaded
+	// targets.json, or 0 if there is no limit (see WithMaxTargets)
+	maxTargets int
+
+	// metaTempDir and metaTempThreshold control downloading large metadata
+	// via a temporary file (see WithMetaTempDir)
+	metaTempDir       string
+	metaTempThreshold int64
+
+	// targetValidator is called with the custom metadata of each updated
+	// target (see SetTargetValidator)
+	targetValidator TargetValidatorFunc
+
+	// metaCache caches metadata decoded from local storage, or is nil if
+	// caching is disabled (see WithMetaCacheSize)
+	metaCache *metaCache
+
+	// rootRotationHandler is called when an update restarts with a newly
+	// downloaded root.json (see WithRootRotationHandler)
+	rootRotationHandler func(oldVer, newVer int)
+
+	// targetURLFunc maps target names to the paths they are downloaded
+	// from, or is nil to use the default paths (see WithTargetURLFunc)
+	targetURLFunc func(name string, meta data.FileMeta) string
+
+	// targetCache caches downloaded target data by hash, or is nil if
+	// caching is disabled (see WithTargetContentCache)
+	targetCache *targetCache
+
+	// targetPathAllowlist contains the normalized prefixes of the targets
+	// which may be downloaded, or is nil if any target may be (see
+	// WithTargetPathAllowlist)
+	targetPathAllowlist []string
+
+	// updateStats tracks the data transferred by the most recent update
+	// (see LastUpdateStats)
+	updateStats UpdateStats
+
+	// stats contains cumulative counts of the paths taken by updates (see
+	// Stats)
+	stats Stats
+
+	// timestampCurrent indicates that the last timestamp.json downloaded
+	// from the remote store was fully processed by a successful update, so
+	// a conditional request may be made for the next one (see
+	// HTTPRemoteStore). It is also cleared by SetRemoteStore while holding
+	// remoteMtx for writing.
+	timestampCurrent bool
+}
+
+// ClientOption configures optional Client behaviour in NewClient.
+type ClientOption func(*Client)
+
+// WithMaxMetaSize sets the maximum size of top-level metadata as described
+// in SetMaxMetaSize. As options cannot return errors, a non-positive n keeps
+// the default of 50 KiB; use SetMaxMetaSize to have it rejected instead.
+func WithMaxMetaSize(n int64) ClientOption {
+	return func(c *Client) {
+		if n > 0 {
+			c.maxMetaSize = n
+		}
+	}
+}
+
+// WithRetry makes the client attempt each remote request up to maxAttempts
+// times, waiting backoff(attempt) between attempts (or not at all if backoff
+// is nil).
+//
+// Only errors returned by the RemoteStore are retried, verification failures
+// and ErrNotFound are returned immediately. If all attempts fail, the last
+// error is returned wrapped in ErrRetryFailed.
+func WithRetry(maxAttempts int, backoff func(attempt int) time.Duration) ClientOption {
+	return func(c *Client) {
+		c.retryAttempts = maxAttempts
+		c.retryBackoff = backoff
+	}
+}
+
+// WithConsistentSnapshots makes the client download metadata and targets
+// from a repository which publishes consistent snapshots as specified by
+// newer versions of the TUF spec, with metadata named VERSION.ROLE.json and
+// targets named HASH.FILENAME.
+//
+// Metadata versions are taken from the referencing metadata (e.g. the
+// snapshot.json version listed in timestamp.json), and metadata without a
+// known version (including timestamp.json) is downloaded by its plain name.
+// Metadata is still stored locally as ROLE.json.
+//
+// When root.json changes, each intermediate VERSION.root.json is downloaded
+// and verified using the keys of the previous version in turn, as required
+// by the spec, and the update fails if any of them is missing.
+//
+// This option is not needed for repositories published by this package:
+// when the trusted root.json declares consistent_snapshot, the client
+// downloads metadata (other than timestamp.json) as HASH.ROLE.json and
+// targets as HASH.FILENAME without any configuration.
+func WithConsistentSnapshots(enabled bool) ClientOption {
+	return func(c *Client) {
+		c.versionedMeta = enabled
+	}
+}
+
+// WithClock sets the clock used to check whether metadata has expired,
+// defaulting to the system time.
+func WithClock(clock verify.Clock) ClientOption {
+	return func(c *Client) {
+		c.clock = clock
+	}
+}
+
+// WithMaxRootRotations limits the number of versions a single update may
+// advance the trusted root by to n, returning ErrTooManyRootRotations if the
+// remote root is further ahead. Non-positive values remove the limit.
+//
+// With a limit set, the client walks the chain of intermediate roots by
+// downloading VERSION.root.json for each version following the trusted root,
+// checking that each is signed by the keys of the previous one, before
+// downloading the latest root.json. The update fails with
+// ErrMissingRemoteMetadata if root.json is newer than the last
+// VERSION.root.json found, so that no intermediate root can be skipped.
+func WithMaxRootRotations(n int) ClientOption {
+	return func(c *Client) {
+		c.maxRootRotations = n
+	}
+}
+
+// WithRootRotationHandler sets a function which is called when an update
+// downloads a newer root.json and restarts using it, with the versions of
+// the previously trusted root and the new root. This happens when the
+// trusted root has expired or its keys no longer verify the other metadata,
+// or when snapshot.json lists a different root.json, and is usually due to
+// a key rotation, which applications may want to log or audit. It is not
+// called if the downloaded root.json has the same version as the trusted
+// root.
+//
+// f is called while the update is in progress, so must not call methods of
+// the client.
+func WithRootRotationHandler(f func(oldVer, newVer int)) ClientOption {
+	return func(c *Client) {
+		c.rootRotationHandler = f
+	}
+}
+
+// WithMaxTargets limits the number of targets accepted in a downloaded
+// targets.json to n, returning ErrTooManyTargets if there are more. The
+// targets are counted without decoding their metadata, protecting clients
+// with limited memory. Non-positive values remove the limit, which is the
+// default.
+func WithMaxTargets(n int) ClientOption {
+	return func(c *Client) {
+		c.maxTargets = n
+	}
+}
+
+// WithMetaCacheSize makes the client cache up to n decoded top-level
+// metadata files, so that metadata in local storage which has not changed
+// is not decoded and verified again when it is reloaded (e.g. at the start
+// of each update). This saves CPU for clients which update frequently with
+// large targets.json files. Cached metadata is identified by a hash of its
+// content and of the trusted root.json, so changed metadata is always
+// decoded again. Non-positive values disable the cache, which is the
+// default.
+func WithMetaCacheSize(n int) ClientOption {
+	return func(c *Client) {
+		c.metaCache = nil
+		if n > 0 {
+			c.metaCache = newMetaCache(n)
+		}
+	}
+}
+
+// WithTargetURLFunc makes the client download each target from the path
+// returned by f, which is passed to the RemoteStore's GetTarget, instead of
+// from the target's name (or its hash-prefixed names when the repository
+// uses consistent snapshots). f is called with the normalized target name
+// and its metadata from the local targets.json, so it can map targets to
+// other layouts, such as a CDN which stores them by hash.
+//
+// f only determines where target data is read from. The data is verified
+// against the local targets.json as usual.
+func WithTargetURLFunc(f func(name string, meta data.FileMeta) string) ClientOption {
+	return func(c *Client) {
+		c.targetURLFunc = f
+	}
+}
+
+// WithTargetContentCache makes Download keep a copy of each downloaded
+// target in dir, named after the hash of its data, and use a cached copy
+// instead of downloading a target with the same length and hashes again,
+// e.g. when a repository lists identical files under many names. The data
+// of a cached copy is checked before it is used, and is verified against
+// the local targets.json as usual as it is written to the destination.
+//
+// Only complete downloads are cached, so data from resumed downloads (see
+// ResumableDestination) is not. Cached copies are never removed by the
+// client.
+func WithTargetContentCache(dir string) ClientOption {
+	return func(c *Client) {
+		c.targetCache = &targetCache{dir: dir}
+	}
+}
+
+// WithTargetPathAllowlist makes Download and VerifyTarget (and the other
+// methods which download targets) return ErrForbiddenTargetPath for any
+// target whose name does not start with one of the given prefixes, e.g.
+// "/tenant-a/". Prefixes are normalized as target names are, keeping any
+// trailing slash, so "tenant-a/" does not allow "/tenant-ab/foo.txt".
+//
+// Names which could escape a local directory (see checkTargetPath) are
+// rejected whether or not an allowlist is set.
+func WithTargetPathAllowlist(prefixes []string) ClientOption {
+	return func(c *Client) {
+		c.targetPathAllowlist = make([]string, len(prefixes))
+		for i, prefix := range prefixes {
+			normalized := util.NormalizeTarget(prefix)
+			if strings.HasSuffix(prefix, "/") && normalized != "/" {
+				normalized += "/"
+			}
+			c.targetPathAllowlist[i] = normalized
+		}
+	}
+}
+
+// WithMinRootVersion makes the client reject any root.json with a version
+// lower than n, even if it is validly signed, returning ErrRootBelowMinimum.
+// This allows roots which were compromised but are still validly signed to
+// be blocked after an incident.
+//
+// If the local root.json is below the minimum, the latest root.json is
+// downloaded on the next update. The minimum is saved in local storage so it
+// continues to apply if the client is later created without this option, and
+// a lower minimum than the saved one has no effect.
+func WithMinRootVersion(n int) ClientOption {
+	return func(c *Client) {
+		c.minRootVersion = n
+	}
+}
+
+// minRootVersionState is the name of the client state entry recording the
+// minimum trusted root version (see WithMinRootVersion).
+const minRootVersionState = "min-root-version.json"
+
+type minRootVersion struct {
+	Version int `json:"version"`
+}
+
+// loadMinRootVersion raises c.minRootVersion to the minimum root version
+// saved in the given client state, returning whether c.minRootVersion is
+// saved.
+func (c *Client) loadMinRootVersion(state map[string]json.RawMessage) (bool, error) {
+	saved := &minRootVersion{}
+	if b, ok := state[minRootVersionState]; ok {
+		if err := json.Unmarshal(b, saved); err != nil {
+			return false, localMetaErr(minRootVersionState, err)
+		}
+	}
+	if saved.Version >= c.minRootVersion {
+		c.minRootVersion = saved.Version
+		return true, nil
+	}
+	return false, nil
+}
+
+// saveMinRootVersion saves c.minRootVersion in local storage if it is higher
+// than the minimum root version saved in the client state. It must only be
+// called with c.mtx locked for writing.
+func (c *Client) saveMinRootVersion() error {
+	state, err := c.getState()
+	if err != nil {
+		return err
+	}
+	saved, err := c.loadMinRootVersion(state)
+	if err != nil || saved {
+		c.minRootVersionSaved = saved
+		return err
+	}
+	b, err := json.Marshal(&minRootVersion{Version: c.minRootVersion})
+	if err != nil {
+		return err
+	}
+	if err := c.setState(minRootVersionState, b); err != nil {
+		return err
+	}
+	c.minRootVersionSaved = true
+	return nil
 }
 
-func NewClient(local LocalStore, remote RemoteStore) *Client {
-	return &Client{
-		local:  local,
-		remote: remote,
+// WithMetaTempDir makes the client download metadata whose expected length
+// is more than threshold bytes to a temporary file in dir while it is
+// verified, rather than buffering it in memory, and then read it back with
+// a single allocation of the expected length. The temporary file is removed
+// whether or not the download succeeds.
+//
+// This limits the memory used when downloading very large metadata (e.g. a
+// targets.json listing many targets). By default all metadata is buffered
+// in memory.
+func WithMetaTempDir(dir string, threshold int64) ClientOption {
+	return func(c *Client) {
+		c.metaTempDir = dir
+		c.metaTempThreshold = threshold
+	}
+}
+
+func NewClient(local LocalStore, remote RemoteStore, opts ...ClientOption) *Client {
+	c := &Client{
+		local:       local,
+		remote:      remote,
+		maxMetaSize: maxMetaSize,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// SetMaxMetaSize sets the maximum number of bytes that will be downloaded for
+// any top-level metadata (root.json, timestamp.json, snapshot.json and
+// targets.json), defaulting to 50 KiB. Repositories with many targets may
+// need a higher limit for their targets.json.
+//
+// Metadata whose size, as reported by the remote store or listed in other
+// signed metadata, is greater than n is rejected with ErrMetaTooLarge.
+// Compressed targets.json is limited by its decompressed size.
+// ErrInvalidMaxMetaSize is returned if n is not positive.
+func (c *Client) SetMaxMetaSize(n int64) error {
+	if n <= 0 {
+		return ErrInvalidMaxMetaSize{n}
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.maxMetaSize = n
+	return nil
+}
+
+// SetLocalStore copies the metadata in the client's current local storage
+// to local and switches the client to using it, keeping the trusted state,
+// for example to start persisting metadata to disk after starting with
+// MemoryLocalStore. It waits for any in-progress updates to complete. The
+// client state is also copied if local is a StateLocalStore.
+//
+// If writing any metadata or state to local fails, the error is returned and the
+// client continues to use its current local storage.
+func (c *Client) SetLocalStore(local LocalStore) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	meta, err := c.local.GetMeta()
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(meta))
+	for name := range meta {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := local.SetMeta(name, meta[name]); err != nil {
+			return err
+		}
+	}
+	if store, ok := local.(StateLocalStore); ok {
+		state, err := c.getState()
+		if err != nil {
+			return err
+		}
+		names := make([]string, 0, len(state))
+		for name := range state {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if err := store.SetState(name, state[name]); err != nil {
+				return err
+			}
+		}
 	}
+	c.local = local
+	// save the minimum root version in the new store on the next update
+	c.minRootVersionSaved = false
+	return nil
+}
+
+// SetRemoteStore replaces the remote storage used for subsequent updates and
+// downloads, keeping the trusted metadata and keys, for example to fail over
+// to a different mirror. It waits for any in-progress Init, Update,
+// CheckUpdate or Download calls to complete so they are not disrupted.
+//
+// The new remote must serve the same repository (i.e. with the same chain of
+// root metadata) as only the transport is changed, and metadata it serves is
+// verified in the same way as before.
+func (c *Client) SetRemoteStore(r RemoteStore) {
+	c.remoteMtx.Lock()
+	defer c.remoteMtx.Unlock()
+	c.remote = r
+	c.timestampCurrent = false
+}
+
+// TargetValidatorFunc checks the custom metadata of the named target,
+// returning an error if the target should not be accepted. custom is nil if
+// the target has no custom metadata.
+type TargetValidatorFunc func(name string, custom json.RawMessage) error
+
+// SetTargetValidator sets a function which is called during updates with the
+// custom metadata of each new or changed target, after targets.json has been
+// verified. If it returns an error for any target, the update fails with
+// ErrTargetValidation, and neither targets.json nor snapshot.json are saved
+// locally or trusted by the client.
+func (c *Client) SetTargetValidator(f TargetValidatorFunc) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.targetValidator = f
 }
 
 // Init initializes a local repository.
@@ -91,12 +639,19 @@ func (c *Client) Init(rootKeys []*data.Key, threshold int) error {
 	if len(rootKeys) < threshold {
 		return ErrInsufficientKeys
 	}
-	rootJSON, err := c.downloadMetaUnsafe("root.json")
+	c.remoteMtx.RLock()
+	defer c.remoteMtx.RUnlock()
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if err := c.saveMinRootVersion(); err != nil {
+		return err
+	}
+	rootJSON, err := c.downloadMetaUnsafe(context.Background(), "root.json")
 	if err != nil {
 		return err
 	}
 
-	c.db = verify.NewDB()
+	c.db = c.newDB()
 	rootKeyIDs := make([]string, len(rootKeys))
 	for i, key := range rootKeys {
 		id := key.ID()
@@ -111,12 +666,85 @@ func (c *Client) Init(rootKeys []*data.Key, threshold int) error {
 	}
 
 	if err := c.decodeRoot(rootJSON); err != nil {
+		if isDecodeFailedWithErr(err, verify.ErrRoleThreshold) || isDecodeFailedWithErr(err, verify.ErrNoSignatures) {
+			return rootVerificationFailed(rootJSON, c.db, rootKeyIDs, threshold)
+		}
 		return err
 	}
 
 	return c.local.SetMeta("root.json", rootJSON)
 }
 
+// InitFrom initializes a local repository from the given trusted root.json
+// (e.g. one embedded in the application) rather than downloading it, so that
+// no remote metadata is trusted on first use.
+//
+// The root.json is verified using its own root keys and threshold, and then
+// saved in local storage. It may have expired or be below the minimum set
+// with WithMinRootVersion, in which case it is replaced by the latest
+// root.json (which must be signed by its keys) on the first update.
+func (c *Client) InitFrom(rootJSON []byte) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	s := &data.Signed{}
+	if err := json.Unmarshal(rootJSON, s); err != nil {
+		return ErrDecodeFailed{"root.json", err}
+	}
+	root := &data.Root{}
+	if err := json.Unmarshal(s.Signed, root); err != nil {
+		return ErrDecodeFailed{"root.json", err}
+	}
+	db, err := c.rootDB(root)
+	if err != nil {
+		return ErrDecodeFailed{"root.json", err}
+	}
+	if err := db.VerifySignatures(s, "root"); err != nil {
+		return ErrDecodeFailed{"root.json", err}
+	}
+	if !strings.EqualFold(root.Type, "root") {
+		return ErrDecodeFailed{"root.json", verify.ErrWrongMetaType}
+	}
+	if err := c.local.SetMeta("root.json", rootJSON); err != nil {
+		return err
+	}
+	c.db = db
+	c.rootVer = root.Version
+	c.consistentSnapshot = root.ConsistentSnapshot
+	c.setExpires("root", root.Expires)
+	return nil
+}
+
+// rootVerificationFailed returns an ErrRootVerification describing the
+// signatures of the given root.json which failed to meet threshold using
+// db, which contains the root keys with the given IDs.
+func rootVerificationFailed(rootJSON json.RawMessage, db *verify.DB, rootKeyIDs []string, threshold int) error {
+	s := &data.Signed{}
+	if err := json.Unmarshal(rootJSON, s); err != nil {
+		return ErrDecodeFailed{"root.json", err}
+	}
+	found, err := db.CountSignatures(s, "root")
+	if err != nil {
+		return ErrDecodeFailed{"root.json", err}
+	}
+	known := make(map[string]struct{}, len(rootKeyIDs))
+	for _, id := range rootKeyIDs {
+		known[id] = struct{}{}
+	}
+	unknown := make(map[string]struct{})
+	for _, sig := range s.Signatures {
+		if _, ok := known[sig.KeyID]; !ok {
+			unknown[sig.KeyID] = struct{}{}
+		}
+	}
+	unknownIDs := make([]string, 0, len(unknown))
+	for id := range unknown {
+		unknownIDs = append(unknownIDs, id)
+	}
+	sort.Strings(unknownIDs)
+	return ErrRootVerification{Expected: threshold, Found: found, UnknownKeyIDs: unknownIDs}
+}
+
 // Update downloads and verifies remote metadata and returns updated targets.
 //
 // It performs the update part of "The client application" workflow from
@@ -124,474 +752,2417 @@ func (c *Client) Init(rootKeys []*data.Key, threshold int) error {
 //
 // https://github.com/theupdateframework/tuf/blob/v0.9.9/docs/tuf-spec.txt#L714
 func (c *Client) Update() (data.Files, error) {
-	return c.update(false)
+	return c.UpdateContext(context.Background())
 }
 
-func (c *Client) update(latestRoot bool) (data.Files, error) {
-	// Always start the update using local metadata
-	if err := c.getLocalMeta(); err != nil {
-		if _, ok := err.(verify.ErrExpired); ok {
-			if !latestRoot {
-				return c.updateWithLatestRoot(nil)
-			}
-			// this should not be reached as if the latest root has
-			// been downloaded and it is expired, updateWithLatestRoot
-			// should not have continued the update
-			return nil, err
-		}
-		if latestRoot && err == verify.ErrRoleThreshold {
-			// Root was updated with new keys, so our local metadata is no
-			// longer validating. Read only the versions from the local metadata
-			// and re-download everything.
-			if err := c.getRootAndLocalVersionsUnsafe(); err != nil {
-				return nil, err
-			}
-		} else {
-			return nil, err
-		}
-	}
+// UpdateContext is like Update but aborts the update and returns ctx.Err()
+// if ctx is cancelled before the update completes.
+func (c *Client) UpdateContext(ctx context.Context) (data.Files, error) {
+	c.remoteMtx.RLock()
+	defer c.remoteMtx.RUnlock()
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.updateStats = UpdateStats{}
+	return c.update(ctx, false)
+}
 
-	// Get timestamp.json, extract snapshot.json file meta and save the
-	// timestamp.json locally
-	timestampJSON, err := c.downloadMetaUnsafe("timestamp.json")
-	if err != nil {
-		return nil, err
+// ForceUpdate is like Update but ignores the timestamp.json, snapshot.json
+// and targets.json in local storage, so that they are all downloaded and
+// verified again even if they have not changed, for example to rule out
+// tampering with local storage. The returned files are all the targets.
+//
+// The trusted root.json is kept, and is only replaced by a newer root as in
+// Update, so root version monotonicity is still enforced. The version of
+// the trusted timestamp.json is also kept as the minimum accepted, so that an
+// older timestamp.json (and through it an older snapshot.json) cannot be
+// replayed. The versions of snapshot.json and targets.json are not checked
+// against the ignored local copies, which are replaced once the update
+// succeeds.
+func (c *Client) ForceUpdate() (data.Files, error) {
+	c.remoteMtx.RLock()
+	defer c.remoteMtx.RUnlock()
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.updateStats = UpdateStats{}
+	c.timestampCurrent = false
+
+	// load the trusted timestamp version if it is not already loaded,
+	// ignoring errors as the local metadata may have been tampered with
+	if c.localMeta == nil {
+		c.getLocalMeta()
 	}
-	snapshotMeta, err := c.decodeTimestamp(timestampJSON)
+
+	// run the update against a view of local storage without the
+	// metadata being refreshed, discarding the state loaded from it
+	c.targets = nil
+	c.snapshotVer, c.targetsVer = 0, 0
+	c.snapshotJSON = nil
+	local := c.local
+	c.local = &refreshLocalStore{LocalStore: local, written: make(map[string]struct{})}
+	files, err := c.update(context.Background(), false)
+	c.local = local
 	if err != nil {
-		// ErrRoleThreshold could indicate timestamp keys have been
-		// revoked, so retry with the latest root.json
-		if isDecodeFailedWithErr(err, verify.ErrRoleThreshold) && !latestRoot {
-			return c.updateWithLatestRoot(nil)
-		}
-		return nil, err
-	}
-	if err := c.local.SetMeta("timestamp.json", timestampJSON); err != nil {
+		// restore the client state from local storage
+		c.getLocalMeta()
 		return nil, err
 	}
+	return files, nil
+}
 
-	// Return ErrLatestSnapshot if we already have the latest snapshot.json
-	if c.hasMeta("snapshot.json", snapshotMeta) {
-		return nil, ErrLatestSnapshot{c.snapshotVer}
-	}
+// refreshLocalStore is a LocalStore which hides the timestamp.json,
+// snapshot.json and targets.json in an underlying store until they are
+// written, so that an update downloads them again (see ForceUpdate).
+type refreshLocalStore struct {
+	LocalStore
+	written map[string]struct{}
+}
 
-	// Get snapshot.json, then extract root.json and targets.json file meta.
-	//
-	// The snapshot.json is only saved locally after checking root.json and
-	// targets.json so that it will be re-downloaded on subsequent updates
-	// if this update fails.
-	snapshotJSON, err := c.downloadMeta("snapshot.json", snapshotMeta)
-	if err != nil {
-		return nil, err
-	}
-	rootMeta, targetsMeta, err := c.decodeSnapshot(snapshotJSON)
+func (r *refreshLocalStore) GetMeta() (map[string]json.RawMessage, error) {
+	meta, err := r.LocalStore.GetMeta()
 	if err != nil {
-		// ErrRoleThreshold could indicate snapshot keys have been
-		// revoked, so retry with the latest root.json
-		if isDecodeFailedWithErr(err, verify.ErrRoleThreshold) && !latestRoot {
-			return c.updateWithLatestRoot(nil)
-		}
 		return nil, err
 	}
-
-	// If we don't have the root.json, download it, save it in local
-	// storage and restart the update
-	if !c.hasMeta("root.json", rootMeta) {
-		return c.updateWithLatestRoot(&rootMeta)
+	// copy the metadata as the store may return its own map
+	visible := make(map[string]json.RawMessage, len(meta))
+	for name, m := range meta {
+		visible[name] = m
 	}
-
-	// If we don't have the targets.json, download it, determine updated
-	// targets and save targets.json in local storage
-	var updatedTargets data.Files
-	if !c.hasMeta("targets.json", targetsMeta) {
-		targetsJSON, err := c.downloadMeta("targets.json", targetsMeta)
-		if err != nil {
-			return nil, err
-		}
-		updatedTargets, err = c.decodeTargets(targetsJSON)
-		if err != nil {
-			return nil, err
-		}
-		if err := c.local.SetMeta("targets.json", targetsJSON); err != nil {
-			return nil, err
+	for _, name := range []string{"timestamp.json", "snapshot.json", "targets.json"} {
+		if _, ok := r.written[name]; !ok {
+			delete(visible, name)
 		}
 	}
+	return visible, nil
+}
 
-	// Save the snapshot.json now it has been processed successfully
-	if err := c.local.SetMeta("snapshot.json", snapshotJSON); err != nil {
-		return nil, err
+func (r *refreshLocalStore) SetMeta(name string, meta json.RawMessage) error {
+	if err := r.LocalStore.SetMeta(name, meta); err != nil {
+		return err
 	}
+	r.written[name] = struct{}{}
+	return nil
+}
 
-	return updatedTargets, nil
+// lastUpdateState is the name of the client state entry recording the time
+// of the last successful update made by UpdateIfStale.
+const lastUpdateState = "last-update.json"
+
+type lastUpdate struct {
+	Time time.Time `json:"time"`
 }
 
-func (c *Client) updateWithLatestRoot(m *data.FileMeta) (data.Files, error) {
-	var rootJSON json.RawMessage
-	var err error
-	if m == nil {
-		rootJSON, err = c.downloadMetaUnsafe("root.json")
-	} else {
-		rootJSON, err = c.downloadMeta("root.json", *m)
-	}
-	if err != nil {
+// UpdateIfStale is like Update but only updates if the last successful
+// update made by UpdateIfStale (which is recorded in local storage if it is a
+// StateLocalStore, otherwise only in memory) was at
+// least maxAge ago, or if the local timestamp.json has expired, returning
+// ErrNotStale otherwise without making any remote requests. Updates made by
+// Update, UpdateContext or ForceUpdate are not recorded.
+//
+// An update which finds that there is nothing to update (i.e. which returns
+// ErrLatestSnapshot) counts as successful.
+func (c *Client) UpdateIfStale(maxAge time.Duration) (data.Files, error) {
+	if err := c.checkStale(maxAge); err != nil {
 		return nil, err
 	}
-	if err := c.decodeRoot(rootJSON); err != nil {
+	c.remoteMtx.RLock()
+	defer c.remoteMtx.RUnlock()
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.updateStats = UpdateStats{}
+	files, err := c.update(context.Background(), false)
+	if err != nil && !IsLatestSnapshot(err) {
 		return nil, err
 	}
-	if err := c.local.SetMeta("root.json", rootJSON); err != nil {
-		return nil, err
+	if err := c.setLastUpdate(c.now()); err != nil {
+		return files, err
 	}
-	return c.update(true)
+	return files, err
 }
 
-// getLocalMeta decodes and verifies metadata from local storage.
-//
-// The verification of local files is purely for consistency, if an attacker
-// has compromised the local storage, there is no guarantee it can be trusted.
-func (c *Client) getLocalMeta() error {
+// checkStale returns ErrNotStale if an update is not needed as described in
+// UpdateIfStale.
+func (c *Client) checkStale(maxAge time.Duration) error {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
 	meta, err := c.local.GetMeta()
 	if err != nil {
 		return err
 	}
-
+	state, err := c.getState()
+	if err != nil {
+		return err
+	}
+	last := &lastUpdate{Time: c.lastUpdate}
+	if b, ok := state[lastUpdateState]; ok {
+		if err := json.Unmarshal(b, last); err != nil {
+			return err
+		}
+	}
+	if !last.Time.IsZero() && !c.timestampExpired(meta) && c.now().Sub(last.Time) < maxAge {
+		return ErrNotStale{last.Time}
+	}
+	return nil
+}
+
+// timestampExpired reports whether the timestamp.json in the given local
+// metadata is missing or has expired.
+func (c *Client) timestampExpired(meta map[string]json.RawMessage) bool {
+	b, ok := meta["timestamp.json"]
+	if !ok {
+		return true
+	}
+	s := &data.Signed{}
+	if err := json.Unmarshal(b, s); err != nil {
+		return true
+	}
+	timestamp := &data.Timestamp{}
+	if err := json.Unmarshal(s.Signed, timestamp); err != nil {
+		return true
+	}
+	return !timestamp.Expires.After(c.now())
+}
+
+func (c *Client) setLastUpdate(t time.Time) error {
+	c.lastUpdate = t
+	b, err := json.Marshal(&lastUpdate{Time: t})
+	if err != nil {
+		return err
+	}
+	return c.setState(lastUpdateState, b)
+}
+
+// getState returns the client state persisted in local storage, or nil if
+// the local store is not a StateLocalStore.
+func (c *Client) getState() (map[string]json.RawMessage, error) {
+	if store, ok := c.local.(StateLocalStore); ok {
+		return store.GetState()
+	}
+	return nil, nil
+}
+
+// setState persists the given client state entry in local storage if the
+// local store is a StateLocalStore.
+func (c *Client) setState(name string, state json.RawMessage) error {
+	if store, ok := c.local.(StateLocalStore); ok {
+		return store.SetState(name, state)
+	}
+	return nil
+}
+
+// now returns the current time according to the client's clock.
+func (c *Client) now() time.Time {
+	if c.clock != nil {
+		return c.clock.Now()
+	}
+	return time.Now()
+}
+
+// trustedMetaCurrent returns whether the trusted timestamp, snapshot and
+// targets metadata have all not yet expired according to the client's clock.
+func (c *Client) trustedMetaCurrent() bool {
+	now := c.now()
+	for _, role := range []string{"timestamp", "snapshot", "targets"} {
+		if t, ok := c.expires[role]; !ok || !t.After(now) {
+			return false
+		}
+	}
+	return true
+}
+
+// UpdateStats contains statistics about the data transferred by an update.
+type UpdateStats struct {
+	// MetaBytes is the total number of metadata bytes read from remote
+	// storage, including any metadata downloaded again when the update
+	// is restarted after fetching a new root.json.
+	MetaBytes int64
+}
+
+// LastUpdateStats returns statistics about the most recent call to Update,
+// UpdateContext or CheckUpdate, whether or not it succeeded.
+func (c *Client) LastUpdateStats() UpdateStats {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	return c.updateStats
+}
+
+// Stats contains cumulative counts of the paths taken by the updates made by
+// a Client, including those made by CheckUpdate.
+type Stats struct {
+	// SnapshotCacheHits is the number of updates which found that the
+	// latest snapshot.json was already trusted, and so returned
+	// ErrLatestSnapshot without downloading any other metadata.
+	SnapshotCacheHits int64
+
+	// TargetsCacheHits is the number of times a new snapshot.json listed
+	// a targets.json which was already trusted, so it was not downloaded.
+	TargetsCacheHits int64
+
+	// RootRestarts is the number of times an update was restarted after
+	// downloading a new root.json.
+	RootRestarts int64
+
+	// FullDownloads is the number of times targets.json was downloaded.
+	FullDownloads int64
+}
+
+// Stats returns cumulative counts of the paths taken by the updates made by
+// the client since it was created, which can be used to tune how often
+// updates are made.
+func (c *Client) Stats() Stats {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	return c.stats
+}
+
+// UpdateSummary describes the changes an update would make.
+type UpdateSummary struct {
+	// Versions are the versions of the metadata after the update.
+	Versions MetaVersions
+
+	// Added, Removed and Changed are the targets which would be added,
+	// removed and changed by the update.
+	Added   data.Files
+	Removed data.Files
+	Changed data.Files
+}
+
+// CheckUpdate downloads and verifies remote metadata like Update, but does not
+// persist anything in local storage, and returns a summary of the changes the
+// update would make.
+//
+// As with Update, ErrLatestSnapshot is returned if there is nothing to
+// update.
+func (c *Client) CheckUpdate() (*UpdateSummary, error) {
+	c.remoteMtx.RLock()
+	defer c.remoteMtx.RUnlock()
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if err := c.getLocalMeta(); err != nil {
+		return nil, err
+	}
+	oldTargets := c.targets
+
+	// run the update against an in-memory overlay of local storage, and
+	// restore the client state from local storage afterwards
+	c.updateStats = UpdateStats{}
+	local := c.local
+	minRootVersionSaved := c.minRootVersionSaved
+	c.local = &dryRunLocalStore{LocalStore: local, meta: make(map[string]json.RawMessage)}
+	updated, err := c.update(context.Background(), false)
+	newTargets := c.targets
+	// the downloaded timestamp.json was not saved in local storage
+	c.timestampCurrent = false
+	versions := MetaVersions{
+		Root:      c.rootVer,
+		Targets:   c.targetsVer,
+		Snapshot:  c.snapshotVer,
+		Timestamp: c.timestampVer,
+	}
+	c.local = local
+	c.minRootVersionSaved = minRootVersionSaved
+	if err := c.getLocalMeta(); err != nil {
+		return nil, err
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	summary := &UpdateSummary{
+		Versions: versions,
+		Added:    make(data.Files),
+		Removed:  make(data.Files),
+		Changed:  make(data.Files),
+	}
+	for path, meta := range updated {
+		if _, ok := oldTargets[path]; ok {
+			summary.Changed[path] = meta
+		} else {
+			summary.Added[path] = meta
+		}
+	}
+	for path, meta := range oldTargets {
+		if _, ok := newTargets[path]; !ok {
+			summary.Removed[path] = meta
+		}
+	}
+	return summary, nil
+}
+
+// dryRunLocalStore is a LocalStore which reads from an underlying store but
+// keeps any changes in memory.
+type dryRunLocalStore struct {
+	LocalStore
+	meta map[string]json.RawMessage
+}
+
+func (d *dryRunLocalStore) GetMeta() (map[string]json.RawMessage, error) {
+	meta, err := d.LocalStore.GetMeta()
+	if err != nil {
+		return nil, err
+	}
+	merged := make(map[string]json.RawMessage, len(meta)+len(d.meta))
+	for name, m := range meta {
+		merged[name] = m
+	}
+	for name, m := range d.meta {
+		merged[name] = m
+	}
+	return merged, nil
+}
+
+func (d *dryRunLocalStore) SetMeta(name string, meta json.RawMessage) error {
+	d.meta[name] = meta
+	return nil
+}
+
+func (d *dryRunLocalStore) DeleteMeta(name string) error {
+	delete(d.meta, name)
+	return nil
+}
+
+func (c *Client) update(ctx context.Context, latestRoot bool) (data.Files, error) {
+	if !c.minRootVersionSaved {
+		if err := c.saveMinRootVersion(); err != nil {
+			return nil, err
+		}
+	}
+
+	// Always start the update using local metadata
+	if err := c.getLocalMeta(); err != nil {
+		// make sure timestamp.json is downloaded even if it has not
+		// changed, so that the local metadata is checked against it
+		c.timestampCurrent = false
+		if isExpiredOrBelowMinimum(err) {
+			if !latestRoot {
+				return c.updateWithLatestRoot(ctx, nil)
+			}
+			// this should not be reached as if the latest root has
+			// been downloaded and it is expired or below the minimum
+			// version, updateWithLatestRoot should not have continued
+			// the update
+			return nil, err
+		}
+		if latestRoot && err == verify.ErrRoleThreshold {
+			// Root was updated with new keys, so our local metadata is no
+			// longer validating. Read only the versions from the local metadata
+			// and re-download everything.
+			if err := c.getRootAndLocalVersionsUnsafe(); err != nil {
+				return nil, err
+			}
+		} else {
+			return nil, err
+		}
+	}
+
+	// Get timestamp.json, extract snapshot.json file meta and save the
+	// timestamp.json locally.
+	//
+	// If the previous update completed, ask the remote store to only send
+	// timestamp.json if it has changed, returning ErrLatestSnapshot if not.
+	// A response that it has not changed is only trusted while the trusted
+	// metadata has not expired, as otherwise a mirror could keep the client
+	// on expired metadata indefinitely, so it is requested again in full.
+	timestampCtx := ctx
+	conditional := c.timestampCurrent
+	if conditional {
+		timestampCtx = withConditional(ctx)
+	}
+	c.timestampCurrent = false
+	timestampJSON, err := c.downloadMetaUnsafe(timestampCtx, "timestamp.json")
+	if conditional && IsNotModified(err) {
+		if c.trustedMetaCurrent() {
+			c.timestampCurrent = true
+			return nil, ErrLatestSnapshot{c.snapshotVer}
+		}
+		timestampJSON, err = c.downloadMetaUnsafe(ctx, "timestamp.json")
+	}
+	if err != nil {
+		return nil, err
+	}
+	snapshotMeta, err := c.decodeTimestamp(timestampJSON)
+	if err != nil {
+		// ErrRoleThreshold could indicate timestamp keys have been
+		// revoked, so retry with the latest root.json
+		if isDecodeFailedWithErr(err, verify.ErrRoleThreshold) && !latestRoot {
+			return c.updateWithLatestRoot(ctx, nil)
+		}
+		return nil, err
+	}
+	if err := c.local.SetMeta("timestamp.json", timestampJSON); err != nil {
+		return nil, err
+	}
+
+	// Return ErrLatestSnapshot if we already have the latest snapshot.json
+	// and the targets.json it lists (which is missing if it has been
+	// deleted from local storage, e.g. as it was corrupt)
+	if _, ok := c.localMeta["targets.json"]; ok && c.hasMeta("snapshot.json", snapshotMeta) {
+		c.stats.SnapshotCacheHits++
+		c.timestampCurrent = true
+		return nil, ErrLatestSnapshot{c.snapshotVer}
+	}
+
+	// Get snapshot.json, then extract root.json and targets.json file meta.
+	//
+	// The snapshot.json is only saved locally after checking root.json and
+	// targets.json so that it will be re-downloaded on subsequent updates
+	// if this update fails.
+	snapshotJSON, err := c.downloadMeta(ctx, "snapshot.json", snapshotMeta)
+	if err != nil {
+		return nil, err
+	}
+	snapshotFiles, err := c.decodeSnapshot(snapshotJSON)
+	if err != nil {
+		// ErrRoleThreshold could indicate snapshot keys have been
+		// revoked, so retry with the latest root.json
+		if isDecodeFailedWithErr(err, verify.ErrRoleThreshold) && !latestRoot {
+			return c.updateWithLatestRoot(ctx, nil)
+		}
+		return nil, err
+	}
+	rootMeta, err := snapshotFileMeta(snapshotFiles, "root.json")
+	if err != nil {
+		return nil, err
+	}
+	targetsMeta, err := snapshotFileMeta(snapshotFiles, "targets.json")
+	if err != nil {
+		return nil, err
+	}
+
+	// If we don't have the root.json, download it, save it in local
+	// storage and restart the update
+	if !c.hasMeta("root.json", rootMeta) {
+		return c.updateWithLatestRoot(ctx, &rootMeta)
+	}
+
+	// If we don't have the targets.json, download it, determine updated
+	// targets and save targets.json in local storage
+	var updatedTargets data.Files
+	if c.hasMeta("targets.json", targetsMeta) {
+		c.stats.TargetsCacheHits++
+	} else {
+		c.stats.FullDownloads++
+		targetsJSON, err := c.downloadTargetsMeta(ctx, snapshotFiles, targetsMeta)
+		if err != nil {
+			return nil, err
+		}
+		updatedTargets, err = c.decodeTargets(targetsJSON)
+		if err != nil {
+			return nil, err
+		}
+		if err := c.local.SetMeta("targets.json", targetsJSON); err != nil {
+			return nil, err
+		}
+	}
+
+	// Save the snapshot.json now it has been processed successfully
+	if err := c.local.SetMeta("snapshot.json", snapshotJSON); err != nil {
+		return nil, err
+	}
+
+	c.timestampCurrent = true
+	return updatedTargets, nil
+}
+
+func (c *Client) updateWithLatestRoot(ctx context.Context, m *data.FileMeta) (data.Files, error) {
+	var startVer int
+	stepwise := c.maxRootRotations > 0 || c.versionedMeta
+	if stepwise || c.rootRotationHandler != nil {
+		// use the version of the local root even if it has expired
+		meta, err := c.local.GetMeta()
+		if err != nil {
+			return nil, err
+		}
+		startVer, err = metaVersionUnsafe(meta["root.json"])
+		if err != nil {
+			return nil, err
+		}
+	}
+	lastVer := startVer
+	if stepwise {
+		var err error
+		lastVer, err = c.updateRootStepwise(ctx, startVer)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var rootJSON json.RawMessage
+	var err error
+	if m == nil {
+		rootJSON, err = c.downloadMetaUnsafe(ctx, "root.json")
+	} else {
+		rootJSON, err = c.downloadMeta(ctx, "root.json", *m)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// root.json must not be newer than the last VERSION.root.json, as
+	// otherwise withholding an intermediate root (e.g. one which revokes
+	// compromised keys) would skip its checks
+	if v, err := metaVersionUnsafe(rootJSON); stepwise && err == nil && v > lastVer {
+		if c.maxRootRotations > 0 && v-startVer > c.maxRootRotations {
+			return nil, ErrTooManyRootRotations{startVer, v, c.maxRootRotations}
+		}
+		return nil, ErrMissingRemoteMetadata{fmt.Sprintf("%d.root.json", lastVer+1)}
+	}
+	if err := c.decodeRoot(rootJSON); err != nil {
+		return nil, err
+	}
+	if c.maxRootRotations > 0 && c.rootVer-startVer > c.maxRootRotations {
+		return nil, ErrTooManyRootRotations{startVer, c.rootVer, c.maxRootRotations}
+	}
+	if err := c.local.SetMeta("root.json", rootJSON); err != nil {
+		return nil, err
+	}
+	c.stats.RootRestarts++
+	if c.rootRotationHandler != nil && c.rootVer > startVer {
+		c.rootRotationHandler(startVer, c.rootVer)
+	}
+	return c.update(ctx, true)
+}
+
+// updateRootStepwise updates the trusted root by downloading
+// VERSION.root.json for each version following the trusted root in turn,
+// stopping at the first version which is missing, and returns the version of
+// the last root trusted.
+//
+// Each root must be signed by a threshold of the keys in both the previous
+// root and itself, so a root which revoked keys cannot be skipped. If
+// c.maxRootRotations is set, ErrTooManyRootRotations is returned if the root
+// would advance by more than that many versions.
+func (c *Client) updateRootStepwise(ctx context.Context, startVer int) (int, error) {
+	for version := startVer + 1; ; version++ {
+		name := fmt.Sprintf("%d.root.json", version)
+		rootJSON, err := c.downloadMetaUnsafe(ctx, name)
+		if err != nil {
+			if _, ok := err.(ErrMissingRemoteMetadata); ok {
+				return version - 1, nil
+			}
+			return 0, err
+		}
+		if c.maxRootRotations > 0 && version-startVer > c.maxRootRotations {
+			return 0, ErrTooManyRootRotations{startVer, version, c.maxRootRotations}
+		}
+		if err := c.decodeIntermediateRoot(name, version, rootJSON); err != nil {
+			return 0, err
+		}
+		if err := c.local.SetMeta("root.json", rootJSON); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// decodeIntermediateRoot decodes and verifies the given version of the root
+// metadata, replacing the trusted keys with its keys.
+//
+// Intermediate roots are not checked for expiry as only the latest root
+// needs to be current.
+func (c *Client) decodeIntermediateRoot(name string, version int, b json.RawMessage) error {
+	s := &data.Signed{}
+	if err := json.Unmarshal(b, s); err != nil {
+		return ErrDecodeFailed{name, err}
+	}
+	if err := c.db.VerifySignatures(s, "root"); err != nil {
+		return ErrDecodeFailed{name, err}
+	}
+	root := &data.Root{}
+	if err := json.Unmarshal(s.Signed, root); err != nil {
+		return ErrDecodeFailed{name, err}
+	}
+	if root.Version != version {
+		return ErrDecodeFailed{name, fmt.Errorf("tuf: expected version %d, got %d", version, root.Version)}
+	}
+	db, err := c.rootDB(root)
+	if err != nil {
+		return ErrDecodeFailed{name, err}
+	}
+	if err := db.VerifySignatures(s, "root"); err != nil {
+		return ErrDecodeFailed{name, err}
+	}
+	c.db = db
+	c.rootVer = root.Version
+	c.consistentSnapshot = root.ConsistentSnapshot
+	c.setExpires("root", root.Expires)
+	return nil
+}
+
+// rootDB returns a key DB containing the keys and roles listed in the given
+// root metadata.
+func (c *Client) rootDB(root *data.Root) (*verify.DB, error) {
+	db := c.newDB()
+	for id, k := range root.Keys {
+		if err := db.AddKey(id, k); err != nil {
+			return nil, err
+		}
+	}
+	for name, role := range root.Roles {
+		if err := db.AddRole(name, role); err != nil {
+			return nil, err
+		}
+	}
+	return db, nil
+}
+
+// getLocalMeta decodes and verifies metadata from local storage.
+//
+// The verification of local files is purely for consistency, if an attacker
+// has compromised the local storage, there is no guarantee it can be trusted.
+func (c *Client) getLocalMeta() error {
+	meta, err := c.local.GetMeta()
+	if err != nil {
+		return err
+	}
+	state, err := c.getState()
+	if err != nil {
+		return err
+	}
+	if _, err := c.loadMinRootVersion(state); err != nil {
+		return err
+	}
+	c.expires = make(map[string]time.Time)
+
+	// rootHash identifies the trusted root in the keys of cached metadata,
+	// and is left empty if the metadata must not be cached
+	var rootHash string
 	if rootJSON, ok := meta["root.json"]; ok {
 		// unmarshal root.json without verifying as we need the root
 		// keys first
 		s := &data.Signed{}
 		if err := json.Unmarshal(rootJSON, s); err != nil {
+			return localMetaErr("root.json", err)
+		}
+		root := &data.Root{}
+		if err := json.Unmarshal(s.Signed, root); err != nil {
+			return err
+		}
+		c.db, err = c.rootDB(root)
+		if err != nil {
+			return err
+		}
+		if err := c.db.Verify(s, "root", 0); err != nil {
+			return err
+		}
+		c.rootVer = root.Version
+		c.consistentSnapshot = root.ConsistentSnapshot
+		c.setExpires("root", root.Expires)
+		if root.Version < c.minRootVersion {
+			return ErrRootBelowMinimum{root.Version, c.minRootVersion}
+		}
+		if c.metaCache != nil {
+			rootHash = metaHash(rootJSON)
+		}
+	} else {
+		return ErrNotInitialized
+	}
+
+	if snapshotJSON, ok := meta["snapshot.json"]; ok {
+		v, err := c.unmarshalLocal(snapshotJSON, "snapshot", rootHash, &data.Snapshot{})
+		if err != nil {
+			return err
+		}
+		snapshot := v.(*data.Snapshot)
+		c.snapshotVer = snapshot.Version
+		c.snapshotJSON = snapshotJSON
+		c.setExpires("snapshot", snapshot.Expires)
+	}
+
+	if targetsJSON, ok := meta["targets.json"]; ok {
+		v, err := c.unmarshalLocal(targetsJSON, "targets", rootHash, &data.Targets{})
+		if err != nil {
+			return err
+		}
+		targets := v.(*data.Targets)
+		c.targetsVer = targets.Version
+		c.targets = targets.Targets
+		c.setExpires("targets", targets.Expires)
+	}
+
+	c.timestampCustom = nil
+	if timestampJSON, ok := meta["timestamp.json"]; ok {
+		v, err := c.unmarshalLocal(timestampJSON, "timestamp", rootHash, &data.Timestamp{})
+		if err != nil {
+			return err
+		}
+		timestamp := v.(*data.Timestamp)
+		c.timestampVer = timestamp.Version
+		c.setExpires("timestamp", timestamp.Expires)
+		c.setTimestampCustom(timestamp)
+	}
+
+	c.localMeta = meta
+	return nil
+}
+
+// unmarshalLocal decodes and verifies the given metadata for role from local
+// storage into v, returning v. If rootHash is set, the value decoded from
+// identical metadata is returned from the metadata cache instead if
+// possible, and otherwise v is added to the cache, so the returned value
+// must not be modified.
+func (c *Client) unmarshalLocal(b []byte, role, rootHash string, v interface{}) (interface{}, error) {
+	var key string
+	if rootHash != "" {
+		key = metaCacheKey(rootHash, role, b)
+		if cached, ok := c.metaCache.get(key); ok {
+			return cached, nil
+		}
+	}
+	if err := verify.UnmarshalTrusted(b, v, role, c.db); err != nil {
+		return nil, localMetaErr(role+".json", err)
+	}
+	if key != "" {
+		c.metaCache.add(key, v)
+	}
+	return v, nil
+}
+
+// localMetaErr returns ErrLocalMetaCorrupt if err is a JSON syntax error
+// from decoding the given metadata from local storage, which indicates that
+// the stored data is corrupt (e.g. truncated) rather than that it failed
+// verification. Other errors are returned unchanged.
+func localMetaErr(name string, err error) error {
+	var syntaxErr *json.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		return ErrLocalMetaCorrupt{name, err}
+	}
+	return err
+}
+
+func (c *Client) setExpires(role string, t time.Time) {
+	if c.expires == nil {
+		c.expires = make(map[string]time.Time)
+	}
+	c.expires[role] = t
+}
+
+// newDB returns a key DB which checks expiry using the client's clock.
+func (c *Client) newDB() *verify.DB {
+	db := verify.NewDB()
+	if c.clock != nil {
+		db.SetClock(c.clock)
+	}
+	return db
+}
+
+// maxMetaSize is the default maximum number of bytes that will be downloaded
+// for top-level metadata (see SetMaxMetaSize).
+const maxMetaSize = 50 * 1024
+
+// downloadMetaUnsafe downloads top-level metadata from remote storage without
+// verifying it's length and hashes (used for example to download timestamp.json
+// which has unknown size). It will download at most c.maxMetaSize bytes.
+func (c *Client) downloadMetaUnsafe(ctx context.Context, name string) ([]byte, error) {
+	r, size, err := c.getMeta(ctx, name)
+	if err != nil {
+		if IsNotFound(err) {
+			return nil, ErrMissingRemoteMetadata{name}
+		}
+		return nil, ErrDownloadFailed{name, err}
+	}
+	defer r.Close()
+
+	// return ErrMetaTooLarge if the reported size is greater than maxMetaSize
+	if size > c.maxMetaSize {
+		return nil, ErrMetaTooLarge{name, size, c.maxMetaSize}
+	}
+
+	// although the size has been checked above, use a LimitReader in case
+	// the reported size is inaccurate, or size is -1 which indicates an
+	// unknown length
+	return ioutil.ReadAll(io.LimitReader(r, c.maxMetaSize))
+}
+
+// getRootAndLocalVersionsUnsafe decodes the versions stored in the local
+// metadata without verifying signatures to protect against downgrade attacks
+// when the root is replaced and contains new keys. It also sets the local meta
+// cache to only contain the local root metadata.
+func (c *Client) getRootAndLocalVersionsUnsafe() error {
+	meta, err := c.local.GetMeta()
+	if err != nil {
+		return err
+	}
+
+	getVersion := func(name string) (int, error) {
+		return metaVersionUnsafe(meta[name])
+	}
+
+	c.timestampVer, err = getVersion("timestamp.json")
+	if err != nil {
+		return err
+	}
+	c.snapshotVer, err = getVersion("snapshot.json")
+	if err != nil {
+		return err
+	}
+	c.snapshotJSON = meta["snapshot.json"]
+	c.targetsVer, err = getVersion("targets.json")
+	if err != nil {
+		return err
+	}
+
+	root, ok := meta["root.json"]
+	if !ok {
+		return errors.New("tuf: missing local root after downloading, this should not be possible")
+	}
+	c.localMeta = map[string]json.RawMessage{"root.json": root}
+
+	return nil
+}
+
+// metaVersionUnsafe returns the version of the given metadata without
+// verifying its signatures, or 0 if b is empty.
+func metaVersionUnsafe(b json.RawMessage) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	var data struct {
+		Signed struct {
+			Version int
+		}
+	}
+	if err := json.Unmarshal(b, &data); err != nil {
+		return 0, err
+	}
+	return data.Signed.Version, nil
+}
+
+// remoteGetFunc is the type of function the download method uses to download
+// remote files
+type remoteGetFunc func(context.Context, string) (io.ReadCloser, int64, error)
+
+// getMeta gets the given metadata from remote storage, passing ctx to the
+// store if it supports it.
+func (c *Client) getMeta(ctx context.Context, name string) (io.ReadCloser, int64, error) {
+	return c.getMetaFrom(ctx, c.remote, name)
+}
+
+// getMetaFrom is like getMeta but gets the metadata from the given store.
+func (c *Client) getMetaFrom(ctx context.Context, remote RemoteStore, name string) (io.ReadCloser, int64, error) {
+	r, size, err := c.get(ctx, func() (io.ReadCloser, int64, error) {
+		if remote, ok := remote.(ContextRemoteStore); ok {
+			return remote.GetMetaContext(ctx, name)
+		}
+		return remote.GetMeta(name)
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return &countingReader{r, &c.updateStats.MetaBytes}, size, nil
+}
+
+// countingReader adds the number of bytes read from a remote stream to n.
+type countingReader struct {
+	io.ReadCloser
+	n *int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	*r.n += int64(n)
+	return n, err
+}
+
+// getTarget gets the given target file from remote storage, passing ctx to
+// the store if it supports it.
+func (c *Client) getTarget(ctx context.Context, path string) (io.ReadCloser, int64, error) {
+	return c.get(ctx, func() (io.ReadCloser, int64, error) {
+		if remote, ok := c.remote.(ContextRemoteStore); ok {
+			return remote.GetTargetContext(ctx, path)
+		}
+		return c.remote.GetTarget(path)
+	})
+}
+
+// getTargetRange downloads the given target from remote storage starting at
+// the given offset, returning ErrRangeNotSupported if the remote store is
+// not a RangeRemoteStore.
+func (c *Client) getTargetRange(ctx context.Context, path string, offset int64) (io.ReadCloser, int64, error) {
+	remote, ok := c.remote.(RangeRemoteStore)
+	if !ok {
+		return nil, 0, ErrRangeNotSupported{path}
+	}
+	return c.get(ctx, func() (io.ReadCloser, int64, error) {
+		return remote.GetTargetRange(ctx, path, offset)
+	})
+}
+
+// get calls fetch to get a file from remote storage, retrying failed
+// requests according to the retry policy set with WithRetry.
+//
+// ErrNotFound, ErrNotModified, ErrRangeNotSupported and context errors are
+// never retried, and if
+// all attempts fail the last error is returned wrapped in ErrRetryFailed.
+func (c *Client) get(ctx context.Context, fetch func() (io.ReadCloser, int64, error)) (io.ReadCloser, int64, error) {
+	for attempt := 1; ; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return nil, 0, err
+		}
+		r, size, err := fetch()
+		if err == nil {
+			return &contextReader{ctx, r}, size, nil
+		}
+		if IsNotFound(err) || IsNotModified(err) || IsRangeNotSupported(err) || ctx.Err() != nil || c.retryAttempts <= 1 {
+			return nil, 0, err
+		}
+		if attempt >= c.retryAttempts {
+			return nil, 0, ErrRetryFailed{attempt, err}
+		}
+		if c.retryBackoff != nil {
+			t := time.NewTimer(c.retryBackoff(attempt))
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				t.Stop()
+				return nil, 0, ctx.Err()
+			}
+		}
+	}
+}
+
+// contextReader wraps a remote stream so that reads fail with ctx.Err() once
+// ctx has been cancelled.
+type contextReader struct {
+	ctx context.Context
+	io.ReadCloser
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.ReadCloser.Read(p)
+}
+
+// download downloads the given file from remote storage using the get function,
+// adding hashes to the path if consistent snapshots are in use
+func (c *Client) download(ctx context.Context, file string, get remoteGetFunc, hashes data.Hashes) (io.ReadCloser, int64, error) {
+	if c.consistentSnapshot {
+		return c.downloadHashed(ctx, file, get, hashes)
+	} else {
+		return get(ctx, file)
+	}
+}
+
+// downloadHashed downloads the given file from remote storage using the get
+// function, trying each hashed path in turn
+func (c *Client) downloadHashed(ctx context.Context, file string, get remoteGetFunc, hashes data.Hashes) (io.ReadCloser, int64, error) {
+	// try each hashed path in turn, and either return the contents,
+	// try the next one if a 404 is returned, or return an error
+	for _, path := range util.HashedPaths(file, hashes) {
+		r, size, err := get(ctx, path)
+		if err != nil {
+			if IsNotFound(err) {
+				continue
+			}
+			return nil, 0, err
+		}
+		return r, size, nil
+	}
+	return nil, 0, ErrNotFound{file}
+}
+
+// downloadMeta downloads top-level metadata from remote storage and verifies
+// it using the given file metadata.
+//
+// If the remote store is a MirroredRemoteStore, each mirror is tried in turn
+// until one serves metadata which passes verification. If all mirrors fail,
+// ErrMissingRemoteMetadata is returned if none of them have the metadata,
+// otherwise an ErrMirrorsFailed containing each mirror's error.
+func (c *Client) downloadMeta(ctx context.Context, name string, m data.FileMeta) ([]byte, error) {
+	if m.Length > c.maxMetaSize {
+		return nil, ErrMetaTooLarge{name, m.Length, c.maxMetaSize}
+	}
+	mirrored, ok := c.remote.(MirroredRemoteStore)
+	if !ok {
+		return c.downloadMetaFrom(ctx, c.remote, name, m)
+	}
+	mirrors := mirrored.Mirrors()
+	errs := make([]error, 0, len(mirrors))
+	missing := true
+	for _, remote := range mirrors {
+		b, err := c.downloadMetaFrom(ctx, remote, name, m)
+		if err == nil {
+			return b, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if _, ok := err.(ErrMissingRemoteMetadata); !ok {
+			missing = false
+		}
+		errs = append(errs, err)
+	}
+	if missing {
+		return nil, ErrMissingRemoteMetadata{name}
+	}
+	return nil, ErrMirrorsFailed{errs}
+}
+
+// downloadTargetsMeta downloads targets.json, using the gzip compressed
+// targets.json.gz instead if snapshot.json lists it. The compressed data is
+// verified using its own file meta before it is decompressed, and the
+// decompressed data is then verified using the file meta of targets.json.
+//
+// targets.json is downloaded as normal if targets.json.gz is missing from
+// remote storage.
+func (c *Client) downloadTargetsMeta(ctx context.Context, snapshotFiles data.Files, m data.FileMeta) ([]byte, error) {
+	if m.Length > c.maxMetaSize {
+		return nil, ErrMetaTooLarge{"targets.json", m.Length, c.maxMetaSize}
+	}
+	gzMeta, ok := snapshotFiles["targets.json.gz"]
+	if !ok {
+		return c.downloadMeta(ctx, "targets.json", m)
+	}
+	gz, err := c.downloadMeta(ctx, "targets.json.gz", gzMeta)
+	if _, ok := err.(ErrMissingRemoteMetadata); ok {
+		return c.downloadMeta(ctx, "targets.json", m)
+	} else if err != nil {
+		return nil, err
+	}
+	return decompressMeta("targets.json", gz, m)
+}
+
+// decompressMeta decompresses gzip compressed metadata and verifies it using
+// the given file meta of the uncompressed metadata, reading at most
+// m.Length bytes of decompressed data. As for downloaded metadata,
+// ErrWrongSize is returned if the decompressed data has the wrong length.
+func decompressMeta(name string, gz []byte, m data.FileMeta) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(gz))
+	if err != nil {
+		return nil, ErrDownloadFailed{name, err}
+	}
+	defer r.Close()
+	var buf bytes.Buffer
+	meta, err := util.GenerateFileMeta(io.TeeReader(io.LimitReader(r, m.Length+1), &buf), m.HashAlgorithms()...)
+	if err != nil {
+		return nil, ErrDownloadFailed{name, err}
+	}
+	if err := checkDownloadedMeta(name, meta, m); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// downloadMetaFrom downloads top-level metadata from the given remote store
+// and verifies it using the given file metadata.
+func (c *Client) downloadMetaFrom(ctx context.Context, remote RemoteStore, name string, m data.FileMeta) ([]byte, error) {
+	get := func(ctx context.Context, path string) (io.ReadCloser, int64, error) {
+		return c.getMetaFrom(ctx, remote, path)
+	}
+	var r io.ReadCloser
+	var size int64
+	var err error
+	if c.versionedMeta && m.Version > 0 {
+		r, size, err = get(ctx, fmt.Sprintf("%d.%s", m.Version, name))
+	} else {
+		r, size, err = c.download(ctx, name, get, m.Hashes)
+	}
+	if err != nil {
+		if IsNotFound(err) {
+			return nil, ErrMissingRemoteMetadata{name}
+		}
+		return nil, err
+	}
+	defer r.Close()
+
+	// return ErrWrongSize if the reported size is known and incorrect
+	if size >= 0 && size != m.Length {
+		return nil, ErrWrongSize{name, size, m.Length}
+	}
+
+	// wrap the data in a LimitReader so we download at most m.Length bytes
+	stream := io.LimitReader(r, m.Length)
+
+	if c.metaTempDir != "" && m.Length > c.metaTempThreshold {
+		return c.downloadMetaToTempFile(name, stream, m)
+	}
+
+	// read the data, simultaneously writing it to buf and generating
+	// metadata for every hash algorithm in m (failing if any of them are
+	// unknown)
+	var buf bytes.Buffer
+	meta, err := util.GenerateFileMeta(io.TeeReader(stream, &buf), m.HashAlgorithms()...)
+	if err != nil {
+		return nil, ErrDownloadFailed{name, err}
+	}
+	if err := checkDownloadedMeta(name, meta, m); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// checkDownloadedMeta checks that the actual file meta of downloaded metadata
+// matches the expected file meta, returning ErrWrongSize if the data ended
+// early (e.g. when the remote reported an unknown size) and ErrDownloadFailed
+// if the hashes do not match.
+func checkDownloadedMeta(name string, actual, expected data.FileMeta) error {
+	if err := util.FileMetaEqual(actual, expected); err != nil {
+		if err == util.ErrWrongLength {
+			return ErrWrongSize{name, actual.Length, expected.Length}
+		}
+		return ErrDownloadFailed{name, err}
+	}
+	return nil
+}
+
+// downloadMetaToTempFile reads metadata from r into a temporary file in
+// c.metaTempDir, generating metadata for every hash algorithm in m, and
+// returns the data once it has been verified.
+func (c *Client) downloadMetaToTempFile(name string, r io.Reader, m data.FileMeta) ([]byte, error) {
+	f, err := ioutil.TempFile(c.metaTempDir, "tuf-meta-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	meta, err := util.GenerateFileMeta(io.TeeReader(r, f), m.HashAlgorithms()...)
+	if err != nil {
+		return nil, ErrDownloadFailed{name, err}
+	}
+	if err := checkDownloadedMeta(name, meta, m); err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	b := make([]byte, meta.Length)
+	if _, err := io.ReadFull(f, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// decodeFailed returns ErrRollback if err indicates the downloaded metadata
+// for the given role has a lower version than the trusted version, and
+// ErrDecodeFailed otherwise.
+func decodeFailed(role string, err error) error {
+	if e, ok := err.(verify.ErrLowVersion); ok {
+		return ErrRollback{role, e.Actual, e.Current}
+	}
+	return ErrDecodeFailed{role + ".json", err}
+}
+
+// isExpiredOrBelowMinimum reports whether err indicates the local root.json
+// can no longer be trusted, so the latest root.json should be downloaded.
+func isExpiredOrBelowMinimum(err error) bool {
+	switch err.(type) {
+	case verify.ErrExpired, ErrRootBelowMinimum:
+		return true
+	}
+	return false
+}
+
+// decodeRoot decodes and verifies root metadata.
+func (c *Client) decodeRoot(b json.RawMessage) error {
+	root := &data.Root{}
+	if err := verify.Unmarshal(b, root, "root", c.rootVer, c.db); err != nil {
+		return decodeFailed("root", err)
+	}
+
+	// check the root is also signed by a threshold of its own root keys,
+	// as it would otherwise fail verification once it is trusted
+	s := &data.Signed{}
+	if err := json.Unmarshal(b, s); err != nil {
+		return ErrDecodeFailed{"root.json", err}
+	}
+	db, err := c.rootDB(root)
+	if err != nil {
+		return ErrDecodeFailed{"root.json", err}
+	}
+	if err := db.VerifySignatures(s, "root"); err != nil {
+		return ErrRootInconsistent{err}
+	}
+	if root.Version < c.minRootVersion {
+		return ErrRootBelowMinimum{root.Version, c.minRootVersion}
+	}
+	c.rootVer = root.Version
+	c.consistentSnapshot = root.ConsistentSnapshot
+	c.setExpires("root", root.Expires)
+	return nil
+}
+
+// decodeSnapshot decodes and verifies snapshot metadata, and returns the file
+// meta of all the metadata it lists.
+func (c *Client) decodeSnapshot(b json.RawMessage) (data.Files, error) {
+	snapshot := &data.Snapshot{}
+	if err := verify.Unmarshal(b, snapshot, "snapshot", c.snapshotVer, c.db); err != nil {
+		return nil, decodeFailed("snapshot", err)
+	}
+	// verify.Unmarshal only rejects lower versions, so also reject a
+	// snapshot.json which differs from the trusted one but has the same
+	// version (re-downloading the trusted one is allowed, e.g. when
+	// targets.json is missing locally)
+	if c.snapshotJSON != nil && snapshot.Version == c.snapshotVer && !bytes.Equal(b, c.snapshotJSON) {
+		return nil, ErrRollback{"snapshot", snapshot.Version, c.snapshotVer}
+	}
+	for _, name := range []string{"root.json", "targets.json"} {
+		if _, ok := snapshot.Meta[name]; !ok {
+			return nil, ErrMissingSnapshotMeta{name}
+		}
+	}
+	c.snapshotVer = snapshot.Version
+	c.snapshotJSON = b
+	c.setExpires("snapshot", snapshot.Expires)
+	return snapshot.Meta, nil
+}
+
+// snapshotFileMeta returns the file meta listed in snapshot.json for the
+// given metadata, which must be used to verify the metadata when it is
+// downloaded to prevent mix-and-match attacks.
+func snapshotFileMeta(files data.Files, name string) (data.FileMeta, error) {
+	m, ok := files[name]
+	if !ok {
+		return data.FileMeta{}, ErrMissingSnapshotMeta{name}
+	}
+	return m, nil
+}
+
+// decodeTargets decodes and verifies targets metadata, sets c.targets and
+// returns updated targets.
+func (c *Client) decodeTargets(b json.RawMessage) (data.Files, error) {
+	// check the number of targets before decoding them into a map (see
+	// WithMaxTargets)
+	if c.maxTargets > 0 {
+		n, err := countTargets(b)
+		if err != nil {
+			return nil, decodeFailed("targets", err)
+		}
+		if n > c.maxTargets {
+			return nil, ErrTooManyTargets{n, c.maxTargets}
+		}
+	}
+
+	targets := &data.Targets{}
+	if err := verify.Unmarshal(b, targets, "targets", c.targetsVer, c.db); err != nil {
+		return nil, decodeFailed("targets", err)
+	}
+	updatedTargets := make(data.Files)
+	for path, meta := range targets.Targets {
+		if local, ok := c.targets[path]; ok {
+			if err := util.FileMetaEqual(local, meta); err == nil {
+				continue
+			}
+		}
+		updatedTargets[path] = meta
+	}
+	if c.targetValidator != nil {
+		if err := c.validateTargets(updatedTargets); err != nil {
+			return nil, err
+		}
+	}
+	c.targetsVer = targets.Version
+	c.targets = targets.Targets
+	c.setExpires("targets", targets.Expires)
+	return updatedTargets, nil
+}
+
+// validateTargets calls c.targetValidator for each of the given targets in
+// path order, returning the first error.
+func (c *Client) validateTargets(targets data.Files) error {
+	paths := make([]string, 0, len(targets))
+	for path := range targets {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		var custom json.RawMessage
+		if meta := targets[path]; meta.Custom != nil {
+			custom = *meta.Custom
+		}
+		if err := c.targetValidator(path, custom); err != nil {
+			return ErrTargetValidation{path, err}
+		}
+	}
+	return nil
+}
+
+// countTargets returns the number of targets listed in the given
+// targets.json without decoding their metadata.
+func countTargets(b json.RawMessage) (int, error) {
+	var v struct {
+		Signed struct {
+			Targets targetCounter `json:"targets"`
+		} `json:"signed"`
+	}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return 0, err
+	}
+	return int(v.Signed.Targets), nil
+}
+
+// targetCounter is the number of entries in a JSON object, which are read
+// one at a time and discarded when it is unmarshalled.
+type targetCounter int
+
+func (t *targetCounter) UnmarshalJSON(b []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	if _, err := dec.Token(); err != nil {
+		return err
+	}
+	for dec.More() {
+		// read the key, then skip the value
+		if _, err := dec.Token(); err != nil {
 			return err
 		}
-		root := &data.Root{}
-		if err := json.Unmarshal(s.Signed, root); err != nil {
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
 			return err
 		}
-		c.db = verify.NewDB()
-		for id, k := range root.Keys {
-			if err := c.db.AddKey(id, k); err != nil {
-				return err
-			}
+		*t++
+	}
+	return nil
+}
+
+// decodeTimestamp decodes and verifies timestamp metadata, and returns the
+// new snapshot file meta.
+func (c *Client) decodeTimestamp(b json.RawMessage) (data.FileMeta, error) {
+	timestamp := &data.Timestamp{}
+	if err := verify.Unmarshal(b, timestamp, "timestamp", c.timestampVer, c.db); err != nil {
+		return data.FileMeta{}, decodeFailed("timestamp", err)
+	}
+	snapshotMeta, ok := timestamp.Meta["snapshot.json"]
+	if !ok {
+		return data.FileMeta{}, ErrMalformedTimestamp{"snapshot.json is not listed"}
+	}
+	if snapshotMeta.Length <= 0 {
+		return data.FileMeta{}, ErrMalformedTimestamp{fmt.Sprintf("invalid snapshot.json length %d", snapshotMeta.Length)}
+	}
+	if len(snapshotMeta.Hashes) == 0 {
+		return data.FileMeta{}, ErrMalformedTimestamp{"snapshot.json has no hashes"}
+	}
+	c.timestampVer = timestamp.Version
+	c.setExpires("timestamp", timestamp.Expires)
+	c.setTimestampCustom(timestamp)
+	return snapshotMeta, nil
+}
+
+func (c *Client) setTimestampCustom(timestamp *data.Timestamp) {
+	c.timestampCustom = nil
+	if timestamp.Custom != nil {
+		c.timestampCustom = *timestamp.Custom
+	}
+}
+
+// hasMeta checks whether local metadata has the given file meta
+func (c *Client) hasMeta(name string, m data.FileMeta) bool {
+	b, ok := c.localMeta[name]
+	if !ok {
+		return false
+	}
+	meta, err := util.GenerateFileMeta(bytes.NewReader(b), m.HashAlgorithms()...)
+	if err != nil {
+		return false
+	}
+	err = util.FileMetaEqual(meta, m)
+	return err == nil
+}
+
+type Destination interface {
+	io.Writer
+	Delete() error
+}
+
+// ResumableDestination is a Destination which keeps the data written by an
+// interrupted download, so that Download can resume it.
+//
+// If the remote store is a RangeRemoteStore, Download reads back the data
+// already written and requests only the rest of the target. The data read
+// back is hashed along with the rest of the target, so the complete data is
+// verified as usual and the destination is deleted if it does not match. If
+// the data written is longer than the target or cannot be read, or the
+// remote cannot resume the download, the destination is reset and the
+// download restarts from the beginning.
+//
+// Download does not delete a ResumableDestination if the download fails
+// while the target is being transferred, so it can be resumed later.
+type ResumableDestination interface {
+	Destination
+
+	// Written returns a reader of the data written to the destination
+	// since it was created or last reset.
+	Written() (io.ReadCloser, error)
+
+	// Reset discards the data written to the destination.
+	Reset() error
+}
+
+// HashingDestination is a Destination which passes writes through to an
+// underlying Destination while hashing the data written, so that the digest
+// of a downloaded target can be recorded without reading it again.
+//
+// As Download verifies the data against the local targets.json, after a
+// successful download Sum returns the target's hash from the metadata for
+// the hash algorithm used (e.g. Hashes["sha512"] for sha512.New()).
+type HashingDestination struct {
+	Destination
+	hash hash.Hash
+}
+
+// NewHashingDestination returns a HashingDestination which writes to dest
+// and hashes the data using h.
+func NewHashingDestination(dest Destination, h hash.Hash) *HashingDestination {
+	return &HashingDestination{Destination: dest, hash: h}
+}
+
+func (h *HashingDestination) Write(p []byte) (int, error) {
+	n, err := h.Destination.Write(p)
+	h.hash.Write(p[:n])
+	return n, err
+}
+
+// Delete resets the hash and deletes the underlying Destination.
+func (h *HashingDestination) Delete() error {
+	h.hash.Reset()
+	return h.Destination.Delete()
+}
+
+// Sum returns the hash of the data written since the destination was
+// created or last deleted.
+func (h *HashingDestination) Sum() data.HexBytes {
+	return h.hash.Sum(nil)
+}
+
+// Download downloads the given target file from remote storage into dest.
+//
+// dest will be deleted and an error returned in the following situations:
+//
+//   * The target does not exist in the local targets.json
+//   * The target does not exist in remote storage (ErrNotFound)
+//   * Metadata cannot be generated for the downloaded data
+//   * Generated metadata does not match local metadata for the given file
+//
+// The data is hashed with every hash algorithm listed for the target in the
+// local targets.json, and must match all of the hashes, so a collision in
+// one algorithm is not enough for other data to be accepted. Targets listing
+// an unknown hash algorithm cannot be downloaded.
+func (c *Client) Download(name string, dest Destination) error {
+	return c.DownloadContext(context.Background(), name, dest)
+}
+
+// DownloadContext is like Download but aborts the download, deleting dest,
+// if ctx is cancelled before the download completes.
+func (c *Client) DownloadContext(ctx context.Context, name string, dest Destination) error {
+	return c.downloadTarget(ctx, name, dest, false)
+}
+
+// DownloadOffline is like Download but only uses the targets.json already
+// loaded by the client (e.g. by Update, Targets or a previous Download),
+// returning ErrNoLocalMeta if it has not been loaded. It never reads or
+// updates metadata, so the only request made is for the target itself,
+// which is verified against the loaded metadata as in Download.
+func (c *Client) DownloadOffline(name string, dest Destination) error {
+	return c.downloadTarget(context.Background(), name, dest, true)
+}
+
+// downloadTarget downloads the given target into dest, using only the already
+// loaded targets.json if offline is set (see findTarget).
+func (c *Client) downloadTarget(ctx context.Context, name string, dest Destination, offline bool) (err error) {
+	c.remoteMtx.RLock()
+	defer c.remoteMtx.RUnlock()
+
+	// delete dest if there is an error, unless it is a ResumableDestination
+	// and the transfer was interrupted
+	resumable, _ := dest.(ResumableDestination)
+	interrupted := false
+	defer func() {
+		if err != nil && !(resumable != nil && interrupted) {
+			dest.Delete()
 		}
-		for name, role := range root.Roles {
-			if err := c.db.AddRole(name, role); err != nil {
-				return err
+	}()
+
+	t, err := c.findTarget(name, offline)
+	if err != nil {
+		return err
+	}
+	localMeta := t.meta
+
+	// generate metadata for every hash algorithm in localMeta (failing if
+	// any of them are unknown)
+	meta, err := util.NewFileMetaWriter(localMeta.HashAlgorithms()...)
+	if err != nil {
+		return ErrDownloadFailed{name, err}
+	}
+
+	// resume the download from the data already written to dest if
+	// possible, otherwise restart it
+	var offset int64
+	if resumable != nil {
+		if offset, err = c.resumeOffset(resumable, localMeta.Length, meta); err != nil {
+			return ErrDownloadFailed{name, err}
+		}
+	}
+
+	// use a cached copy of the data if there is one, otherwise cache the
+	// data as it is downloaded if it is not being resumed
+	var stream io.Reader = &bytes.Reader{}
+	var cached bool
+	var cacheWriter *targetCacheWriter
+	if c.targetCache != nil && offset == 0 && localMeta.Length > 0 {
+		if f, ok := c.targetCache.open(localMeta); ok {
+			defer f.Close()
+			stream = io.LimitReader(f, localMeta.Length)
+			cached = true
+		} else if cacheWriter = c.targetCache.create(localMeta); cacheWriter != nil {
+			defer cacheWriter.abort()
+		}
+	}
+	if !cached && offset < localMeta.Length {
+		r, err := c.openTargetAt(ctx, t, offset)
+		if offset > 0 && IsRangeNotSupported(err) {
+			if err := resumable.Reset(); err != nil {
+				return ErrDownloadFailed{name, err}
 			}
+			meta.Reset()
+			offset = 0
+			r, err = c.openTargetAt(ctx, t, 0)
 		}
-		if err := c.db.Verify(s, "root", 0); err != nil {
+		if err != nil {
 			return err
 		}
-		c.consistentSnapshot = root.ConsistentSnapshot
+		defer r.Close()
+
+		// wrap the data in a LimitReader so we download at most the rest
+		// of localMeta.Length bytes
+		stream = io.LimitReader(r, localMeta.Length-offset)
+		if cacheWriter != nil && offset == 0 {
+			stream = io.TeeReader(stream, cacheWriter)
+		}
+	}
+
+	// report progress as data is written to dest if requested
+	var w io.Writer = dest
+	if t.progress != nil {
+		w = &progressWriter{Writer: dest, name: name, total: localMeta.Length, written: offset, progress: t.progress}
+	}
+
+	// read the data, simultaneously writing it to dest and generating its
+	// metadata
+	if _, err := io.Copy(io.MultiWriter(w, meta), stream); err != nil {
+		interrupted = true
+		return ErrDownloadFailed{name, err}
+	}
+	actual := meta.FileMeta()
+
+	// check the data has the correct length and hashes
+	if err := util.FileMetaEqual(actual, localMeta); err != nil {
+		if err == util.ErrWrongLength {
+			return ErrWrongSize{name, actual.Length, localMeta.Length}
+		}
+		return ErrDownloadFailed{name, err}
+	}
+	if cacheWriter != nil {
+		cacheWriter.commit()
+	}
+
+	if t.progress != nil {
+		t.progress(name, localMeta.Length, localMeta.Length)
+	}
+	return nil
+}
+
+// resumeOffset writes the data already written to dest to meta, returning
+// its length as the offset to resume a download of a target of the given
+// length from. If the download cannot be resumed, dest is reset and zero is
+// returned.
+func (c *Client) resumeOffset(dest ResumableDestination, length int64, meta *util.FileMetaWriter) (int64, error) {
+	if _, ok := c.remote.(RangeRemoteStore); ok {
+		if r, err := dest.Written(); err == nil {
+			n, err := io.Copy(meta, io.LimitReader(r, length+1))
+			r.Close()
+			if err == nil && n <= length {
+				return n, nil
+			}
+		}
+	}
+	if err := dest.Reset(); err != nil {
+		return 0, err
+	}
+	meta.Reset()
+	return 0, nil
+}
+
+// remoteTarget is a target found in the local targets.json by findTarget.
+type remoteTarget struct {
+	// name is the name passed to findTarget, and path the normalized
+	// path of the target
+	name string
+	path string
+	meta data.FileMeta
+
+	// hashed is whether the target is stored under hash-prefixed paths
+	hashed bool
+
+	// progress is the client's download progress function at the time the
+	// target was looked up
+	progress DownloadProgressFunc
+}
+
+// findTarget looks up the given target in the local targets.json, loading
+// it from local storage if necessary unless offline is set, in which case
+// ErrNoLocalMeta is returned if it has not been loaded.
+func (c *Client) findTarget(name string, offline bool) (remoteTarget, error) {
+	if err := c.checkTargetPath(name); err != nil {
+		return remoteTarget{}, err
+	}
+
+	// look up the file in the local targets.json, holding the lock only
+	// while reading the client state and not during the transfer
+	if offline {
+		c.mtx.RLock()
+		if c.targets == nil {
+			c.mtx.RUnlock()
+			return remoteTarget{}, ErrNoLocalMeta
+		}
+	} else if err := c.rlockTargets(); err != nil {
+		return remoteTarget{}, err
+	}
+	defer c.mtx.RUnlock()
+	normalizedName, localMeta, ok := c.lookupTarget(name)
+
+	// return ErrUnknownTarget if the file is not in the local targets.json
+	if !ok {
+		return remoteTarget{}, ErrUnknownTarget{name}
+	}
+	return remoteTarget{
+		name:     name,
+		path:     normalizedName,
+		meta:     localMeta,
+		hashed:   c.versionedMeta || c.consistentSnapshot,
+		progress: c.downloadProgress,
+	}, nil
+}
+
+// openTarget looks up the given target in the local targets.json and opens
+// it in remote storage, checking the size reported by the remote if known.
+// c.remoteMtx must be held for reading.
+func (c *Client) openTarget(ctx context.Context, name string) (io.ReadCloser, data.FileMeta, error) {
+	t, err := c.findTarget(name, false)
+	if err != nil {
+		return nil, data.FileMeta{}, err
+	}
+	r, err := c.openTargetAt(ctx, t, 0)
+	if err != nil {
+		return nil, data.FileMeta{}, err
+	}
+	return r, t.meta, nil
+}
+
+// openTargetAt opens the given target in remote storage starting at the
+// given offset, checking the size reported by the remote if known.
+// c.remoteMtx must be held for reading.
+func (c *Client) openTargetAt(ctx context.Context, t remoteTarget, offset int64) (io.ReadCloser, error) {
+	get := c.getTarget
+	if offset > 0 {
+		get = func(ctx context.Context, path string) (io.ReadCloser, int64, error) {
+			return c.getTargetRange(ctx, path, offset)
+		}
+	}
+
+	// get the data from remote storage
+	var r io.ReadCloser
+	var size int64
+	var err error
+	if c.targetURLFunc != nil {
+		r, size, err = get(ctx, c.targetURLFunc(t.path, t.meta))
+	} else if t.hashed {
+		r, size, err = c.downloadHashed(ctx, t.path, get, t.meta.Hashes)
 	} else {
-		return ErrNoRootKeys
+		r, size, err = get(ctx, t.path)
+	}
+	if err != nil {
+		if IsNotFound(err) {
+			return nil, ErrNotFound{t.path}
+		}
+		return nil, err
+	}
+
+	// return ErrWrongSize if the reported size is known and incorrect
+	if size >= 0 && size != t.meta.Length-offset {
+		r.Close()
+		return nil, ErrWrongSize{t.name, offset + size, t.meta.Length}
+	}
+	return r, nil
+}
+
+// DownloadStream opens the given target file in remote storage and returns a
+// reader of its data along with its length from the local targets.json, for
+// processing the target without buffering it or writing it to a
+// Destination.
+//
+// The data is verified as it is read, so callers must read to EOF and check
+// the error returned by Close to get the result of the verification: if the
+// data does not match the local targets.json, the final Read and Close
+// return the same error as Download would. At most the expected length is
+// read, and Close returns ErrDownloadFailed wrapping io.ErrUnexpectedEOF if
+// the reader is closed before reaching EOF, as the data is then unverified.
+func (c *Client) DownloadStream(name string) (io.ReadCloser, int64, error) {
+	c.remoteMtx.RLock()
+	defer c.remoteMtx.RUnlock()
+	r, localMeta, err := c.openTarget(context.Background(), name)
+	if err != nil {
+		return nil, 0, err
+	}
+	w, err := util.NewFileMetaWriter(localMeta.HashAlgorithms()...)
+	if err != nil {
+		r.Close()
+		return nil, 0, ErrDownloadFailed{name, err}
+	}
+	stream := &verifyingReader{
+		Reader: io.TeeReader(io.LimitReader(r, localMeta.Length), w),
+		closer: r,
+		name:   name,
+		meta:   localMeta,
+		actual: w,
+	}
+	return stream, localMeta.Length, nil
+}
+
+// verifyingReader verifies the data read through it against meta once EOF
+// is reached.
+type verifyingReader struct {
+	io.Reader
+	closer io.Closer
+	name   string
+	meta   data.FileMeta
+	actual *util.FileMetaWriter
+
+	// eof is set once EOF is reached, and err is the result of verifying
+	// the data
+	eof bool
+	err error
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	if v.eof {
+		return 0, v.eofErr()
+	}
+	n, err := v.Reader.Read(p)
+	if err == io.EOF {
+		v.eof = true
+		v.err = v.verify()
+		return n, v.eofErr()
+	}
+	return n, err
+}
+
+// eofErr returns the error to return from Read once EOF is reached.
+func (v *verifyingReader) eofErr() error {
+	if v.err != nil {
+		return v.err
+	}
+	return io.EOF
+}
+
+func (v *verifyingReader) verify() error {
+	actual := v.actual.FileMeta()
+	if err := util.FileMetaEqual(actual, v.meta); err != nil {
+		if err == util.ErrWrongLength {
+			return ErrWrongSize{v.name, actual.Length, v.meta.Length}
+		}
+		return ErrDownloadFailed{v.name, err}
+	}
+	return nil
+}
+
+func (v *verifyingReader) Close() error {
+	err := v.closer.Close()
+	if !v.eof {
+		return ErrDownloadFailed{v.name, io.ErrUnexpectedEOF}
+	}
+	if v.err != nil {
+		return v.err
+	}
+	return err
+}
+
+// DownloadToFile downloads the given target file from remote storage into a
+// file at path with mode 0644, creating any missing parent directories.
+//
+// The target is downloaded to a temporary file in the same directory, which
+// is synced to disk and renamed to path once the download has been verified.
+// If the download fails, the temporary file is removed and any existing file
+// at path is left untouched.
+func (c *Client) DownloadToFile(name, path string) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := c.Download(name, &fileDestination{tmp}); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// fileDestination is a Destination which writes to a file, closing and
+// removing it on Delete.
+type fileDestination struct {
+	*os.File
+}
+
+func (f *fileDestination) Delete() error {
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// checkTargetPath returns ErrForbiddenTargetPath if the given target name
+// is not allowed by WithTargetPathAllowlist, or could escape a local
+// directory if used as a relative path, protecting callers from target
+// names served by a compromised repository. Names which could escape
+// contain a ".." element, or are absolute once the single leading slash
+// used in targets.json is removed (e.g. "//etc/passwd" or `C:\foo`).
+func (c *Client) checkTargetPath(name string) error {
+	for _, elem := range strings.FieldsFunc(name, isPathSeparator) {
+		if elem == ".." {
+			return ErrForbiddenTargetPath{name}
+		}
+	}
+	rel := strings.TrimPrefix(name, "/")
+	if strings.HasPrefix(rel, "/") || strings.HasPrefix(rel, `\`) || hasDriveLetter(rel) {
+		return ErrForbiddenTargetPath{name}
+	}
+	if c.targetPathAllowlist == nil {
+		return nil
+	}
+	normalized := util.NormalizeTarget(name)
+	for _, prefix := range c.targetPathAllowlist {
+		if strings.HasPrefix(normalized, prefix) {
+			return nil
+		}
+	}
+	return ErrForbiddenTargetPath{name}
+}
+
+func hasDriveLetter(p string) bool {
+	return len(p) >= 2 && p[1] == ':' && ('a' <= p[0] && p[0] <= 'z' || 'A' <= p[0] && p[0] <= 'Z')
+}
+
+func isPathSeparator(r rune) bool {
+	return r == '/' || r == '\\'
+}
+
+// lookupTarget returns the normalized path and metadata of the given target
+// from c.targets. c.mtx must be held.
+//
+// Target names are relative to the targets directory, but callers commonly
+// include the "targets/" directory itself, so if name is not a known target
+// and has a leading "targets/", that prefix is stripped and the lookup
+// retried (e.g. "targets/foo.txt" is treated as "/foo.txt").
+func (c *Client) lookupTarget(name string) (string, data.FileMeta, bool) {
+	normalizedName := util.NormalizeTarget(name)
+	if meta, ok := c.targets[normalizedName]; ok {
+		return normalizedName, meta, true
+	}
+	if !strings.HasPrefix(normalizedName, "/targets/") {
+		return "", data.FileMeta{}, false
+	}
+	normalizedName = strings.TrimPrefix(normalizedName, "/targets")
+	meta, ok := c.targets[normalizedName]
+	return normalizedName, meta, ok
+}
+
+// VerifyTarget verifies that the data read from r matches the length and
+// hashes of the given target in the local targets.json, for example when the
+// target has been downloaded out-of-band.
+//
+// ErrUnknownTarget is returned if the target does not exist in the local
+// targets.json, ErrWrongSize if the data has the wrong length and
+// util.ErrWrongHash if the data has the wrong hash.
+//
+// If a progress function has been set with SetDownloadProgress, it is
+// called as the data is read, as it is by Download, which is useful when
+// verifying large files.
+func (c *Client) VerifyTarget(name string, r io.Reader) error {
+	if err := c.checkTargetPath(name); err != nil {
+		return err
 	}
+	if err := c.rlockTargets(); err != nil {
+		return err
+	}
+	_, localMeta, ok := c.lookupTarget(name)
+	progress := c.downloadProgress
+	c.mtx.RUnlock()
 
-	if snapshotJSON, ok := meta["snapshot.json"]; ok {
-		snapshot := &data.Snapshot{}
-		if err := verify.UnmarshalTrusted(snapshotJSON, snapshot, "snapshot", c.db); err != nil {
-			return err
-		}
-		c.snapshotVer = snapshot.Version
+	// return ErrUnknownTarget if the file is not in the local targets.json
+	if !ok {
+		return ErrUnknownTarget{name}
 	}
 
-	if targetsJSON, ok := meta["targets.json"]; ok {
-		targets := &data.Targets{}
-		if err := verify.UnmarshalTrusted(targetsJSON, targets, "targets", c.db); err != nil {
-			return err
-		}
-		c.targetsVer = targets.Version
-		c.targets = targets.Targets
+	meta, err := util.NewFileMetaWriter(localMeta.HashAlgorithms()...)
+	if err != nil {
+		return err
+	}
+	var w io.Writer = meta
+	if progress != nil {
+		w = &progressWriter{Writer: meta, name: name, total: localMeta.Length, progress: progress}
 	}
 
-	if timestampJSON, ok := meta["timestamp.json"]; ok {
-		timestamp := &data.Timestamp{}
-		if err := verify.UnmarshalTrusted(timestampJSON, timestamp, "timestamp", c.db); err != nil {
-			return err
+	// read at most one byte more than expected so that data which is too
+	// long is detected without reading all of it
+	if _, err := io.Copy(w, io.LimitReader(r, localMeta.Length+1)); err != nil {
+		return err
+	}
+	actual := meta.FileMeta()
+
+	// check the data has the correct length and hashes
+	if err := util.FileMetaEqual(actual, localMeta); err != nil {
+		if err == util.ErrWrongLength {
+			return ErrWrongSize{name, actual.Length, localMeta.Length}
 		}
-		c.timestampVer = timestamp.Version
+		return err
 	}
 
-	c.localMeta = meta
+	if progress != nil {
+		progress(name, localMeta.Length, localMeta.Length)
+	}
 	return nil
 }
 
-// maxMetaSize is the maximum number of bytes that will be downloaded when
-// getting remote metadata without knowing it's length.
-const maxMetaSize = 50 * 1024
+// DownloadProgressFunc is called during a download with the number of bytes
+// of the named target read so far and its total expected length.
+type DownloadProgressFunc func(name string, bytesRead, total int64)
 
-// downloadMetaUnsafe downloads top-level metadata from remote storage without
-// verifying it's length and hashes (used for example to download timestamp.json
-// which has unknown size). It will download at most maxMetaSize bytes.
-func (c *Client) downloadMetaUnsafe(name string) ([]byte, error) {
-	r, size, err := c.remote.GetMeta(name)
-	if err != nil {
-		if IsNotFound(err) {
-			return nil, ErrMissingRemoteMetadata{name}
-		}
-		return nil, ErrDownloadFailed{name, err}
-	}
-	defer r.Close()
+// SetDownloadProgress sets a function to be called periodically as target
+// data is downloaded by Download, or read by VerifyTarget.
+//
+// The function is called a final time with bytesRead equal to total once the
+// target has been successfully verified, and is not called again if the
+// download or verification fails. It may be called concurrently by
+// DownloadBatch.
+func (c *Client) SetDownloadProgress(f DownloadProgressFunc) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.downloadProgress = f
+}
 
-	// return ErrMetaTooLarge if the reported size is greater than maxMetaSize
-	if size > maxMetaSize {
-		return nil, ErrMetaTooLarge{name, size}
-	}
+// progressWriter reports the number of bytes written through it, holding back
+// the final report until the download has been verified.
+type progressWriter struct {
+	io.Writer
+	name     string
+	written  int64
+	total    int64
+	progress DownloadProgressFunc
+}
 
-	// although the size has been checked above, use a LimitReader in case
-	// the reported size is inaccurate, or size is -1 which indicates an
-	// unknown length
-	return ioutil.ReadAll(io.LimitReader(r, maxMetaSize))
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.Writer.Write(b)
+	p.written += int64(n)
+	if p.written < p.total {
+		p.progress(p.name, p.written, p.total)
+	}
+	return n, err
 }
 
-// getRootAndLocalVersionsUnsafe decodes the versions stored in the local
-// metadata without verifying signatures to protect against downgrade attacks
-// when the root is replaced and contains new keys. It also sets the local meta
-// cache to only contain the local root metadata.
-func (c *Client) getRootAndLocalVersionsUnsafe() error {
-	type versionData struct {
-		Signed struct {
-			Version int
+// DownloadBatch downloads the given target files from remote storage into the
+// corresponding destinations in dests, running up to concurrency downloads in
+// parallel (defaulting to runtime.NumCPU() if concurrency is not positive).
+//
+// Each target is verified as in Download, and each destination is deleted
+// only if its own download fails. If any downloads fail, an ErrBatchDownload
+// is returned containing the error for each failed target.
+func (c *Client) DownloadBatch(names []string, dests map[string]Destination, concurrency int) error {
+	for _, name := range names {
+		if _, ok := dests[name]; !ok {
+			return fmt.Errorf("tuf: missing destination for %s", name)
 		}
 	}
+	if concurrency <= 0 {
+		concurrency = runtime.NumCPU()
+	}
 
-	meta, err := c.local.GetMeta()
-	if err != nil {
+	// populate c.targets from local storage before starting any downloads
+	// so that a failure to load it is returned only once
+	if err := c.rlockTargets(); err != nil {
 		return err
 	}
+	c.mtx.RUnlock()
+
+	var mtx sync.Mutex
+	var wg sync.WaitGroup
+	errs := make(ErrBatchDownload)
+	sem := make(chan struct{}, concurrency)
+	for _, name := range names {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(name string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			if err := c.Download(name, dests[name]); err != nil {
+				mtx.Lock()
+				errs[name] = err
+				mtx.Unlock()
+			}
+		}(name)
+	}
+	wg.Wait()
 
-	getVersion := func(name string) (int, error) {
-		m, ok := meta[name]
-		if !ok {
-			return 0, nil
-		}
-		var data versionData
-		if err := json.Unmarshal(m, &data); err != nil {
-			return 0, err
-		}
-		return data.Signed.Version, nil
+	if len(errs) > 0 {
+		return errs
 	}
+	return nil
+}
 
-	c.timestampVer, err = getVersion("timestamp.json")
-	if err != nil {
+// Clean removes metadata from local storage which is no longer referenced by
+// the local snapshot.json, for example metadata for roles which have been
+// removed from the repository, or which does not match the version listed in
+// snapshot.json. The in-memory targets are pruned to those listed in the
+// remaining targets.json, so targets which have been removed are no longer
+// returned by Targets.
+//
+// root.json, snapshot.json and timestamp.json are always kept, and nothing
+// is removed if there is no local snapshot.json.
+func (c *Client) Clean() error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if err := c.getLocalMeta(); err != nil {
 		return err
 	}
-	c.snapshotVer, err = getVersion("snapshot.json")
-	if err != nil {
-		return err
+	snapshotJSON, ok := c.localMeta["snapshot.json"]
+	if !ok {
+		return nil
 	}
-	c.targetsVer, err = getVersion("targets.json")
-	if err != nil {
+	snapshot := &data.Snapshot{}
+	if err := verify.UnmarshalTrusted(snapshotJSON, snapshot, "snapshot", c.db); err != nil {
 		return err
 	}
-
-	root, ok := meta["root.json"]
-	if !ok {
-		return errors.New("tuf: missing local root after downloading, this should not be possible")
+	for name := range c.localMeta {
+		switch name {
+		case "root.json", "snapshot.json", "timestamp.json":
+			continue
+		}
+		if m, ok := snapshot.Meta[name]; ok && c.hasMeta(name, m) {
+			continue
+		}
+		if err := c.local.DeleteMeta(name); err != nil {
+			return err
+		}
+		delete(c.localMeta, name)
+		if name == "targets.json" {
+			c.targets = nil
+			c.targetsVer = 0
+		}
 	}
-	c.localMeta = map[string]json.RawMessage{"root.json": root}
-
 	return nil
 }
 
-// remoteGetFunc is the type of function the download method uses to download
-// remote files
-type remoteGetFunc func(string) (io.ReadCloser, int64, error)
+// MetaVersions contains the versions of the top-level metadata.
+type MetaVersions struct {
+	Root      int
+	Targets   int
+	Snapshot  int
+	Timestamp int
+}
 
-// download downloads the given file from remote storage using the get function,
-// adding hashes to the path if consistent snapshots are in use
-func (c *Client) download(file string, get remoteGetFunc, hashes data.Hashes) (io.ReadCloser, int64, error) {
-	if c.consistentSnapshot {
-		// try each hashed path in turn, and either return the contents,
-		// try the next one if a 404 is returned, or return an error
-		for _, path := range util.HashedPaths(file, hashes) {
-			r, size, err := get(path)
-			if err != nil {
-				if IsNotFound(err) {
-					continue
-				}
-				return nil, 0, err
-			}
-			return r, size, nil
-		}
-		return nil, 0, ErrNotFound{file}
-	} else {
-		return get(file)
+// MetaVersions returns the versions of the top-level metadata currently
+// trusted by the client, loading them from local storage if necessary.
+func (c *Client) MetaVersions() (MetaVersions, error) {
+	if err := c.rlockLocalMeta(func() bool { return c.localMeta != nil }); err != nil {
+		return MetaVersions{}, err
 	}
+	defer c.mtx.RUnlock()
+	return MetaVersions{
+		Root:      c.rootVer,
+		Targets:   c.targetsVer,
+		Snapshot:  c.snapshotVer,
+		Timestamp: c.timestampVer,
+	}, nil
 }
 
-// downloadMeta downloads top-level metadata from remote storage and verifies
-// it using the given file metadata.
-func (c *Client) downloadMeta(name string, m data.FileMeta) ([]byte, error) {
-	r, size, err := c.download(name, c.remote.GetMeta, m.Hashes)
-	if err != nil {
-		if IsNotFound(err) {
-			return nil, ErrMissingRemoteMetadata{name}
-		}
+// TimestampCustom returns the custom data included by the publisher in the
+// currently trusted timestamp.json (see tuf.Repo.TimestampWithCustom),
+// loading it from local storage if necessary, or nil if there is none.
+func (c *Client) TimestampCustom() (json.RawMessage, error) {
+	if err := c.rlockLocalMeta(func() bool { return c.localMeta != nil }); err != nil {
 		return nil, err
 	}
-	defer r.Close()
-
-	// return ErrWrongSize if the reported size is known and incorrect
-	if size >= 0 && size != m.Length {
-		return nil, ErrWrongSize{name, size, m.Length}
-	}
-
-	// wrap the data in a LimitReader so we download at most m.Length bytes
-	stream := io.LimitReader(r, m.Length)
+	defer c.mtx.RUnlock()
+	return c.timestampCustom, nil
+}
 
-	// read the data, simultaneously writing it to buf and generating metadata
-	var buf bytes.Buffer
-	meta, err := util.GenerateFileMeta(io.TeeReader(stream, &buf), m.HashAlgorithms()...)
-	if err != nil {
+// Expiries returns the expiry time of the currently trusted metadata for
+// each top-level role (i.e. "root", "targets", "snapshot" and "timestamp"),
+// loading it from local storage if necessary. Roles without any trusted
+// metadata are omitted.
+//
+// Once the metadata has expired, updates will fail until newer metadata is
+// available, so this can be used to warn before that happens.
+func (c *Client) Expiries() (map[string]time.Time, error) {
+	if err := c.rlockLocalMeta(func() bool { return c.localMeta != nil }); err != nil {
 		return nil, err
 	}
-	if err := util.FileMetaEqual(meta, m); err != nil {
-		return nil, ErrDownloadFailed{name, err}
+	defer c.mtx.RUnlock()
+	expires := make(map[string]time.Time, len(c.expires))
+	for role, t := range c.expires {
+		expires[role] = t
 	}
-	return buf.Bytes(), nil
+	return expires, nil
 }
 
-// decodeRoot decodes and verifies root metadata.
-func (c *Client) decodeRoot(b json.RawMessage) error {
-	root := &data.Root{}
-	if err := verify.Unmarshal(b, root, "root", c.rootVer, c.db); err != nil {
-		return ErrDecodeFailed{"root.json", err}
+// TrustedRootKeys returns the root keys and threshold the client currently
+// trusts, loading them from local storage if necessary. The keys are sorted
+// by ID.
+//
+// ErrNotInitialized is returned if the client has not been initialized.
+func (c *Client) TrustedRootKeys() ([]*data.Key, int, error) {
+	if err := c.rlockLocalMeta(func() bool { return c.db != nil }); err != nil {
+		return nil, 0, err
 	}
-	c.rootVer = root.Version
-	c.consistentSnapshot = root.ConsistentSnapshot
-	return nil
+	defer c.mtx.RUnlock()
+	role := c.db.GetRole("root")
+	if role == nil {
+		return nil, 0, ErrNotInitialized
+	}
+	ids := make([]string, 0, len(role.KeyIDs))
+	for id := range role.KeyIDs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	keys := make([]*data.Key, 0, len(ids))
+	for _, id := range ids {
+		if key := c.db.GetKey(id); key != nil {
+			keys = append(keys, key)
+		}
+	}
+	return keys, role.Threshold, nil
 }
 
-// decodeSnapshot decodes and verifies snapshot metadata, and returns the new
-// root and targets file meta.
-func (c *Client) decodeSnapshot(b json.RawMessage) (data.FileMeta, data.FileMeta, error) {
-	snapshot := &data.Snapshot{}
-	if err := verify.Unmarshal(b, snapshot, "snapshot", c.snapshotVer, c.db); err != nil {
-		return data.FileMeta{}, data.FileMeta{}, ErrDecodeFailed{"snapshot.json", err}
+// Targets returns the complete list of available targets.
+func (c *Client) Targets() (data.Files, error) {
+	if err := c.rlockTargets(); err != nil {
+		return nil, err
 	}
-	c.snapshotVer = snapshot.Version
-	return snapshot.Meta["root.json"], snapshot.Meta["targets.json"], nil
+	defer c.mtx.RUnlock()
+	return c.targets, nil
 }
 
-// decodeTargets decodes and verifies targets metadata, sets c.targets and
-// returns updated targets.
-func (c *Client) decodeTargets(b json.RawMessage) (data.Files, error) {
-	targets := &data.Targets{}
-	if err := verify.Unmarshal(b, targets, "targets", c.targetsVer, c.db); err != nil {
-		return nil, ErrDecodeFailed{"targets.json", err}
+// TargetsDiff compares the given targets with the targets currently trusted
+// by the client, returning the targets which have been added, removed and
+// changed (i.e. have a different length or hashes).
+//
+// To find the changes made by an update, including removed targets (which
+// are not returned by Update), capture the result of Targets before the
+// update and pass it to TargetsDiff afterwards.
+func (c *Client) TargetsDiff(previous data.Files) (added, removed, changed data.Files, err error) {
+	if err := c.rlockTargets(); err != nil {
+		return nil, nil, nil, err
 	}
-	updatedTargets := make(data.Files)
-	for path, meta := range targets.Targets {
-		if local, ok := c.targets[path]; ok {
-			if err := util.FileMetaEqual(local, meta); err == nil {
-				continue
-			}
+	defer c.mtx.RUnlock()
+	added = make(data.Files)
+	removed = make(data.Files)
+	changed = make(data.Files)
+	for path, meta := range c.targets {
+		prev, ok := previous[path]
+		if !ok {
+			added[path] = meta
+		} else if err := util.FileMetaEqual(meta, prev); err != nil {
+			changed[path] = meta
 		}
-		updatedTargets[path] = meta
 	}
-	c.targetsVer = targets.Version
-	c.targets = targets.Targets
-	return updatedTargets, nil
+	for path, meta := range previous {
+		if _, ok := c.targets[path]; !ok {
+			removed[path] = meta
+		}
+	}
+	return added, removed, changed, nil
 }
 
-// decodeTimestamp decodes and verifies timestamp metadata, and returns the
-// new snapshot file meta.
-func (c *Client) decodeTimestamp(b json.RawMessage) (data.FileMeta, error) {
-	timestamp := &data.Timestamp{}
-	if err := verify.Unmarshal(b, timestamp, "timestamp", c.timestampVer, c.db); err != nil {
-		return data.FileMeta{}, ErrDecodeFailed{"timestamp.json", err}
+// LocalTargets returns the targets from the verified targets.json in local
+// storage, always re-reading the local metadata and never making requests to
+// remote storage. It returns nil if there is no local targets.json.
+//
+// This allows an application to use the last known good targets (e.g. when
+// starting up offline) before attempting an update.
+func (c *Client) LocalTargets() (data.Files, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if err := c.getLocalMeta(); err != nil {
+		return nil, err
 	}
-	c.timestampVer = timestamp.Version
-	return timestamp.Meta["snapshot.json"], nil
+	if _, ok := c.localMeta["targets.json"]; !ok {
+		return nil, nil
+	}
+	return c.targets, nil
 }
 
-// hasMeta checks whether local metadata has the given file meta
-func (c *Client) hasMeta(name string, m data.FileMeta) bool {
-	b, ok := c.localMeta[name]
-	if !ok {
-		return false
+// rlockLocalMeta acquires c.mtx for reading, first populating the client
+// state from local storage (with c.mtx held for writing) if loaded returns
+// false. c.mtx must be released by the caller if no error is returned.
+func (c *Client) rlockLocalMeta(loaded func() bool) error {
+	c.mtx.RLock()
+	if loaded() {
+		return nil
 	}
-	meta, err := util.GenerateFileMeta(bytes.NewReader(b), m.HashAlgorithms()...)
+	c.mtx.RUnlock()
+
+	c.mtx.Lock()
+	var err error
+	if !loaded() {
+		err = c.getLocalMeta()
+	}
+	c.mtx.Unlock()
 	if err != nil {
-		return false
+		return err
 	}
-	err = util.FileMetaEqual(meta, m)
-	return err == nil
+	c.mtx.RLock()
+	return nil
 }
 
-type Destination interface {
-	io.Writer
-	Delete() error
+// rlockTargets is like rlockLocalMeta but populates c.targets if not set.
+func (c *Client) rlockTargets() error {
+	return c.rlockLocalMeta(func() bool { return c.targets != nil })
 }
 
-// Download downloads the given target file from remote storage into dest.
-//
-// dest will be deleted and an error returned in the following situations:
-//
-//   * The target does not exist in the local targets.json
-//   * The target does not exist in remote storage
-//   * Metadata cannot be generated for the downloaded data
-//   * Generated metadata does not match local metadata for the given file
-func (c *Client) Download(name string, dest Destination) (err error) {
-	// delete dest if there is an error
-	defer func() {
-		if err != nil {
-			dest.Delete()
-		}
-	}()
-
-	// populate c.targets from local storage if not set
-	if c.targets == nil {
-		if err := c.getLocalMeta(); err != nil {
-			return err
-		}
+// TargetCustom returns the custom metadata of the given target from the local
+// targets.json, or ErrUnknownTarget if the target does not exist.
+func (c *Client) TargetCustom(name string) (json.RawMessage, error) {
+	if err := c.rlockTargets(); err != nil {
+		return nil, err
+	}
+	_, meta, ok := c.lookupTarget(name)
+	c.mtx.RUnlock()
+	if !ok {
+		return nil, ErrUnknownTarget{name}
 	}
+	if meta.Custom == nil {
+		return nil, nil
+	}
+	return *meta.Custom, nil
+}
 
-	// return ErrUnknownTarget if the file is not in the local targets.json
-	normalizedName := util.NormalizeTarget(name)
-	localMeta, ok := c.targets[normalizedName]
+// TargetMeta returns the metadata (e.g. the length and hashes) of the given
+// target from the local targets.json, or ErrUnknownTarget if the target does
+// not exist. This allows, for example, the size of a target to be checked
+// before calling Download.
+func (c *Client) TargetMeta(name string) (data.FileMeta, error) {
+	if err := c.rlockTargets(); err != nil {
+		return data.FileMeta{}, err
+	}
+	_, meta, ok := c.lookupTarget(name)
+	c.mtx.RUnlock()
 	if !ok {
-		return ErrUnknownTarget{name}
+		return data.FileMeta{}, ErrUnknownTarget{name}
 	}
+	return meta, nil
+}
 
-	// get the data from remote storage
-	r, size, err := c.download(normalizedName, c.remote.GetTarget, localMeta.Hashes)
+// TargetsWithPrefix returns the available targets whose paths start with
+// prefix.
+//
+// Target paths are normalized, slash-separated paths starting with "/" (e.g.
+// "/plugins/foo.txt"), and a leading "/" is added to prefix if it is missing,
+// so both "plugins/" and "/plugins/" match "/plugins/foo.txt".
+func (c *Client) TargetsWithPrefix(prefix string) (data.Files, error) {
+	targets, err := c.Targets()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer r.Close()
-
-	// return ErrWrongSize if the reported size is known and incorrect
-	if size >= 0 && size != localMeta.Length {
-		return ErrWrongSize{name, size, localMeta.Length}
+	if !strings.HasPrefix(prefix, "/") {
+		prefix = "/" + prefix
 	}
+	files := make(data.Files)
+	for path, meta := range targets {
+		if strings.HasPrefix(path, prefix) {
+			files[path] = meta
+		}
+	}
+	return files, nil
+}
 
-	// wrap the data in a LimitReader so we download at most localMeta.Length bytes
-	stream := io.LimitReader(r, localMeta.Length)
-
-	// read the data, simultaneously writing it to dest and generating metadata
-	actual, err := util.GenerateFileMeta(io.TeeReader(stream, dest), localMeta.HashAlgorithms()...)
+// LatestByChannel groups the available targets by the release channel in
+// their custom metadata, which is the string value of channelKey in the
+// custom JSON object (e.g. "stable" for {"channel": "stable"}), so that
+// updaters can pick the latest target of the channel they follow.
+//
+// Targets without custom metadata, with custom metadata which is not a JSON
+// object, or without a string value at channelKey are skipped.
+func (c *Client) LatestByChannel(channelKey string) (map[string]data.Files, error) {
+	targets, err := c.Targets()
 	if err != nil {
-		return ErrDownloadFailed{name, err}
+		return nil, err
 	}
-
-	// check the data has the correct length and hashes
-	if err := util.FileMetaEqual(actual, localMeta); err != nil {
-		if err == util.ErrWrongLength {
-			return ErrWrongSize{name, actual.Length, localMeta.Length}
+	channels := make(map[string]data.Files)
+	for path, meta := range targets {
+		if meta.Custom == nil {
+			continue
 		}
-		return ErrDownloadFailed{name, err}
+		var custom map[string]json.RawMessage
+		if err := json.Unmarshal(*meta.Custom, &custom); err != nil {
+			continue
+		}
+		var channel *string
+		if err := json.Unmarshal(custom[channelKey], &channel); err != nil || channel == nil {
+			continue
+		}
+		if channels[*channel] == nil {
+			channels[*channel] = make(data.Files)
+		}
+		channels[*channel][path] = meta
 	}
-
-	return nil
+	return channels, nil
 }
 
-// Targets returns the complete list of available targets.
-func (c *Client) Targets() (data.Files, error) {
-	// populate c.targets from local storage if not set
-	if c.targets == nil {
-		if err := c.getLocalMeta(); err != nil {
-			return nil, err
+// PruneRemovedTargets removes the cached copies of targets in contentDir (see
+// WithTargetContentCache) which are not listed in the local targets.json,
+// e.g. as the targets have since been removed from the repository, returning
+// the paths of the removed files. This keeps the disk space used by the
+// cache bounded for long-lived clients.
+//
+// Only files named as cache entries are removed, so other files in
+// contentDir and downloads still being written to the cache are left alone.
+// The cache should not be shared with clients of other repositories, as
+// their targets would be removed.
+func (c *Client) PruneRemovedTargets(contentDir string) ([]string, error) {
+	if err := c.rlockTargets(); err != nil {
+		return nil, err
+	}
+	listed := make(map[string]struct{}, len(c.targets))
+	for _, meta := range c.targets {
+		if name, ok := targetCacheName(meta); ok {
+			listed[name] = struct{}{}
 		}
 	}
-	return c.targets, nil
+	c.mtx.RUnlock()
+
+	entries, err := ioutil.ReadDir(contentDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var removed []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.Mode().IsRegular() || !isTargetCacheName(name) {
+			continue
+		}
+		if _, ok := listed[name]; ok {
+			continue
+		}
+		path := filepath.Join(contentDir, name)
+		if err := os.Remove(path); err != nil {
+			return removed, err
+		}
+		removed = append(removed, path)
+	}
+	return removed, nil
 }
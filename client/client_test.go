@@ -1,17 +1,45 @@
 package client
 
 import (
+	"archive/tar"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"testing/iotest"
 	"time"
 
 	"github.com/flynn/go-tuf"
 	"github.com/flynn/go-tuf/data"
+	"github.com/flynn/go-tuf/sign"
 	"github.com/flynn/go-tuf/util"
 	"github.com/flynn/go-tuf/verify"
 	. "gopkg.in/check.v1"
@@ -156,6 +184,29 @@ func (s *ClientSuite) syncRemote(c *C) {
 	}
 }
 
+// syncVersionedRemote publishes the metadata in the repo to remote as
+// VERSION.ROLE.json, keeping earlier versions. timestamp.json and root.json
+// are also published under their plain names, as clients need them to
+// start an update and to initialize.
+func (s *ClientSuite) syncVersionedRemote(c *C, remote *fakeRemoteStore) {
+	meta, err := s.store.GetMeta()
+	c.Assert(err, IsNil)
+	for name, b := range meta {
+		if name == "root.json" {
+			remote.meta[name] = newFakeFile(b)
+		}
+		if name == "timestamp.json" {
+			remote.meta[name] = newFakeFile(b)
+			continue
+		}
+		signed := &data.Signed{}
+		c.Assert(json.Unmarshal(b, signed), IsNil)
+		v := &struct{ Version int }{}
+		c.Assert(json.Unmarshal(signed.Signed, v), IsNil)
+		remote.meta[fmt.Sprintf("%d.%s", v.Version, name)] = newFakeFile(b)
+	}
+}
+
 func (s *ClientSuite) addRemoteTarget(c *C, name string) {
 	c.Assert(s.repo.AddTarget(name, nil), IsNil)
 	c.Assert(s.repo.Snapshot(tuf.CompressionTypeNone), IsNil)
@@ -213,6 +264,30 @@ func assertWrongHash(c *C, err error) {
 	}
 }
 
+func (s *ClientSuite) TestErrorsUnwrap(c *C) {
+	// check errors.As finds the hash error in a download failure
+	client := s.updatedClient(c)
+	s.remote.targets["/foo.txt"] = newFakeFile([]byte("bar"))
+	err := client.Download("/foo.txt", &testDestination{})
+	var wrongHash util.ErrWrongHash
+	c.Assert(errors.As(err, &wrongHash), Equals, true)
+
+	// check errors.Is finds errors wrapped by each type
+	errFoo := errors.New("foo")
+	for _, err := range []error{
+		ErrDownloadFailed{"foo", errFoo},
+		ErrDecodeFailed{"foo", errFoo},
+		ErrRetryFailed{2, errFoo},
+		ErrTargetValidation{"foo", errFoo},
+		ErrMirrorsFailed{[]error{ErrNotFound{"foo"}, errFoo}},
+		ErrBatchDownload{"foo": ErrDownloadFailed{"foo", errFoo}},
+		ErrRetryFailed{2, ErrDecodeFailed{"foo", errFoo}},
+	} {
+		c.Assert(errors.Is(err, errFoo), Equals, true, Commentf("%T", err))
+	}
+	c.Assert(errors.Is(ErrDecodeFailed{"foo", verify.ErrExpired{}}, errFoo), Equals, false)
+}
+
 func (s *ClientSuite) assertErrExpired(c *C, err error, file string) {
 	decodeErr, ok := err.(ErrDecodeFailed)
 	if !ok {
@@ -229,7 +304,7 @@ func (s *ClientSuite) assertErrExpired(c *C, err error, file string) {
 func (s *ClientSuite) TestInitRootTooLarge(c *C) {
 	client := NewClient(MemoryLocalStore(), s.remote)
 	s.remote.meta["root.json"] = newFakeFile(make([]byte, maxMetaSize+1))
-	c.Assert(client.Init(s.rootKeys(c), 0), Equals, ErrMetaTooLarge{"root.json", maxMetaSize + 1})
+	c.Assert(client.Init(s.rootKeys(c), 0), Equals, ErrMetaTooLarge{"root.json", maxMetaSize + 1, maxMetaSize})
 }
 
 func (s *ClientSuite) TestInitRootExpired(c *C) {
@@ -250,8 +325,37 @@ func (s *ClientSuite) TestInit(c *C) {
 	// check Init() returns signed.ErrRoleThreshold when not enough keys
 	c.Assert(client.Init(s.rootKeys(c), 2), Equals, ErrInsufficientKeys)
 
+	// check Init() returns ErrRootVerification with the wrong root keys
+	wrongKey, err := sign.GenerateEd25519Key()
+	c.Assert(err, IsNil)
+	err = client.Init([]*data.Key{wrongKey.PublicData()}, 1)
+	c.Assert(err, DeepEquals, ErrRootVerification{Expected: 1, Found: 0, UnknownKeyIDs: []string{s.keyIDs["root"]}})
+
+	// check Init() returns ErrRootVerification when the threshold is not met
+	keys := append(s.rootKeys(c), wrongKey.PublicData())
+	err = client.Init(keys, 2)
+	c.Assert(err, DeepEquals, ErrRootVerification{Expected: 2, Found: 1, UnknownKeyIDs: []string{}})
+
+	// check signatures by the given keys which do not count towards the
+	// threshold (e.g. with an unknown method) are not counted
+	meta, err := s.store.GetMeta()
+	c.Assert(err, IsNil)
+	signed := &data.Signed{}
+	c.Assert(json.Unmarshal(meta["root.json"], signed), IsNil)
+	signed.Signatures = append(signed.Signatures, data.Signature{
+		KeyID:     wrongKey.PublicData().ID(),
+		Method:    "foo",
+		Signature: []byte("bar"),
+	})
+	rootJSON, err := json.Marshal(signed)
+	c.Assert(err, IsNil)
+	s.remote.meta["root.json"] = newFakeFile(rootJSON)
+	err = client.Init(keys, 2)
+	c.Assert(err, DeepEquals, ErrRootVerification{Expected: 2, Found: 1, UnknownKeyIDs: []string{}})
+	s.syncRemote(c)
+
 	// check Update() returns ErrNoRootKeys when uninitialized
-	_, err := client.Update()
+	_, err = client.Update()
 	c.Assert(err, Equals, ErrNoRootKeys)
 
 	// check Update() does not return ErrNoRootKeys after initialization
@@ -260,6 +364,153 @@ func (s *ClientSuite) TestInit(c *C) {
 	c.Assert(err, Not(Equals), ErrNoRootKeys)
 }
 
+func (s *ClientSuite) TestInitFrom(c *C) {
+	meta, err := s.store.GetMeta()
+	c.Assert(err, IsNil)
+	rootJSON := meta["root.json"]
+
+	// check InitFrom() rejects invalid JSON
+	client := NewClient(MemoryLocalStore(), s.remote)
+	err = client.InitFrom([]byte("{"))
+	c.Assert(err, FitsTypeOf, ErrDecodeFailed{})
+
+	// check InitFrom() rejects a root.json which is not signed by its own keys
+	signed := &data.Signed{}
+	c.Assert(json.Unmarshal(rootJSON, signed), IsNil)
+	signed.Signatures = nil
+	unsigned, err := json.Marshal(signed)
+	c.Assert(err, IsNil)
+	err = client.InitFrom(unsigned)
+	c.Assert(err, DeepEquals, ErrDecodeFailed{"root.json", verify.ErrNoSignatures})
+	_, err = client.Update()
+	c.Assert(err, Equals, ErrNoRootKeys)
+
+	// check InitFrom() does not read from the remote store
+	s.local = MemoryLocalStore()
+	s.remote.meta["root.json"].bytesRead = 0
+	client = NewClient(s.local, s.remote)
+	c.Assert(client.InitFrom(rootJSON), IsNil)
+	c.Assert(s.remote.meta["root.json"].bytesRead, Equals, 0)
+	local, err := s.local.GetMeta()
+	c.Assert(err, IsNil)
+	c.Assert(local["root.json"], DeepEquals, json.RawMessage(rootJSON))
+
+	// check Update() succeeds after InitFrom()
+	files, err := client.Update()
+	c.Assert(err, IsNil)
+	assertFiles(c, files, []string{"/foo.txt"})
+}
+
+func (s *ClientSuite) TestNotInitialized(c *C) {
+	client := NewClient(MemoryLocalStore(), s.remote)
+	var dest testDestination
+	_, _, streamErr := client.DownloadStream("/foo.txt")
+	_, _, trustedErr := client.TrustedRootKeys()
+	_, _, _, diffErr := client.TargetsDiff(nil)
+	for _, err := range []error{
+		second(client.Update()),
+		second(client.UpdateContext(context.Background())),
+		second(client.UpdateIfStale(time.Hour)),
+		second(client.CheckUpdate()),
+		client.Download("/foo.txt", &dest),
+		client.DownloadContext(context.Background(), "/foo.txt", &dest),
+		streamErr,
+		client.DownloadToFile("/foo.txt", filepath.Join(c.MkDir(), "foo.txt")),
+		client.VerifyTarget("/foo.txt", strings.NewReader("foo")),
+		client.DownloadBatch([]string{"/foo.txt"}, map[string]Destination{"/foo.txt": &dest}, 1),
+		client.Clean(),
+		second(client.MetaVersions()),
+		second(client.TimestampCustom()),
+		second(client.Expiries()),
+		trustedErr,
+		second(client.Targets()),
+		diffErr,
+		second(client.LocalTargets()),
+		second(client.TargetCustom("/foo.txt")),
+		second(client.TargetMeta("/foo.txt")),
+		second(client.TargetsWithPrefix("/")),
+		second(NewVerifier(MemoryLocalStore()).Targets()),
+	} {
+		if e, ok := err.(ErrBatchDownload); ok {
+			err = e["/foo.txt"]
+		}
+		c.Assert(err, Equals, ErrNotInitialized)
+	}
+}
+
+// second returns the second of two values, for checking the error returned
+// by methods which return a value and an error.
+func second(_ interface{}, err error) error {
+	return err
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func (s *ClientSuite) TestErrorClassification(c *C) {
+	netErr := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	for _, t := range []struct {
+		err       error
+		retriable bool
+		security  bool
+	}{
+		{err: nil},
+		{err: errors.New("foo")},
+		{err: ErrNotFound{"foo.txt"}},
+		{err: ErrLatestSnapshot{1}},
+		{err: context.Canceled},
+		{err: netErr, retriable: true},
+		{err: timeoutError{}, retriable: true},
+		{err: &url.Error{Op: "Get", URL: "http://example.com", Err: timeoutError{}}, retriable: true},
+		{err: ErrDownloadFailed{"foo.txt", io.ErrUnexpectedEOF}, retriable: true},
+		{err: ErrRetryFailed{3, netErr}, retriable: true},
+		{err: fmt.Errorf("update: %w", context.DeadlineExceeded), retriable: true},
+		{err: ErrMirrorsFailed{[]error{netErr, ErrNotFound{"foo.txt"}}}, retriable: true},
+		{err: ErrDownloadFailed{"foo.txt", util.ErrWrongHash{}}, security: true},
+		{err: ErrDownloadFailed{"foo.txt", util.ErrWrongLength}, security: true},
+		{err: ErrWrongSize{"foo.txt", 4, 3}, security: true},
+		{err: ErrDecodeFailed{"timestamp.json", verify.ErrRoleThreshold}, security: true},
+		{err: ErrDecodeFailed{"snapshot.json", verify.ErrExpired{}}, security: true},
+		{err: ErrDecodeFailed{"targets.json", verify.ErrLowVersion{}}, security: true},
+		{err: ErrRollback{"snapshot", 1, 2}, security: true},
+		{err: ErrRootInconsistent{verify.ErrRoleThreshold}, security: true},
+		{err: ErrMirrorsFailed{[]error{netErr, ErrWrongSize{"foo.txt", 4, 3}}}, security: true},
+	} {
+		c.Assert(IsRetriable(t.err), Equals, t.retriable, Commentf("%#v", t.err))
+		c.Assert(IsSecurityError(t.err), Equals, t.security, Commentf("%#v", t.err))
+	}
+
+	// check the error predicates match wrapped errors
+	c.Assert(IsNotFound(fmt.Errorf("get: %w", ErrNotFound{"foo.txt"})), Equals, true)
+	c.Assert(IsRollback(fmt.Errorf("update: %w", ErrRollback{"snapshot", 1, 2})), Equals, true)
+	c.Assert(IsLatestSnapshot(fmt.Errorf("update: %w", ErrLatestSnapshot{1})), Equals, true)
+	c.Assert(IsNotStale(fmt.Errorf("update: %w", ErrNotStale{})), Equals, true)
+	c.Assert(IsNotFound(ErrRollback{"snapshot", 1, 2}), Equals, false)
+	c.Assert(IsNotFound(ErrMirrorsFailed{[]error{netErr, ErrNotFound{"foo.txt"}}}), Equals, false)
+
+	// check an unreachable server gives a retriable error
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+	remote, err := HTTPRemoteStore(srv.URL, nil)
+	c.Assert(err, IsNil)
+	err = NewClient(MemoryLocalStore(), remote).Init(s.rootKeys(c), 1)
+	c.Assert(IsRetriable(err), Equals, true, Commentf("%v", err))
+	c.Assert(IsSecurityError(err), Equals, false)
+
+	// check expired metadata gives a security error
+	client := s.updatedClient(c)
+	c.Assert(s.repo.TimestampWithExpires(s.expiredTime), IsNil)
+	s.syncRemote(c)
+	s.withMetaExpired(func() {
+		_, err := client.Update()
+		c.Assert(IsSecurityError(err), Equals, true, Commentf("%v", err))
+		c.Assert(IsRetriable(err), Equals, false)
+	})
+}
+
 func (s *ClientSuite) TestFirstUpdate(c *C) {
 	files, err := s.newClient(c).Update()
 	c.Assert(err, IsNil)
@@ -267,6 +518,105 @@ func (s *ClientSuite) TestFirstUpdate(c *C) {
 	assertFiles(c, files, []string{"/foo.txt"})
 }
 
+func (s *ClientSuite) TestFirstUpdateGzip(c *C) {
+	for _, consistentSnapshot := range []bool{false, true} {
+		// publish a repository with gzip compressed targets.json to the
+		// file system
+		dir := c.MkDir()
+		repo, err := tuf.NewRepo(tuf.FileSystemStore(dir, nil))
+		c.Assert(err, IsNil)
+		c.Assert(repo.Init(consistentSnapshot), IsNil)
+		for _, role := range []string{"root", "snapshot", "targets", "timestamp"} {
+			_, err := repo.GenKey(role)
+			c.Assert(err, IsNil)
+		}
+		target := filepath.Join(dir, "staged", "targets", "foo.txt")
+		c.Assert(os.MkdirAll(filepath.Dir(target), 0755), IsNil)
+		c.Assert(ioutil.WriteFile(target, []byte("foo"), 0644), IsNil)
+		c.Assert(repo.AddTarget("foo.txt", nil), IsNil)
+		c.Assert(repo.Snapshot(tuf.CompressionTypeGzip), IsNil)
+		c.Assert(repo.Timestamp(), IsNil)
+		c.Assert(repo.Commit(), IsNil)
+
+		// serve it over HTTP, recording the metadata requested
+		var mtx sync.Mutex
+		var requested []string
+		files := http.FileServer(http.Dir(filepath.Join(dir, "repository")))
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mtx.Lock()
+			requested = append(requested, path.Base(r.URL.Path))
+			mtx.Unlock()
+			files.ServeHTTP(w, r)
+		}))
+		defer srv.Close()
+
+		// check the first update fetches, verifies and decompresses
+		// targets.json.gz
+		remote, err := HTTPRemoteStore(srv.URL, nil)
+		c.Assert(err, IsNil)
+		s.local = MemoryLocalStore()
+		client := NewClient(s.local, remote)
+		rootKeys, err := repo.RootKeys()
+		c.Assert(err, IsNil)
+		c.Assert(client.Init(rootKeys, 1), IsNil)
+		targets, err := client.Update()
+		c.Assert(err, IsNil)
+		assertFiles(c, targets, []string{"/foo.txt"})
+		var fetchedGzip bool
+		for _, name := range requested {
+			c.Assert(strings.HasSuffix(name, "targets.json"), Equals, false)
+			if strings.HasSuffix(name, "targets.json.gz") {
+				fetchedGzip = true
+			}
+		}
+		c.Assert(fetchedGzip, Equals, true)
+
+		// check the uncompressed targets.json is saved locally
+		local, err := s.local.GetMeta()
+		c.Assert(err, IsNil)
+		targetsJSON, err := ioutil.ReadFile(filepath.Join(dir, "repository", "targets.json"))
+		c.Assert(err, IsNil)
+		c.Assert([]byte(local["targets.json"]), DeepEquals, targetsJSON)
+
+		var dest testDestination
+		c.Assert(client.Download("/foo.txt", &dest), IsNil)
+		c.Assert(dest.String(), Equals, "foo")
+	}
+}
+
+func (s *ClientSuite) TestInitRootInconsistent(c *C) {
+	// publish a root.json which declares a root threshold of 2 but is only
+	// signed by its one existing root key
+	meta, err := s.store.GetMeta()
+	c.Assert(err, IsNil)
+	signed := &data.Signed{}
+	c.Assert(json.Unmarshal(meta["root.json"], signed), IsNil)
+	root := &data.Root{}
+	c.Assert(json.Unmarshal(signed.Signed, root), IsNil)
+	extra, err := sign.GenerateEd25519Key()
+	c.Assert(err, IsNil)
+	root.Keys[extra.PublicData().ID()] = extra.PublicData()
+	root.Roles["root"].KeyIDs = append(root.Roles["root"].KeyIDs, extra.PublicData().ID())
+	root.Roles["root"].Threshold = 2
+	signers, err := s.store.GetSigningKeys("root")
+	c.Assert(err, IsNil)
+	signed, err = sign.Marshal(root, signers...)
+	c.Assert(err, IsNil)
+	rootJSON, err := json.Marshal(signed)
+	c.Assert(err, IsNil)
+	s.remote.meta["root.json"] = newFakeFile(rootJSON)
+
+	// check Init fails even though the root is signed by the pinned key
+	s.local = MemoryLocalStore()
+	client := NewClient(s.local, s.remote)
+	err = client.Init(s.rootKeys(c), 1)
+	c.Assert(err, FitsTypeOf, ErrRootInconsistent{})
+	c.Assert(errors.Is(err, verify.ErrRoleThreshold), Equals, true)
+	local, err := s.local.GetMeta()
+	c.Assert(err, IsNil)
+	c.Assert(local, HasLen, 0)
+}
+
 func (s *ClientSuite) TestMissingRemoteMetadata(c *C) {
 	client := s.newClient(c)
 
@@ -287,158 +637,1457 @@ func (s *ClientSuite) TestNoChangeUpdate(c *C) {
 	c.Assert(IsLatestSnapshot(err), Equals, true)
 }
 
-func (s *ClientSuite) TestNewTimestamp(c *C) {
-	client := s.updatedClient(c)
-	version := client.timestampVer
-	c.Assert(version > 0, Equals, true)
-	c.Assert(s.repo.Timestamp(), IsNil)
-	s.syncRemote(c)
-	_, err := client.Update()
-	c.Assert(IsLatestSnapshot(err), Equals, true)
-	c.Assert(client.timestampVer > version, Equals, true)
-}
-
-func (s *ClientSuite) TestNewRoot(c *C) {
+func (s *ClientSuite) TestLastUpdateStats(c *C) {
 	client := s.newClient(c)
-
-	// replace all keys
-	newKeyIDs := make(map[string]string)
-	for role, id := range s.keyIDs {
-		c.Assert(s.repo.RevokeKey(role, id), IsNil)
-		newKeyIDs[role] = s.genKey(c, role)
+	size := func(names ...string) (n int64) {
+		meta, err := s.store.GetMeta()
+		c.Assert(err, IsNil)
+		for _, name := range names {
+			n += int64(len(meta[name]))
+		}
+		return
 	}
 
-	// update metadata
-	c.Assert(s.repo.Sign("targets.json"), IsNil)
+	_, err := client.Update()
+	c.Assert(err, IsNil)
+	c.Assert(client.LastUpdateStats(), Equals, UpdateStats{
+		MetaBytes: size("timestamp.json", "snapshot.json", "targets.json"),
+	})
+
+	// only timestamp.json is downloaded if there is nothing to update
+	_, err = client.Update()
+	c.Assert(IsLatestSnapshot(err), Equals, true)
+	c.Assert(client.LastUpdateStats(), Equals, UpdateStats{MetaBytes: size("timestamp.json")})
+
+	// metadata downloaded before restarting with a new root is counted
+	s.genKey(c, "root")
 	c.Assert(s.repo.Snapshot(tuf.CompressionTypeNone), IsNil)
 	c.Assert(s.repo.Timestamp(), IsNil)
 	s.syncRemote(c)
+	_, err = client.Update()
+	c.Assert(err, IsNil)
+	c.Assert(client.LastUpdateStats(), Equals, UpdateStats{
+		MetaBytes: size("root.json") + 2*size("timestamp.json", "snapshot.json"),
+	})
+}
 
-	// check update gets new root version
-	c.Assert(client.getLocalMeta(), IsNil)
-	version := client.rootVer
-	c.Assert(version > 0, Equals, true)
+func (s *ClientSuite) TestForceUpdate(c *C) {
+	client := s.updatedClient(c)
 	_, err := client.Update()
-	c.Assert(err, IsNil)
-	c.Assert(client.rootVer > version, Equals, true)
+	c.Assert(IsLatestSnapshot(err), Equals, true)
 
-	// check old keys are not in db
-	for _, id := range s.keyIDs {
-		c.Assert(client.db.GetKey(id), IsNil)
+	// check unchanged metadata other than root.json is downloaded again
+	for _, f := range s.remote.meta {
+		f.bytesRead = 0
 	}
-
-	// check new keys are in db
-	for name, id := range newKeyIDs {
-		key := client.db.GetKey(id)
-		c.Assert(key, NotNil)
-		c.Assert(key.ID(), Equals, id)
-		role := client.db.GetRole(name)
-		c.Assert(role, NotNil)
-		c.Assert(role.KeyIDs, DeepEquals, map[string]struct{}{id: {}})
+	files, err := client.ForceUpdate()
+	c.Assert(err, IsNil)
+	assertFiles(c, files, []string{"/foo.txt"})
+	for _, name := range []string{"timestamp.json", "snapshot.json", "targets.json"} {
+		c.Assert(s.remote.meta[name].bytesRead > 0, Equals, true, Commentf("%s not downloaded", name))
 	}
-}
+	c.Assert(s.remote.meta["root.json"].bytesRead, Equals, 0)
+	versions, err := client.MetaVersions()
+	c.Assert(err, IsNil)
+	c.Assert(versions.Targets, Equals, 1)
 
-func (s *ClientSuite) TestNewTargets(c *C) {
-	client := s.newClient(c)
-	files, err := client.Update()
+	// check tampered local metadata is replaced
+	c.Assert(s.local.SetMeta("targets.json", []byte("{}")), IsNil)
+	_, err = NewClient(s.local, s.remote).Targets()
+	c.Assert(err, NotNil)
+	files, err = NewClient(s.local, s.remote).ForceUpdate()
+	c.Assert(err, IsNil)
+	assertFiles(c, files, []string{"/foo.txt"})
+	files, err = NewClient(s.local, s.remote).Targets()
 	c.Assert(err, IsNil)
 	assertFiles(c, files, []string{"/foo.txt"})
 
-	s.addRemoteTarget(c, "bar.txt")
-	s.addRemoteTarget(c, "baz.txt")
-
-	files, err = client.Update()
+	// check a failed update keeps the local metadata
+	s.remote.meta["snapshot.json"] = newFakeFile([]byte("{}"))
+	_, err = client.ForceUpdate()
+	c.Assert(err, NotNil)
+	files, err = client.Targets()
 	c.Assert(err, IsNil)
-	assertFiles(c, files, []string{"/bar.txt", "/baz.txt"})
+	assertFiles(c, files, []string{"/foo.txt"})
+	s.syncRemote(c)
 
-	// Adding the same exact file should not lead to an update
-	s.addRemoteTarget(c, "bar.txt")
-	files, err = client.Update()
+	// check an older timestamp.json is rejected
+	meta, err := s.store.GetMeta()
 	c.Assert(err, IsNil)
-	c.Assert(files, HasLen, 0)
+	oldTimestamp := meta["timestamp.json"]
+	c.Assert(s.repo.Timestamp(), IsNil)
+	s.syncRemote(c)
+	_, err = client.ForceUpdate()
+	c.Assert(err, IsNil)
+	version := client.timestampVer
+	s.remote.meta["timestamp.json"] = newFakeFile(oldTimestamp)
+	_, err = client.ForceUpdate()
+	c.Assert(err, DeepEquals, ErrRollback{"timestamp", version - 1, version})
+	_, err = NewClient(s.local, s.remote).ForceUpdate()
+	c.Assert(err, DeepEquals, ErrRollback{"timestamp", version - 1, version})
 }
 
-func (s *ClientSuite) TestNewTimestampKey(c *C) {
+func (s *ClientSuite) TestStats(c *C) {
 	client := s.newClient(c)
+	c.Assert(client.Stats(), Equals, Stats{})
 
-	// replace key
-	oldID := s.keyIDs["timestamp"]
-	c.Assert(s.repo.RevokeKey("timestamp", oldID), IsNil)
-	newID := s.genKey(c, "timestamp")
+	// the first update downloads targets.json
+	_, err := client.Update()
+	c.Assert(err, IsNil)
+	c.Assert(client.Stats(), Equals, Stats{FullDownloads: 1})
 
-	// generate new snapshot (because root has changed) and timestamp
+	// an update with nothing to update hits the snapshot cache
+	_, err = client.Update()
+	c.Assert(IsLatestSnapshot(err), Equals, true)
+	c.Assert(client.Stats(), Equals, Stats{SnapshotCacheHits: 1, FullDownloads: 1})
+
+	// a new root restarts the update, which hits the targets cache
+	s.genKey(c, "root")
 	c.Assert(s.repo.Snapshot(tuf.CompressionTypeNone), IsNil)
 	c.Assert(s.repo.Timestamp(), IsNil)
 	s.syncRemote(c)
-
-	// check update gets new root and timestamp
-	c.Assert(client.getLocalMeta(), IsNil)
-	rootVer := client.rootVer
-	timestampVer := client.timestampVer
-	_, err := client.Update()
+	_, err = client.Update()
 	c.Assert(err, IsNil)
-	c.Assert(client.rootVer > rootVer, Equals, true)
-	c.Assert(client.timestampVer > timestampVer, Equals, true)
+	c.Assert(client.Stats(), Equals, Stats{
+		SnapshotCacheHits: 1,
+		TargetsCacheHits:  1,
+		RootRestarts:      1,
+		FullDownloads:     1,
+	})
 
-	// check key has been replaced in db
-	c.Assert(client.db.GetKey(oldID), IsNil)
-	key := client.db.GetKey(newID)
-	c.Assert(key, NotNil)
-	c.Assert(key.ID(), Equals, newID)
-	role := client.db.GetRole("timestamp")
-	c.Assert(role, NotNil)
-	c.Assert(role.KeyIDs, DeepEquals, map[string]struct{}{newID: {}})
+	// new targets are downloaded
+	s.addRemoteTarget(c, "bar.txt")
+	_, err = client.Update()
+	c.Assert(err, IsNil)
+	c.Assert(client.Stats(), Equals, Stats{
+		SnapshotCacheHits: 1,
+		TargetsCacheHits:  1,
+		RootRestarts:      1,
+		FullDownloads:     2,
+	})
 }
 
-func (s *ClientSuite) TestNewSnapshotKey(c *C) {
+func (s *ClientSuite) TestUpdateContextCancelled(c *C) {
 	client := s.newClient(c)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := client.UpdateContext(ctx)
+	c.Assert(err, DeepEquals, ErrDownloadFailed{"timestamp.json", context.Canceled})
 
-	// replace key
-	oldID := s.keyIDs["snapshot"]
-	c.Assert(s.repo.RevokeKey("snapshot", oldID), IsNil)
-	newID := s.genKey(c, "snapshot")
+	// the update succeeds with a live context
+	files, err := client.UpdateContext(context.Background())
+	c.Assert(err, IsNil)
+	assertFiles(c, files, []string{"/foo.txt"})
+}
 
-	// generate new snapshot and timestamp
-	c.Assert(s.repo.Snapshot(tuf.CompressionTypeNone), IsNil)
-	c.Assert(s.repo.Timestamp(), IsNil)
-	s.syncRemote(c)
+// flakyRemoteStore fails the first `failures` requests with a network error.
+type flakyRemoteStore struct {
+	RemoteStore
+	failures int
+	calls    int
+}
 
-	// check update gets new root, snapshot and timestamp
-	c.Assert(client.getLocalMeta(), IsNil)
-	rootVer := client.rootVer
-	snapshotVer := client.snapshotVer
-	timestampVer := client.timestampVer
-	_, err := client.Update()
-	c.Assert(err, IsNil)
-	c.Assert(client.rootVer > rootVer, Equals, true)
-	c.Assert(client.snapshotVer > snapshotVer, Equals, true)
-	c.Assert(client.timestampVer > timestampVer, Equals, true)
+var errFlakyNetwork = errors.New("network error")
 
-	// check key has been replaced in db
-	c.Assert(client.db.GetKey(oldID), IsNil)
-	key := client.db.GetKey(newID)
-	c.Assert(key, NotNil)
-	c.Assert(key.ID(), Equals, newID)
-	role := client.db.GetRole("snapshot")
-	c.Assert(role, NotNil)
-	c.Assert(role.KeyIDs, DeepEquals, map[string]struct{}{newID: {}})
+func (f *flakyRemoteStore) GetMeta(name string) (io.ReadCloser, int64, error) {
+	f.calls++
+	if f.calls <= f.failures {
+		return nil, 0, errFlakyNetwork
+	}
+	return f.RemoteStore.GetMeta(name)
 }
 
-func (s *ClientSuite) TestNewTargetsKey(c *C) {
-	client := s.newClient(c)
+func (f *flakyRemoteStore) GetTarget(path string) (io.ReadCloser, int64, error) {
+	f.calls++
+	if f.calls <= f.failures {
+		return nil, 0, errFlakyNetwork
+	}
+	return f.RemoteStore.GetTarget(path)
+}
 
-	// replace key
-	oldID := s.keyIDs["targets"]
-	c.Assert(s.repo.RevokeKey("targets", oldID), IsNil)
-	newID := s.genKey(c, "targets")
+func (s *ClientSuite) TestLocalTargets(c *C) {
+	remote := &flakyRemoteStore{RemoteStore: s.remote, failures: math.MaxInt32}
 
-	// re-sign targets and generate new snapshot and timestamp
-	c.Assert(s.repo.Sign("targets.json"), IsNil)
-	c.Assert(s.repo.Snapshot(tuf.CompressionTypeNone), IsNil)
-	c.Assert(s.repo.Timestamp(), IsNil)
-	s.syncRemote(c)
+	// check ErrNoRootKeys is returned when uninitialized
+	s.local = MemoryLocalStore()
+	_, err := NewClient(s.local, remote).LocalTargets()
+	c.Assert(err, Equals, ErrNoRootKeys)
 
-	// check update gets new metadata
+	// check nil is returned before the first update
+	client := s.newClient(c)
+	files, err := NewClient(s.local, remote).LocalTargets()
+	c.Assert(err, IsNil)
+	c.Assert(files, IsNil)
+
+	// check the targets saved by an update are returned by another client
+	// sharing the local store, without using the remote store
+	_, err = client.Update()
+	c.Assert(err, IsNil)
+	files, err = NewClient(s.local, remote).LocalTargets()
+	c.Assert(err, IsNil)
+	assertFiles(c, files, []string{"/foo.txt"})
+	c.Assert(remote.calls, Equals, 0)
+
+	// check local targets are re-read by a client which already has targets
+	other := NewClient(s.local, remote)
+	_, err = other.Targets()
+	c.Assert(err, IsNil)
+	s.addRemoteTarget(c, "bar.txt")
+	_, err = client.Update()
+	c.Assert(err, IsNil)
+	files, err = other.LocalTargets()
+	c.Assert(err, IsNil)
+	assertFiles(c, files, []string{"/foo.txt", "/bar.txt"})
+	c.Assert(remote.calls, Equals, 0)
+}
+
+func (s *ClientSuite) TestTargetsDiff(c *C) {
+	client := s.updatedClient(c)
+	s.addRemoteTarget(c, "bar.txt")
+	_, err := client.Update()
+	c.Assert(err, IsNil)
+	previous, err := client.Targets()
+	c.Assert(err, IsNil)
+
+	// check nothing is reported when the targets are unchanged
+	added, removed, changed, err := client.TargetsDiff(previous)
+	c.Assert(err, IsNil)
+	c.Assert(added, HasLen, 0)
+	c.Assert(removed, HasLen, 0)
+	c.Assert(changed, HasLen, 0)
+
+	// check removals are reported as well as additions
+	c.Assert(s.repo.RemoveTarget("bar.txt"), IsNil)
+	s.addRemoteTarget(c, "baz.txt")
+	_, err = client.Update()
+	c.Assert(err, IsNil)
+	added, removed, changed, err = client.TargetsDiff(previous)
+	c.Assert(err, IsNil)
+	assertFiles(c, added, []string{"/baz.txt"})
+	c.Assert(removed, HasLen, 1)
+	c.Assert(removed["/bar.txt"], DeepEquals, previous["/bar.txt"])
+	c.Assert(changed, HasLen, 0)
+
+	// check a target with a different length is reported as changed
+	foo := previous["/foo.txt"]
+	foo.Length++
+	previous["/foo.txt"] = foo
+	_, _, changed, err = client.TargetsDiff(previous)
+	c.Assert(err, IsNil)
+	assertFiles(c, changed, []string{"/foo.txt"})
+}
+
+func (s *ClientSuite) TestUpdateRetry(c *C) {
+	s.newClient(c)
+	remote := &flakyRemoteStore{RemoteStore: s.remote, failures: 2}
+	var backoffs []int
+	backoff := func(attempt int) time.Duration {
+		backoffs = append(backoffs, attempt)
+		return time.Millisecond
+	}
+
+	// transient errors are retried
+	client := NewClient(s.local, remote, WithRetry(3, backoff))
+	files, err := client.Update()
+	c.Assert(err, IsNil)
+	assertFiles(c, files, []string{"/foo.txt"})
+	c.Assert(backoffs, DeepEquals, []int{1, 2})
+
+	// the error is wrapped once all attempts fail
+	remote.calls = 0
+	remote.failures = 3
+	var dest testDestination
+	c.Assert(client.Download("/foo.txt", &dest), DeepEquals, ErrRetryFailed{3, errFlakyNetwork})
+	c.Assert(remote.calls, Equals, 3)
+
+	// ErrNotFound is not retried
+	remote.calls = 0
+	remote.failures = 0
+	c.Assert(client.Download("/bar.txt", &dest), Equals, ErrUnknownTarget{"/bar.txt"})
+	delete(s.remote.targets, "/foo.txt")
+	c.Assert(client.Download("/foo.txt", &dest), Equals, ErrNotFound{"/foo.txt"})
+	c.Assert(remote.calls, Equals, 1)
+
+	// without a retry policy errors are returned immediately
+	remote.calls = 0
+	remote.failures = 1
+	_, err = NewClient(s.local, remote).Update()
+	c.Assert(err, DeepEquals, ErrDownloadFailed{"timestamp.json", errFlakyNetwork})
+	c.Assert(remote.calls, Equals, 1)
+}
+
+func (s *ClientSuite) TestUpdateMirrors(c *C) {
+	s.newClient(c)
+
+	// the first mirror is missing timestamp.json and the second serves a
+	// tampered targets.json
+	missing := newFakeRemoteStore()
+	tampered := newFakeRemoteStore()
+	for name, file := range s.remote.meta {
+		b, err := ioutil.ReadAll(file)
+		c.Assert(err, IsNil)
+		file.Close()
+		if name == "targets.json" {
+			b = bytes.Replace(b, []byte("targets"), []byte("xargets"), 1)
+		}
+		tampered.meta[name] = newFakeFile(b)
+		if name != "timestamp.json" {
+			missing.meta[name] = newFakeFile(b)
+		}
+	}
+
+	// the update falls through to the valid mirror
+	client := NewClient(s.local, MultiRemoteStore{missing, tampered, s.remote})
+	files, err := client.Update()
+	c.Assert(err, IsNil)
+	assertFiles(c, files, []string{"/foo.txt"})
+
+	// targets are downloaded from the first mirror which has them
+	var dest testDestination
+	c.Assert(client.Download("/foo.txt", &dest), IsNil)
+	c.Assert(dest.String(), Equals, "foo")
+
+	// errors from each mirror are returned if they all fail (both mirrors
+	// serve the old snapshot.json)
+	s.addRemoteTarget(c, "bar.txt")
+	tampered.meta["timestamp.json"] = s.remote.meta["timestamp.json"]
+	client = NewClient(s.local, MultiRemoteStore{missing, tampered})
+	_, err = client.Update()
+	e, ok := err.(ErrMirrorsFailed)
+	if !ok {
+		c.Fatalf("expected err to have type ErrMirrorsFailed, got %T", err)
+	}
+	c.Assert(e.Errs, HasLen, 2)
+	for _, err := range e.Errs {
+		assertWrongHash(c, err)
+	}
+
+	// ErrNotFound is returned if no mirror has the file
+	c.Assert(client.Download("/foo.txt", &dest), Equals, ErrNotFound{"/foo.txt"})
+}
+
+// blockingRemoteStore is a RemoteStore which signals started and then waits
+// for unblock to be closed before serving timestamp.json.
+type blockingRemoteStore struct {
+	RemoteStore
+	started chan struct{}
+	unblock chan struct{}
+}
+
+func (b *blockingRemoteStore) GetMeta(name string) (io.ReadCloser, int64, error) {
+	if name == "timestamp.json" {
+		close(b.started)
+		<-b.unblock
+	}
+	return b.RemoteStore.GetMeta(name)
+}
+
+func (s *ClientSuite) TestSetRemoteStore(c *C) {
+	s.updatedClient(c)
+	blocking := &blockingRemoteStore{
+		RemoteStore: s.remote,
+		started:     make(chan struct{}),
+		unblock:     make(chan struct{}),
+	}
+	client := NewClient(s.local, blocking)
+
+	// the new remote serves bar.txt, the old remote does not
+	newRemote := newFakeRemoteStore()
+	for name, file := range s.remote.meta {
+		newRemote.meta[name] = file
+	}
+	c.Assert(s.repo.AddTarget("bar.txt", nil), IsNil)
+	c.Assert(s.repo.Snapshot(tuf.CompressionTypeNone), IsNil)
+	c.Assert(s.repo.Timestamp(), IsNil)
+	meta, err := s.store.GetMeta()
+	c.Assert(err, IsNil)
+	for _, name := range []string{"targets.json", "snapshot.json", "timestamp.json"} {
+		newRemote.meta[name] = newFakeFile(meta[name])
+	}
+
+	// check the remote is not replaced during an update
+	updateErr := make(chan error)
+	go func() {
+		_, err := client.Update()
+		updateErr <- err
+	}()
+	<-blocking.started
+	replaced := make(chan struct{})
+	go func() {
+		client.SetRemoteStore(newRemote)
+		close(replaced)
+	}()
+	select {
+	case <-replaced:
+		c.Fatal("expected SetRemoteStore to wait for the update")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(blocking.unblock)
+	c.Assert(IsLatestSnapshot(<-updateErr), Equals, true)
+	<-replaced
+
+	// check the next update uses the new remote
+	files, err := client.Update()
+	c.Assert(err, IsNil)
+	assertFiles(c, files, []string{"/bar.txt"})
+}
+
+func (s *ClientSuite) TestCheckUpdate(c *C) {
+	client := s.updatedClient(c)
+	before, err := s.local.GetMeta()
+	c.Assert(err, IsNil)
+	snapshot := make(map[string]json.RawMessage, len(before))
+	for name, meta := range before {
+		snapshot[name] = meta
+	}
+
+	s.addRemoteTarget(c, "bar.txt")
+	c.Assert(s.repo.RemoveTarget("foo.txt"), IsNil)
+	c.Assert(s.repo.AddTarget("baz.txt", json.RawMessage(`{"changed":true}`)), IsNil)
+	c.Assert(s.repo.Snapshot(tuf.CompressionTypeNone), IsNil)
+	c.Assert(s.repo.Timestamp(), IsNil)
+	s.syncRemote(c)
+
+	summary, err := client.CheckUpdate()
+	c.Assert(err, IsNil)
+	assertFiles(c, summary.Added, []string{"/bar.txt", "/baz.txt"})
+	assertFiles(c, summary.Removed, []string{"/foo.txt"})
+	c.Assert(summary.Changed, HasLen, 0)
+	c.Assert(summary.Versions, Equals, MetaVersions{Root: 4, Targets: 4, Snapshot: 3, Timestamp: 3})
+
+	// nothing is persisted and the client state is unchanged
+	after, err := s.local.GetMeta()
+	c.Assert(err, IsNil)
+	c.Assert(after, DeepEquals, snapshot)
+	files, err := client.Targets()
+	c.Assert(err, IsNil)
+	assertFiles(c, files, []string{"/foo.txt"})
+
+	// the real update matches the summary
+	files, err = client.Update()
+	c.Assert(err, IsNil)
+	assertFiles(c, files, []string{"/bar.txt", "/baz.txt"})
+}
+
+func (s *ClientSuite) TestUpdateConsistentSnapshots(c *C) {
+	s.newClient(c)
+
+	// publish metadata as VERSION.ROLE.json and targets as HASH.FILENAME
+	remote := newFakeRemoteStore()
+	s.syncVersionedRemote(c, remote)
+	targets, err := s.repo.Targets()
+	c.Assert(err, IsNil)
+	for _, hashedPath := range util.HashedPaths("/foo.txt", targets["/foo.txt"].Hashes) {
+		remote.targets[hashedPath] = newFakeFile(targetFiles["/foo.txt"])
+	}
+
+	client := NewClient(s.local, remote, WithConsistentSnapshots(true))
+	files, err := client.Update()
+	c.Assert(err, IsNil)
+	assertFiles(c, files, []string{"/foo.txt"})
+	var dest testDestination
+	c.Assert(client.Download("/foo.txt", &dest), IsNil)
+	c.Assert(dest.String(), Equals, "foo")
+
+	// metadata is stored locally under the plain role names
+	local, err := s.local.GetMeta()
+	c.Assert(err, IsNil)
+	for _, name := range []string{"root.json", "targets.json", "snapshot.json", "timestamp.json"} {
+		_, ok := local[name]
+		c.Assert(ok, Equals, true)
+	}
+
+	// the plain names are not requested
+	_, err = NewClient(s.local, s.remote, WithConsistentSnapshots(true)).Update()
+	c.Assert(IsLatestSnapshot(err), Equals, true)
+	s.addRemoteTarget(c, "bar.txt")
+	_, err = NewClient(s.local, s.remote, WithConsistentSnapshots(true)).Update()
+	c.Assert(err, Equals, ErrMissingRemoteMetadata{"snapshot.json"})
+}
+
+func (s *ClientSuite) TestUpdateRootConsistentSnapshot(c *C) {
+	// create a repo whose root.json declares consistent_snapshot: true
+	store := tuf.MemoryStore(nil, targetFiles)
+	repo, err := tuf.NewRepo(store)
+	c.Assert(err, IsNil)
+	c.Assert(repo.Init(true), IsNil)
+	for _, role := range []string{"root", "targets", "snapshot", "timestamp"} {
+		_, err := repo.GenKey(role)
+		c.Assert(err, IsNil)
+	}
+
+	// publish metadata as HASH.ROLE.json and targets as HASH.FILENAME,
+	// with only timestamp.json and root.json (needed to initialize) also
+	// under their plain names
+	remote := newFakeRemoteStore()
+	publish := func(names ...string) {
+		c.Assert(repo.AddTargets(names, nil), IsNil)
+		c.Assert(repo.Snapshot(tuf.CompressionTypeNone), IsNil)
+		c.Assert(repo.Timestamp(), IsNil)
+		meta, err := store.GetMeta()
+		c.Assert(err, IsNil)
+		for name, b := range meta {
+			if name == "root.json" || name == "timestamp.json" {
+				remote.meta[name] = newFakeFile(b)
+			}
+			if name == "timestamp.json" {
+				continue
+			}
+			m, err := util.GenerateFileMeta(bytes.NewReader(b))
+			c.Assert(err, IsNil)
+			for _, hashedPath := range util.HashedPaths(name, m.Hashes) {
+				remote.meta[hashedPath] = newFakeFile(b)
+			}
+		}
+		targets, err := repo.Targets()
+		c.Assert(err, IsNil)
+		for _, name := range names {
+			path := "/" + name
+			for _, hashedPath := range util.HashedPaths(path, targets[path].Hashes) {
+				remote.targets[hashedPath] = newFakeFile(targetFiles[path])
+			}
+		}
+	}
+	publish("foo.txt")
+
+	// check a client without any options follows the flag in root.json
+	rootKeys, err := repo.RootKeys()
+	c.Assert(err, IsNil)
+	client := NewClient(MemoryLocalStore(), remote)
+	c.Assert(client.Init(rootKeys, 1), IsNil)
+	files, err := client.Update()
+	c.Assert(err, IsNil)
+	c.Assert(client.consistentSnapshot, Equals, true)
+	assertFiles(c, files, []string{"/foo.txt"})
+	var dest testDestination
+	c.Assert(client.Download("/foo.txt", &dest), IsNil)
+	c.Assert(dest.String(), Equals, "foo")
+
+	// check later updates also use the hashed names
+	publish("bar.txt")
+	files, err = client.Update()
+	c.Assert(err, IsNil)
+	assertFiles(c, files, []string{"/bar.txt"})
+	dest = testDestination{}
+	c.Assert(client.Download("/bar.txt", &dest), IsNil)
+	c.Assert(dest.String(), Equals, "bar")
+
+	// check a client of a repo whose root.json does not declare
+	// consistent snapshots requests the plain names
+	client = s.updatedClient(c)
+	c.Assert(client.consistentSnapshot, Equals, false)
+}
+
+func (s *ClientSuite) TestUpdateRootChain(c *C) {
+	remote := newFakeRemoteStore()
+	s.syncVersionedRemote(c, remote)
+	client := NewClient(MemoryLocalStore(), remote, WithConsistentSnapshots(true))
+	c.Assert(client.Init(s.rootKeys(c), 1), IsNil)
+	_, err := client.Update()
+	c.Assert(err, IsNil)
+	startVer := client.rootVer
+
+	// rotate the root key twice, publishing each intermediate root
+	oldID := s.keyIDs["root"]
+	for i := 0; i < 2; i++ {
+		newID := s.genKey(c, "root")
+		s.syncVersionedRemote(c, remote)
+		c.Assert(s.repo.RevokeKey("root", oldID), IsNil)
+		s.syncVersionedRemote(c, remote)
+		oldID = newID
+	}
+	c.Assert(s.repo.Snapshot(tuf.CompressionTypeNone), IsNil)
+	c.Assert(s.repo.Timestamp(), IsNil)
+	s.syncVersionedRemote(c, remote)
+
+	// check an intermediate root which fails verification is not skipped
+	name := fmt.Sprintf("%d.root.json", startVer+2)
+	valid := remote.meta[name]
+	signed := &data.Signed{}
+	c.Assert(json.NewDecoder(valid).Decode(signed), IsNil)
+	c.Assert(valid.Close(), IsNil)
+	signed.Signatures = nil
+	invalid, err := json.Marshal(signed)
+	c.Assert(err, IsNil)
+	remote.meta[name] = newFakeFile(invalid)
+	_, err = client.Update()
+	c.Assert(err, FitsTypeOf, ErrDecodeFailed{})
+	c.Assert(err.(ErrDecodeFailed).File, Equals, name)
+
+	// check the client steps through each root
+	remote.meta[name] = valid
+	_, err = client.Update()
+	c.Assert(err, IsNil)
+	c.Assert(client.rootVer, Equals, startVer+4)
+	for v := startVer + 1; v <= startVer+4; v++ {
+		c.Assert(remote.meta[fmt.Sprintf("%d.root.json", v)].bytesRead > 0, Equals, true)
+	}
+	keys, _, err := client.TrustedRootKeys()
+	c.Assert(err, IsNil)
+	c.Assert(keys, HasLen, 1)
+	c.Assert(keys[0].ID(), Equals, oldID)
+}
+
+func (s *ClientSuite) TestUpdateRootChainMissingVersion(c *C) {
+	remote := newFakeRemoteStore()
+	s.syncVersionedRemote(c, remote)
+	client := NewClient(MemoryLocalStore(), remote, WithConsistentSnapshots(true))
+	c.Assert(client.Init(s.rootKeys(c), 1), IsNil)
+	_, err := client.Update()
+	c.Assert(err, IsNil)
+	startVer := client.rootVer
+
+	// publish two new roots, both of which are signed by the trusted root
+	// key, and withhold the first of them
+	s.genKey(c, "root")
+	s.syncVersionedRemote(c, remote)
+	s.genKey(c, "targets")
+	c.Assert(s.repo.Snapshot(tuf.CompressionTypeNone), IsNil)
+	c.Assert(s.repo.Timestamp(), IsNil)
+	s.syncVersionedRemote(c, remote)
+	name := fmt.Sprintf("%d.root.json", startVer+1)
+	withheld := remote.meta[name]
+	delete(remote.meta, name)
+
+	// check root.json is not trusted without the missing version
+	_, err = client.Update()
+	c.Assert(err, Equals, ErrMissingRemoteMetadata{name})
+	c.Assert(client.rootVer, Equals, startVer)
+
+	// check the update succeeds once it is published
+	remote.meta[name] = withheld
+	_, err = client.Update()
+	c.Assert(err, IsNil)
+	c.Assert(client.rootVer, Equals, startVer+2)
+}
+
+func (s *ClientSuite) TestUpdateIfStale(c *C) {
+	clock := verify.NewFakeClock(time.Now())
+	s.local = MemoryLocalStore()
+	client := NewClient(s.local, s.remote, WithClock(clock))
+	c.Assert(client.Init(s.rootKeys(c), 1), IsNil)
+
+	// the first update always happens
+	files, err := client.UpdateIfStale(time.Hour)
+	c.Assert(err, IsNil)
+	assertFiles(c, files, []string{"/foo.txt"})
+
+	// no remote requests are made within maxAge of the last update
+	s.addRemoteTarget(c, "bar.txt")
+	s.remote.meta = nil
+	clock.Advance(time.Minute)
+	_, err = client.UpdateIfStale(time.Hour)
+	c.Assert(err, FitsTypeOf, ErrNotStale{})
+	c.Assert(err.(ErrNotStale).LastUpdate.Equal(clock.Now().Add(-time.Minute)), Equals, true)
+
+	// the last update time survives restarts
+	client = NewClient(s.local, s.remote, WithClock(clock))
+	_, err = client.UpdateIfStale(time.Hour)
+	c.Assert(IsNotStale(err), Equals, true)
+
+	// updates happen once the last update is older than maxAge
+	s.remote.meta = make(map[string]*fakeFile)
+	s.syncRemote(c)
+	clock.Advance(time.Hour)
+	files, err = client.UpdateIfStale(time.Hour)
+	c.Assert(err, IsNil)
+	assertFiles(c, files, []string{"/bar.txt"})
+
+	// an update which finds nothing new is recorded
+	clock.Advance(2 * time.Hour)
+	_, err = client.UpdateIfStale(time.Hour)
+	c.Assert(IsLatestSnapshot(err), Equals, true)
+	_, err = client.UpdateIfStale(time.Hour)
+	c.Assert(IsNotStale(err), Equals, true)
+
+	// updates happen if the local timestamp.json has expired
+	clock.Advance(48 * time.Hour)
+	c.Assert(s.repo.TimestampWithExpires(clock.Now().Add(time.Hour)), IsNil)
+	s.syncRemote(c)
+	_, err = client.UpdateIfStale(100 * time.Hour)
+	c.Assert(IsLatestSnapshot(err), Equals, true)
+
+	// updates made by Update are not recorded
+	s.updatedClient(c)
+	state, err := s.local.(StateLocalStore).GetState()
+	c.Assert(err, IsNil)
+	_, ok := state[lastUpdateState]
+	c.Assert(ok, Equals, false)
+}
+
+// recordingLocalStore is a LocalStore which records the names of the
+// metadata written to it, and is not a StateLocalStore.
+type recordingLocalStore struct {
+	LocalStore
+	names []string
+}
+
+func (r *recordingLocalStore) SetMeta(name string, meta json.RawMessage) error {
+	r.names = append(r.names, name)
+	return r.LocalStore.SetMeta(name, meta)
+}
+
+func (s *ClientSuite) TestLocalStoreWithoutState(c *C) {
+	local := &recordingLocalStore{LocalStore: MemoryLocalStore()}
+	client := NewClient(local, s.remote, WithMinRootVersion(1))
+	c.Assert(client.Init(s.rootKeys(c), 1), IsNil)
+	_, err := client.UpdateIfStale(time.Hour)
+	c.Assert(err, IsNil)
+
+	// check the client state is kept in memory
+	_, err = client.UpdateIfStale(time.Hour)
+	c.Assert(IsNotStale(err), Equals, true)
+
+	// check only top-level metadata was written to the store
+	c.Assert(local.names, Not(HasLen), 0)
+	for _, name := range local.names {
+		c.Assert(isTopLevelMeta(name), Equals, true, Commentf("%s", name))
+	}
+}
+
+func (s *ClientSuite) TestNewTimestamp(c *C) {
+	client := s.updatedClient(c)
+	version := client.timestampVer
+	c.Assert(version > 0, Equals, true)
+	c.Assert(s.repo.Timestamp(), IsNil)
+	s.syncRemote(c)
+	_, err := client.Update()
+	c.Assert(IsLatestSnapshot(err), Equals, true)
+	c.Assert(client.timestampVer > version, Equals, true)
+}
+
+func (s *ClientSuite) TestClean(c *C) {
+	client := s.updatedClient(c)
+
+	// metadata referenced by snapshot.json is kept
+	c.Assert(client.Clean(), IsNil)
+	meta, err := s.local.GetMeta()
+	c.Assert(err, IsNil)
+	c.Assert(meta, HasLen, 4)
+
+	// unreferenced metadata is removed
+	c.Assert(s.local.SetMeta("foo.json", []byte("{}")), IsNil)
+	c.Assert(client.Clean(), IsNil)
+	meta, err = s.local.GetMeta()
+	c.Assert(err, IsNil)
+	c.Assert(meta, HasLen, 4)
+	_, ok := meta["foo.json"]
+	c.Assert(ok, Equals, false)
+	files, err := client.Targets()
+	c.Assert(err, IsNil)
+	assertFiles(c, files, []string{"/foo.txt"})
+
+	// in-memory targets removed from the local targets.json are pruned
+	oldTargets := meta["targets.json"]
+	c.Assert(s.repo.RemoveTarget("foo.txt"), IsNil)
+	s.addRemoteTarget(c, "bar.txt")
+	_, err = NewClient(s.local, s.remote).Update()
+	c.Assert(err, IsNil)
+	c.Assert(client.Clean(), IsNil)
+	assertFiles(c, client.targets, []string{"/bar.txt"})
+
+	// a targets.json which does not match snapshot.json is removed
+	c.Assert(s.local.SetMeta("targets.json", oldTargets), IsNil)
+	c.Assert(client.Clean(), IsNil)
+	meta, err = s.local.GetMeta()
+	c.Assert(err, IsNil)
+	_, ok = meta["targets.json"]
+	c.Assert(ok, Equals, false)
+	c.Assert(client.targets, IsNil)
+}
+
+func (s *ClientSuite) TestMetaVersions(c *C) {
+	s.updatedClient(c)
+	expected := MetaVersions{Root: 4, Targets: 1, Snapshot: 1, Timestamp: 1}
+
+	// versions are loaded from local storage
+	client := NewClient(s.local, s.remote)
+	versions, err := client.MetaVersions()
+	c.Assert(err, IsNil)
+	c.Assert(versions, Equals, expected)
+
+	// versions are updated by Update
+	s.addRemoteTarget(c, "bar.txt")
+	_, err = client.Update()
+	c.Assert(err, IsNil)
+	versions, err = client.MetaVersions()
+	c.Assert(err, IsNil)
+	expected.Targets++
+	expected.Snapshot++
+	expected.Timestamp++
+	c.Assert(versions, Equals, expected)
+
+	// an uninitialized client returns ErrNoRootKeys
+	_, err = NewClient(MemoryLocalStore(), s.remote).MetaVersions()
+	c.Assert(err, Equals, ErrNoRootKeys)
+}
+
+func (s *ClientSuite) TestExpiries(c *C) {
+	s.updatedClient(c)
+	assertExpiries := func(client *Client) {
+		expiries, err := client.Expiries()
+		c.Assert(err, IsNil)
+		c.Assert(expiries, HasLen, 4)
+		for _, role := range []string{"root", "targets", "snapshot", "timestamp"} {
+			meta, err := s.store.GetMeta()
+			c.Assert(err, IsNil)
+			signed := &data.Signed{}
+			c.Assert(json.Unmarshal(meta[role+".json"], signed), IsNil)
+			v := &struct{ Expires time.Time }{}
+			c.Assert(json.Unmarshal(signed.Signed, v), IsNil)
+			c.Assert(expiries[role].Equal(v.Expires), Equals, true, Commentf("role = %s", role))
+		}
+	}
+
+	// check the expiries are loaded from local storage
+	client := NewClient(s.local, s.remote)
+	assertExpiries(client)
+
+	// check the expiries are updated by an update
+	c.Assert(s.repo.TimestampWithExpires(time.Now().Add(2*time.Hour)), IsNil)
+	s.syncRemote(c)
+	_, err := client.Update()
+	c.Assert(IsLatestSnapshot(err), Equals, true)
+	assertExpiries(client)
+
+	// check uninitialized clients return an error
+	_, err = NewClient(MemoryLocalStore(), s.remote).Expiries()
+	c.Assert(err, Equals, ErrNoRootKeys)
+}
+
+func (s *ClientSuite) TestNewRoot(c *C) {
+	client := s.newClient(c)
+
+	// replace all keys
+	newKeyIDs := make(map[string]string)
+	for role, id := range s.keyIDs {
+		c.Assert(s.repo.RevokeKey(role, id), IsNil)
+		newKeyIDs[role] = s.genKey(c, role)
+	}
+
+	// update metadata
+	c.Assert(s.repo.Sign("targets.json"), IsNil)
+	c.Assert(s.repo.Snapshot(tuf.CompressionTypeNone), IsNil)
+	c.Assert(s.repo.Timestamp(), IsNil)
+	s.syncRemote(c)
+
+	// check update gets new root version
+	c.Assert(client.getLocalMeta(), IsNil)
+	version := client.rootVer
+	c.Assert(version > 0, Equals, true)
+	_, err := client.Update()
+	c.Assert(err, IsNil)
+	c.Assert(client.rootVer > version, Equals, true)
+
+	// check old keys are not in db
+	for _, id := range s.keyIDs {
+		c.Assert(client.db.GetKey(id), IsNil)
+	}
+
+	// check new keys are in db
+	for name, id := range newKeyIDs {
+		key := client.db.GetKey(id)
+		c.Assert(key, NotNil)
+		c.Assert(key.ID(), Equals, id)
+		role := client.db.GetRole(name)
+		c.Assert(role, NotNil)
+		c.Assert(role.KeyIDs, DeepEquals, map[string]struct{}{id: {}})
+	}
+}
+
+func (s *ClientSuite) TestTrustedRootKeys(c *C) {
+	// check an uninitialized client returns ErrNoRootKeys
+	_, _, err := NewClient(MemoryLocalStore(), s.remote).TrustedRootKeys()
+	c.Assert(err, Equals, ErrNoRootKeys)
+
+	client := s.updatedClient(c)
+	keys, threshold, err := client.TrustedRootKeys()
+	c.Assert(err, IsNil)
+	c.Assert(threshold, Equals, 1)
+	c.Assert(keys, HasLen, 1)
+	c.Assert(keys[0].ID(), Equals, s.keyIDs["root"])
+
+	// rotate the root key and check the new key is trusted after an update
+	c.Assert(s.repo.RevokeKey("root", s.keyIDs["root"]), IsNil)
+	newID := s.genKey(c, "root")
+	c.Assert(s.repo.Snapshot(tuf.CompressionTypeNone), IsNil)
+	c.Assert(s.repo.Timestamp(), IsNil)
+	s.syncRemote(c)
+	_, err = client.Update()
+	c.Assert(err, IsNil)
+	keys, threshold, err = client.TrustedRootKeys()
+	c.Assert(err, IsNil)
+	c.Assert(threshold, Equals, 1)
+	c.Assert(keys, HasLen, 1)
+	c.Assert(keys[0].ID(), Equals, newID)
+
+	// check the keys are loaded from local storage by a new client
+	keys, _, err = NewClient(s.local, s.remote).TrustedRootKeys()
+	c.Assert(err, IsNil)
+	c.Assert(keys, HasLen, 1)
+	c.Assert(keys[0].ID(), Equals, newID)
+}
+
+func (s *ClientSuite) TestMaxRootRotations(c *C) {
+	// publishRoot publishes the staged root.json as VERSION.root.json
+	publishRoot := func() string {
+		meta, err := s.store.GetMeta()
+		c.Assert(err, IsNil)
+		rootJSON := meta["root.json"]
+		signed := &data.Signed{}
+		c.Assert(json.Unmarshal(rootJSON, signed), IsNil)
+		root := &data.Root{}
+		c.Assert(json.Unmarshal(signed.Signed, root), IsNil)
+		name := fmt.Sprintf("%d.root.json", root.Version)
+		s.remote.meta[name] = newFakeFile(rootJSON)
+		return name
+	}
+
+	newClient := func(max int) *Client {
+		client := NewClient(MemoryLocalStore(), s.remote, WithMaxRootRotations(max))
+		c.Assert(client.Init(s.rootKeys(c), 1), IsNil)
+		_, err := client.Update()
+		c.Assert(err, IsNil)
+		return client
+	}
+	client := newClient(3)
+	tooFewClient := newClient(1)
+	noVersionsClient := newClient(1)
+	startVer := client.rootVer
+
+	// rotate the root key, which advances root.json by two versions
+	newID := s.genKey(c, "root")
+	intermediate := publishRoot()
+	c.Assert(s.repo.RevokeKey("root", s.keyIDs["root"]), IsNil)
+	publishRoot()
+	c.Assert(s.repo.Snapshot(tuf.CompressionTypeNone), IsNil)
+	c.Assert(s.repo.Timestamp(), IsNil)
+	s.syncRemote(c)
+
+	// check a client allowing three rotations walks the intermediate roots
+	_, err := client.Update()
+	c.Assert(err, IsNil)
+	c.Assert(client.rootVer, Equals, startVer+2)
+	c.Assert(s.remote.meta[intermediate].bytesRead > 0, Equals, true)
+	keys, _, err := client.TrustedRootKeys()
+	c.Assert(err, IsNil)
+	c.Assert(keys, HasLen, 1)
+	c.Assert(keys[0].ID(), Equals, newID)
+
+	// check a client allowing one rotation refuses the update
+	_, err = tooFewClient.Update()
+	c.Assert(err, DeepEquals, ErrTooManyRootRotations{startVer, startVer + 2, 1})
+
+	// check the limit is also enforced if the remote does not publish
+	// versioned roots
+	for name := range s.remote.meta {
+		if name != "root.json" && strings.HasSuffix(name, ".root.json") {
+			delete(s.remote.meta, name)
+		}
+	}
+	_, err = noVersionsClient.Update()
+	c.Assert(err, DeepEquals, ErrTooManyRootRotations{startVer, startVer + 2, 1})
+}
+
+func (s *ClientSuite) TestNewTargets(c *C) {
+	client := s.newClient(c)
+	files, err := client.Update()
+	c.Assert(err, IsNil)
+	assertFiles(c, files, []string{"/foo.txt"})
+
+	s.addRemoteTarget(c, "bar.txt")
+	s.addRemoteTarget(c, "baz.txt")
+
+	files, err = client.Update()
+	c.Assert(err, IsNil)
+	assertFiles(c, files, []string{"/bar.txt", "/baz.txt"})
+
+	// Adding the same exact file should not lead to an update
+	s.addRemoteTarget(c, "bar.txt")
+	files, err = client.Update()
+	c.Assert(err, IsNil)
+	c.Assert(files, HasLen, 0)
+}
+
+func (s *ClientSuite) TestCompressedTargets(c *C) {
+	client := s.updatedClient(c)
+
+	// check the compressed targets.json.gz is downloaded instead of
+	// targets.json, and the uncompressed targets.json is saved locally
+	c.Assert(s.repo.AddTarget("bar.txt", nil), IsNil)
+	c.Assert(s.repo.Snapshot(tuf.CompressionTypeGzip), IsNil)
+	c.Assert(s.repo.Timestamp(), IsNil)
+	s.syncRemote(c)
+	files, err := client.Update()
+	c.Assert(err, IsNil)
+	assertFiles(c, files, []string{"/bar.txt"})
+	c.Assert(s.remote.meta["targets.json.gz"].bytesRead > 0, Equals, true)
+	c.Assert(s.remote.meta["targets.json"].bytesRead, Equals, 0)
+	meta, err := s.store.GetMeta()
+	c.Assert(err, IsNil)
+	local, err := s.local.GetMeta()
+	c.Assert(err, IsNil)
+	c.Assert(local["targets.json"], DeepEquals, meta["targets.json"])
+	_, ok := local["targets.json.gz"]
+	c.Assert(ok, Equals, false)
+
+	// check a modified targets.json.gz fails the update
+	c.Assert(s.repo.AddTarget("baz.txt", nil), IsNil)
+	c.Assert(s.repo.Snapshot(tuf.CompressionTypeGzip), IsNil)
+	c.Assert(s.repo.Timestamp(), IsNil)
+	s.syncRemote(c)
+	valid := s.remote.meta["targets.json.gz"]
+	s.remote.meta["targets.json.gz"] = newFakeFile(bytes.Repeat([]byte{0}, int(valid.size)))
+	_, err = client.Update()
+	c.Assert(err, FitsTypeOf, ErrDownloadFailed{})
+	c.Assert(err.(ErrDownloadFailed).File, Equals, "targets.json.gz")
+
+	// check targets.json is used if targets.json.gz is missing
+	delete(s.remote.meta, "targets.json.gz")
+	files, err = client.Update()
+	c.Assert(err, IsNil)
+	assertFiles(c, files, []string{"/baz.txt"})
+	c.Assert(s.remote.meta["targets.json"].bytesRead > 0, Equals, true)
+
+	// check decompressed data which is too short returns ErrWrongSize
+	fooMeta, err := util.GenerateFileMeta(strings.NewReader("foobar"))
+	c.Assert(err, IsNil)
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	_, err = w.Write([]byte("foo"))
+	c.Assert(err, IsNil)
+	c.Assert(w.Close(), IsNil)
+	_, err = decompressMeta("targets.json", gz.Bytes(), fooMeta)
+	c.Assert(err, DeepEquals, ErrWrongSize{"targets.json", 3, 6})
+}
+
+func (s *ClientSuite) TestMetaTempDir(c *C) {
+	tmp := c.MkDir()
+	assertEmpty := func() {
+		names, err := ioutil.ReadDir(tmp)
+		c.Assert(err, IsNil)
+		c.Assert(names, HasLen, 0)
+	}
+
+	// check metadata is downloaded via temporary files which are removed
+	s.local = MemoryLocalStore()
+	client := NewClient(s.local, s.remote, WithMetaTempDir(tmp, 0))
+	c.Assert(client.Init(s.rootKeys(c), 1), IsNil)
+	files, err := client.Update()
+	c.Assert(err, IsNil)
+	assertFiles(c, files, []string{"/foo.txt"})
+	assertEmpty()
+	meta, err := s.store.GetMeta()
+	c.Assert(err, IsNil)
+	local, err := s.local.GetMeta()
+	c.Assert(err, IsNil)
+	c.Assert(local["targets.json"], DeepEquals, meta["targets.json"])
+
+	// check temporary files are removed when verification fails
+	s.addRemoteTarget(c, "bar.txt")
+	valid := s.remote.meta["targets.json"]
+	s.remote.meta["targets.json"] = newFakeFile(bytes.Repeat([]byte{0}, int(valid.size)))
+	_, err = client.Update()
+	c.Assert(err, FitsTypeOf, ErrDownloadFailed{})
+	c.Assert(err.(ErrDownloadFailed).File, Equals, "targets.json")
+	assertEmpty()
+
+	// check metadata below the threshold is not written to the directory
+	s.local = MemoryLocalStore()
+	client = NewClient(s.local, s.remote, WithMetaTempDir(filepath.Join(tmp, "missing"), maxMetaSize))
+	c.Assert(client.Init(s.rootKeys(c), 1), IsNil)
+	s.remote.meta["targets.json"] = valid
+	_, err = client.Update()
+	c.Assert(err, IsNil)
+}
+
+func (s *ClientSuite) TestMetaCache(c *C) {
+	s.local = MemoryLocalStore()
+	client := NewClient(s.local, s.remote, WithMetaCacheSize(3))
+	c.Assert(client.Init(s.rootKeys(c), 1), IsNil)
+	_, err := client.Update()
+	c.Assert(err, IsNil)
+
+	// check unchanged local metadata is decoded once
+	files, err := client.LocalTargets()
+	c.Assert(err, IsNil)
+	c.Assert(client.metaCache.order.Len(), Equals, 3)
+	cached, err := client.LocalTargets()
+	c.Assert(err, IsNil)
+	c.Assert(reflect.ValueOf(cached).Pointer(), Equals, reflect.ValueOf(files).Pointer())
+
+	// check changed metadata is decoded again, evicting old entries
+	s.addRemoteTarget(c, "bar.txt")
+	_, err = client.Update()
+	c.Assert(err, IsNil)
+	files, err = client.LocalTargets()
+	c.Assert(err, IsNil)
+	assertFiles(c, files, []string{"/foo.txt", "/bar.txt"})
+	c.Assert(client.metaCache.order.Len(), Equals, 3)
+
+	// check nothing is cached by default
+	client = NewClient(s.local, s.remote)
+	files, err = client.LocalTargets()
+	c.Assert(err, IsNil)
+	cached, err = client.LocalTargets()
+	c.Assert(err, IsNil)
+	c.Assert(reflect.ValueOf(cached).Pointer() == reflect.ValueOf(files).Pointer(), Equals, false)
+}
+
+// benchmarkLocalMeta benchmarks loading local metadata for a repository
+// with n targets.
+func benchmarkLocalMeta(c *C, n int, opts ...ClientOption) {
+	files := make(map[string][]byte, n)
+	for i := 0; i < n; i++ {
+		files[fmt.Sprintf("/file%d.txt", i)] = []byte(fmt.Sprint(i))
+	}
+	store := tuf.MemoryStore(make(map[string]json.RawMessage), files)
+	repo, err := tuf.NewRepo(store)
+	c.Assert(err, IsNil)
+	_, err = repo.InitDefaultRoles()
+	c.Assert(err, IsNil)
+	c.Assert(repo.AddTargets(nil, nil), IsNil)
+	c.Assert(repo.Snapshot(tuf.CompressionTypeNone), IsNil)
+	c.Assert(repo.Timestamp(), IsNil)
+	c.Assert(repo.Commit(), IsNil)
+	meta, err := store.GetMeta()
+	c.Assert(err, IsNil)
+	local := MemoryLocalStore()
+	for name, b := range meta {
+		c.Assert(local.SetMeta(name, b), IsNil)
+	}
+
+	client := NewClient(local, nil, opts...)
+	c.ResetTimer()
+	for i := 0; i < c.N; i++ {
+		client.mtx.Lock()
+		err := client.getLocalMeta()
+		client.mtx.Unlock()
+		if err != nil {
+			c.Fatal(err)
+		}
+	}
+}
+
+func (s *ClientSuite) BenchmarkLocalMeta(c *C) {
+	benchmarkLocalMeta(c, 10000)
+}
+
+func (s *ClientSuite) BenchmarkLocalMetaCached(c *C) {
+	benchmarkLocalMeta(c, 10000, WithMetaCacheSize(3))
+}
+
+func (s *ClientSuite) TestMaxTargets(c *C) {
+	s.local = MemoryLocalStore()
+	client := NewClient(s.local, s.remote, WithMaxTargets(2))
+	c.Assert(client.Init(s.rootKeys(c), 1), IsNil)
+	files, err := client.Update()
+	c.Assert(err, IsNil)
+	assertFiles(c, files, []string{"/foo.txt"})
+
+	// check reaching the limit is ok
+	s.addRemoteTarget(c, "bar.txt")
+	files, err = client.Update()
+	c.Assert(err, IsNil)
+	assertFiles(c, files, []string{"/bar.txt"})
+
+	// check exceeding the limit fails without changing the local targets
+	s.addRemoteTarget(c, "baz.txt")
+	_, err = client.Update()
+	c.Assert(err, Equals, ErrTooManyTargets{3, 2})
+	targets, err := client.Targets()
+	c.Assert(err, IsNil)
+	assertFiles(c, targets, []string{"/foo.txt", "/bar.txt"})
+
+	// check the default is unlimited
+	_, err = NewClient(s.local, s.remote).Update()
+	c.Assert(err, IsNil)
+}
+
+func (s *ClientSuite) TestTargetValidator(c *C) {
+	client := s.newClient(c)
+	var validated []string
+	client.SetTargetValidator(func(name string, custom json.RawMessage) error {
+		validated = append(validated, name)
+		if custom == nil {
+			return nil
+		}
+		v := &struct{ Channel string }{}
+		if err := json.Unmarshal(custom, v); err != nil {
+			return err
+		}
+		if v.Channel != "stable" {
+			return fmt.Errorf("unexpected channel %q", v.Channel)
+		}
+		return nil
+	})
+
+	// check targets without custom metadata or with valid custom metadata
+	// are accepted
+	c.Assert(s.repo.AddTarget("bar.txt", json.RawMessage(`{"channel":"stable"}`)), IsNil)
+	c.Assert(s.repo.Snapshot(tuf.CompressionTypeNone), IsNil)
+	c.Assert(s.repo.Timestamp(), IsNil)
+	s.syncRemote(c)
+	files, err := client.Update()
+	c.Assert(err, IsNil)
+	assertFiles(c, files, []string{"/foo.txt", "/bar.txt"})
+	c.Assert(validated, DeepEquals, []string{"/bar.txt", "/foo.txt"})
+
+	// check an invalid target fails the update without persisting the
+	// targets, and only updated targets are validated
+	validated = nil
+	c.Assert(s.repo.AddTarget("baz.txt", json.RawMessage(`{"channel":"beta"}`)), IsNil)
+	c.Assert(s.repo.Snapshot(tuf.CompressionTypeNone), IsNil)
+	c.Assert(s.repo.Timestamp(), IsNil)
+	s.syncRemote(c)
+	before, err := s.local.GetMeta()
+	c.Assert(err, IsNil)
+	_, err = client.Update()
+	c.Assert(err, FitsTypeOf, ErrTargetValidation{})
+	c.Assert(err.(ErrTargetValidation).Name, Equals, "/baz.txt")
+	c.Assert(validated, DeepEquals, []string{"/baz.txt"})
+	after, err := s.local.GetMeta()
+	c.Assert(err, IsNil)
+	c.Assert(after["targets.json"], DeepEquals, before["targets.json"])
+	c.Assert(after["snapshot.json"], DeepEquals, before["snapshot.json"])
+	targets, err := client.Targets()
+	c.Assert(err, IsNil)
+	assertFiles(c, targets, []string{"/foo.txt", "/bar.txt"})
+
+	// check removing the validator allows the update
+	client.SetTargetValidator(nil)
+	files, err = client.Update()
+	c.Assert(err, IsNil)
+	assertFiles(c, files, []string{"/baz.txt"})
+}
+
+func (s *ClientSuite) TestNewThreshold(c *C) {
+	client := s.updatedClient(c)
+
+	// add a second timestamp key and require both to sign
+	s.genKey(c, "timestamp")
+	c.Assert(s.repo.SetThreshold("timestamp", 2), IsNil)
+	c.Assert(s.repo.Snapshot(tuf.CompressionTypeNone), IsNil)
+	c.Assert(s.repo.Timestamp(), IsNil)
+	s.syncRemote(c)
+
+	// check update gets the new root with the new threshold
+	_, err := client.Update()
+	c.Assert(err, IsNil)
+	meta, err := s.store.GetMeta()
+	c.Assert(err, IsNil)
+	root := &data.Root{}
+	signed := &data.Signed{}
+	c.Assert(json.Unmarshal(meta["root.json"], signed), IsNil)
+	c.Assert(json.Unmarshal(signed.Signed, root), IsNil)
+	c.Assert(client.rootVer, Equals, root.Version)
+	c.Assert(root.Roles["timestamp"].Threshold, Equals, 2)
+
+	// check a timestamp.json signed by only one key is rejected
+	c.Assert(s.repo.Timestamp(), IsNil)
+	meta, err = s.store.GetMeta()
+	c.Assert(err, IsNil)
+	signed = &data.Signed{}
+	c.Assert(json.Unmarshal(meta["timestamp.json"], signed), IsNil)
+	c.Assert(signed.Signatures, HasLen, 2)
+	signed.Signatures = signed.Signatures[:1]
+	timestampJSON, err := json.Marshal(signed)
+	c.Assert(err, IsNil)
+	s.remote.meta["timestamp.json"] = newFakeFile(timestampJSON)
+	_, err = client.Update()
+	c.Assert(err, DeepEquals, ErrDecodeFailed{"timestamp.json", verify.ErrRoleThreshold})
+}
+
+func (s *ClientSuite) TestMinRootVersion(c *C) {
+	s.updatedClient(c)
+	meta, err := s.local.GetMeta()
+	c.Assert(err, IsNil)
+	oldVer, err := metaVersionUnsafe(meta["root.json"])
+	c.Assert(err, IsNil)
+
+	// publish a new root
+	s.genKey(c, "root")
+	c.Assert(s.repo.Snapshot(tuf.CompressionTypeNone), IsNil)
+	c.Assert(s.repo.Timestamp(), IsNil)
+	s.syncRemote(c)
+	meta, err = s.store.GetMeta()
+	c.Assert(err, IsNil)
+	newVer, err := metaVersionUnsafe(meta["root.json"])
+	c.Assert(err, IsNil)
+	c.Assert(newVer > oldVer, Equals, true)
+
+	// check the local root is not trusted if it is below the minimum
+	client := NewClient(s.local, s.remote, WithMinRootVersion(newVer))
+	_, err = client.Targets()
+	c.Assert(err, Equals, ErrRootBelowMinimum{oldVer, newVer})
+
+	// check an update downloads the latest root
+	_, err = client.Update()
+	c.Assert(err, IsNil)
+	c.Assert(client.rootVer, Equals, newVer)
+
+	// check reading local metadata does not save the minimum
+	client = NewClient(s.local, s.remote, WithMinRootVersion(newVer+1))
+	_, err = client.Targets()
+	c.Assert(err, Equals, ErrRootBelowMinimum{newVer, newVer + 1})
+	state, err := s.local.(StateLocalStore).GetState()
+	c.Assert(err, IsNil)
+	saved := &minRootVersion{}
+	c.Assert(json.Unmarshal(state[minRootVersionState], saved), IsNil)
+	c.Assert(saved.Version, Equals, newVer)
+
+	// check a remote root below the minimum is rejected
+	_, err = client.Update()
+	c.Assert(err, Equals, ErrRootBelowMinimum{newVer, newVer + 1})
+
+	// check the minimum is saved, so applies to clients created without
+	// the option and can't be lowered
+	for _, client := range []*Client{
+		NewClient(s.local, s.remote),
+		NewClient(s.local, s.remote, WithMinRootVersion(newVer)),
+	} {
+		_, err = client.Targets()
+		c.Assert(err, Equals, ErrRootBelowMinimum{newVer, newVer + 1})
+	}
+
+	// check Init rejects a root below the minimum
+	rootKeys, err := s.repo.RootKeys()
+	c.Assert(err, IsNil)
+	client = NewClient(MemoryLocalStore(), s.remote, WithMinRootVersion(newVer+1))
+	err = client.Init(rootKeys, 1)
+	c.Assert(err, Equals, ErrRootBelowMinimum{newVer, newVer + 1})
+}
+
+func (s *ClientSuite) TestDeprecatedKeyRotation(c *C) {
+	client := s.updatedClient(c)
+
+	// add a targets key held externally and deprecate the old key, which
+	// continues to be the only key signing targets.json
+	newKey, err := sign.GenerateEd25519Key()
+	c.Assert(err, IsNil)
+	c.Assert(s.repo.AddVerificationKey("targets", newKey.PublicData()), IsNil)
+	c.Assert(s.repo.DeprecateKey("targets", s.keyIDs["targets"], time.Now().Add(time.Hour)), IsNil)
+	s.addRemoteTarget(c, "bar.txt")
+	meta, err := s.store.GetMeta()
+	c.Assert(err, IsNil)
+	oldTargets := &data.Signed{}
+	c.Assert(json.Unmarshal(meta["targets.json"], oldTargets), IsNil)
+
+	// check targets signed by the deprecated key are accepted during the
+	// grace period
+	files, err := client.Update()
+	c.Assert(err, IsNil)
+	assertFiles(c, files, []string{"/bar.txt"})
+
+	// re-sign with the new key during the grace period
+	c.Assert(s.repo.SignWithSigner("targets.json", newKey.Signer()), IsNil)
+	c.Assert(s.repo.Snapshot(tuf.CompressionTypeNone), IsNil)
+	c.Assert(s.repo.Timestamp(), IsNil)
+	s.syncRemote(c)
+	_, err = client.Update()
+	c.Assert(err, IsNil)
+
+	// end the grace period, and check the client stops trusting the
+	// deprecated key once it is removed
+	store := s.store.(tuf.KeyDeprecationStore)
+	deprecations, err := store.GetKeyDeprecations()
+	c.Assert(err, IsNil)
+	deprecations["targets"][0].GraceUntil = time.Now().Add(-time.Hour)
+	c.Assert(store.SetKeyDeprecations(deprecations), IsNil)
+	c.Assert(s.repo.RemoveDeprecatedKeys(), IsNil)
+	c.Assert(s.repo.Snapshot(tuf.CompressionTypeNone), IsNil)
+	c.Assert(s.repo.Timestamp(), IsNil)
+	s.syncRemote(c)
+	_, err = client.Update()
+	c.Assert(err, IsNil)
+	targets, err := client.Targets()
+	c.Assert(err, IsNil)
+	assertFiles(c, targets, []string{"/foo.txt", "/bar.txt"})
+	c.Assert(client.db.GetRole("targets").KeyIDs, DeepEquals, map[string]struct{}{newKey.PublicData().ID(): {}})
+	c.Assert(client.db.Verify(oldTargets, "targets", 0), Equals, verify.ErrRoleThreshold)
+}
+
+func (s *ClientSuite) TestNewTimestampKey(c *C) {
+	client := s.newClient(c)
+
+	// replace key
+	oldID := s.keyIDs["timestamp"]
+	c.Assert(s.repo.RevokeKey("timestamp", oldID), IsNil)
+	newID := s.genKey(c, "timestamp")
+
+	// generate new snapshot (because root has changed) and timestamp
+	c.Assert(s.repo.Snapshot(tuf.CompressionTypeNone), IsNil)
+	c.Assert(s.repo.Timestamp(), IsNil)
+	s.syncRemote(c)
+
+	// check update gets new root and timestamp
+	c.Assert(client.getLocalMeta(), IsNil)
+	rootVer := client.rootVer
+	timestampVer := client.timestampVer
+	_, err := client.Update()
+	c.Assert(err, IsNil)
+	c.Assert(client.rootVer > rootVer, Equals, true)
+	c.Assert(client.timestampVer > timestampVer, Equals, true)
+
+	// check key has been replaced in db
+	c.Assert(client.db.GetKey(oldID), IsNil)
+	key := client.db.GetKey(newID)
+	c.Assert(key, NotNil)
+	c.Assert(key.ID(), Equals, newID)
+	role := client.db.GetRole("timestamp")
+	c.Assert(role, NotNil)
+	c.Assert(role.KeyIDs, DeepEquals, map[string]struct{}{newID: {}})
+}
+
+func (s *ClientSuite) TestNewSnapshotKey(c *C) {
+	client := s.newClient(c)
+
+	// replace key
+	oldID := s.keyIDs["snapshot"]
+	c.Assert(s.repo.RevokeKey("snapshot", oldID), IsNil)
+	newID := s.genKey(c, "snapshot")
+
+	// generate new snapshot and timestamp
+	c.Assert(s.repo.Snapshot(tuf.CompressionTypeNone), IsNil)
+	c.Assert(s.repo.Timestamp(), IsNil)
+	s.syncRemote(c)
+
+	// check update gets new root, snapshot and timestamp
+	c.Assert(client.getLocalMeta(), IsNil)
+	rootVer := client.rootVer
+	snapshotVer := client.snapshotVer
+	timestampVer := client.timestampVer
+	_, err := client.Update()
+	c.Assert(err, IsNil)
+	c.Assert(client.rootVer > rootVer, Equals, true)
+	c.Assert(client.snapshotVer > snapshotVer, Equals, true)
+	c.Assert(client.timestampVer > timestampVer, Equals, true)
+
+	// check key has been replaced in db
+	c.Assert(client.db.GetKey(oldID), IsNil)
+	key := client.db.GetKey(newID)
+	c.Assert(key, NotNil)
+	c.Assert(key.ID(), Equals, newID)
+	role := client.db.GetRole("snapshot")
+	c.Assert(role, NotNil)
+	c.Assert(role.KeyIDs, DeepEquals, map[string]struct{}{newID: {}})
+}
+
+func (s *ClientSuite) TestNewTargetsKey(c *C) {
+	client := s.newClient(c)
+
+	// replace key
+	oldID := s.keyIDs["targets"]
+	c.Assert(s.repo.RevokeKey("targets", oldID), IsNil)
+	newID := s.genKey(c, "targets")
+
+	// re-sign targets and generate new snapshot and timestamp
+	c.Assert(s.repo.Sign("targets.json"), IsNil)
+	c.Assert(s.repo.Snapshot(tuf.CompressionTypeNone), IsNil)
+	c.Assert(s.repo.Timestamp(), IsNil)
+	s.syncRemote(c)
+
+	// check update gets new metadata
 	c.Assert(client.getLocalMeta(), IsNil)
 	rootVer := client.rootVer
 	targetsVer := client.targetsVer
@@ -446,304 +2095,1474 @@ func (s *ClientSuite) TestNewTargetsKey(c *C) {
 	timestampVer := client.timestampVer
 	_, err := client.Update()
 	c.Assert(err, IsNil)
-	c.Assert(client.rootVer > rootVer, Equals, true)
-	c.Assert(client.targetsVer > targetsVer, Equals, true)
-	c.Assert(client.snapshotVer > snapshotVer, Equals, true)
-	c.Assert(client.timestampVer > timestampVer, Equals, true)
+	c.Assert(client.rootVer > rootVer, Equals, true)
+	c.Assert(client.targetsVer > targetsVer, Equals, true)
+	c.Assert(client.snapshotVer > snapshotVer, Equals, true)
+	c.Assert(client.timestampVer > timestampVer, Equals, true)
+
+	// check key has been replaced in db
+	c.Assert(client.db.GetKey(oldID), IsNil)
+	key := client.db.GetKey(newID)
+	c.Assert(key, NotNil)
+	c.Assert(key.ID(), Equals, newID)
+	role := client.db.GetRole("targets")
+	c.Assert(role, NotNil)
+	c.Assert(role.KeyIDs, DeepEquals, map[string]struct{}{newID: {}})
+}
+
+func (s *ClientSuite) TestECDSATargetsKey(c *C) {
+	client := s.newClient(c)
+
+	// replace the targets key with an ECDSA key and add a target
+	c.Assert(s.repo.RevokeKey("targets", s.keyIDs["targets"]), IsNil)
+	id, err := s.repo.GenKeyWithType("targets", data.KeyTypeECDSA_SHA2_P256)
+	c.Assert(err, IsNil)
+	s.addRemoteTarget(c, "bar.txt")
+
+	// check targets.json is only signed by the ECDSA key
+	meta, err := s.store.GetMeta()
+	c.Assert(err, IsNil)
+	signed := &data.Signed{}
+	c.Assert(json.Unmarshal(meta["targets.json"], signed), IsNil)
+	c.Assert(signed.Signatures, HasLen, 1)
+	c.Assert(signed.Signatures[0].KeyID, Equals, id)
+	c.Assert(signed.Signatures[0].Method, Equals, data.KeyTypeECDSA_SHA2_P256)
+
+	// check the client verifies the new targets and downloads bar.txt
+	files, err := client.Update()
+	c.Assert(err, IsNil)
+	assertFiles(c, files, []string{"/foo.txt", "/bar.txt"})
+	var dest testDestination
+	c.Assert(client.Download("/bar.txt", &dest), IsNil)
+	c.Assert(dest.String(), Equals, "bar")
+}
+
+func (s *ClientSuite) TestLocalExpired(c *C) {
+	client := s.newClient(c)
+
+	// locally expired timestamp.json is ok
+	version := client.timestampVer
+	c.Assert(s.repo.TimestampWithExpires(s.expiredTime), IsNil)
+	s.syncLocal(c)
+	s.withMetaExpired(func() {
+		c.Assert(client.getLocalMeta(), IsNil)
+		c.Assert(client.timestampVer > version, Equals, true)
+	})
+
+	// locally expired snapshot.json is ok
+	version = client.snapshotVer
+	c.Assert(s.repo.SnapshotWithExpires(tuf.CompressionTypeNone, s.expiredTime), IsNil)
+	s.syncLocal(c)
+	s.withMetaExpired(func() {
+		c.Assert(client.getLocalMeta(), IsNil)
+		c.Assert(client.snapshotVer > version, Equals, true)
+	})
+
+	// locally expired targets.json is ok
+	version = client.targetsVer
+	c.Assert(s.repo.AddTargetWithExpires("foo.txt", nil, s.expiredTime), IsNil)
+	s.syncLocal(c)
+	s.withMetaExpired(func() {
+		c.Assert(client.getLocalMeta(), IsNil)
+		c.Assert(client.targetsVer > version, Equals, true)
+	})
+
+	// locally expired root.json is not ok
+	version = client.rootVer
+	s.genKeyExpired(c, "targets")
+	s.syncLocal(c)
+	s.withMetaExpired(func() {
+		err := client.getLocalMeta()
+		if _, ok := err.(verify.ErrExpired); !ok {
+			c.Fatalf("expected err to have type signed.ErrExpired, got %T", err)
+		}
+		c.Assert(client.rootVer, Equals, version)
+	})
+}
+
+func (s *ClientSuite) TestClockExpired(c *C) {
+	clock := verify.NewFakeClock(time.Now())
+	s.local = MemoryLocalStore()
+	client := NewClient(s.local, s.remote, WithClock(clock))
+	c.Assert(client.Init(s.rootKeys(c), 1), IsNil)
+	_, err := client.Update()
+	c.Assert(err, IsNil)
+
+	// metadata is checked against the client's clock rather than the
+	// system time
+	c.Assert(s.repo.TimestampWithExpires(s.expiredTime), IsNil)
+	s.syncRemote(c)
+	clock.Set(s.expiredTime.Add(time.Second))
+	_, err = client.Update()
+	c.Assert(err, FitsTypeOf, ErrDecodeFailed{})
+	c.Assert(err.(ErrDecodeFailed).Err, FitsTypeOf, verify.ErrExpired{})
+
+	clock.Set(s.expiredTime.Add(-time.Minute))
+	_, err = client.Update()
+	c.Assert(IsLatestSnapshot(err), Equals, true)
+}
+
+func (s *ClientSuite) TestTimestampTooLarge(c *C) {
+	s.remote.meta["timestamp.json"] = newFakeFile(make([]byte, maxMetaSize+1))
+	_, err := s.newClient(c).Update()
+	c.Assert(err, Equals, ErrMetaTooLarge{"timestamp.json", maxMetaSize + 1, maxMetaSize})
+}
+
+func (s *ClientSuite) TestMaxMetaSize(c *C) {
+	client := NewClient(MemoryLocalStore(), s.remote, WithMaxMetaSize(10))
+	c.Assert(client.Init(s.rootKeys(c), 1), DeepEquals, ErrMetaTooLarge{"root.json", s.remote.meta["root.json"].size, 10})
+
+	c.Assert(client.SetMaxMetaSize(0), Equals, ErrInvalidMaxMetaSize{0})
+	c.Assert(client.SetMaxMetaSize(-1), Equals, ErrInvalidMaxMetaSize{-1})
+	c.Assert(client.maxMetaSize, Equals, int64(10))
+
+	// a non-positive option keeps the default
+	c.Assert(NewClient(MemoryLocalStore(), s.remote, WithMaxMetaSize(0)).maxMetaSize, Equals, int64(maxMetaSize))
+
+	// a larger limit allows metadata over the default size
+	s.remote.meta["timestamp.json"] = newFakeFile(make([]byte, maxMetaSize+1))
+	client = s.newClient(c)
+	c.Assert(client.SetMaxMetaSize(2*maxMetaSize), IsNil)
+	_, err := client.Update()
+	c.Assert(err, FitsTypeOf, ErrDecodeFailed{})
+
+	// the limit also applies to metadata whose length is listed in signed
+	// metadata
+	custom := json.RawMessage(fmt.Sprintf(`{"pad":%q}`, strings.Repeat("x", 10*1024)))
+	c.Assert(s.repo.AddTarget("foo.txt", custom), IsNil)
+	c.Assert(s.repo.Snapshot(tuf.CompressionTypeNone), IsNil)
+	c.Assert(s.repo.Timestamp(), IsNil)
+	s.syncRemote(c)
+	size := s.remote.meta["targets.json"].size
+	client = s.newClient(c)
+	c.Assert(client.SetMaxMetaSize(size-1), IsNil)
+	_, err = client.Update()
+	c.Assert(err, DeepEquals, ErrMetaTooLarge{"targets.json", size, size - 1})
+}
+
+func (s *ClientSuite) TestUpdateLocalRootExpired(c *C) {
+	client := s.newClient(c)
+
+	// add soon to expire root.json to local storage
+	s.genKeyExpired(c, "timestamp")
+	c.Assert(s.repo.Timestamp(), IsNil)
+	s.syncLocal(c)
+
+	// add far expiring root.json to remote storage
+	s.genKey(c, "timestamp")
+	s.addRemoteTarget(c, "bar.txt")
+	s.syncRemote(c)
+
+	// check the update downloads the non expired remote root.json and
+	// restarts itself, thus successfully updating
+	s.withMetaExpired(func() {
+		err := client.getLocalMeta()
+		if _, ok := err.(verify.ErrExpired); !ok {
+			c.Fatalf("expected err to have type signed.ErrExpired, got %T", err)
+		}
+
+		client := NewClient(s.local, s.remote)
+		_, err = client.Update()
+		c.Assert(err, IsNil)
+	})
+}
+
+func (s *ClientSuite) TestRootRotationHandler(c *C) {
+	var rotations [][2]int
+	handler := func(oldVer, newVer int) {
+		rotations = append(rotations, [2]int{oldVer, newVer})
+	}
+	s.local = MemoryLocalStore()
+	client := NewClient(s.local, s.remote, WithRootRotationHandler(handler))
+	c.Assert(client.Init(s.rootKeys(c), 1), IsNil)
+	_, err := client.Update()
+	c.Assert(err, IsNil)
+	c.Assert(rotations, HasLen, 0)
+	rootVersion := func() int {
+		meta, err := s.local.GetMeta()
+		c.Assert(err, IsNil)
+		version, err := metaVersionUnsafe(meta["root.json"])
+		c.Assert(err, IsNil)
+		return version
+	}
+	ver := rootVersion()
+
+	// check the handler is called when snapshot.json lists a new root
+	s.genKey(c, "root")
+	c.Assert(s.repo.Snapshot(tuf.CompressionTypeNone), IsNil)
+	c.Assert(s.repo.Timestamp(), IsNil)
+	s.syncRemote(c)
+	_, err = client.Update()
+	c.Assert(err, IsNil)
+	c.Assert(rotations, DeepEquals, [][2]int{{ver, ver + 1}})
+
+	// check the handler is called when the local root has expired
+	rotations = nil
+	s.genKeyExpired(c, "timestamp")
+	c.Assert(s.repo.Timestamp(), IsNil)
+	s.syncLocal(c)
+	ver = rootVersion()
+	s.genKey(c, "timestamp")
+	s.addRemoteTarget(c, "bar.txt")
+	s.withMetaExpired(func() {
+		_, err = client.Update()
+		c.Assert(err, IsNil)
+	})
+	c.Assert(rotations, DeepEquals, [][2]int{{ver, ver + 1}})
+
+	// check the handler is not called when an update restarts with a
+	// root of the same version (here because timestamp.json is signed by an
+	// unknown key)
+	rotations = nil
+	restarts := client.stats.RootRestarts
+	meta, err := s.store.GetMeta()
+	c.Assert(err, IsNil)
+	signed := &data.Signed{}
+	c.Assert(json.Unmarshal(meta["timestamp.json"], signed), IsNil)
+	key, err := sign.GenerateEd25519Key()
+	c.Assert(err, IsNil)
+	signed.Signatures = nil
+	c.Assert(sign.Sign(signed, key.Signer()), IsNil)
+	timestampJSON, err := json.Marshal(signed)
+	c.Assert(err, IsNil)
+	s.remote.meta["timestamp.json"] = newFakeFile(timestampJSON)
+	_, err = client.Update()
+	c.Assert(err, NotNil)
+	c.Assert(client.stats.RootRestarts, Equals, restarts+1)
+	c.Assert(rotations, HasLen, 0)
+}
+
+func (s *ClientSuite) TestLocalMetaCorrupt(c *C) {
+	s.updatedClient(c)
+	meta, err := s.local.GetMeta()
+	c.Assert(err, IsNil)
+
+	// check truncated metadata returns ErrLocalMetaCorrupt
+	for _, name := range []string{"root.json", "targets.json", "snapshot.json", "timestamp.json"} {
+		local := MemoryLocalStore()
+		for n, b := range meta {
+			if n == name {
+				b = b[:len(b)/2]
+			}
+			c.Assert(local.SetMeta(n, b), IsNil)
+		}
+		_, err := NewClient(local, s.remote).Targets()
+		c.Assert(err, FitsTypeOf, ErrLocalMetaCorrupt{})
+		c.Assert(err.(ErrLocalMetaCorrupt).Name, Equals, name)
+
+		// check the client recovers once corrupt metadata other than
+		// root.json is deleted
+		if name == "root.json" {
+			continue
+		}
+		c.Assert(local.DeleteMeta(name), IsNil)
+		client := NewClient(local, s.remote)
+		_, err = client.Update()
+		if !IsLatestSnapshot(err) {
+			c.Assert(err, IsNil)
+		}
+		files, err := client.Targets()
+		c.Assert(err, IsNil)
+		assertFiles(c, files, []string{"/foo.txt"})
+	}
+
+	// check metadata which fails verification is not reported as corrupt
+	local := MemoryLocalStore()
+	for n, b := range meta {
+		c.Assert(local.SetMeta(n, b), IsNil)
+	}
+	c.Assert(local.SetMeta("timestamp.json", meta["snapshot.json"]), IsNil)
+	_, err = NewClient(local, s.remote).Targets()
+	c.Assert(err, NotNil)
+	c.Assert(err, Not(FitsTypeOf), ErrLocalMetaCorrupt{})
+
+	// check an empty file in a directory store is reported as corrupt
+	dir := c.MkDir()
+	dirStore, err := DirLocalStore(dir)
+	c.Assert(err, IsNil)
+	for n, b := range meta {
+		c.Assert(dirStore.SetMeta(n, b), IsNil)
+	}
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "targets.json"), nil, 0600), IsNil)
+	_, err = NewClient(dirStore, s.remote).Targets()
+	c.Assert(err, DeepEquals, ErrLocalMetaCorrupt{"targets.json", err.(ErrLocalMetaCorrupt).Err})
+}
+
+func (s *ClientSuite) TestUpdateRemoteExpired(c *C) {
+	client := s.updatedClient(c)
+
+	// expired remote metadata should always be rejected
+	c.Assert(s.repo.TimestampWithExpires(s.expiredTime), IsNil)
+	s.syncRemote(c)
+	s.withMetaExpired(func() {
+		_, err := client.Update()
+		s.assertErrExpired(c, err, "timestamp.json")
+	})
+
+	c.Assert(s.repo.SnapshotWithExpires(tuf.CompressionTypeNone, s.expiredTime), IsNil)
+	c.Assert(s.repo.Timestamp(), IsNil)
+	s.syncRemote(c)
+	s.withMetaExpired(func() {
+		_, err := client.Update()
+		s.assertErrExpired(c, err, "snapshot.json")
+	})
+
+	c.Assert(s.repo.AddTargetWithExpires("bar.txt", nil, s.expiredTime), IsNil)
+	c.Assert(s.repo.Snapshot(tuf.CompressionTypeNone), IsNil)
+	c.Assert(s.repo.Timestamp(), IsNil)
+	s.syncRemote(c)
+	s.withMetaExpired(func() {
+		_, err := client.Update()
+		s.assertErrExpired(c, err, "targets.json")
+	})
+
+	s.genKeyExpired(c, "timestamp")
+	c.Assert(s.repo.RemoveTarget("bar.txt"), IsNil)
+	c.Assert(s.repo.Snapshot(tuf.CompressionTypeNone), IsNil)
+	c.Assert(s.repo.Timestamp(), IsNil)
+	s.syncRemote(c)
+	s.withMetaExpired(func() {
+		_, err := client.Update()
+		s.assertErrExpired(c, err, "root.json")
+	})
+}
+
+func (s *ClientSuite) TestUpdateLocalRootExpiredKeyChange(c *C) {
+	client := s.newClient(c)
+
+	// add soon to expire root.json to local storage
+	s.genKeyExpired(c, "timestamp")
+	c.Assert(s.repo.Timestamp(), IsNil)
+	s.syncLocal(c)
+
+	// replace all keys
+	newKeyIDs := make(map[string]string)
+	for role, id := range s.keyIDs {
+		c.Assert(s.repo.RevokeKey(role, id), IsNil)
+		newKeyIDs[role] = s.genKey(c, role)
+	}
+
+	// update metadata
+	c.Assert(s.repo.Sign("targets.json"), IsNil)
+	c.Assert(s.repo.Snapshot(tuf.CompressionTypeNone), IsNil)
+	c.Assert(s.repo.Timestamp(), IsNil)
+	s.syncRemote(c)
+
+	// check the update downloads the non expired remote root.json and
+	// restarts itself, thus successfully updating
+	s.withMetaExpired(func() {
+		err := client.getLocalMeta()
+		c.Assert(err, FitsTypeOf, verify.ErrExpired{})
+
+		_, err = client.Update()
+		c.Assert(err, IsNil)
+	})
+}
+
+func (s *ClientSuite) TestUpdateMixAndMatchAttack(c *C) {
+	// generate metadata with an explicit expires so we can make predictable changes
+	expires := time.Now().Add(time.Hour)
+	c.Assert(s.repo.AddTargetWithExpires("foo.txt", nil, expires), IsNil)
+	c.Assert(s.repo.Snapshot(tuf.CompressionTypeNone), IsNil)
+	c.Assert(s.repo.Timestamp(), IsNil)
+	s.syncRemote(c)
+	client := s.updatedClient(c)
+
+	// grab the remote targets.json
+	oldTargets, ok := s.remote.meta["targets.json"]
+	if !ok {
+		c.Fatal("missing remote targets.json")
+	}
+
+	// generate new remote metadata, but replace targets.json with the old one
+	c.Assert(s.repo.AddTargetWithExpires("bar.txt", nil, expires), IsNil)
+	c.Assert(s.repo.Snapshot(tuf.CompressionTypeNone), IsNil)
+	c.Assert(s.repo.Timestamp(), IsNil)
+	s.syncRemote(c)
+	newTargets, ok := s.remote.meta["targets.json"]
+	if !ok {
+		c.Fatal("missing remote targets.json")
+	}
+	s.remote.meta["targets.json"] = oldTargets
+
+	// check update returns ErrWrongSize for targets.json
+	_, err := client.Update()
+	c.Assert(err, DeepEquals, ErrWrongSize{"targets.json", oldTargets.size, newTargets.size})
+
+	// do the same but keep the size the same
+	c.Assert(s.repo.RemoveTargetWithExpires("foo.txt", expires), IsNil)
+	c.Assert(s.repo.Snapshot(tuf.CompressionTypeNone), IsNil)
+	c.Assert(s.repo.Timestamp(), IsNil)
+	s.syncRemote(c)
+	s.remote.meta["targets.json"] = oldTargets
+
+	// check update returns ErrWrongHash
+	_, err = client.Update()
+	assertWrongHash(c, err)
+}
+
+func (s *ClientSuite) TestUpdateReplayAttack(c *C) {
+	client := s.updatedClient(c)
+
+	// grab the remote timestamp.json
+	oldTimestamp, ok := s.remote.meta["timestamp.json"]
+	if !ok {
+		c.Fatal("missing remote timestamp.json")
+	}
+
+	// generate a new timestamp and sync with the client
+	version := client.timestampVer
+	c.Assert(version > 0, Equals, true)
+	c.Assert(s.repo.Timestamp(), IsNil)
+	s.syncRemote(c)
+	_, err := client.Update()
+	c.Assert(IsLatestSnapshot(err), Equals, true)
+	c.Assert(client.timestampVer > version, Equals, true)
+
+	// replace remote timestamp.json with the old one
+	s.remote.meta["timestamp.json"] = oldTimestamp
+
+	// check update returns ErrRollback
+	_, err = client.Update()
+	c.Assert(err, DeepEquals, ErrRollback{"timestamp", version, client.timestampVer})
+	c.Assert(IsRollback(err), Equals, true)
+}
+
+func (s *ClientSuite) TestUpdateTamperedTargets(c *C) {
+	client := s.newClient(c)
+
+	// get local targets.json
+	meta, err := s.store.GetMeta()
+	c.Assert(err, IsNil)
+	targetsJSON, ok := meta["targets.json"]
+	if !ok {
+		c.Fatal("missing targets.json")
+	}
+	targets := &data.Signed{}
+	c.Assert(json.Unmarshal(targetsJSON, targets), IsNil)
+
+	// update remote targets.json to have different content but same size
+	c.Assert(targets.Signatures, HasLen, 1)
+	targets.Signatures[0].Method = "xxxxxxx"
+	tamperedJSON, err := json.Marshal(targets)
+	c.Assert(err, IsNil)
+	s.store.SetMeta("targets.json", tamperedJSON)
+	s.syncRemote(c)
+	_, err = client.Update()
+	assertWrongHash(c, err)
+
+	// update remote targets.json to have the wrong size
+	targets.Signatures[0].Method = "xxx"
+	tamperedJSON, err = json.Marshal(targets)
+	c.Assert(err, IsNil)
+	s.store.SetMeta("targets.json", tamperedJSON)
+	s.syncRemote(c)
+	_, err = client.Update()
+	c.Assert(err, DeepEquals, ErrWrongSize{"targets.json", int64(len(tamperedJSON)), int64(len(targetsJSON))})
+}
+
+func (s *ClientSuite) TestUpdateMissingSnapshotMeta(c *C) {
+	client := s.newClient(c)
+
+	// root.json is checked first, so it is removed after targets.json
+	for _, name := range []string{"targets.json", "root.json"} {
+		// re-sign snapshot.json without the file meta
+		meta, err := s.store.GetMeta()
+		c.Assert(err, IsNil)
+		signed := &data.Signed{}
+		c.Assert(json.Unmarshal(meta["snapshot.json"], signed), IsNil)
+		snapshot := &data.Snapshot{}
+		c.Assert(json.Unmarshal(signed.Signed, snapshot), IsNil)
+		delete(snapshot.Meta, name)
+		snapshot.Version++
+		keys, err := s.store.GetSigningKeys("snapshot")
+		c.Assert(err, IsNil)
+		signed, err = sign.Marshal(snapshot, keys...)
+		c.Assert(err, IsNil)
+		snapshotJSON, err := json.Marshal(signed)
+		c.Assert(err, IsNil)
+		c.Assert(s.store.SetMeta("snapshot.json", snapshotJSON), IsNil)
+
+		// generate timestamp.json for the new snapshot.json
+		repo, err := tuf.NewRepo(s.store)
+		c.Assert(err, IsNil)
+		c.Assert(repo.Timestamp(), IsNil)
+		s.syncRemote(c)
+
+		_, err = client.Update()
+		c.Assert(err, Equals, ErrMissingSnapshotMeta{name})
+	}
+}
+
+func (s *ClientSuite) TestUpdateSetVersion(c *C) {
+	client := s.updatedClient(c)
+
+	// check the client accepts metadata whose versions have jumped
+	c.Assert(s.repo.SetVersion("snapshot", 50), IsNil)
+	c.Assert(s.repo.SetVersion("timestamp", 100), IsNil)
+	s.addRemoteTarget(c, "bar.txt")
+	_, err := client.Update()
+	c.Assert(err, IsNil)
+	c.Assert(client.snapshotVer, Equals, 50)
+	c.Assert(client.timestampVer, Equals, 100)
 
-	// check key has been replaced in db
-	c.Assert(client.db.GetKey(oldID), IsNil)
-	key := client.db.GetKey(newID)
-	c.Assert(key, NotNil)
-	c.Assert(key.ID(), Equals, newID)
-	role := client.db.GetRole("targets")
-	c.Assert(role, NotNil)
-	c.Assert(role.KeyIDs, DeepEquals, map[string]struct{}{newID: {}})
+	// check the client rejects a timestamp.json with a lower version,
+	// which the repo does not allow SetVersion to produce
+	c.Assert(s.repo.SetVersion("timestamp", 99), Equals, tuf.ErrInvalidVersion{Role: "timestamp", Version: 99, Current: 100})
+	meta, err := s.store.GetMeta()
+	c.Assert(err, IsNil)
+	signed := &data.Signed{}
+	c.Assert(json.Unmarshal(meta["timestamp.json"], signed), IsNil)
+	timestamp := &data.Timestamp{}
+	c.Assert(json.Unmarshal(signed.Signed, timestamp), IsNil)
+	timestamp.Version = 99
+	keys, err := s.store.GetSigningKeys("timestamp")
+	c.Assert(err, IsNil)
+	signed, err = sign.Marshal(timestamp, keys...)
+	c.Assert(err, IsNil)
+	timestampJSON, err := json.Marshal(signed)
+	c.Assert(err, IsNil)
+	s.remote.meta["timestamp.json"] = newFakeFile(timestampJSON)
+	_, err = client.Update()
+	c.Assert(err, DeepEquals, ErrRollback{"timestamp", 99, 100})
+	c.Assert(client.timestampVer, Equals, 100)
 }
 
-func (s *ClientSuite) TestLocalExpired(c *C) {
-	client := s.newClient(c)
+func (s *ClientSuite) TestUpdateOlderSnapshot(c *C) {
+	meta, err := s.store.GetMeta()
+	c.Assert(err, IsNil)
+	oldSnapshot := meta["snapshot.json"]
+	client := s.updatedClient(c)
+	oldVersion := client.snapshotVer
 
-	// locally expired timestamp.json is ok
+	s.addRemoteTarget(c, "bar.txt")
+	_, err = client.Update()
+	c.Assert(err, IsNil)
+	version := client.snapshotVer
+	c.Assert(version > oldVersion, Equals, true)
+
+	// check a new timestamp.json pointing at an older snapshot.json is
+	// rejected
+	c.Assert(s.store.SetMeta("snapshot.json", oldSnapshot), IsNil)
+	c.Assert(s.repo.Timestamp(), IsNil)
+	s.syncRemote(c)
+	_, err = client.Update()
+	c.Assert(err, DeepEquals, ErrRollback{"snapshot", oldVersion, version})
+	c.Assert(client.snapshotVer, Equals, version)
+
+	// check a different snapshot.json with the same version as the trusted
+	// one is also rejected
+	signed := &data.Signed{}
+	c.Assert(json.Unmarshal(meta["snapshot.json"], signed), IsNil)
+	snapshot := &data.Snapshot{}
+	c.Assert(json.Unmarshal(signed.Signed, snapshot), IsNil)
+	snapshot.Version = version
+	snapshot.Expires = snapshot.Expires.Add(time.Hour)
+	keys, err := s.store.GetSigningKeys("snapshot")
+	c.Assert(err, IsNil)
+	signed, err = sign.Marshal(snapshot, keys...)
+	c.Assert(err, IsNil)
+	snapshotJSON, err := json.Marshal(signed)
+	c.Assert(err, IsNil)
+	c.Assert(s.store.SetMeta("snapshot.json", snapshotJSON), IsNil)
+	c.Assert(s.repo.Timestamp(), IsNil)
+	s.syncRemote(c)
+	_, err = client.Update()
+	c.Assert(err, DeepEquals, ErrRollback{"snapshot", version, version})
+	c.Assert(client.snapshotVer, Equals, version)
+}
+
+func (s *ClientSuite) TestUpdateMalformedTimestamp(c *C) {
+	client := s.updatedClient(c)
 	version := client.timestampVer
-	c.Assert(s.repo.TimestampWithExpires(s.expiredTime), IsNil)
-	s.syncLocal(c)
-	s.withMetaExpired(func() {
-		c.Assert(client.getLocalMeta(), IsNil)
-		c.Assert(client.timestampVer > version, Equals, true)
-	})
 
-	// locally expired snapshot.json is ok
-	version = client.snapshotVer
-	c.Assert(s.repo.SnapshotWithExpires(tuf.CompressionTypeNone, s.expiredTime), IsNil)
-	s.syncLocal(c)
-	s.withMetaExpired(func() {
-		c.Assert(client.getLocalMeta(), IsNil)
-		c.Assert(client.snapshotVer > version, Equals, true)
-	})
+	meta, err := s.store.GetMeta()
+	c.Assert(err, IsNil)
+	signed := &data.Signed{}
+	c.Assert(json.Unmarshal(meta["timestamp.json"], signed), IsNil)
+	timestamp := &data.Timestamp{}
+	c.Assert(json.Unmarshal(signed.Signed, timestamp), IsNil)
+	snapshotMeta := timestamp.Meta["snapshot.json"]
+	keys, err := s.store.GetSigningKeys("timestamp")
+	c.Assert(err, IsNil)
 
-	// locally expired targets.json is ok
-	version = client.targetsVer
-	c.Assert(s.repo.AddTargetWithExpires("foo.txt", nil, s.expiredTime), IsNil)
-	s.syncLocal(c)
-	s.withMetaExpired(func() {
-		c.Assert(client.getLocalMeta(), IsNil)
-		c.Assert(client.targetsVer > version, Equals, true)
-	})
+	for _, t := range []struct {
+		meta   data.Files
+		reason string
+	}{
+		{
+			meta:   data.Files{},
+			reason: "snapshot.json is not listed",
+		},
+		{
+			meta:   data.Files{"snapshot.json": {Length: 0, Hashes: snapshotMeta.Hashes}},
+			reason: "invalid snapshot.json length 0",
+		},
+		{
+			meta:   data.Files{"snapshot.json": {Length: snapshotMeta.Length}},
+			reason: "snapshot.json has no hashes",
+		},
+	} {
+		// re-sign timestamp.json with the malformed meta
+		timestamp.Meta = t.meta
+		timestamp.Version++
+		signed, err := sign.Marshal(timestamp, keys...)
+		c.Assert(err, IsNil)
+		timestampJSON, err := json.Marshal(signed)
+		c.Assert(err, IsNil)
+		c.Assert(s.store.SetMeta("timestamp.json", timestampJSON), IsNil)
+		s.syncRemote(c)
 
-	// locally expired root.json is not ok
-	version = client.rootVer
-	s.genKeyExpired(c, "targets")
-	s.syncLocal(c)
-	s.withMetaExpired(func() {
-		err := client.getLocalMeta()
-		if _, ok := err.(verify.ErrExpired); !ok {
-			c.Fatalf("expected err to have type signed.ErrExpired, got %T", err)
+		// check the update fails without trusting the timestamp
+		_, err = client.Update()
+		c.Assert(err, Equals, ErrMalformedTimestamp{t.reason})
+		c.Assert(client.timestampVer, Equals, version)
+	}
+}
+
+func (s *ClientSuite) TestUpdateFromArchive(c *C) {
+	var buf bytes.Buffer
+	c.Assert(s.repo.Export(&buf), IsNil)
+	archive := buf.Bytes()
+
+	// check exporting the same metadata gives the same archive
+	var again bytes.Buffer
+	c.Assert(s.repo.Export(&again), IsNil)
+	c.Assert(bytes.Equal(again.Bytes(), archive), Equals, true)
+
+	remote, err := ArchiveRemoteStore(bytes.NewReader(archive))
+	c.Assert(err, IsNil)
+	client := NewClient(MemoryLocalStore(), remote)
+	c.Assert(client.Init(s.rootKeys(c), 1), IsNil)
+	files, err := client.Update()
+	c.Assert(err, IsNil)
+	assertFiles(c, files, []string{"/foo.txt"})
+	var dest testDestination
+	c.Assert(client.Download("/foo.txt", &dest), IsNil)
+	c.Assert(dest.String(), Equals, "foo")
+
+	// check the unpacked archive can be served over HTTP
+	dir := c.MkDir()
+	tr := tar.NewReader(bytes.NewReader(archive))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
 		}
-		c.Assert(client.rootVer, Equals, version)
+		c.Assert(err, IsNil)
+		path := filepath.Join(dir, filepath.FromSlash(hdr.Name))
+		c.Assert(os.MkdirAll(filepath.Dir(path), 0755), IsNil)
+		b, err := ioutil.ReadAll(tr)
+		c.Assert(err, IsNil)
+		c.Assert(ioutil.WriteFile(path, b, 0644), IsNil)
+	}
+	srv := httptest.NewServer(http.FileServer(http.Dir(dir)))
+	defer srv.Close()
+	remote, err = HTTPRemoteStore(srv.URL, nil)
+	c.Assert(err, IsNil)
+	client = NewClient(MemoryLocalStore(), remote)
+	c.Assert(client.Init(s.rootKeys(c), 1), IsNil)
+	_, err = client.Update()
+	c.Assert(err, IsNil)
+	dest.Reset()
+	c.Assert(client.Download("/foo.txt", &dest), IsNil)
+	c.Assert(dest.String(), Equals, "foo")
+
+	// check a corrupted archive is rejected
+	tampered := bytes.Replace(archive, []byte(`"/foo.txt"`), []byte(`"/bad.txt"`), 1)
+	c.Assert(bytes.Equal(tampered, archive), Equals, false)
+	_, err = ArchiveRemoteStore(bytes.NewReader(tampered))
+	c.Assert(err, FitsTypeOf, ErrInvalidArchive{})
+}
+
+// failingLocalStore is a LocalStore which fails to write metadata.
+type failingLocalStore struct {
+	LocalStore
+}
+
+func (failingLocalStore) SetMeta(string, json.RawMessage) error {
+	return errors.New("write failed")
+}
+
+func (s *ClientSuite) TestSetLocalStore(c *C) {
+	client := s.updatedClient(c)
+
+	// check failing to copy the metadata keeps the current store
+	c.Assert(client.SetLocalStore(failingLocalStore{MemoryLocalStore()}), ErrorMatches, "write failed")
+	s.addRemoteTarget(c, "bar.txt")
+	_, err := client.Update()
+	c.Assert(err, IsNil)
+	files, err := NewClient(s.local, s.remote).LocalTargets()
+	c.Assert(err, IsNil)
+	assertFiles(c, files, []string{"/foo.txt", "/bar.txt"})
+
+	// check the metadata is copied and subsequent updates use the new store
+	local, err := FileLocalStore(filepath.Join(c.MkDir(), "tuf.db"))
+	c.Assert(err, IsNil)
+	c.Assert(client.SetLocalStore(local), IsNil)
+	before, err := s.local.GetMeta()
+	c.Assert(err, IsNil)
+	after, err := local.GetMeta()
+	c.Assert(err, IsNil)
+	c.Assert(after, DeepEquals, before)
+	s.addRemoteTarget(c, "baz.txt")
+	files, err = client.Update()
+	c.Assert(err, IsNil)
+	assertFiles(c, files, []string{"/baz.txt"})
+	files, err = NewClient(local, s.remote).LocalTargets()
+	c.Assert(err, IsNil)
+	assertFiles(c, files, []string{"/foo.txt", "/bar.txt", "/baz.txt"})
+	files, err = NewClient(s.local, s.remote).LocalTargets()
+	c.Assert(err, IsNil)
+	assertFiles(c, files, []string{"/foo.txt", "/bar.txt"})
+}
+
+func (s *ClientSuite) TestTargetURLFunc(c *C) {
+	// serve foo.txt by its sha512 hash
+	targets, err := s.updatedClient(c).Targets()
+	c.Assert(err, IsNil)
+	foo := targets["/foo.txt"]
+	hashPath := "/by-hash/" + foo.Hashes["sha512"].String()
+	s.remote.targets[hashPath] = newFakeFile(targetFiles["/foo.txt"])
+	delete(s.remote.targets, "/foo.txt")
+
+	var names []string
+	client := NewClient(s.local, s.remote, WithTargetURLFunc(func(name string, meta data.FileMeta) string {
+		names = append(names, name)
+		return "/by-hash/" + meta.Hashes["sha512"].String()
+	}))
+	var dest testDestination
+	c.Assert(client.Download("foo.txt", &dest), IsNil)
+	c.Assert(dest.String(), Equals, "foo")
+	c.Assert(names, DeepEquals, []string{"/foo.txt"})
+
+	// check data from the mapped path is still verified
+	s.remote.targets[hashPath] = newFakeFile([]byte("bad"))
+	dest = testDestination{}
+	c.Assert(client.Download("foo.txt", &dest), NotNil)
+	c.Assert(dest.deleted, Equals, true)
+}
+
+func (s *ClientSuite) TestTargetPathAllowlist(c *C) {
+	client := s.updatedClient(c)
+
+	// check path traversal is rejected without an allowlist and without
+	// contacting the remote
+	remote := &flakyRemoteStore{RemoteStore: s.remote, failures: math.MaxInt32}
+	client.SetRemoteStore(remote)
+	for _, name := range []string{
+		"../../etc/passwd",
+		"/foo/../../etc/passwd",
+		"/foo.txt/..",
+		`..\..\windows\system32`,
+		"//etc/passwd",
+		`\\server\share`,
+		`C:\foo.txt`,
+	} {
+		var dest testDestination
+		c.Assert(client.Download(name, &dest), DeepEquals, ErrForbiddenTargetPath{name})
+		c.Assert(dest.deleted, Equals, true)
+		c.Assert(client.VerifyTarget(name, strings.NewReader("foo")), DeepEquals, ErrForbiddenTargetPath{name})
+	}
+	c.Assert(remote.calls, Equals, 0)
+	client.SetRemoteStore(s.remote)
+
+	// check targets matching an allowed prefix can be downloaded
+	s.addRemoteTarget(c, "bar.txt")
+	client = NewClient(MemoryLocalStore(), s.remote, WithTargetPathAllowlist([]string{"foo"}))
+	c.Assert(client.Init(s.rootKeys(c), 1), IsNil)
+	_, err := client.Update()
+	c.Assert(err, IsNil)
+	var dest testDestination
+	c.Assert(client.Download("foo.txt", &dest), IsNil)
+	c.Assert(client.VerifyTarget("/foo.txt", strings.NewReader("foo")), IsNil)
+	c.Assert(client.Download("/bar.txt", &dest), DeepEquals, ErrForbiddenTargetPath{"/bar.txt"})
+	c.Assert(client.VerifyTarget("bar.txt", strings.NewReader("bar")), DeepEquals, ErrForbiddenTargetPath{"bar.txt"})
+
+	// check a trailing slash only allows targets in that directory
+	client = NewClient(MemoryLocalStore(), s.remote, WithTargetPathAllowlist([]string{"foo.txt/"}))
+	c.Assert(client.Init(s.rootKeys(c), 1), IsNil)
+	_, err = client.Update()
+	c.Assert(err, IsNil)
+	c.Assert(client.Download("/foo.txt", &dest), DeepEquals, ErrForbiddenTargetPath{"/foo.txt"})
+}
+
+func (s *ClientSuite) TestHashingDestination(c *C) {
+	client := s.updatedClient(c)
+	targets, err := client.Targets()
+	c.Assert(err, IsNil)
+
+	// check the hash matches the metadata after a successful download
+	dest := NewHashingDestination(&testDestination{}, sha512.New())
+	c.Assert(client.Download("/foo.txt", dest), IsNil)
+	c.Assert(dest.Sum(), DeepEquals, targets["/foo.txt"].Hashes["sha512"])
+	c.Assert(dest.Destination.(*testDestination).String(), Equals, "foo")
+
+	// check a failed download deletes the destination and resets the hash
+	s.remote.targets["/foo.txt"] = newFakeFile([]byte("bad"))
+	dest = NewHashingDestination(&testDestination{}, sha512.New())
+	c.Assert(client.Download("/foo.txt", dest), NotNil)
+	c.Assert(dest.Destination.(*testDestination).deleted, Equals, true)
+	empty := sha512.Sum512(nil)
+	c.Assert(dest.Sum(), DeepEquals, data.HexBytes(empty[:]))
+}
+
+func (s *ClientSuite) TestUpdateHTTP(c *C) {
+	tmp := c.MkDir()
+
+	// start file server
+	addr, cleanup := startFileServer(c, tmp)
+	defer cleanup()
+
+	for _, consistentSnapshot := range []bool{false, true} {
+		dir := fmt.Sprintf("consistent-snapshot-%t", consistentSnapshot)
+
+		// generate repository
+		repo := generateRepoFS(c, filepath.Join(tmp, dir), targetFiles, consistentSnapshot)
+
+		// initialize a client
+		remote, err := HTTPRemoteStore(fmt.Sprintf("http://%s/%s/repository", addr, dir), nil)
+		c.Assert(err, IsNil)
+		client := NewClient(MemoryLocalStore(), remote)
+		rootKeys, err := repo.RootKeys()
+		c.Assert(err, IsNil)
+		c.Assert(rootKeys, HasLen, 1)
+		c.Assert(client.Init(rootKeys, 1), IsNil)
+
+		// check update is ok
+		targets, err := client.Update()
+		c.Assert(err, IsNil)
+		assertFiles(c, targets, []string{"/foo.txt", "/bar.txt", "/baz.txt"})
+
+		// check can download files
+		for name, data := range targetFiles {
+			var dest testDestination
+			c.Assert(client.Download(name, &dest), IsNil)
+			c.Assert(dest.deleted, Equals, false)
+			c.Assert(dest.String(), Equals, string(data))
+		}
+	}
+}
+
+// serveRepo serves the repo metadata and targets over HTTP.
+func (s *ClientSuite) serveRepo(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, "/targets/") {
+		b, ok := targetFiles[strings.TrimPrefix(r.URL.Path, "/targets")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(b)
+		return
+	}
+	meta, err := s.store.GetMeta()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	b, ok := meta[strings.TrimPrefix(r.URL.Path, "/")]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Write(b)
+}
+
+func (s *ClientSuite) TestHTTPRemoteHeaders(c *C) {
+	// serve the repo, recording the headers of each request
+	var mtx sync.Mutex
+	var headers []http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		headers = append(headers, r.Header)
+		mtx.Unlock()
+		s.serveRepo(w, r)
+	}))
+	defer srv.Close()
+
+	requests := 0
+	remote, err := HTTPRemoteStore(srv.URL, &HTTPRemoteOptions{
+		UserAgent: "tuf-test/1.0",
+		Header:    http.Header{"Authorization": {"Bearer token"}, "X-Foo": {"foo", "bar"}},
+		RequestModifier: func(r *http.Request) {
+			requests++
+			r.Header.Set("X-Request", strconv.Itoa(requests))
+		},
 	})
+	c.Assert(err, IsNil)
+	s.local = MemoryLocalStore()
+	client := NewClient(s.local, remote)
+	c.Assert(client.Init(s.rootKeys(c), 1), IsNil)
+	_, err = client.Update()
+	c.Assert(err, IsNil)
+	var dest testDestination
+	c.Assert(client.Download("/foo.txt", &dest), IsNil)
+	c.Assert(dest.String(), Equals, "foo")
+
+	// check every request carried the headers
+	c.Assert(headers, HasLen, requests)
+	c.Assert(len(headers) > 1, Equals, true)
+	for i, h := range headers {
+		c.Assert(h.Get("User-Agent"), Equals, "tuf-test/1.0")
+		c.Assert(h.Get("Authorization"), Equals, "Bearer token")
+		c.Assert(h["X-Foo"], DeepEquals, []string{"foo", "bar"})
+		c.Assert(h.Get("X-Request"), Equals, strconv.Itoa(i+1))
+	}
 }
 
-func (s *ClientSuite) TestTimestampTooLarge(c *C) {
-	s.remote.meta["timestamp.json"] = newFakeFile(make([]byte, maxMetaSize+1))
-	_, err := s.newClient(c).Update()
-	c.Assert(err, Equals, ErrMetaTooLarge{"timestamp.json", maxMetaSize + 1})
+func (s *ClientSuite) TestHTTPRemoteMutualTLS(c *C) {
+	// generate a CA and a client certificate signed by it
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "tuf test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	c.Assert(err, IsNil)
+	caCert, err := x509.ParseCertificate(caDER)
+	c.Assert(err, IsNil)
+	clientKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+	clientDER, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "tuf test client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, caCert, &clientKey.PublicKey, caKey)
+	c.Assert(err, IsNil)
+
+	// serve the repo over TLS, requiring a client certificate signed by
+	// the CA
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(s.serveRepo))
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(caCert)
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	srv.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	srv.StartTLS()
+	defer srv.Close()
+
+	newClient := func(certs ...tls.Certificate) *Client {
+		// srv.Client trusts the server certificate
+		httpClient := srv.Client()
+		httpClient.Transport.(*http.Transport).TLSClientConfig.Certificates = certs
+		remote, err := HTTPRemoteStore(srv.URL, &HTTPRemoteOptions{Client: httpClient})
+		c.Assert(err, IsNil)
+		s.local = MemoryLocalStore()
+		return NewClient(s.local, remote)
+	}
+
+	// check the handshake error is surfaced when no certificate is given
+	err = newClient().Init(s.rootKeys(c), 1)
+	c.Assert(err, ErrorMatches, ".*remote error: tls: certificate required")
+	var opErr *net.OpError
+	c.Assert(errors.As(err, &opErr), Equals, true)
+	c.Assert(opErr.Op, Equals, "remote error")
+	c.Assert(IsRetriable(err), Equals, false)
+
+	// check the error is surfaced when the server certificate is not trusted
+	remote, err := HTTPRemoteStore(srv.URL, &HTTPRemoteOptions{Client: &http.Client{}})
+	c.Assert(err, IsNil)
+	err = NewClient(MemoryLocalStore(), remote).Init(s.rootKeys(c), 1)
+	var unknownAuth x509.UnknownAuthorityError
+	c.Assert(errors.As(err, &unknownAuth), Equals, true, Commentf("%v", err))
+	c.Assert(IsRetriable(err), Equals, false)
+
+	// check the client can update and download with the certificate
+	client := newClient(tls.Certificate{Certificate: [][]byte{clientDER}, PrivateKey: clientKey})
+	c.Assert(client.Init(s.rootKeys(c), 1), IsNil)
+	_, err = client.Update()
+	c.Assert(err, IsNil)
+	var dest testDestination
+	c.Assert(client.Download("/foo.txt", &dest), IsNil)
+	c.Assert(dest.String(), Equals, "foo")
 }
 
-func (s *ClientSuite) TestUpdateLocalRootExpired(c *C) {
-	client := s.newClient(c)
+func (s *ClientSuite) TestHTTPConditionalTimestamp(c *C) {
+	// serve the repo metadata with ETags, returning 304 Not Modified for
+	// conditional requests which match
+	var mtx sync.Mutex
+	var downloads, notModified int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		meta, err := s.store.GetMeta()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		name := strings.TrimPrefix(r.URL.Path, "/")
+		b, ok := meta[name]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		etag := fmt.Sprintf(`"%x"`, sha256.Sum256(b))
+		if name == "timestamp.json" {
+			mtx.Lock()
+			defer mtx.Unlock()
+			if r.Header.Get("If-None-Match") == etag {
+				notModified++
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			downloads++
+		}
+		w.Header().Set("ETag", etag)
+		w.Write(b)
+	}))
+	defer srv.Close()
+
+	remote, err := HTTPRemoteStore(srv.URL, nil)
+	c.Assert(err, IsNil)
+	s.local = MemoryLocalStore()
+	client := NewClient(s.local, remote)
+	c.Assert(client.Init(s.rootKeys(c), 1), IsNil)
+
+	// check the first update downloads timestamp.json unconditionally
+	_, err = client.Update()
+	c.Assert(err, IsNil)
+	c.Assert(downloads, Equals, 1)
+	c.Assert(notModified, Equals, 0)
 
-	// add soon to expire root.json to local storage
-	s.genKeyExpired(c, "timestamp")
-	c.Assert(s.repo.Timestamp(), IsNil)
-	s.syncLocal(c)
+	// check a 304 response returns ErrLatestSnapshot
+	_, err = client.Update()
+	c.Assert(IsLatestSnapshot(err), Equals, true)
+	c.Assert(downloads, Equals, 1)
+	c.Assert(notModified, Equals, 1)
 
-	// add far expiring root.json to remote storage
-	s.genKey(c, "timestamp")
+	// check a changed timestamp.json is downloaded
 	s.addRemoteTarget(c, "bar.txt")
-	s.syncRemote(c)
+	files, err := client.Update()
+	c.Assert(err, IsNil)
+	assertFiles(c, files, []string{"/bar.txt"})
+	c.Assert(downloads, Equals, 2)
+	c.Assert(notModified, Equals, 1)
 
-	// check the update downloads the non expired remote root.json and
-	// restarts itself, thus successfully updating
-	s.withMetaExpired(func() {
-		err := client.getLocalMeta()
-		if _, ok := err.(verify.ErrExpired); !ok {
-			c.Fatalf("expected err to have type signed.ErrExpired, got %T", err)
+	// check the store makes unconditional requests for other callers
+	r, _, err := remote.GetMeta("timestamp.json")
+	c.Assert(err, IsNil)
+	r.Close()
+	c.Assert(downloads, Equals, 3)
+}
+
+func (s *ClientSuite) TestHTTPConditionalTimestampExpired(c *C) {
+	// serve the repo metadata, returning 304 Not Modified for every
+	// conditional request for timestamp.json
+	var mtx sync.Mutex
+	var downloads, notModified int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		meta, err := s.store.GetMeta()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		name := strings.TrimPrefix(r.URL.Path, "/")
+		b, ok := meta[name]
+		if !ok {
+			http.NotFound(w, r)
+			return
 		}
+		if name == "timestamp.json" {
+			mtx.Lock()
+			defer mtx.Unlock()
+			if r.Header.Get("If-None-Match") != "" {
+				notModified++
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			downloads++
+		}
+		w.Header().Set("ETag", fmt.Sprintf(`"%x"`, sha256.Sum256(b)))
+		w.Write(b)
+	}))
+	defer srv.Close()
 
-		client := NewClient(s.local, s.remote)
+	remote, err := HTTPRemoteStore(srv.URL, nil)
+	c.Assert(err, IsNil)
+	clock := verify.NewFakeClock(time.Now())
+	client := NewClient(MemoryLocalStore(), remote, WithClock(clock))
+	c.Assert(client.Init(s.rootKeys(c), 1), IsNil)
+	_, err = client.Update()
+	c.Assert(err, IsNil)
+	_, err = client.Update()
+	c.Assert(IsLatestSnapshot(err), Equals, true)
+	c.Assert(downloads, Equals, 1)
+	c.Assert(notModified, Equals, 1)
+
+	// check a 304 is not trusted once the local timestamp.json has expired,
+	// and the expired timestamp.json downloaded in full is rejected
+	clock.Advance(2 * 24 * time.Hour)
+	for i := 0; i < 2; i++ {
 		_, err = client.Update()
-		c.Assert(err, IsNil)
-	})
+		c.Assert(err, NotNil)
+		c.Assert(IsLatestSnapshot(err), Equals, false)
+		var expired verify.ErrExpired
+		c.Assert(errors.As(err, &expired), Equals, true)
+	}
+	c.Assert(downloads, Equals, 3)
 }
 
-func (s *ClientSuite) TestUpdateRemoteExpired(c *C) {
-	client := s.updatedClient(c)
+func (s *ClientSuite) TestDownloadOffline(c *C) {
+	// check ErrNoLocalMeta is returned before targets.json is loaded, even
+	// if it is in local storage
+	s.updatedClient(c)
+	client := NewClient(s.local, s.remote)
+	var dest testDestination
+	c.Assert(client.DownloadOffline("/foo.txt", &dest), Equals, ErrNoLocalMeta)
+	c.Assert(dest.deleted, Equals, true)
 
-	// expired remote metadata should always be rejected
-	c.Assert(s.repo.TimestampWithExpires(s.expiredTime), IsNil)
-	s.syncRemote(c)
-	s.withMetaExpired(func() {
-		_, err := client.Update()
-		s.assertErrExpired(c, err, "timestamp.json")
-	})
+	// check the target is downloaded once targets.json is loaded, without
+	// the remote metadata
+	_, err := client.Targets()
+	c.Assert(err, IsNil)
+	s.remote.meta = make(map[string]*fakeFile)
+	dest = testDestination{}
+	c.Assert(client.DownloadOffline("/foo.txt", &dest), IsNil)
+	c.Assert(dest.String(), Equals, "foo")
 
-	c.Assert(s.repo.SnapshotWithExpires(tuf.CompressionTypeNone, s.expiredTime), IsNil)
-	c.Assert(s.repo.Timestamp(), IsNil)
-	s.syncRemote(c)
-	s.withMetaExpired(func() {
-		_, err := client.Update()
-		s.assertErrExpired(c, err, "snapshot.json")
-	})
+	// check the target is still verified
+	s.remote.targets["/foo.txt"] = newFakeFile([]byte("bar"))
+	dest = testDestination{}
+	c.Assert(client.DownloadOffline("/foo.txt", &dest), FitsTypeOf, ErrDownloadFailed{})
+	c.Assert(dest.deleted, Equals, true)
+	c.Assert(client.DownloadOffline("/bar.txt", &dest), Equals, ErrUnknownTarget{"/bar.txt"})
+}
 
-	c.Assert(s.repo.AddTargetWithExpires("bar.txt", nil, s.expiredTime), IsNil)
+func (s *ClientSuite) TestAddTargetReader(c *C) {
+	// stage a streamed target, which the memory store adds to targetFiles
+	defer delete(targetFiles, "/streamed.txt")
+	c.Assert(s.repo.AddTargetReader("streamed.txt", bytes.NewReader([]byte("streamed")), nil), IsNil)
 	c.Assert(s.repo.Snapshot(tuf.CompressionTypeNone), IsNil)
 	c.Assert(s.repo.Timestamp(), IsNil)
 	s.syncRemote(c)
-	s.withMetaExpired(func() {
-		_, err := client.Update()
-		s.assertErrExpired(c, err, "targets.json")
-	})
+	c.Assert(s.store.WalkStagedTargets([]string{"/streamed.txt"}, func(path string, r io.Reader) error {
+		b, err := ioutil.ReadAll(r)
+		s.remote.targets[path] = newFakeFile(b)
+		return err
+	}), IsNil)
 
-	s.genKeyExpired(c, "timestamp")
-	c.Assert(s.repo.RemoveTarget("bar.txt"), IsNil)
-	c.Assert(s.repo.Snapshot(tuf.CompressionTypeNone), IsNil)
-	c.Assert(s.repo.Timestamp(), IsNil)
-	s.syncRemote(c)
-	s.withMetaExpired(func() {
-		_, err := client.Update()
-		s.assertErrExpired(c, err, "root.json")
-	})
+	// check the client can download it
+	client := s.updatedClient(c)
+	var dest testDestination
+	c.Assert(client.Download("/streamed.txt", &dest), IsNil)
+	c.Assert(dest.String(), Equals, "streamed")
 }
 
-func (s *ClientSuite) TestUpdateLocalRootExpiredKeyChange(c *C) {
-	client := s.newClient(c)
+func (s *ClientSuite) TestReplaceTarget(c *C) {
+	// publish a target, which the memory store adds to targetFiles
+	defer delete(targetFiles, "/app-latest.bin")
+	publish := func() {
+		c.Assert(s.repo.Snapshot(tuf.CompressionTypeNone), IsNil)
+		c.Assert(s.repo.Timestamp(), IsNil)
+		s.syncRemote(c)
+		s.remote.targets["/app-latest.bin"] = newFakeFile(targetFiles["/app-latest.bin"])
+	}
+	custom := json.RawMessage(`{"version":"1.0"}`)
+	c.Assert(s.repo.AddTargetReader("app-latest.bin", strings.NewReader("v1"), custom), IsNil)
+	publish()
+	client := s.updatedClient(c)
+	var dest testDestination
+	c.Assert(client.Download("/app-latest.bin", &dest), IsNil)
+	c.Assert(dest.String(), Equals, "v1")
 
-	// add soon to expire root.json to local storage
-	s.genKeyExpired(c, "timestamp")
-	c.Assert(s.repo.Timestamp(), IsNil)
-	s.syncLocal(c)
+	// check the client downloads and verifies the new content after the
+	// target is replaced
+	c.Assert(s.repo.ReplaceTarget("app-latest.bin", strings.NewReader("v2 content"), nil), IsNil)
+	publish()
+	_, err := client.Update()
+	c.Assert(err, IsNil)
+	meta, err := client.TargetMeta("/app-latest.bin")
+	c.Assert(err, IsNil)
+	expected, err := util.GenerateFileMeta(strings.NewReader("v2 content"))
+	c.Assert(err, IsNil)
+	c.Assert(util.FileMetaEqual(meta, expected), IsNil)
+	c.Assert(*meta.Custom, DeepEquals, custom)
+	dest = testDestination{}
+	c.Assert(client.Download("/app-latest.bin", &dest), IsNil)
+	c.Assert(dest.String(), Equals, "v2 content")
+}
 
-	// replace all keys
-	newKeyIDs := make(map[string]string)
-	for role, id := range s.keyIDs {
-		c.Assert(s.repo.RevokeKey(role, id), IsNil)
-		newKeyIDs[role] = s.genKey(c, role)
+func (s *ClientSuite) TestTargetContentCache(c *C) {
+	// list two targets with the same content as foo.txt
+	meta, err := util.GenerateFileMeta(bytes.NewReader(targetFiles["/foo.txt"]), "sha256", "sha512")
+	c.Assert(err, IsNil)
+	for _, name := range []string{"/a/foo.txt", "/b/foo.txt"} {
+		c.Assert(s.repo.AddTargetMeta(name, meta, nil), IsNil)
+		s.remote.targets[name] = newFakeFile(targetFiles["/foo.txt"])
 	}
-
-	// update metadata
-	c.Assert(s.repo.Sign("targets.json"), IsNil)
 	c.Assert(s.repo.Snapshot(tuf.CompressionTypeNone), IsNil)
 	c.Assert(s.repo.Timestamp(), IsNil)
 	s.syncRemote(c)
+	dir := c.MkDir()
+	s.local = MemoryLocalStore()
+	client := NewClient(s.local, s.remote, WithTargetContentCache(dir))
+	c.Assert(client.Init(s.rootKeys(c), 1), IsNil)
+	_, err = client.Update()
+	c.Assert(err, IsNil)
 
-	// check the update downloads the non expired remote root.json and
-	// restarts itself, thus successfully updating
-	s.withMetaExpired(func() {
-		err := client.getLocalMeta()
-		c.Assert(err, FitsTypeOf, verify.ErrExpired{})
+	// check only the first target is fetched from the remote
+	for _, name := range []string{"/a/foo.txt", "/b/foo.txt"} {
+		var dest testDestination
+		c.Assert(client.Download(name, &dest), IsNil)
+		c.Assert(dest.String(), Equals, "foo")
+	}
+	c.Assert(s.remote.targets["/a/foo.txt"].bytesRead, Equals, 3)
+	c.Assert(s.remote.targets["/b/foo.txt"].bytesRead, Equals, 0)
+	entries, err := ioutil.ReadDir(dir)
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 1)
+	c.Assert(entries[0].Name(), Equals, "sha256-"+meta.Hashes["sha256"].String())
 
-		_, err = client.Update()
-		c.Assert(err, IsNil)
-	})
+	// check a corrupt cache entry is replaced by downloading the target
+	path := filepath.Join(dir, entries[0].Name())
+	c.Assert(ioutil.WriteFile(path, []byte("bar"), 0644), IsNil)
+	var dest testDestination
+	c.Assert(client.Download("/b/foo.txt", &dest), IsNil)
+	c.Assert(dest.String(), Equals, "foo")
+	c.Assert(s.remote.targets["/b/foo.txt"].bytesRead, Equals, 3)
+	b, err := ioutil.ReadFile(path)
+	c.Assert(err, IsNil)
+	c.Assert(string(b), Equals, "foo")
+
+	// check a failed download is not cached
+	c.Assert(os.Remove(path), IsNil)
+	s.remote.targets["/a/foo.txt"] = newFakeFile([]byte("bar"))
+	dest = testDestination{}
+	c.Assert(client.Download("/a/foo.txt", &dest), NotNil)
+	entries, err = ioutil.ReadDir(dir)
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 0)
 }
 
-func (s *ClientSuite) TestUpdateMixAndMatchAttack(c *C) {
-	// generate metadata with an explicit expires so we can make predictable changes
-	expires := time.Now().Add(time.Hour)
-	c.Assert(s.repo.AddTargetWithExpires("foo.txt", nil, expires), IsNil)
-	c.Assert(s.repo.Snapshot(tuf.CompressionTypeNone), IsNil)
-	c.Assert(s.repo.Timestamp(), IsNil)
-	s.syncRemote(c)
-	client := s.updatedClient(c)
+func (s *ClientSuite) TestPruneRemovedTargets(c *C) {
+	s.addRemoteTarget(c, "bar.txt")
+	s.addRemoteTarget(c, "baz.txt")
+	dir := c.MkDir()
+	s.local = MemoryLocalStore()
+	client := NewClient(s.local, s.remote, WithTargetContentCache(dir))
+	c.Assert(client.Init(s.rootKeys(c), 1), IsNil)
+	_, err := client.Update()
+	c.Assert(err, IsNil)
+	for _, name := range []string{"/foo.txt", "/bar.txt", "/baz.txt"} {
+		var dest testDestination
+		c.Assert(client.Download(name, &dest), IsNil)
+	}
+	cacheName := func(name string) string {
+		meta, err := client.TargetMeta(name)
+		c.Assert(err, IsNil)
+		n, ok := targetCacheName(meta)
+		c.Assert(ok, Equals, true)
+		return n
+	}
+	bar, baz := cacheName("/bar.txt"), cacheName("/baz.txt")
 
-	// grab the remote targets.json
-	oldTargets, ok := s.remote.meta["targets.json"]
-	if !ok {
-		c.Fatal("missing remote targets.json")
+	// add files which are not cache entries, and an entry for a target
+	// which is no longer listed
+	unlisted := "sha256-" + strings.Repeat("ab", sha256.Size)
+	for _, name := range []string{
+		"notes.txt",
+		"sha256-abc",
+		"sha256-" + strings.Repeat("AB", sha256.Size),
+		"md5-" + strings.Repeat("ab", 16),
+		".tmp-123",
+		unlisted,
+	} {
+		c.Assert(ioutil.WriteFile(filepath.Join(dir, name), []byte("x"), 0644), IsNil)
 	}
+	c.Assert(os.Mkdir(filepath.Join(dir, "sha256-"+strings.Repeat("cd", sha256.Size)), 0755), IsNil)
 
-	// generate new remote metadata, but replace targets.json with the old one
-	c.Assert(s.repo.AddTargetWithExpires("bar.txt", nil, expires), IsNil)
+	// check only the entries of unlisted targets are removed
+	c.Assert(s.repo.RemoveTarget("bar.txt"), IsNil)
+	c.Assert(s.repo.RemoveTarget("baz.txt"), IsNil)
 	c.Assert(s.repo.Snapshot(tuf.CompressionTypeNone), IsNil)
 	c.Assert(s.repo.Timestamp(), IsNil)
 	s.syncRemote(c)
-	newTargets, ok := s.remote.meta["targets.json"]
-	if !ok {
-		c.Fatal("missing remote targets.json")
+	_, err = client.Update()
+	c.Assert(err, IsNil)
+	removed, err := client.PruneRemovedTargets(dir)
+	c.Assert(err, IsNil)
+	expected := []string{filepath.Join(dir, bar), filepath.Join(dir, baz), filepath.Join(dir, unlisted)}
+	sort.Strings(expected)
+	sort.Strings(removed)
+	c.Assert(removed, DeepEquals, expected)
+	entries, err := ioutil.ReadDir(dir)
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 7)
+	for _, path := range removed {
+		_, err := os.Stat(path)
+		c.Assert(os.IsNotExist(err), Equals, true)
 	}
-	s.remote.meta["targets.json"] = oldTargets
+	_, err = os.Stat(filepath.Join(dir, cacheName("/foo.txt")))
+	c.Assert(err, IsNil)
 
-	// check update returns ErrWrongSize for targets.json
-	_, err := client.Update()
-	c.Assert(err, DeepEquals, ErrWrongSize{"targets.json", oldTargets.size, newTargets.size})
+	// check a missing directory has nothing to prune
+	removed, err = client.PruneRemovedTargets(filepath.Join(dir, "missing"))
+	c.Assert(err, IsNil)
+	c.Assert(removed, HasLen, 0)
+}
 
-	// do the same but keep the size the same
-	c.Assert(s.repo.RemoveTargetWithExpires("foo.txt", expires), IsNil)
+func (s *ClientSuite) TestDownloadMultipleHashes(c *C) {
+	// list sha256 and sha512 hashes for foo.txt, with a wrong sha256 hash
+	meta, err := util.GenerateFileMeta(bytes.NewReader(targetFiles["/foo.txt"]), "sha256", "sha512")
+	c.Assert(err, IsNil)
+	wrong := sha256.Sum256([]byte("bar"))
+	meta.Hashes["sha256"] = wrong[:]
+	c.Assert(s.repo.AddTargetMeta("foo.txt", meta, nil), IsNil)
 	c.Assert(s.repo.Snapshot(tuf.CompressionTypeNone), IsNil)
 	c.Assert(s.repo.Timestamp(), IsNil)
 	s.syncRemote(c)
-	s.remote.meta["targets.json"] = oldTargets
-
-	// check update returns ErrWrongHash
-	_, err = client.Update()
-	assertWrongHash(c, err)
-}
-
-func (s *ClientSuite) TestUpdateReplayAttack(c *C) {
 	client := s.updatedClient(c)
 
-	// grab the remote timestamp.json
-	oldTimestamp, ok := s.remote.meta["timestamp.json"]
-	if !ok {
-		c.Fatal("missing remote timestamp.json")
-	}
-
-	// generate a new timestamp and sync with the client
-	version := client.timestampVer
-	c.Assert(version > 0, Equals, true)
-	c.Assert(s.repo.Timestamp(), IsNil)
-	s.syncRemote(c)
-	_, err := client.Update()
-	c.Assert(IsLatestSnapshot(err), Equals, true)
-	c.Assert(client.timestampVer > version, Equals, true)
-
-	// replace remote timestamp.json with the old one
-	s.remote.meta["timestamp.json"] = oldTimestamp
+	// check the download fails although the sha512 hash matches
+	var dest testDestination
+	err = client.Download("/foo.txt", &dest)
+	c.Assert(err, FitsTypeOf, ErrDownloadFailed{})
+	c.Assert(err.(ErrDownloadFailed).Err, FitsTypeOf, util.ErrWrongHash{})
+	c.Assert(err.(ErrDownloadFailed).Err.(util.ErrWrongHash).Type, Equals, "sha256")
+	c.Assert(dest.deleted, Equals, true)
+	c.Assert(client.VerifyTarget("/foo.txt", bytes.NewReader(targetFiles["/foo.txt"])), FitsTypeOf, util.ErrWrongHash{})
 
-	// check update returns ErrLowVersion
+	// check the download succeeds once both hashes match
+	right := sha256.Sum256(targetFiles["/foo.txt"])
+	meta.Hashes["sha256"] = right[:]
+	c.Assert(s.repo.AddTargetMeta("foo.txt", meta, nil), IsNil)
+	s.addRemoteTarget(c, "bar.txt")
 	_, err = client.Update()
-	c.Assert(err, DeepEquals, ErrDecodeFailed{"timestamp.json", verify.ErrLowVersion{version, client.timestampVer}})
+	c.Assert(err, IsNil)
+	dest = testDestination{}
+	c.Assert(client.Download("/foo.txt", &dest), IsNil)
+	c.Assert(dest.String(), Equals, "foo")
 }
 
-func (s *ClientSuite) TestUpdateTamperedTargets(c *C) {
-	client := s.newClient(c)
-
-	// get local targets.json
-	meta, err := s.store.GetMeta()
-	c.Assert(err, IsNil)
-	targetsJSON, ok := meta["targets.json"]
-	if !ok {
-		c.Fatal("missing targets.json")
+func (s *ClientSuite) TestResumableDownload(c *C) {
+	// serve the repo over HTTP, interrupting target downloads after the
+	// first byte when interrupt is set and ignoring Range headers when
+	// noRange is set
+	var mtx sync.Mutex
+	var interrupt, noRange bool
+	var ranges []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		if strings.HasPrefix(r.URL.Path, "/targets/") {
+			b, ok := targetFiles[strings.TrimPrefix(r.URL.Path, "/targets")]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			ranges = append(ranges, r.Header.Get("Range"))
+			if noRange {
+				r.Header.Del("Range")
+			}
+			if interrupt {
+				w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+				w.Write(b[:1])
+				w.(http.Flusher).Flush()
+				panic(http.ErrAbortHandler)
+			}
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(b))
+			return
+		}
+		meta, err := s.store.GetMeta()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		b, ok := meta[strings.TrimPrefix(r.URL.Path, "/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(b)
+	}))
+	defer srv.Close()
+	setServer := func(i, n bool) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		interrupt, noRange, ranges = i, n, nil
 	}
-	targets := &data.Signed{}
-	c.Assert(json.Unmarshal(targetsJSON, targets), IsNil)
 
-	// update remote targets.json to have different content but same size
-	c.Assert(targets.Signatures, HasLen, 1)
-	targets.Signatures[0].Method = "xxxxxxx"
-	tamperedJSON, err := json.Marshal(targets)
+	remote, err := HTTPRemoteStore(srv.URL, nil)
 	c.Assert(err, IsNil)
-	s.store.SetMeta("targets.json", tamperedJSON)
-	s.syncRemote(c)
+	client := NewClient(MemoryLocalStore(), remote)
+	c.Assert(client.Init(s.rootKeys(c), 1), IsNil)
 	_, err = client.Update()
-	assertWrongHash(c, err)
-
-	// update remote targets.json to have the wrong size
-	targets.Signatures[0].Method = "xxx"
-	tamperedJSON, err = json.Marshal(targets)
 	c.Assert(err, IsNil)
-	s.store.SetMeta("targets.json", tamperedJSON)
-	s.syncRemote(c)
-	_, err = client.Update()
-	c.Assert(err, DeepEquals, ErrWrongSize{"targets.json", int64(len(tamperedJSON)), int64(len(targetsJSON))})
-}
 
-func (s *ClientSuite) TestUpdateHTTP(c *C) {
-	tmp := c.MkDir()
+	// check an interrupted download keeps the data written
+	setServer(true, false)
+	var dest resumableDestination
+	err = client.Download("/foo.txt", &dest)
+	c.Assert(err, FitsTypeOf, ErrDownloadFailed{})
+	c.Assert(dest.deleted, Equals, false)
+	c.Assert(dest.String(), Equals, "f")
 
-	// start file server
-	addr, cleanup := startFileServer(c, tmp)
-	defer cleanup()
+	// check the download is resumed with a Range request
+	setServer(false, false)
+	c.Assert(client.Download("/foo.txt", &dest), IsNil)
+	c.Assert(dest.String(), Equals, "foo")
+	c.Assert(ranges, DeepEquals, []string{"bytes=1-"})
 
-	for _, consistentSnapshot := range []bool{false, true} {
-		dir := fmt.Sprintf("consistent-snapshot-%t", consistentSnapshot)
+	// check the download restarts if the server ignores the Range header
+	dest = resumableDestination{}
+	dest.WriteString("f")
+	setServer(false, true)
+	c.Assert(client.Download("/foo.txt", &dest), IsNil)
+	c.Assert(dest.String(), Equals, "foo")
+	c.Assert(dest.resets, Equals, 1)
+	c.Assert(ranges, DeepEquals, []string{"bytes=1-", ""})
 
-		// generate repository
-		repo := generateRepoFS(c, filepath.Join(tmp, dir), targetFiles, consistentSnapshot)
+	// check the download restarts if the data written is too long
+	dest = resumableDestination{}
+	dest.WriteString("foobar")
+	setServer(false, false)
+	c.Assert(client.Download("/foo.txt", &dest), IsNil)
+	c.Assert(dest.String(), Equals, "foo")
+	c.Assert(ranges, DeepEquals, []string{""})
 
-		// initialize a client
-		remote, err := HTTPRemoteStore(fmt.Sprintf("http://%s/%s/repository", addr, dir), nil)
-		c.Assert(err, IsNil)
-		client := NewClient(MemoryLocalStore(), remote)
-		rootKeys, err := repo.RootKeys()
-		c.Assert(err, IsNil)
-		c.Assert(rootKeys, HasLen, 1)
-		c.Assert(client.Init(rootKeys, 1), IsNil)
+	// check complete data is verified without downloading it again
+	setServer(false, false)
+	c.Assert(client.Download("/foo.txt", &dest), IsNil)
+	c.Assert(dest.String(), Equals, "foo")
+	c.Assert(ranges, HasLen, 0)
+
+	// check the complete data is verified after resuming, deleting the
+	// destination if it does not match
+	dest = resumableDestination{}
+	dest.WriteString("x")
+	err = client.Download("/foo.txt", &dest)
+	c.Assert(err, FitsTypeOf, ErrDownloadFailed{})
+	c.Assert(dest.deleted, Equals, true)
+	c.Assert(ranges, DeepEquals, []string{"bytes=1-"})
+}
+
+// resumableDestination is a ResumableDestination which writes to memory.
+type resumableDestination struct {
+	bytes.Buffer
+	resets  int
+	deleted bool
+}
 
-		// check update is ok
-		targets, err := client.Update()
-		c.Assert(err, IsNil)
-		assertFiles(c, targets, []string{"/foo.txt", "/bar.txt", "/baz.txt"})
+func (r *resumableDestination) Written() (io.ReadCloser, error) {
+	return ioutil.NopCloser(bytes.NewReader(r.Bytes())), nil
+}
 
-		// check can download files
-		for name, data := range targetFiles {
-			var dest testDestination
-			c.Assert(client.Download(name, &dest), IsNil)
-			c.Assert(dest.deleted, Equals, false)
-			c.Assert(dest.String(), Equals, string(data))
-		}
-	}
+func (r *resumableDestination) Reset() error {
+	r.resets++
+	r.Buffer.Reset()
+	return nil
+}
+
+func (r *resumableDestination) Delete() error {
+	r.deleted = true
+	r.Buffer.Reset()
+	return nil
 }
 
 type testDestination struct {
@@ -756,6 +3575,125 @@ func (t *testDestination) Delete() error {
 	return nil
 }
 
+// syncMemoryRemote copies the files in remote to m.
+func syncMemoryRemote(m *MemoryRemoteStore, remote *fakeRemoteStore) {
+	read := func(f *fakeFile) []byte {
+		defer f.Close()
+		b, _ := ioutil.ReadAll(f.buf)
+		return b
+	}
+	for name, file := range remote.meta {
+		m.SetMeta(name, read(file))
+	}
+	for path, file := range remote.targets {
+		m.SetTarget(path, read(file))
+	}
+}
+
+// TestConcurrentUpdateDownload checks updates and downloads can be run
+// concurrently, and is most useful when run with the race detector.
+func (s *ClientSuite) TestConcurrentUpdateDownload(c *C) {
+	s.local = MemoryLocalStore()
+	remote := NewMemoryRemoteStore()
+	syncMemoryRemote(remote, s.remote)
+	client := NewClient(s.local, remote)
+	c.Assert(client.Init(s.rootKeys(c), 1), IsNil)
+	_, err := client.Update()
+	c.Assert(err, IsNil)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	run := func(n int, f func() error) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < n; i++ {
+				if err := f(); err != nil {
+					errs <- err
+				}
+			}
+		}()
+	}
+	run(10, func() error {
+		var dest testDestination
+		if err := client.Download("/foo.txt", &dest); err != nil {
+			return err
+		}
+		if dest.String() != "foo" {
+			return fmt.Errorf("unexpected data: %q", dest.String())
+		}
+		return nil
+	})
+	run(10, func() error {
+		_, err := client.Targets()
+		return err
+	})
+	run(10, func() error {
+		_, err := client.MetaVersions()
+		return err
+	})
+	run(5, func() error {
+		_, err := client.Update()
+		if IsLatestSnapshot(err) {
+			return nil
+		}
+		return err
+	})
+
+	// publish new metadata while the goroutines are running
+	s.addRemoteTarget(c, "bar.txt")
+	syncMemoryRemote(remote, s.remote)
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		c.Error(err)
+	}
+	_, err = client.Update()
+	c.Assert(IsLatestSnapshot(err), Equals, true)
+	files, err := client.Targets()
+	c.Assert(err, IsNil)
+	assertFiles(c, files, []string{"/foo.txt", "/bar.txt"})
+}
+
+func (s *ClientSuite) TestMemoryRemoteStore(c *C) {
+	remote := NewMemoryRemoteStore()
+	_, _, err := remote.GetMeta("root.json")
+	c.Assert(err, Equals, ErrNotFound{"root.json"})
+	_, _, err = remote.GetTarget("/foo.txt")
+	c.Assert(err, Equals, ErrNotFound{"/foo.txt"})
+
+	syncMemoryRemote(remote, s.remote)
+	r, size, err := remote.GetTarget("/foo.txt")
+	c.Assert(err, IsNil)
+	c.Assert(size, Equals, int64(3))
+	b, err := ioutil.ReadAll(r)
+	c.Assert(err, IsNil)
+	c.Assert(string(b), Equals, "foo")
+	c.Assert(r.Close(), IsNil)
+
+	// check target paths are normalized
+	remote.SetTarget("dir/bar.txt", []byte("bar"))
+	for _, path := range []string{"/dir/bar.txt", "dir/bar.txt", "/dir/../dir/bar.txt"} {
+		_, size, err = remote.GetTarget(path)
+		c.Assert(err, IsNil)
+		c.Assert(size, Equals, int64(3))
+		_, size, err = remote.GetTargetRange(context.Background(), path, 1)
+		c.Assert(err, IsNil)
+		c.Assert(size, Equals, int64(2))
+	}
+
+	// check a client can be updated from it
+	client := NewClient(MemoryLocalStore(), remote)
+	c.Assert(client.Init(s.rootKeys(c), 1), IsNil)
+	files, err := client.Update()
+	c.Assert(err, IsNil)
+	assertFiles(c, files, []string{"/foo.txt"})
+	var dest testDestination
+	c.Assert(client.Download("/foo.txt", &dest), IsNil)
+	c.Assert(dest.String(), Equals, "foo")
+}
+
 func (s *ClientSuite) TestDownloadUnknownTarget(c *C) {
 	client := s.updatedClient(c)
 	var dest testDestination
@@ -774,7 +3712,7 @@ func (s *ClientSuite) TestDownloadNoExist(c *C) {
 func (s *ClientSuite) TestDownloadOK(c *C) {
 	client := s.updatedClient(c)
 	// the filename is normalized if necessary
-	for _, name := range []string{"/foo.txt", "foo.txt"} {
+	for _, name := range []string{"/foo.txt", "foo.txt", "targets/foo.txt", "/targets/foo.txt"} {
 		var dest testDestination
 		c.Assert(client.Download(name, &dest), IsNil)
 		c.Assert(dest.deleted, Equals, false)
@@ -782,6 +3720,35 @@ func (s *ClientSuite) TestDownloadOK(c *C) {
 	}
 }
 
+func (s *ClientSuite) TestDownloadContextCancelled(c *C) {
+	client := s.updatedClient(c)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	var dest testDestination
+	c.Assert(client.DownloadContext(ctx, "/foo.txt", &dest), Equals, context.Canceled)
+	c.Assert(dest.deleted, Equals, true)
+	c.Assert(s.remote.targets["/foo.txt"].bytesRead, Equals, 0)
+}
+
+func (s *ClientSuite) TestDownloadTargetsPrefix(c *C) {
+	client := s.updatedClient(c)
+	c.Assert(client.VerifyTarget("targets/foo.txt", bytes.NewReader([]byte("foo"))), IsNil)
+	_, err := client.TargetCustom("targets/foo.txt")
+	c.Assert(err, IsNil)
+
+	// a target which is actually in a targets directory is not stripped
+	client.targets["/targets/foo.txt"] = client.targets["/foo.txt"]
+	s.remote.targets["/targets/foo.txt"] = newFakeFile([]byte("foo"))
+	delete(s.remote.targets, "/foo.txt")
+	var dest testDestination
+	c.Assert(client.Download("targets/foo.txt", &dest), IsNil)
+	c.Assert(dest.String(), Equals, "foo")
+
+	// only a single prefix is stripped
+	delete(client.targets, "/targets/foo.txt")
+	c.Assert(client.Download("targets/targets/foo.txt", &dest), Equals, ErrUnknownTarget{"targets/targets/foo.txt"})
+}
+
 func (s *ClientSuite) TestDownloadWrongSize(c *C) {
 	client := s.updatedClient(c)
 	remoteFile := &fakeFile{buf: bytes.NewReader([]byte("wrong-size")), size: 10}
@@ -803,6 +3770,26 @@ func (s *ClientSuite) TestDownloadTargetTooLong(c *C) {
 	c.Assert(dest.String(), Equals, "foo")
 }
 
+func (s *ClientSuite) TestUnknownSizeTruncated(c *C) {
+	client := s.updatedClient(c)
+
+	// check truncated metadata of unknown size fails with ErrWrongSize
+	s.addRemoteTarget(c, "bar.txt")
+	targetsJSON := s.remote.meta["targets.json"]
+	truncated := make([]byte, targetsJSON.size-10)
+	_, err := io.ReadFull(targetsJSON.buf, truncated)
+	c.Assert(err, IsNil)
+	s.remote.meta["targets.json"] = &fakeFile{buf: bytes.NewReader(truncated), size: -1}
+	_, err = client.Update()
+	c.Assert(err, DeepEquals, ErrWrongSize{"targets.json", targetsJSON.size - 10, targetsJSON.size})
+
+	// check a truncated target of unknown size fails with ErrWrongSize
+	s.remote.targets["/foo.txt"] = &fakeFile{buf: bytes.NewReader([]byte("fo")), size: -1}
+	var dest testDestination
+	c.Assert(client.Download("/foo.txt", &dest), DeepEquals, ErrWrongSize{"/foo.txt", 2, 3})
+	c.Assert(dest.deleted, Equals, true)
+}
+
 func (s *ClientSuite) TestDownloadTargetTooShort(c *C) {
 	client := s.updatedClient(c)
 	remoteFile := s.remote.targets["/foo.txt"]
@@ -821,6 +3808,274 @@ func (s *ClientSuite) TestDownloadTargetCorruptData(c *C) {
 	c.Assert(dest.deleted, Equals, true)
 }
 
+func (s *ClientSuite) TestDownloadStream(c *C) {
+	client := s.updatedClient(c)
+
+	// check a valid target can be read
+	r, size, err := client.DownloadStream("/foo.txt")
+	c.Assert(err, IsNil)
+	c.Assert(size, Equals, int64(3))
+	b, err := ioutil.ReadAll(r)
+	c.Assert(err, IsNil)
+	c.Assert(string(b), Equals, "foo")
+	c.Assert(r.Close(), IsNil)
+
+	// check closing before EOF returns an error
+	r, _, err = client.DownloadStream("/foo.txt")
+	c.Assert(err, IsNil)
+	c.Assert(r.Close(), Equals, ErrDownloadFailed{"/foo.txt", io.ErrUnexpectedEOF})
+
+	// check unknown targets fail before returning a reader
+	_, _, err = client.DownloadStream("/bar.txt")
+	c.Assert(err, Equals, ErrUnknownTarget{"/bar.txt"})
+
+	// check corrupt data fails at EOF and on Close
+	s.remote.targets["/foo.txt"].buf = bytes.NewReader([]byte("corrupt"))
+	r, _, err = client.DownloadStream("/foo.txt")
+	c.Assert(err, IsNil)
+	_, err = ioutil.ReadAll(r)
+	assertWrongHash(c, err)
+	assertWrongHash(c, r.Close())
+
+	// check short data fails with ErrWrongSize
+	s.remote.targets["/foo.txt"].buf = bytes.NewReader([]byte("fo"))
+	r, _, err = client.DownloadStream("/foo.txt")
+	c.Assert(err, IsNil)
+	_, err = ioutil.ReadAll(r)
+	c.Assert(err, Equals, ErrWrongSize{"/foo.txt", 2, 3})
+	c.Assert(r.Close(), Equals, ErrWrongSize{"/foo.txt", 2, 3})
+
+	// check missing targets fail before returning a reader
+	delete(s.remote.targets, "/foo.txt")
+	_, _, err = client.DownloadStream("/foo.txt")
+	c.Assert(err, Equals, ErrNotFound{"/foo.txt"})
+}
+
+func (s *ClientSuite) TestDownloadProgress(c *C) {
+	client := s.updatedClient(c)
+	type progress struct {
+		name             string
+		bytesRead, total int64
+	}
+	var reports []progress
+	client.SetDownloadProgress(func(name string, bytesRead, total int64) {
+		reports = append(reports, progress{name, bytesRead, total})
+	})
+
+	// the final report has bytesRead equal to total
+	s.remote.targets["/foo.txt"].buf = bytes.NewReader([]byte("foo"))
+	var dest testDestination
+	c.Assert(client.Download("/foo.txt", &dest), IsNil)
+	c.Assert(reports, DeepEquals, []progress{{"/foo.txt", 3, 3}})
+
+	// a failed download does not report completion
+	reports = nil
+	s.remote.targets["/foo.txt"].buf = bytes.NewReader([]byte("fo"))
+	c.Assert(client.Download("/foo.txt", &dest), DeepEquals, ErrWrongSize{"/foo.txt", 2, 3})
+	c.Assert(reports, DeepEquals, []progress{{"/foo.txt", 2, 3}})
+	s.remote.targets["/foo.txt"].buf = bytes.NewReader([]byte("bar"))
+	reports = nil
+	assertWrongHash(c, client.Download("/foo.txt", &dest))
+	c.Assert(reports, HasLen, 0)
+}
+
+func (s *ClientSuite) TestDownloadBatch(c *C) {
+	s.addRemoteTarget(c, "bar.txt")
+	s.addRemoteTarget(c, "baz.txt")
+	client := s.updatedClient(c)
+
+	names := []string{"/foo.txt", "/bar.txt", "/baz.txt"}
+	dests := make(map[string]Destination, len(names))
+	for _, name := range names {
+		dests[name] = &testDestination{}
+	}
+	c.Assert(client.DownloadBatch(names, dests, 2), IsNil)
+	for _, name := range names {
+		dest := dests[name].(*testDestination)
+		c.Assert(dest.deleted, Equals, false)
+		c.Assert(dest.String(), Equals, string(targetFiles[name]))
+	}
+
+	// a failed download only deletes its own destination
+	s.remote.targets["/bar.txt"].buf = bytes.NewReader([]byte("corrupt"))
+	delete(s.remote.targets, "/baz.txt")
+	for _, name := range names {
+		dests[name] = &testDestination{}
+	}
+	err := client.DownloadBatch(names, dests, 0)
+	e, ok := err.(ErrBatchDownload)
+	if !ok {
+		c.Fatalf("expected err to have type ErrBatchDownload, got %T", err)
+	}
+	c.Assert(e, HasLen, 2)
+	assertWrongHash(c, e["/bar.txt"])
+	c.Assert(e["/baz.txt"], Equals, ErrNotFound{"/baz.txt"})
+	c.Assert(dests["/foo.txt"].(*testDestination).deleted, Equals, false)
+	c.Assert(dests["/bar.txt"].(*testDestination).deleted, Equals, true)
+	c.Assert(dests["/baz.txt"].(*testDestination).deleted, Equals, true)
+}
+
+func (s *ClientSuite) TestDownloadTargetCorruptDataSHA512(c *C) {
+	// generate a repo which hashes targets with both sha256 and sha512
+	var err error
+	s.repo, err = tuf.NewRepo(s.store, "sha256", "sha512")
+	c.Assert(err, IsNil)
+	c.Assert(s.repo.AddTarget("foo.txt", nil), IsNil)
+	c.Assert(s.repo.Snapshot(tuf.CompressionTypeNone), IsNil)
+	c.Assert(s.repo.Timestamp(), IsNil)
+	s.syncRemote(c)
+	client := s.updatedClient(c)
+	c.Assert(client.targets["/foo.txt"].Hashes, HasLen, 2)
+
+	// corrupt data fails with both hashes
+	remoteFile := s.remote.targets["/foo.txt"]
+	remoteFile.buf = bytes.NewReader([]byte("bar"))
+	var dest testDestination
+	assertWrongHash(c, client.Download("/foo.txt", &dest))
+	c.Assert(dest.deleted, Equals, true)
+
+	// a matching sha256 does not mask a wrong sha512
+	remoteFile.buf = bytes.NewReader([]byte("foo"))
+	meta := client.targets["/foo.txt"]
+	meta.Hashes["sha512"] = make([]byte, len(meta.Hashes["sha512"]))
+	dest = testDestination{}
+	err = client.Download("/foo.txt", &dest)
+	assertWrongHash(c, err)
+	c.Assert(err.(ErrDownloadFailed).Err.(util.ErrWrongHash).Type, Equals, "sha512")
+	c.Assert(dest.deleted, Equals, true)
+}
+
+func (s *ClientSuite) TestDownloadUnknownHashAlgorithm(c *C) {
+	client := s.updatedClient(c)
+	client.targets["/foo.txt"].Hashes["md5"] = []byte("foo")
+	var dest testDestination
+	c.Assert(client.Download("/foo.txt", &dest), DeepEquals, ErrDownloadFailed{"/foo.txt", util.ErrUnknownHashAlgorithm{Name: "md5"}})
+	c.Assert(dest.deleted, Equals, true)
+}
+
+func (s *ClientSuite) TestDownloadToFile(c *C) {
+	client := s.updatedClient(c)
+	dir := c.MkDir()
+
+	// parent directories are created
+	path := filepath.Join(dir, "a", "b", "foo.txt")
+	c.Assert(client.DownloadToFile("/foo.txt", path), IsNil)
+	b, err := ioutil.ReadFile(path)
+	c.Assert(err, IsNil)
+	c.Assert(string(b), Equals, "foo")
+
+	// no partial file is left if the download fails
+	valid := s.remote.targets["/foo.txt"]
+	s.remote.targets["/foo.txt"] = newFakeFile([]byte("fo"))
+	path = filepath.Join(dir, "partial.txt")
+	c.Assert(client.DownloadToFile("/foo.txt", path), DeepEquals, ErrWrongSize{"/foo.txt", 2, 3})
+	_, err = os.Stat(path)
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	// an existing file is kept if the download fails
+	existing := filepath.Join(dir, "existing.txt")
+	c.Assert(ioutil.WriteFile(existing, []byte("old"), 0644), IsNil)
+	c.Assert(client.DownloadToFile("/foo.txt", existing), DeepEquals, ErrWrongSize{"/foo.txt", 2, 3})
+	b, err = ioutil.ReadFile(existing)
+	c.Assert(err, IsNil)
+	c.Assert(string(b), Equals, "old")
+
+	// an existing file is replaced once the download succeeds
+	s.remote.targets["/foo.txt"] = valid
+	valid.buf.Seek(0, io.SeekStart)
+	c.Assert(client.DownloadToFile("/foo.txt", existing), IsNil)
+	b, err = ioutil.ReadFile(existing)
+	c.Assert(err, IsNil)
+	c.Assert(string(b), Equals, "foo")
+
+	// no temporary files are left behind
+	names, err := ioutil.ReadDir(dir)
+	c.Assert(err, IsNil)
+	c.Assert(names, HasLen, 2)
+}
+
+func (s *ClientSuite) TestVerifyTarget(c *C) {
+	client := s.updatedClient(c)
+
+	c.Assert(client.VerifyTarget("foo.txt", bytes.NewReader([]byte("foo"))), IsNil)
+	c.Assert(client.VerifyTarget("/nonexistent", bytes.NewReader(nil)), Equals, ErrUnknownTarget{"/nonexistent"})
+	c.Assert(client.VerifyTarget("/foo.txt", bytes.NewReader([]byte("fo"))), DeepEquals, ErrWrongSize{"/foo.txt", 2, 3})
+	c.Assert(client.VerifyTarget("/foo.txt", bytes.NewReader([]byte("foo-ooo"))), DeepEquals, ErrWrongSize{"/foo.txt", 4, 3})
+	c.Assert(client.VerifyTarget("/foo.txt", bytes.NewReader([]byte("bar"))), FitsTypeOf, util.ErrWrongHash{})
+
+	// targets are loaded from local storage if necessary
+	client = NewClient(s.local, s.remote)
+	c.Assert(client.VerifyTarget("/foo.txt", bytes.NewReader([]byte("foo"))), IsNil)
+}
+
+func (s *ClientSuite) TestVerifyTargetProgress(c *C) {
+	client := s.updatedClient(c)
+	type progress struct {
+		name             string
+		bytesRead, total int64
+	}
+	var reports []progress
+	client.SetDownloadProgress(func(name string, bytesRead, total int64) {
+		reports = append(reports, progress{name, bytesRead, total})
+	})
+
+	// check progress is reported as the data is read, with the final
+	// report once it has been verified
+	c.Assert(client.VerifyTarget("/foo.txt", iotest.OneByteReader(bytes.NewReader([]byte("foo")))), IsNil)
+	c.Assert(reports, DeepEquals, []progress{{"/foo.txt", 1, 3}, {"/foo.txt", 2, 3}, {"/foo.txt", 3, 3}})
+
+	// check failed verification does not report completion
+	reports = nil
+	c.Assert(client.VerifyTarget("/foo.txt", bytes.NewReader([]byte("fo"))), DeepEquals, ErrWrongSize{"/foo.txt", 2, 3})
+	c.Assert(reports, DeepEquals, []progress{{"/foo.txt", 2, 3}})
+	reports = nil
+	c.Assert(client.VerifyTarget("/foo.txt", bytes.NewReader([]byte("bar"))), FitsTypeOf, util.ErrWrongHash{})
+	c.Assert(reports, HasLen, 0)
+
+	// check a Verifier reports progress
+	reports = nil
+	v := NewVerifier(s.local)
+	v.SetVerifyProgress(func(name string, bytesRead, total int64) {
+		reports = append(reports, progress{name, bytesRead, total})
+	})
+	c.Assert(v.VerifyTarget("/foo.txt", bytes.NewReader([]byte("foo"))), IsNil)
+	c.Assert(reports, DeepEquals, []progress{{"/foo.txt", 3, 3}})
+}
+
+func (s *ClientSuite) TestVerifier(c *C) {
+	// check ErrNoRootKeys is returned without local metadata
+	s.local = MemoryLocalStore()
+	_, err := NewVerifier(s.local).Targets()
+	c.Assert(err, Equals, ErrNoRootKeys)
+
+	// check targets are read and verified from local metadata
+	c.Assert(s.repo.AddTarget("bar.txt", json.RawMessage(`{"foo":"bar"}`)), IsNil)
+	c.Assert(s.repo.Snapshot(tuf.CompressionTypeNone), IsNil)
+	c.Assert(s.repo.Timestamp(), IsNil)
+	s.syncLocal(c)
+	v := NewVerifier(s.local)
+	files, err := v.Targets()
+	c.Assert(err, IsNil)
+	assertFiles(c, files, []string{"/foo.txt", "/bar.txt"})
+	custom, err := v.TargetCustom("/bar.txt")
+	c.Assert(err, IsNil)
+	c.Assert(custom, DeepEquals, json.RawMessage(`{"foo":"bar"}`))
+	c.Assert(v.VerifyTarget("/foo.txt", bytes.NewReader([]byte("foo"))), IsNil)
+	c.Assert(v.VerifyTarget("/foo.txt", bytes.NewReader([]byte("bar"))), FitsTypeOf, util.ErrWrongHash{})
+
+	// check local metadata which fails verification is rejected
+	meta, err := s.local.GetMeta()
+	c.Assert(err, IsNil)
+	signed := &data.Signed{}
+	c.Assert(json.Unmarshal(meta["targets.json"], signed), IsNil)
+	signed.Signatures = nil
+	unsigned, err := json.Marshal(signed)
+	c.Assert(err, IsNil)
+	c.Assert(s.local.SetMeta("targets.json", unsigned), IsNil)
+	_, err = NewVerifier(s.local).Targets()
+	c.Assert(err, Equals, verify.ErrNoSignatures)
+}
+
 func (s *ClientSuite) TestAvailableTargets(c *C) {
 	client := s.updatedClient(c)
 	files, err := client.Targets()
@@ -835,3 +4090,143 @@ func (s *ClientSuite) TestAvailableTargets(c *C) {
 	c.Assert(err, IsNil)
 	assertFiles(c, files, []string{"/foo.txt", "/bar.txt", "/baz.txt"})
 }
+
+func (s *ClientSuite) TestTargetCustom(c *C) {
+	custom := json.RawMessage(`{"channel":"stable"}`)
+	c.Assert(s.repo.AddTarget("bar.txt", custom), IsNil)
+	c.Assert(s.repo.Snapshot(tuf.CompressionTypeNone), IsNil)
+	c.Assert(s.repo.Timestamp(), IsNil)
+	s.syncRemote(c)
+	client := s.updatedClient(c)
+
+	actual, err := client.TargetCustom("bar.txt")
+	c.Assert(err, IsNil)
+	c.Assert(actual, DeepEquals, custom)
+
+	// targets without custom metadata return nil
+	actual, err = client.TargetCustom("/foo.txt")
+	c.Assert(err, IsNil)
+	c.Assert(actual, IsNil)
+
+	// the custom metadata is read from local storage by a new client
+	actual, err = NewClient(s.local, s.remote).TargetCustom("/bar.txt")
+	c.Assert(err, IsNil)
+	c.Assert(actual, DeepEquals, custom)
+
+	_, err = client.TargetCustom("/nonexistent")
+	c.Assert(err, Equals, ErrUnknownTarget{"/nonexistent"})
+}
+
+func (s *ClientSuite) TestTimestampCustom(c *C) {
+	client := s.updatedClient(c)
+	custom, err := client.TimestampCustom()
+	c.Assert(err, IsNil)
+	c.Assert(custom, IsNil)
+
+	// check custom data in a new timestamp.json is returned after an update
+	// and by a client reading local storage
+	counter := json.RawMessage(`{"counter":42}`)
+	c.Assert(s.repo.TimestampWithCustom(counter), IsNil)
+	s.syncRemote(c)
+	_, err = client.Update()
+	c.Assert(IsLatestSnapshot(err), Equals, true)
+	custom, err = client.TimestampCustom()
+	c.Assert(err, IsNil)
+	c.Assert(custom, DeepEquals, counter)
+	custom, err = NewClient(s.local, s.remote).TimestampCustom()
+	c.Assert(err, IsNil)
+	c.Assert(custom, DeepEquals, counter)
+
+	// check the custom data is covered by the timestamp signature
+	c.Assert(s.repo.TimestampWithCustom(json.RawMessage(`{"counter":43}`)), IsNil)
+	s.syncRemote(c)
+	timestampJSON := s.remote.meta["timestamp.json"]
+	b := make([]byte, timestampJSON.size)
+	_, err = io.ReadFull(timestampJSON.buf, b)
+	c.Assert(err, IsNil)
+	s.remote.meta["timestamp.json"] = newFakeFile(bytes.Replace(b, []byte(`"counter":43`), []byte(`"counter":99`), 1))
+	_, err = client.Update()
+	c.Assert(isDecodeFailedWithErr(err, verify.ErrInvalid), Equals, true)
+	custom, err = client.TimestampCustom()
+	c.Assert(err, IsNil)
+	c.Assert(custom, DeepEquals, counter)
+}
+
+func (s *ClientSuite) TestTargetMeta(c *C) {
+	client := s.updatedClient(c)
+	targets, err := client.Targets()
+	c.Assert(err, IsNil)
+
+	meta, err := client.TargetMeta("foo.txt")
+	c.Assert(err, IsNil)
+	c.Assert(meta, DeepEquals, targets["/foo.txt"])
+	c.Assert(meta.Length, Equals, int64(3))
+
+	// the metadata is read from local storage by a new client
+	meta, err = NewClient(s.local, s.remote).TargetMeta("/foo.txt")
+	c.Assert(err, IsNil)
+	c.Assert(meta, DeepEquals, targets["/foo.txt"])
+
+	_, err = client.TargetMeta("/nonexistent")
+	c.Assert(err, Equals, ErrUnknownTarget{"/nonexistent"})
+}
+
+func (s *ClientSuite) TestLatestByChannel(c *C) {
+	for name, custom := range map[string]string{
+		"/foo.txt": `{"channel":"stable","version":"1.0.0"}`,
+		"/bar.txt": `{"channel":"beta","version":"1.1.0"}`,
+		"/baz.txt": `{"channel":"stable","version":"1.0.1"}`,
+	} {
+		c.Assert(s.repo.AddTarget(name, json.RawMessage(custom)), IsNil)
+	}
+
+	// add targets with missing or invalid channels
+	for name, custom := range map[string]string{
+		"/a.txt": `{"version":"1.0.2"}`,
+		"/b.txt": `{"channel":1}`,
+		"/c.txt": `{"channel":null}`,
+		"/d.txt": `["stable"]`,
+		"/e.txt": `"stable"`,
+		"/f.txt": "",
+	} {
+		meta, err := util.GenerateFileMeta(strings.NewReader(name))
+		c.Assert(err, IsNil)
+		c.Assert(s.repo.AddTargetMeta(name, meta, json.RawMessage(custom)), IsNil)
+	}
+	c.Assert(s.repo.Snapshot(tuf.CompressionTypeNone), IsNil)
+	c.Assert(s.repo.Timestamp(), IsNil)
+	s.syncRemote(c)
+	client := s.updatedClient(c)
+
+	// check targets are grouped by channel, skipping those without one
+	channels, err := client.LatestByChannel("channel")
+	c.Assert(err, IsNil)
+	c.Assert(channels, HasLen, 2)
+	assertFiles(c, channels["stable"], []string{"/foo.txt", "/baz.txt"})
+	assertFiles(c, channels["beta"], []string{"/bar.txt"})
+	custom, err := client.TargetCustom("/baz.txt")
+	c.Assert(err, IsNil)
+	c.Assert(*channels["stable"]["/baz.txt"].Custom, DeepEquals, custom)
+
+	channels, err = client.LatestByChannel("track")
+	c.Assert(err, IsNil)
+	c.Assert(channels, HasLen, 0)
+}
+
+func (s *ClientSuite) TestTargetsWithPrefix(c *C) {
+	s.addRemoteTarget(c, "bar.txt")
+	s.addRemoteTarget(c, "baz.txt")
+	client := s.updatedClient(c)
+
+	for prefix, expected := range map[string][]string{
+		"":     {"/foo.txt", "/bar.txt", "/baz.txt"},
+		"/":    {"/foo.txt", "/bar.txt", "/baz.txt"},
+		"ba":   {"/bar.txt", "/baz.txt"},
+		"/bar": {"/bar.txt"},
+		"qux":  {},
+	} {
+		files, err := client.TargetsWithPrefix(prefix)
+		c.Assert(err, IsNil)
+		assertFiles(c, files, expected)
+	}
+}
@@ -1,13 +1,35 @@
 package client
 
 import (
+	"context"
+	"crypto/x509"
 	"errors"
 	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/flynn/go-tuf/util"
+	"github.com/flynn/go-tuf/verify"
 )
 
 var (
-	ErrNoRootKeys       = errors.New("tuf: no root keys found in local meta store")
 	ErrInsufficientKeys = errors.New("tuf: insufficient keys to meet threshold")
+
+	// ErrNotInitialized is returned by methods which need trusted metadata
+	// when the client has not been initialized with Init or InitFrom (i.e.
+	// there is no root.json in local storage).
+	ErrNotInitialized = errors.New("tuf: client not initialized (no root keys found in local meta store)")
+
+	// ErrNoRootKeys is the same as ErrNotInitialized, and is kept for
+	// compatibility.
+	ErrNoRootKeys = ErrNotInitialized
+
+	// ErrNoLocalMeta is returned by DownloadOffline when the client has not
+	// loaded a targets.json.
+	ErrNoLocalMeta = errors.New("tuf: no local targets metadata loaded")
 )
 
 type ErrMissingRemoteMetadata struct {
@@ -18,6 +40,28 @@ func (e ErrMissingRemoteMetadata) Error() string {
 	return fmt.Sprintf("tuf: missing remote metadata %s", e.Name)
 }
 
+// ErrMissingSnapshotMeta is returned when snapshot.json does not list the
+// length and hashes of the given metadata, so it cannot be safely
+// downloaded.
+type ErrMissingSnapshotMeta struct {
+	Name string
+}
+
+func (e ErrMissingSnapshotMeta) Error() string {
+	return fmt.Sprintf("tuf: %s is not listed in snapshot.json", e.Name)
+}
+
+// ErrMalformedTimestamp is returned when a verified timestamp.json does not
+// list a valid length and hashes for snapshot.json, so snapshot.json cannot
+// be safely downloaded.
+type ErrMalformedTimestamp struct {
+	Reason string
+}
+
+func (e ErrMalformedTimestamp) Error() string {
+	return fmt.Sprintf("tuf: malformed timestamp.json: %s", e.Reason)
+}
+
 type ErrDownloadFailed struct {
 	File string
 	Err  error
@@ -27,6 +71,59 @@ func (e ErrDownloadFailed) Error() string {
 	return fmt.Sprintf("tuf: failed to download %s: %s", e.File, e.Err)
 }
 
+func (e ErrDownloadFailed) Unwrap() error {
+	return e.Err
+}
+
+type ErrRetryFailed struct {
+	Attempts int
+	Err      error
+}
+
+func (e ErrRetryFailed) Error() string {
+	return fmt.Sprintf("tuf: request failed after %d attempts: %s", e.Attempts, e.Err)
+}
+
+func (e ErrRetryFailed) Unwrap() error {
+	return e.Err
+}
+
+// ErrMirrorsFailed contains the errors returned by each mirror, in order,
+// when a file could not be downloaded from any mirror.
+type ErrMirrorsFailed struct {
+	Errs []error
+}
+
+func (e ErrMirrorsFailed) Error() string {
+	errs := make([]string, len(e.Errs))
+	for i, err := range e.Errs {
+		errs[i] = err.Error()
+	}
+	return fmt.Sprintf("tuf: all %d mirrors failed: %s", len(e.Errs), strings.Join(errs, "; "))
+}
+
+func (e ErrMirrorsFailed) Unwrap() []error {
+	return e.Errs
+}
+
+// ErrLocalMetaCorrupt is returned when metadata in local storage cannot be
+// decoded because it is not valid JSON, for example because it was
+// truncated by an interrupted write, as opposed to failing verification.
+// Corrupt metadata other than root.json can be recovered by deleting it from
+// local storage and updating, which downloads it again.
+type ErrLocalMetaCorrupt struct {
+	Name string
+	Err  error
+}
+
+func (e ErrLocalMetaCorrupt) Error() string {
+	return fmt.Sprintf("tuf: local metadata %s is corrupt: %s", e.Name, e.Err)
+}
+
+func (e ErrLocalMetaCorrupt) Unwrap() error {
+	return e.Err
+}
+
 type ErrDecodeFailed struct {
 	File string
 	Err  error
@@ -36,6 +133,31 @@ func (e ErrDecodeFailed) Error() string {
 	return fmt.Sprintf("tuf: failed to decode %s: %s", e.File, e.Err)
 }
 
+func (e ErrDecodeFailed) Unwrap() error {
+	return e.Err
+}
+
+// ErrRollback is returned when downloaded metadata has a lower version than
+// the locally trusted metadata for the same role, which indicates a rollback
+// (replay) attack.
+type ErrRollback struct {
+	Role       string
+	Downloaded int
+	Current    int
+}
+
+func (e ErrRollback) Error() string {
+	if e.Downloaded == e.Current {
+		return fmt.Sprintf("tuf: possible rollback attack: downloaded %s version %d differs from current version %d but is not higher", e.Role, e.Downloaded, e.Current)
+	}
+	return fmt.Sprintf("tuf: possible rollback attack: downloaded %s version %d is lower than current version %d", e.Role, e.Downloaded, e.Current)
+}
+
+func IsRollback(err error) bool {
+	var e ErrRollback
+	return errors.As(err, &e)
+}
+
 func isDecodeFailedWithErr(err, expected error) bool {
 	e, ok := err.(ErrDecodeFailed)
 	if !ok {
@@ -44,6 +166,40 @@ func isDecodeFailedWithErr(err, expected error) bool {
 	return e.Err == expected
 }
 
+// ErrRootVerification is returned by Init when the remote root.json is not
+// signed by enough of the given root keys. Found is the number of distinct
+// given keys which validly signed it, and UnknownKeyIDs are the IDs of the keys
+// which signed it but were not given, which typically means the wrong root
+// keys were given.
+type ErrRootVerification struct {
+	Expected      int
+	Found         int
+	UnknownKeyIDs []string
+}
+
+func (e ErrRootVerification) Error() string {
+	msg := fmt.Sprintf("tuf: root.json has valid signatures from %d of the given root keys, expected %d", e.Found, e.Expected)
+	if len(e.UnknownKeyIDs) > 0 {
+		msg += fmt.Sprintf(" (also signed by unknown keys: %s)", strings.Join(e.UnknownKeyIDs, ", "))
+	}
+	return msg
+}
+
+// ErrRootInconsistent is returned when a downloaded root.json is signed by
+// enough trusted keys, but not by enough of the root keys it declares itself
+// to meet its own root threshold.
+type ErrRootInconsistent struct {
+	Err error
+}
+
+func (e ErrRootInconsistent) Error() string {
+	return fmt.Sprintf("tuf: root.json is not signed by its own root keys: %s", e.Err)
+}
+
+func (e ErrRootInconsistent) Unwrap() error {
+	return e.Err
+}
+
 type ErrNotFound struct {
 	File string
 }
@@ -52,9 +208,109 @@ func (e ErrNotFound) Error() string {
 	return fmt.Sprintf("tuf: file not found: %s", e.File)
 }
 
+// IsNotFound reports whether err is or wraps an ErrNotFound. An
+// ErrMirrorsFailed is not, even if some of the mirrors did not have the file,
+// as MultiRemoteStore returns ErrNotFound if none of them did.
 func IsNotFound(err error) bool {
-	_, ok := err.(ErrNotFound)
-	return ok
+	var e ErrNotFound
+	var mirrors ErrMirrorsFailed
+	return errors.As(err, &e) && !errors.As(err, &mirrors)
+}
+
+// ErrNotModified is returned by a RemoteStore when a conditional request
+// finds that the given file has not changed since it was last downloaded
+// (see HTTPRemoteStore).
+type ErrNotModified struct {
+	File string
+}
+
+func (e ErrNotModified) Error() string {
+	return fmt.Sprintf("tuf: file not modified: %s", e.File)
+}
+
+// IsNotModified reports whether err is, or wraps, an ErrNotModified.
+func IsNotModified(err error) bool {
+	var e ErrNotModified
+	return errors.As(err, &e)
+}
+
+// ErrRangeNotSupported is returned by a RangeRemoteStore when it cannot
+// serve the given file from the requested offset, in which case Download
+// restarts the download from the beginning.
+type ErrRangeNotSupported struct {
+	File string
+}
+
+func (e ErrRangeNotSupported) Error() string {
+	return fmt.Sprintf("tuf: range requests not supported for file: %s", e.File)
+}
+
+// IsRangeNotSupported reports whether err is, or wraps, an
+// ErrRangeNotSupported.
+func IsRangeNotSupported(err error) bool {
+	var e ErrRangeNotSupported
+	return errors.As(err, &e)
+}
+
+// ErrTooManyRootRotations is returned when updating would advance the trusted
+// root from version Current to Latest, which is more than the Max allowed by
+// WithMaxRootRotations.
+type ErrTooManyRootRotations struct {
+	Current int
+	Latest  int
+	Max     int
+}
+
+func (e ErrTooManyRootRotations) Error() string {
+	return fmt.Sprintf("tuf: root version %d is more than %d versions ahead of trusted version %d", e.Latest, e.Max, e.Current)
+}
+
+// ErrRootBelowMinimum is returned when a root.json has version Got, which is
+// lower than the Min set with WithMinRootVersion.
+type ErrRootBelowMinimum struct {
+	Got int
+	Min int
+}
+
+func (e ErrRootBelowMinimum) Error() string {
+	return fmt.Sprintf("tuf: root version %d is below the minimum trusted version %d", e.Got, e.Min)
+}
+
+// ErrTooManyTargets is returned when a downloaded targets.json lists Count
+// targets, which is more than the Limit set with WithMaxTargets.
+type ErrTooManyTargets struct {
+	Count int
+	Limit int
+}
+
+func (e ErrTooManyTargets) Error() string {
+	return fmt.Sprintf("tuf: targets.json lists %d targets, more than the limit of %d", e.Count, e.Limit)
+}
+
+// ErrTargetValidation is returned when the function set with
+// SetTargetValidator rejects the custom metadata of an updated target.
+type ErrTargetValidation struct {
+	Name string
+	Err  error
+}
+
+func (e ErrTargetValidation) Error() string {
+	return fmt.Sprintf("tuf: target %s failed validation: %s", e.Name, e.Err)
+}
+
+func (e ErrTargetValidation) Unwrap() error {
+	return e.Err
+}
+
+// ErrInvalidArchive is returned by ArchiveRemoteStore when a file in the
+// archive is missing or does not match the archive's manifest.
+type ErrInvalidArchive struct {
+	File string
+	Err  error
+}
+
+func (e ErrInvalidArchive) Error() string {
+	return fmt.Sprintf("tuf: invalid archive file %s: %s", e.File, e.Err)
 }
 
 type ErrWrongSize struct {
@@ -76,8 +332,23 @@ func (e ErrLatestSnapshot) Error() string {
 }
 
 func IsLatestSnapshot(err error) bool {
-	_, ok := err.(ErrLatestSnapshot)
-	return ok
+	var e ErrLatestSnapshot
+	return errors.As(err, &e)
+}
+
+// ErrNotStale is returned by UpdateIfStale when the last successful update
+// is recent enough that no update was attempted.
+type ErrNotStale struct {
+	LastUpdate time.Time
+}
+
+func (e ErrNotStale) Error() string {
+	return fmt.Sprintf("tuf: the last update at %s is not stale", e.LastUpdate)
+}
+
+func IsNotStale(err error) bool {
+	var e ErrNotStale
+	return errors.As(err, &e)
 }
 
 type ErrUnknownTarget struct {
@@ -88,13 +359,64 @@ func (e ErrUnknownTarget) Error() string {
 	return fmt.Sprintf("tuf: unknown target file: %s", e.Name)
 }
 
+// ErrForbiddenTargetPath is returned when downloading or verifying a target
+// whose name could escape a local directory, or is not allowed by
+// WithTargetPathAllowlist.
+type ErrForbiddenTargetPath struct {
+	Name string
+}
+
+func (e ErrForbiddenTargetPath) Error() string {
+	return fmt.Sprintf("tuf: forbidden target path: %s", e.Name)
+}
+
+// ErrBatchDownload maps the names of targets which failed to download in a
+// call to DownloadBatch to the error that occurred.
+type ErrBatchDownload map[string]error
+
+func (e ErrBatchDownload) Error() string {
+	names := make([]string, 0, len(e))
+	for name := range e {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	errs := make([]string, len(names))
+	for i, name := range names {
+		errs[i] = fmt.Sprintf("%s: %s", name, e[name])
+	}
+	return fmt.Sprintf("tuf: failed to download %d targets: %s", len(e), strings.Join(errs, "; "))
+}
+
+// Unwrap returns the errors in order of target name.
+func (e ErrBatchDownload) Unwrap() []error {
+	names := make([]string, 0, len(e))
+	for name := range e {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	errs := make([]error, len(names))
+	for i, name := range names {
+		errs[i] = e[name]
+	}
+	return errs
+}
+
 type ErrMetaTooLarge struct {
 	Name string
 	Size int64
+	Max  int64
 }
 
 func (e ErrMetaTooLarge) Error() string {
-	return fmt.Sprintf("tuf: %s size %d bytes greater than maximum %d bytes", e.Name, e.Size, maxMetaSize)
+	return fmt.Sprintf("tuf: %s size %d bytes greater than maximum %d bytes", e.Name, e.Size, e.Max)
+}
+
+type ErrInvalidMaxMetaSize struct {
+	Size int64
+}
+
+func (e ErrInvalidMaxMetaSize) Error() string {
+	return fmt.Sprintf("tuf: invalid maximum metadata size %d bytes", e.Size)
 }
 
 type ErrInvalidURL struct {
@@ -104,3 +426,82 @@ type ErrInvalidURL struct {
 func (e ErrInvalidURL) Error() string {
 	return fmt.Sprintf("tuf: invalid repository URL %s", e.URL)
 }
+
+// IsSecurityError returns whether err, or any error it wraps, indicates that
+// metadata or a target failed verification, for example because of a wrong
+// hash or length, too few valid signatures, expired metadata or a rollback.
+// Such errors may indicate an attack, and retrying will not help.
+func IsSecurityError(err error) bool {
+	if errors.Is(err, util.ErrWrongLength) ||
+		errors.Is(err, verify.ErrInvalid) ||
+		errors.Is(err, verify.ErrNoSignatures) ||
+		errors.Is(err, verify.ErrRoleThreshold) ||
+		errors.Is(err, verify.ErrWrongMethod) ||
+		errors.Is(err, verify.ErrUnknownSignatureMethod) ||
+		errors.Is(err, verify.ErrWrongMetaType) {
+		return true
+	}
+	var (
+		wrongHash        util.ErrWrongHash
+		noCommonHash     util.ErrNoCommonHash
+		expired          verify.ErrExpired
+		lowVersion       verify.ErrLowVersion
+		rollback         ErrRollback
+		rootVerification ErrRootVerification
+		rootInconsistent ErrRootInconsistent
+		rootRotations    ErrTooManyRootRotations
+		rootBelowMinimum ErrRootBelowMinimum
+		wrongSize        ErrWrongSize
+		metaTooLarge     ErrMetaTooLarge
+		forbiddenPath    ErrForbiddenTargetPath
+	)
+	return errors.As(err, &wrongHash) ||
+		errors.As(err, &noCommonHash) ||
+		errors.As(err, &expired) ||
+		errors.As(err, &lowVersion) ||
+		errors.As(err, &rollback) ||
+		errors.As(err, &rootVerification) ||
+		errors.As(err, &rootInconsistent) ||
+		errors.As(err, &rootRotations) ||
+		errors.As(err, &rootBelowMinimum) ||
+		errors.As(err, &wrongSize) ||
+		errors.As(err, &metaTooLarge) ||
+		errors.As(err, &forbiddenPath)
+}
+
+// IsRetriable returns whether err, or any error it wraps, is a network or
+// I/O error (e.g. a failed connection, a timeout or a truncated transfer)
+// which may not happen if the operation is retried. Security errors (see
+// IsSecurityError) are never retriable, even when one mirror failed with a
+// security error and another with a network error. Neither are TLS
+// certificate errors, which need the client or server to be reconfigured.
+func IsRetriable(err error) bool {
+	if err == nil || IsSecurityError(err) || isCertificateError(err) {
+		return false
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, context.DeadlineExceeded)
+}
+
+// isCertificateError returns whether err, or any error it wraps, is a TLS
+// handshake error caused by a certificate being rejected by either side.
+// Rejections by the server are reported by crypto/tls as a *net.OpError with
+// Op "remote error" wrapping the TLS alert sent by the server, and rejections
+// of the server's certificate as the x509 verification error (wrapped in a
+// *tls.CertificateVerificationError by newer versions of crypto/tls).
+func isCertificateError(err error) bool {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "remote error" {
+		return true
+	}
+	var (
+		unknownAuth x509.UnknownAuthorityError
+		hostname    x509.HostnameError
+		invalid     x509.CertificateInvalidError
+	)
+	return errors.As(err, &unknownAuth) ||
+		errors.As(err, &hostname) ||
+		errors.As(err, &invalid)
+}
@@ -2,36 +2,70 @@ package client
 
 import (
 	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/boltdb/bolt"
+	"github.com/flynn/go-tuf/verify"
 )
 
 func MemoryLocalStore() LocalStore {
-	return make(memoryLocalStore)
+	return &memoryLocalStore{
+		meta:  make(map[string]json.RawMessage),
+		state: make(map[string]json.RawMessage),
+	}
+}
+
+type memoryLocalStore struct {
+	meta  map[string]json.RawMessage
+	state map[string]json.RawMessage
 }
 
-type memoryLocalStore map[string]json.RawMessage
+func (m *memoryLocalStore) GetMeta() (map[string]json.RawMessage, error) {
+	return m.meta, nil
+}
 
-func (m memoryLocalStore) GetMeta() (map[string]json.RawMessage, error) {
-	return m, nil
+func (m *memoryLocalStore) SetMeta(name string, meta json.RawMessage) error {
+	m.meta[name] = meta
+	return nil
 }
 
-func (m memoryLocalStore) SetMeta(name string, meta json.RawMessage) error {
-	m[name] = meta
+func (m *memoryLocalStore) DeleteMeta(name string) error {
+	delete(m.meta, name)
+	return nil
+}
+
+func (m *memoryLocalStore) GetState() (map[string]json.RawMessage, error) {
+	return m.state, nil
+}
+
+func (m *memoryLocalStore) SetState(name string, state json.RawMessage) error {
+	m.state[name] = state
 	return nil
 }
 
 const dbBucket = "tuf-client"
 
+// dbStateBucket is the bucket holding the client state, which is kept apart
+// from the metadata in dbBucket.
+const dbStateBucket = "tuf-client-state"
+
 func FileLocalStore(path string) (LocalStore, error) {
 	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
 	if err != nil {
 		return nil, err
 	}
 	if err := db.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists([]byte(dbBucket))
-		return err
+		for _, name := range []string{dbBucket, dbStateBucket} {
+			if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+				return err
+			}
+		}
+		return nil
 	}); err != nil {
 		return nil, err
 	}
@@ -43,25 +77,175 @@ type fileLocalStore struct {
 }
 
 func (f *fileLocalStore) GetMeta() (map[string]json.RawMessage, error) {
-	meta := make(map[string]json.RawMessage)
-	if err := f.db.View(func(tx *bolt.Tx) error {
+	return f.getAll(dbBucket)
+}
+
+func (f *fileLocalStore) SetMeta(name string, meta json.RawMessage) error {
+	return f.put(dbBucket, name, meta)
+}
+
+func (f *fileLocalStore) DeleteMeta(name string) error {
+	return f.db.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(dbBucket))
+		return b.Delete([]byte(name))
+	})
+}
+
+func (f *fileLocalStore) GetState() (map[string]json.RawMessage, error) {
+	return f.getAll(dbStateBucket)
+}
+
+func (f *fileLocalStore) SetState(name string, state json.RawMessage) error {
+	return f.put(dbStateBucket, name, state)
+}
+
+func (f *fileLocalStore) getAll(bucket string) (map[string]json.RawMessage, error) {
+	values := make(map[string]json.RawMessage)
+	if err := f.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
 		b.ForEach(func(k, v []byte) error {
 			vcopy := make([]byte, len(v))
 			copy(vcopy, v)
-			meta[string(k)] = vcopy
+			values[string(k)] = vcopy
 			return nil
 		})
 		return nil
 	}); err != nil {
 		return nil, err
 	}
-	return meta, nil
+	return values, nil
 }
 
-func (f *fileLocalStore) SetMeta(name string, meta json.RawMessage) error {
+func (f *fileLocalStore) put(bucket, name string, value json.RawMessage) error {
 	return f.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(dbBucket))
-		return b.Put([]byte(name), meta)
+		b := tx.Bucket([]byte(bucket))
+		return b.Put([]byte(name), value)
 	})
 }
+
+// DirLocalStore returns a LocalStore which persists each top-level metadata
+// file as ROLE.json in dir, creating dir if it does not exist. The client
+// state (see StateLocalStore) is persisted in dir/state.
+func DirLocalStore(dir string) (LocalStore, error) {
+	fi, err := os.Stat(dir)
+	if err == nil && !fi.IsDir() {
+		return nil, fmt.Errorf("tuf: local store path %s is not a directory", dir)
+	} else if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &dirLocalStore{dir: dir}, nil
+}
+
+type dirLocalStore struct {
+	dir string
+}
+
+func (d *dirLocalStore) GetMeta() (map[string]json.RawMessage, error) {
+	paths, err := filepath.Glob(filepath.Join(d.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	meta := make(map[string]json.RawMessage, len(paths))
+	for _, path := range paths {
+		name := filepath.Base(path)
+		if !isTopLevelMeta(name) {
+			continue
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		meta[name] = b
+	}
+	return meta, nil
+}
+
+// SetMeta writes meta to a temporary file in the store directory, syncs it
+// and then renames it into place so readers never observe a partially
+// written file, even after a crash.
+func (d *dirLocalStore) SetMeta(name string, meta json.RawMessage) error {
+	if !isTopLevelMeta(name) {
+		return fmt.Errorf("tuf: invalid top-level metadata name %s", name)
+	}
+	return writeFileSync(d.dir, name, meta)
+}
+
+// writeFileSync atomically writes b to the given file in dir as described in
+// SetMeta.
+func writeFileSync(dir, name string, b []byte) error {
+	tmp, err := ioutil.TempFile(dir, name)
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(dir, name)); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+func (d *dirLocalStore) DeleteMeta(name string) error {
+	if !isTopLevelMeta(name) {
+		return fmt.Errorf("tuf: invalid top-level metadata name %s", name)
+	}
+	err := os.Remove(filepath.Join(d.dir, name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// GetState reads the client state from the state subdirectory of the store
+// directory, which keeps it apart from the metadata.
+func (d *dirLocalStore) GetState() (map[string]json.RawMessage, error) {
+	paths, err := filepath.Glob(filepath.Join(d.stateDir(), "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	state := make(map[string]json.RawMessage, len(paths))
+	for _, path := range paths {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		state[filepath.Base(path)] = b
+	}
+	return state, nil
+}
+
+func (d *dirLocalStore) SetState(name string, state json.RawMessage) error {
+	if filepath.Base(name) != name || !strings.HasSuffix(name, ".json") {
+		return fmt.Errorf("tuf: invalid client state name %s", name)
+	}
+	if err := os.MkdirAll(d.stateDir(), 0700); err != nil {
+		return err
+	}
+	return writeFileSync(d.stateDir(), name, state)
+}
+
+func (d *dirLocalStore) stateDir() string {
+	return filepath.Join(d.dir, "state")
+}
+
+// isTopLevelMeta checks whether name has the form ROLE.json with ROLE being
+// a valid top-level role.
+func isTopLevelMeta(name string) bool {
+	return strings.HasSuffix(name, ".json") && verify.ValidRole(strings.TrimSuffix(name, ".json"))
+}
@@ -2,6 +2,7 @@ package client
 
 import (
 	"encoding/json"
+	"io/ioutil"
 	"path/filepath"
 
 	. "gopkg.in/check.v1"
@@ -43,4 +44,77 @@ func (LocalStoreSuite) TestFileLocalStore(c *C) {
 	store, err = FileLocalStore(path)
 	c.Assert(err, IsNil)
 	assertGet(meta{"root.json": rootJSON, "targets.json": targetsJSON})
+
+	// DeleteMeta should remove meta
+	c.Assert(store.DeleteMeta("targets.json"), IsNil)
+	assertGet(meta{"root.json": rootJSON})
+	c.Assert(store.DeleteMeta("targets.json"), IsNil)
+
+	// client state should persist apart from the meta
+	stateJSON := []byte(`{"version":2}`)
+	c.Assert(store.(StateLocalStore).SetState("min-root-version.json", stateJSON), IsNil)
+	assertGet(meta{"root.json": rootJSON})
+	c.Assert(store.(*fileLocalStore).db.Close(), IsNil)
+	store, err = FileLocalStore(path)
+	c.Assert(err, IsNil)
+	state, err := store.(StateLocalStore).GetState()
+	c.Assert(err, IsNil)
+	c.Assert(meta(state), DeepEquals, meta{"min-root-version.json": stateJSON})
+}
+
+func (LocalStoreSuite) TestDirLocalStore(c *C) {
+	dir := filepath.Join(c.MkDir(), "meta")
+	store, err := DirLocalStore(dir)
+	c.Assert(err, IsNil)
+
+	type meta map[string]json.RawMessage
+
+	assertGet := func(expected meta) {
+		actual, err := store.GetMeta()
+		c.Assert(err, IsNil)
+		c.Assert(meta(actual), DeepEquals, expected)
+	}
+
+	// initial GetMeta should return empty meta
+	assertGet(meta{})
+
+	// SetMeta should persist
+	rootJSON := []byte(`{"_type":"Root"}`)
+	c.Assert(store.SetMeta("root.json", rootJSON), IsNil)
+	assertGet(meta{"root.json": rootJSON})
+
+	// SetMeta should overwrite existing meta
+	rootJSON = []byte(`{"_type":"Root","version":2}`)
+	c.Assert(store.SetMeta("root.json", rootJSON), IsNil)
+	assertGet(meta{"root.json": rootJSON})
+
+	// non-role json files should be ignored
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "foo.json"), []byte("{}"), 0600), IsNil)
+	assertGet(meta{"root.json": rootJSON})
+	c.Assert(store.SetMeta("foo.json", []byte("{}")), NotNil)
+
+	// a new store should get the same meta
+	store, err = DirLocalStore(dir)
+	c.Assert(err, IsNil)
+	assertGet(meta{"root.json": rootJSON})
+
+	// a regular file is not a valid store directory
+	_, err = DirLocalStore(filepath.Join(dir, "root.json"))
+	c.Assert(err, NotNil)
+
+	// DeleteMeta should remove meta
+	c.Assert(store.DeleteMeta("root.json"), IsNil)
+	assertGet(meta{})
+	c.Assert(store.DeleteMeta("root.json"), IsNil)
+
+	// client state should persist apart from the meta
+	stateJSON := []byte(`{"version":2}`)
+	c.Assert(store.(StateLocalStore).SetState("min-root-version.json", stateJSON), IsNil)
+	c.Assert(store.(StateLocalStore).SetState("../root.json", stateJSON), NotNil)
+	assertGet(meta{})
+	store, err = DirLocalStore(dir)
+	c.Assert(err, IsNil)
+	state, err := store.(StateLocalStore).GetState()
+	c.Assert(err, IsNil)
+	c.Assert(meta(state), DeepEquals, meta{"min-root-version.json": stateJSON})
 }
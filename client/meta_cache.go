@@ -0,0 +1,68 @@
+package client
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// metaCache is a least recently used cache of metadata decoded from local
+// storage (see WithMetaCacheSize). Entries are keyed by the content hashes
+// of the metadata and of the root.json it was verified with, so an entry is
+// never used for metadata which has changed, and entries for old metadata
+// are evicted as newer entries are added.
+//
+// It is not safe for concurrent use, and is protected by Client.mtx.
+type metaCache struct {
+	size    int
+	entries map[string]*list.Element
+	order   *list.List // most recently used first
+}
+
+type metaCacheEntry struct {
+	key   string
+	value interface{}
+}
+
+func newMetaCache(size int) *metaCache {
+	return &metaCache{
+		size:    size,
+		entries: make(map[string]*list.Element, size),
+		order:   list.New(),
+	}
+}
+
+// metaHash returns the hex encoded SHA-256 hash of the given metadata.
+func metaHash(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// metaCacheKey returns the cache key of the given metadata for role, which
+// was verified using the root.json with the given hash.
+func metaCacheKey(rootHash, role string, b []byte) string {
+	return rootHash + ":" + role + ":" + metaHash(b)
+}
+
+func (m *metaCache) get(key string) (interface{}, bool) {
+	e, ok := m.entries[key]
+	if !ok {
+		return nil, false
+	}
+	m.order.MoveToFront(e)
+	return e.Value.(*metaCacheEntry).value, true
+}
+
+func (m *metaCache) add(key string, value interface{}) {
+	if e, ok := m.entries[key]; ok {
+		e.Value.(*metaCacheEntry).value = value
+		m.order.MoveToFront(e)
+		return
+	}
+	m.entries[key] = m.order.PushFront(&metaCacheEntry{key, value})
+	for m.order.Len() > m.size {
+		oldest := m.order.Back()
+		m.order.Remove(oldest)
+		delete(m.entries, oldest.Value.(*metaCacheEntry).key)
+	}
+}
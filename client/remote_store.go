@@ -1,21 +1,66 @@
 package client
 
 import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"net/url"
 	"path"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+
+	"github.com/flynn/go-tuf/data"
+	"github.com/flynn/go-tuf/util"
 )
 
+// HTTPRemoteOptions configures the store returned by HTTPRemoteStore.
+//
+// The Client, UserAgent, Header and RequestModifier options only change how
+// requests are made, for example to identify the client to the server or to
+// authenticate with a CDN. They have no effect on which metadata or targets
+// are trusted, as everything downloaded is verified as usual.
+//
+// To use mutual TLS, set Client to an *http.Client whose Transport presents
+// the client certificate, for example:
+//
+//	cert, err := tls.LoadX509KeyPair("client.crt", "client.key")
+//	...
+//	opts := &HTTPRemoteOptions{Client: &http.Client{
+//		Transport: &http.Transport{
+//			TLSClientConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+//		},
+//	}}
+//
+// Errors returned by the http.Client, such as a failed TLS handshake, are
+// wrapped rather than replaced, so errors.As can find the underlying error
+// in the error returned by Update or Download: an x509.UnknownAuthorityError
+// if the server certificate is not trusted, or a *net.OpError with Op
+// "remote error" if the server rejected the client certificate. Neither is
+// reported as retriable by IsRetriable.
 type HTTPRemoteOptions struct {
 	MetadataPath string
 	TargetsPath  string
 	UserAgent    string
 	Retries      *HTTPRemoteRetries
+
+	// Client is used to make requests, instead of http.DefaultClient.
+	Client *http.Client
+
+	// Header contains headers which are added to every request.
+	Header http.Header
+
+	// RequestModifier, if set, is called with every request just before
+	// it is sent, for example to add an authentication header which is
+	// different for each request.
+	RequestModifier func(*http.Request)
 }
 
 type HTTPRemoteRetries struct {
@@ -28,6 +73,18 @@ var DefaultHTTPRetries = &HTTPRemoteRetries{
 	Total: 10 * time.Second,
 }
 
+// HTTPRemoteStore returns a RemoteStore which downloads metadata and
+// targets over HTTP from the given base URL.
+//
+// The store remembers the ETag and Last-Modified headers of the last
+// timestamp.json it downloaded, and a Client which completed its previous
+// update asks the store to send them in If-None-Match and If-Modified-Since
+// headers. If the server responds with 304 Not Modified, the store returns
+// ErrNotModified and the update returns ErrLatestSnapshot without
+// downloading timestamp.json again. This only saves bandwidth when polling
+// for updates and is best-effort: servers are free to ignore the headers,
+// and the store should not be shared between clients, as each client
+// assumes the remembered headers match the timestamp.json it last trusted.
 func HTTPRemoteStore(baseURL string, opts *HTTPRemoteOptions) (RemoteStore, error) {
 	if !strings.HasPrefix(baseURL, "http") {
 		return nil, ErrInvalidURL{baseURL}
@@ -38,41 +95,99 @@ func HTTPRemoteStore(baseURL string, opts *HTTPRemoteOptions) (RemoteStore, erro
 	if opts.TargetsPath == "" {
 		opts.TargetsPath = "targets"
 	}
-	return &httpRemoteStore{baseURL, opts}, nil
+	return &httpRemoteStore{baseURL: baseURL, opts: opts}, nil
 }
 
 type httpRemoteStore struct {
 	baseURL string
 	opts    *HTTPRemoteOptions
+
+	// mtx protects the validators of the last timestamp.json downloaded,
+	// which are sent when a conditional request is made
+	mtx          sync.Mutex
+	etag         string
+	lastModified string
+}
+
+// conditionalKey is the context key set by withConditional.
+type conditionalKey struct{}
+
+// withConditional returns a context which asks an httpRemoteStore to make a
+// conditional request for timestamp.json, returning ErrNotModified if it has
+// not changed since it was last downloaded.
+func withConditional(ctx context.Context) context.Context {
+	return context.WithValue(ctx, conditionalKey{}, true)
 }
 
 func (h *httpRemoteStore) GetMeta(name string) (io.ReadCloser, int64, error) {
-	return h.get(path.Join(h.opts.MetadataPath, name))
+	return h.GetMetaContext(context.Background(), name)
 }
 
 func (h *httpRemoteStore) GetTarget(name string) (io.ReadCloser, int64, error) {
-	return h.get(path.Join(h.opts.TargetsPath, name))
+	return h.GetTargetContext(context.Background(), name)
+}
+
+func (h *httpRemoteStore) GetMetaContext(ctx context.Context, name string) (io.ReadCloser, int64, error) {
+	return h.get(ctx, path.Join(h.opts.MetadataPath, name), name == "timestamp.json", 0)
+}
+
+func (h *httpRemoteStore) GetTargetContext(ctx context.Context, name string) (io.ReadCloser, int64, error) {
+	return h.get(ctx, path.Join(h.opts.TargetsPath, name), false, 0)
 }
 
-func (h *httpRemoteStore) get(s string) (io.ReadCloser, int64, error) {
+// GetTargetRange makes a Range request for the given target, returning
+// ErrRangeNotSupported if the server does not respond with the requested
+// range.
+func (h *httpRemoteStore) GetTargetRange(ctx context.Context, name string, offset int64) (io.ReadCloser, int64, error) {
+	return h.get(ctx, path.Join(h.opts.TargetsPath, name), false, offset)
+}
+
+// get downloads the file at path s starting at the given offset, recording
+// the validators of the response if timestamp is true.
+func (h *httpRemoteStore) get(ctx context.Context, s string, timestamp bool, offset int64) (io.ReadCloser, int64, error) {
 	u := h.url(s)
 	req, err := http.NewRequest("GET", u, nil)
 	if err != nil {
 		return nil, 0, err
 	}
+	req = req.WithContext(ctx)
+	for key, values := range h.opts.Header {
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
 	if h.opts.UserAgent != "" {
 		req.Header.Set("User-Agent", h.opts.UserAgent)
 	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	if conditional, _ := ctx.Value(conditionalKey{}).(bool); timestamp && conditional {
+		h.mtx.Lock()
+		if h.etag != "" {
+			req.Header.Set("If-None-Match", h.etag)
+		}
+		if h.lastModified != "" {
+			req.Header.Set("If-Modified-Since", h.lastModified)
+		}
+		h.mtx.Unlock()
+	}
+	if h.opts.RequestModifier != nil {
+		h.opts.RequestModifier(req)
+	}
 	var res *http.Response
 	if r := h.opts.Retries; r != nil {
 		for start := time.Now(); time.Since(start) < r.Total; time.Sleep(r.Delay) {
-			res, err = http.DefaultClient.Do(req)
+			res, err = h.client().Do(req)
 			if err == nil && (res.StatusCode < 500 || res.StatusCode > 599) {
 				break
 			}
+			if ctx.Err() != nil {
+				break
+			}
 		}
 	} else {
-		res, err = http.DefaultClient.Do(req)
+		res, err = h.client().Do(req)
 	}
 	if err != nil {
 		return nil, 0, err
@@ -81,6 +196,18 @@ func (h *httpRemoteStore) get(s string) (io.ReadCloser, int64, error) {
 	if res.StatusCode == http.StatusNotFound {
 		res.Body.Close()
 		return nil, 0, ErrNotFound{s}
+	} else if res.StatusCode == http.StatusNotModified && timestamp {
+		res.Body.Close()
+		return nil, 0, ErrNotModified{s}
+	} else if offset > 0 {
+		// the server must return the range starting at offset, otherwise
+		// the download is restarted (e.g. a 200 response with the whole
+		// file if the server ignores the Range header)
+		prefix := fmt.Sprintf("bytes %d-", offset)
+		if res.StatusCode != http.StatusPartialContent || !strings.HasPrefix(res.Header.Get("Content-Range"), prefix) {
+			res.Body.Close()
+			return nil, 0, ErrRangeNotSupported{s}
+		}
 	} else if res.StatusCode != http.StatusOK {
 		res.Body.Close()
 		return nil, 0, &url.Error{
@@ -89,6 +216,12 @@ func (h *httpRemoteStore) get(s string) (io.ReadCloser, int64, error) {
 			Err: fmt.Errorf("unexpected HTTP status %d", res.StatusCode),
 		}
 	}
+	if timestamp {
+		h.mtx.Lock()
+		h.etag = res.Header.Get("ETag")
+		h.lastModified = res.Header.Get("Last-Modified")
+		h.mtx.Unlock()
+	}
 
 	size, err := strconv.ParseInt(res.Header.Get("Content-Length"), 10, 0)
 	if err != nil {
@@ -97,9 +230,233 @@ func (h *httpRemoteStore) get(s string) (io.ReadCloser, int64, error) {
 	return res.Body, size, nil
 }
 
+func (h *httpRemoteStore) client() *http.Client {
+	if h.opts.Client != nil {
+		return h.opts.Client
+	}
+	return http.DefaultClient
+}
+
 func (h *httpRemoteStore) url(path string) string {
 	if !strings.HasPrefix(path, "/") {
 		path = "/" + path
 	}
 	return h.baseURL + path
 }
+
+// MultiRemoteStore is a RemoteStore which downloads files from a list of
+// mirrors, trying each mirror in order until one of them returns the file.
+//
+// If every mirror fails, ErrNotFound is returned if none of the mirrors have
+// the file, otherwise an ErrMirrorsFailed containing the error returned by
+// each mirror.
+//
+// MultiRemoteStore implements MirroredRemoteStore, so a Client will also try
+// the next mirror if metadata served by one mirror fails verification.
+type MultiRemoteStore []RemoteStore
+
+// Mirrors returns the underlying mirrors in the order they are tried.
+func (m MultiRemoteStore) Mirrors() []RemoteStore {
+	return m
+}
+
+func (m MultiRemoteStore) GetMeta(name string) (io.ReadCloser, int64, error) {
+	return m.GetMetaContext(context.Background(), name)
+}
+
+func (m MultiRemoteStore) GetTarget(path string) (io.ReadCloser, int64, error) {
+	return m.GetTargetContext(context.Background(), path)
+}
+
+func (m MultiRemoteStore) GetMetaContext(ctx context.Context, name string) (io.ReadCloser, int64, error) {
+	return m.get(ctx, name, func(remote RemoteStore) (io.ReadCloser, int64, error) {
+		if remote, ok := remote.(ContextRemoteStore); ok {
+			return remote.GetMetaContext(ctx, name)
+		}
+		return remote.GetMeta(name)
+	})
+}
+
+func (m MultiRemoteStore) GetTargetContext(ctx context.Context, path string) (io.ReadCloser, int64, error) {
+	return m.get(ctx, path, func(remote RemoteStore) (io.ReadCloser, int64, error) {
+		if remote, ok := remote.(ContextRemoteStore); ok {
+			return remote.GetTargetContext(ctx, path)
+		}
+		return remote.GetTarget(path)
+	})
+}
+
+func (m MultiRemoteStore) get(ctx context.Context, name string, get func(RemoteStore) (io.ReadCloser, int64, error)) (io.ReadCloser, int64, error) {
+	errs := make([]error, 0, len(m))
+	notFound := true
+	for _, remote := range m {
+		r, size, err := get(remote)
+		if err == nil {
+			return r, size, nil
+		}
+		if ctx.Err() != nil {
+			return nil, 0, ctx.Err()
+		}
+		if !IsNotFound(err) {
+			notFound = false
+		}
+		errs = append(errs, err)
+	}
+	if notFound {
+		return nil, 0, ErrNotFound{name}
+	}
+	return nil, 0, ErrMirrorsFailed{errs}
+}
+
+// MemoryRemoteStore is a RemoteStore which serves metadata and targets from
+// memory, for use in tests or to embed a repository in a binary. It is safe
+// for concurrent use.
+type MemoryRemoteStore struct {
+	mtx     sync.RWMutex
+	meta    map[string][]byte
+	targets map[string][]byte
+}
+
+// NewMemoryRemoteStore returns an empty MemoryRemoteStore.
+func NewMemoryRemoteStore() *MemoryRemoteStore {
+	return &MemoryRemoteStore{
+		meta:    make(map[string][]byte),
+		targets: make(map[string][]byte),
+	}
+}
+
+// SetMeta sets the data served for the given metadata (e.g. "root.json").
+// The data must not be modified afterwards.
+func (m *MemoryRemoteStore) SetMeta(name string, b []byte) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.meta[name] = b
+}
+
+// SetTarget sets the data served for the given target path (e.g.
+// "/foo.txt", which is normalized as target paths are by Download). The
+// data must not be modified afterwards.
+func (m *MemoryRemoteStore) SetTarget(path string, b []byte) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.targets[util.NormalizeTarget(path)] = b
+}
+
+func (m *MemoryRemoteStore) GetMeta(name string) (io.ReadCloser, int64, error) {
+	return m.get(name, m.meta)
+}
+
+// GetTarget returns the given target, normalizing path as SetTarget does.
+func (m *MemoryRemoteStore) GetTarget(path string) (io.ReadCloser, int64, error) {
+	return m.get(util.NormalizeTarget(path), m.targets)
+}
+
+// GetTargetRange returns the given target starting at offset, returning
+// ErrRangeNotSupported if offset is beyond the end of the target. path is
+// normalized as it is by SetTarget.
+func (m *MemoryRemoteStore) GetTargetRange(ctx context.Context, path string, offset int64) (io.ReadCloser, int64, error) {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	b, ok := m.targets[util.NormalizeTarget(path)]
+	if !ok {
+		return nil, 0, ErrNotFound{path}
+	}
+	if offset > int64(len(b)) {
+		return nil, 0, ErrRangeNotSupported{path}
+	}
+	return ioutil.NopCloser(bytes.NewReader(b[offset:])), int64(len(b)) - offset, nil
+}
+
+func (m *MemoryRemoteStore) get(name string, files map[string][]byte) (io.ReadCloser, int64, error) {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	b, ok := files[name]
+	if !ok {
+		return nil, 0, ErrNotFound{name}
+	}
+	return ioutil.NopCloser(bytes.NewReader(b)), int64(len(b)), nil
+}
+
+// archiveManifest is the name of the manifest written by tuf.Repo.Export
+// (see tuf.ExportManifest).
+const archiveManifest = "manifest.json"
+
+// ArchiveRemoteStore returns a RemoteStore which serves metadata and target
+// files from a tar archive written by tuf.Repo.Export, so a client can be
+// updated and download targets without network access.
+//
+// The archive is read into memory and each file is checked against the
+// archive's manifest, returning an ErrInvalidArchive if the manifest is
+// missing or any file does not match it. The manifest is not signed, so
+// this only detects accidental corruption: as with any other RemoteStore,
+// metadata is verified by the client against its trusted root.json when
+// updating, and target files against the verified metadata when downloading.
+func ArchiveRemoteStore(r io.Reader) (RemoteStore, error) {
+	files := make(map[string][]byte)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			continue
+		}
+		b, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		files[path.Clean(hdr.Name)] = b
+	}
+
+	b, ok := files[archiveManifest]
+	if !ok {
+		return nil, ErrInvalidArchive{archiveManifest, ErrNotFound{archiveManifest}}
+	}
+	delete(files, archiveManifest)
+	var manifest data.Files
+	if err := json.Unmarshal(b, &manifest); err != nil {
+		return nil, ErrInvalidArchive{archiveManifest, err}
+	}
+	for name, b := range files {
+		expected, ok := manifest[name]
+		if !ok {
+			return nil, ErrInvalidArchive{name, errors.New("file not listed in manifest")}
+		}
+		actual, err := util.GenerateFileMeta(bytes.NewReader(b), expected.HashAlgorithms()...)
+		if err != nil {
+			return nil, ErrInvalidArchive{name, err}
+		}
+		if err := util.FileMetaEqual(actual, expected); err != nil {
+			return nil, ErrInvalidArchive{name, err}
+		}
+	}
+	for name := range manifest {
+		if _, ok := files[name]; !ok {
+			return nil, ErrInvalidArchive{name, ErrNotFound{name}}
+		}
+	}
+	return archiveRemoteStore(files), nil
+}
+
+type archiveRemoteStore map[string][]byte
+
+func (a archiveRemoteStore) GetMeta(name string) (io.ReadCloser, int64, error) {
+	b, ok := a[name]
+	if !ok {
+		return nil, 0, ErrNotFound{name}
+	}
+	return ioutil.NopCloser(bytes.NewReader(b)), int64(len(b)), nil
+}
+
+// GetTarget returns the target file at path under targets/ in the archive,
+// where HTTPRemoteStore would find it once the archive is unpacked.
+func (a archiveRemoteStore) GetTarget(p string) (io.ReadCloser, int64, error) {
+	b, ok := a[path.Join("targets", p)]
+	if !ok {
+		return nil, 0, ErrNotFound{p}
+	}
+	return ioutil.NopCloser(bytes.NewReader(b)), int64(len(b)), nil
+}
@@ -0,0 +1,153 @@
+package client
+
+import (
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/flynn/go-tuf/data"
+	"github.com/flynn/go-tuf/util"
+)
+
+// targetCache is a content addressed cache of downloaded target data in a
+// local directory (see WithTargetContentCache). Each entry is named after a
+// hash of its data, so targets with different names but the same content
+// share an entry.
+//
+// Entries are written to temporary files and renamed into place, so the
+// cache may be shared by concurrent downloads.
+type targetCache struct {
+	dir string
+}
+
+// path returns the path of the cache entry for a target with the given
+// meta (see targetCacheName).
+func (t *targetCache) path(meta data.FileMeta) (string, bool) {
+	name, ok := targetCacheName(meta)
+	if !ok {
+		return "", false
+	}
+	return filepath.Join(t.dir, name), true
+}
+
+// targetCacheName returns the name of the cache entry for a target with the
+// given meta, which is ALG-HASH with the target's sha256 hash if listed, and
+// otherwise its first hash in order of algorithm name.
+func targetCacheName(meta data.FileMeta) (string, bool) {
+	algs := meta.HashAlgorithms()
+	if len(algs) == 0 {
+		return "", false
+	}
+	sort.Strings(algs)
+	alg := algs[0]
+	if _, ok := meta.Hashes["sha256"]; ok {
+		alg = "sha256"
+	}
+	return alg + "-" + hex.EncodeToString(meta.Hashes[alg]), true
+}
+
+// isTargetCacheName returns whether name could be the name of a cache entry,
+// i.e. it is ALG-HASH where ALG is a registered hash algorithm and HASH a
+// lower case hex encoded hash of the algorithm's size.
+func isTargetCacheName(name string) bool {
+	i := strings.LastIndex(name, "-")
+	if i < 1 {
+		return false
+	}
+	alg, h := name[:i], name[i+1:]
+	w, err := util.NewFileMetaWriter(alg)
+	if err != nil {
+		return false
+	}
+	b, err := hex.DecodeString(h)
+	if err != nil || hex.EncodeToString(b) != h {
+		return false
+	}
+	return len(b) == len(w.FileMeta().Hashes[alg])
+}
+
+// open opens the cache entry for a target with the given meta, first
+// checking that the entry matches the length and all the hashes of meta.
+// Entries which do not match (e.g. as they are corrupt) are removed.
+func (t *targetCache) open(meta data.FileMeta) (*os.File, bool) {
+	path, ok := t.path(meta)
+	if !ok {
+		return nil, false
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, false
+	}
+	actual, err := util.GenerateFileMeta(io.LimitReader(f, meta.Length+1), meta.HashAlgorithms()...)
+	if err != nil || util.FileMetaEqual(actual, meta) != nil {
+		f.Close()
+		os.Remove(path)
+		return nil, false
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		return nil, false
+	}
+	return f, true
+}
+
+// create returns a writer which caches the data written to it as the entry
+// for a target with the given meta once commit is called, or nil if the
+// entry cannot be created.
+func (t *targetCache) create(meta data.FileMeta) *targetCacheWriter {
+	path, ok := t.path(meta)
+	if !ok {
+		return nil
+	}
+	if err := os.MkdirAll(t.dir, 0755); err != nil {
+		return nil
+	}
+	tmp, err := ioutil.TempFile(t.dir, ".tmp-")
+	if err != nil {
+		return nil
+	}
+	return &targetCacheWriter{tmp: tmp, path: path}
+}
+
+// targetCacheWriter writes a new entry to a targetCache. Errors writing the
+// entry are not returned by Write, so that they do not fail the download,
+// but prevent the entry from being committed.
+type targetCacheWriter struct {
+	tmp  *os.File
+	path string
+	err  error
+	done bool
+}
+
+func (w *targetCacheWriter) Write(p []byte) (int, error) {
+	if w.err == nil {
+		_, w.err = w.tmp.Write(p)
+	}
+	return len(p), nil
+}
+
+// commit adds the data written to the cache, which must have been verified.
+func (w *targetCacheWriter) commit() {
+	w.done = true
+	err := w.tmp.Close()
+	if w.err == nil && err == nil {
+		err = os.Rename(w.tmp.Name(), w.path)
+	}
+	if w.err != nil || err != nil {
+		os.Remove(w.tmp.Name())
+	}
+}
+
+// abort discards the data written, unless it has been committed.
+func (w *targetCacheWriter) abort() {
+	if w.done {
+		return
+	}
+	w.done = true
+	w.tmp.Close()
+	os.Remove(w.tmp.Name())
+}
@@ -0,0 +1,55 @@
+package client
+
+import (
+	"encoding/json"
+	"io"
+
+	"github.com/flynn/go-tuf/data"
+)
+
+// Verifier reads and verifies targets using trusted metadata in local
+// storage, for example metadata embedded in a binary. Unlike a Client, it
+// has no remote storage, so the metadata is never updated and targets are
+// never downloaded.
+//
+// The local metadata is verified as it is by a Client, so root.json must not
+// have expired.
+type Verifier struct {
+	c *Client
+}
+
+// NewVerifier returns a Verifier which uses the metadata in local. Only
+// options which affect verification (e.g. WithClock and WithMinRootVersion)
+// have any effect.
+func NewVerifier(local LocalStore, opts ...ClientOption) *Verifier {
+	return &Verifier{c: NewClient(local, nil, opts...)}
+}
+
+// Targets returns the complete list of targets (see Client.Targets).
+func (v *Verifier) Targets() (data.Files, error) {
+	return v.c.Targets()
+}
+
+// TargetCustom returns the custom metadata of the given target (see
+// Client.TargetCustom).
+func (v *Verifier) TargetCustom(name string) (json.RawMessage, error) {
+	return v.c.TargetCustom(name)
+}
+
+// TargetMeta returns the metadata of the given target (see
+// Client.TargetMeta).
+func (v *Verifier) TargetMeta(name string) (data.FileMeta, error) {
+	return v.c.TargetMeta(name)
+}
+
+// VerifyTarget verifies that the data read from r matches the length and
+// hashes of the given target (see Client.VerifyTarget).
+func (v *Verifier) VerifyTarget(name string, r io.Reader) error {
+	return v.c.VerifyTarget(name, r)
+}
+
+// SetVerifyProgress sets a function to be called periodically as data is
+// read by VerifyTarget (see Client.SetDownloadProgress).
+func (v *Verifier) SetVerifyProgress(f DownloadProgressFunc) {
+	v.c.SetDownloadProgress(f)
+}
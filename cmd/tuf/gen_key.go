@@ -5,11 +5,12 @@ import (
 
 	"github.com/flynn/go-docopt"
 	"github.com/flynn/go-tuf"
+	"github.com/flynn/go-tuf/data"
 )
 
 func init() {
 	register("gen-key", cmdGenKey, `
-usage: tuf gen-key [--expires=<days>] <role>
+usage: tuf gen-key [--expires=<days>] [--type=<type>] <role>
 
 Generate a new signing key for the given role.
 
@@ -19,11 +20,14 @@ with the addition of the key's ID to the role's list of key IDs.
 
 Options:
   --expires=<days>   Set the root manifest to expire <days> days from now.
+  --type=<type>      Set the key type, either "ed25519" or "ecdsa-sha2-nistp256"
+                     [default: ed25519].
 `)
 }
 
 func cmdGenKey(args *docopt.Args, repo *tuf.Repo) error {
 	role := args.String["<role>"]
+	keyType := data.KeyType(args.String["--type"])
 	var id string
 	var err error
 	if arg := args.String["--expires"]; arg != "" {
@@ -31,9 +35,9 @@ func cmdGenKey(args *docopt.Args, repo *tuf.Repo) error {
 		if err != nil {
 			return err
 		}
-		id, err = repo.GenKeyWithExpires(role, expires)
+		id, err = repo.GenKeyWithTypeAndExpires(role, keyType, expires)
 	} else {
-		id, err = repo.GenKey(role)
+		id, err = repo.GenKeyWithType(role, keyType)
 	}
 	if err != nil {
 		return err
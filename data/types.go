@@ -16,6 +16,9 @@ const (
 	KeyTypeECDSA_SHA2_P256 = "ecdsa-sha2-nistp256"
 )
 
+// KeyType is the type of a key, as stored in Key.Type (e.g. KeyTypeEd25519).
+type KeyType string
+
 type Signed struct {
 	Signed     json.RawMessage `json:"signed"`
 	Signatures []Signature     `json:"signatures"`
@@ -108,9 +111,10 @@ func NewSnapshot() *Snapshot {
 type Hashes map[string]HexBytes
 
 type FileMeta struct {
-	Length int64            `json:"length"`
-	Hashes Hashes           `json:"hashes"`
-	Custom *json.RawMessage `json:"custom,omitempty"`
+	Length  int64            `json:"length"`
+	Hashes  Hashes           `json:"hashes"`
+	Version int              `json:"version,omitempty"`
+	Custom  *json.RawMessage `json:"custom,omitempty"`
 }
 
 func (f FileMeta) HashAlgorithms() []string {
@@ -141,6 +145,10 @@ type Timestamp struct {
 	Version int       `json:"version"`
 	Expires time.Time `json:"expires"`
 	Meta    Files     `json:"meta"`
+
+	// Custom is optional data from the publisher, such as a publish counter
+	// (see tuf.Repo.TimestampWithCustom)
+	Custom *json.RawMessage `json:"custom,omitempty"`
 }
 
 func NewTimestamp() *Timestamp {
@@ -37,6 +37,10 @@ const (
 	nameSecretBox = "nacl/secretbox"
 )
 
+// ErrDecryptionFailed is returned by Decrypt and Unmarshal if the ciphertext
+// cannot be decrypted, which typically indicates an incorrect passphrase.
+var ErrDecryptionFailed = errors.New("encrypted: decryption failed")
+
 type data struct {
 	KDF        scryptKDF       `json:"kdf"`
 	Cipher     secretBoxCipher `json:"cipher"`
@@ -143,7 +147,7 @@ func (s *secretBoxCipher) Decrypt(ciphertext, key []byte) ([]byte, error) {
 
 	res, ok := secretbox.Open(nil, ciphertext, &nonceBytes, &keyBytes)
 	if !ok {
-		return nil, errors.New("encrypted: decryption failed")
+		return nil, ErrDecryptionFailed
 	}
 	return res, nil
 }
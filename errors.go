@@ -9,6 +9,23 @@ import (
 var (
 	ErrInitNotAllowed = errors.New("tuf: repository already initialized")
 	ErrNewRepository  = errors.New("tuf: repository not yet committed")
+	ErrEmptyPattern   = errors.New("tuf: empty target pattern")
+
+	// ErrPassphraseStoreUnsupported is returned by ChangePassphrase when
+	// the local store does not implement PassphraseStore.
+	ErrPassphraseStoreUnsupported = errors.New("tuf: local store cannot change passphrases")
+
+	// ErrTargetStoreUnsupported is returned by AddTargetReader when the
+	// local store does not implement TargetStore.
+	ErrTargetStoreUnsupported = errors.New("tuf: local store cannot stage targets")
+
+	// ErrResetStoreUnsupported is returned by Reset when the local store
+	// does not implement ResetStore.
+	ErrResetStoreUnsupported = errors.New("tuf: local store cannot be reset")
+
+	// ErrKeyDeprecationStoreUnsupported is returned by DeprecateKey when
+	// the local store does not implement KeyDeprecationStore.
+	ErrKeyDeprecationStoreUnsupported = errors.New("tuf: local store cannot record key deprecations")
 )
 
 type ErrMissingMetadata struct {
@@ -44,6 +61,21 @@ func (e ErrInsufficientSignatures) Error() string {
 	return fmt.Sprintf("tuf: insufficient signatures for %s: %s", e.Name, e.Err)
 }
 
+// ErrWrongTarget is returned by Export when a staged or committed target
+// file does not match its length and hashes in targets.json.
+type ErrWrongTarget struct {
+	Path string
+	Err  error
+}
+
+func (e ErrWrongTarget) Error() string {
+	return fmt.Sprintf("tuf: target file %s does not match targets.json: %s", e.Path, e.Err)
+}
+
+func (e ErrWrongTarget) Unwrap() error {
+	return e.Err
+}
+
 type ErrInvalidRole struct {
 	Role string
 }
@@ -52,6 +84,18 @@ func (e ErrInvalidRole) Error() string {
 	return fmt.Sprintf("tuf: invalid role %s", e.Role)
 }
 
+// ErrInvalidVersion is returned by SetVersion when the given version is not
+// greater than the version of the role's current metadata.
+type ErrInvalidVersion struct {
+	Role    string
+	Version int
+	Current int
+}
+
+func (e ErrInvalidVersion) Error() string {
+	return fmt.Sprintf("tuf: invalid %s version %d, must be greater than current version %d", e.Role, e.Version, e.Current)
+}
+
 type ErrInvalidExpires struct {
 	Expires time.Time
 }
@@ -69,6 +113,16 @@ func (e ErrKeyNotFound) Error() string {
 	return fmt.Sprintf(`tuf: no key with id "%s" exists for the %s role`, e.KeyID, e.Role)
 }
 
+// ErrRoleHasKeys is returned by InitDefaultRoles when a role already has
+// keys.
+type ErrRoleHasKeys struct {
+	Role string
+}
+
+func (e ErrRoleHasKeys) Error() string {
+	return fmt.Sprintf("tuf: %s role already has keys", e.Role)
+}
+
 type ErrNotEnoughKeys struct {
 	Role      string
 	Keys      int
@@ -86,3 +140,59 @@ type ErrPassphraseRequired struct {
 func (e ErrPassphraseRequired) Error() string {
 	return fmt.Sprintf("tuf: a passphrase is required to access the encrypted %s keys file", e.Role)
 }
+
+type ErrWrongPassphrase struct {
+	Role string
+}
+
+func (e ErrWrongPassphrase) Error() string {
+	return fmt.Sprintf("tuf: incorrect passphrase for the encrypted %s keys file", e.Role)
+}
+
+type ErrKeysNotEncrypted struct {
+	Role string
+}
+
+func (e ErrKeysNotEncrypted) Error() string {
+	return fmt.Sprintf("tuf: the %s keys are not stored encrypted", e.Role)
+}
+
+// ErrKeyNotExportable is returned by ExportKeys when a stored signing key
+// does not expose its private key.
+type ErrKeyNotExportable struct {
+	Role  string
+	KeyID string
+}
+
+func (e ErrKeyNotExportable) Error() string {
+	return fmt.Sprintf(`tuf: the %s key with id "%s" cannot be exported`, e.Role, e.KeyID)
+}
+
+// ErrUnsupportedKeysVersion is returned by ImportKeys when the exported keys
+// have an unknown format version.
+type ErrUnsupportedKeysVersion struct {
+	Version int
+}
+
+func (e ErrUnsupportedKeysVersion) Error() string {
+	return fmt.Sprintf("tuf: unsupported exported keys version %d", e.Version)
+}
+
+// ErrUnknownTarget is returned when changing a target which is not listed
+// in targets.json.
+type ErrUnknownTarget struct {
+	Path string
+}
+
+func (e ErrUnknownTarget) Error() string {
+	return fmt.Sprintf("tuf: unknown target %s", e.Path)
+}
+
+type ErrInvalidTargetMeta struct {
+	Path   string
+	Reason string
+}
+
+func (e ErrInvalidTargetMeta) Error() string {
+	return fmt.Sprintf("tuf: invalid file meta for target %s: %s", e.Path, e.Reason)
+}
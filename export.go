@@ -0,0 +1,188 @@
+package tuf
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/flynn/go-tuf/data"
+	"github.com/flynn/go-tuf/util"
+)
+
+// ExportManifest is the name of the file in an exported archive which lists
+// the length and hashes of every other file in the archive. The manifest is
+// not signed, so it only detects accidental corruption of the archive: the
+// integrity of the metadata comes from verifying it against the trusted
+// root.json, as clients do when updating.
+const ExportManifest = "manifest.json"
+
+// Export writes the staged metadata and the target files it lists to w as a
+// tar archive, laid out as it would be served from the root of the remote
+// repository (i.e. the archive can be unpacked into a web root and used with
+// an HTTPRemoteStore, with target files under targets/), along with
+// ExportManifest. Compressed metadata listed in snapshot.json is included,
+// and if the repository uses consistent snapshots, hash-prefixed copies of
+// the metadata and target files are included as they are by Commit.
+//
+// Target files are read from the staged targets, or from the committed
+// targets if the local store is a CommittedTargetStore, and must match
+// targets.json. ErrFileNotFound is returned if a target file cannot be found.
+//
+// The metadata is verified as it would be by Commit before being written.
+// Private keys are never included. Every file in the archive has a
+// modification time derived from the version of timestamp.json, so the same
+// metadata always produces the same archive, while web servers which derive
+// ETag or Last-Modified headers from modification times still see
+// timestamp.json change.
+func (r *Repo) Export(w io.Writer) error {
+	root, err := r.verifyMeta()
+	if err != nil {
+		return err
+	}
+	hashes, err := r.fileHashes()
+	if err != nil {
+		return err
+	}
+	snapshot, err := r.snapshot()
+	if err != nil {
+		return err
+	}
+	timestamp, err := r.timestamp()
+	if err != nil {
+		return err
+	}
+	targets, err := r.targets()
+	if err != nil {
+		return err
+	}
+
+	names := append([]string{}, topLevelManifests...)
+	for _, name := range compressedManifests {
+		if _, ok := snapshot.Meta[name]; ok {
+			names = append(names, name)
+		}
+	}
+	files := make(map[string][]byte)
+	for _, name := range names {
+		b := r.meta[name]
+		files[name] = b
+		if root.ConsistentSnapshot && name != "timestamp.json" {
+			for _, path := range util.HashedPaths(name, hashes[name]) {
+				files[path] = b
+			}
+		}
+	}
+	manifest := make(data.Files, len(files))
+	for name, b := range files {
+		meta, err := util.GenerateFileMeta(bytes.NewReader(b), r.hashAlgorithms...)
+		if err != nil {
+			return err
+		}
+		manifest[name] = meta
+	}
+
+	// target files are read from the local store as the archive is written,
+	// so they are only listed here
+	targetFiles := make(map[string]string)
+	for target, meta := range targets.Targets {
+		p := path.Join("targets", target)
+		paths := []string{p}
+		if root.ConsistentSnapshot {
+			paths = util.HashedPaths(p, meta.Hashes)
+		}
+		for _, p := range paths {
+			targetFiles[p] = target
+			manifest[p] = data.FileMeta{Length: meta.Length, Hashes: meta.Hashes}
+		}
+	}
+
+	manifestJSON, err := json.MarshalIndent(manifest, "", "\t")
+	if err != nil {
+		return err
+	}
+	files[ExportManifest] = manifestJSON
+
+	names = make([]string, 0, len(files)+len(targetFiles))
+	for name := range files {
+		names = append(names, name)
+	}
+	for name := range targetFiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	modTime := time.Unix(int64(timestamp.Version), 0)
+	tw := tar.NewWriter(w)
+	for _, name := range names {
+		hdr := &tar.Header{
+			Name:    name,
+			Mode:    0644,
+			ModTime: modTime,
+		}
+		if target, ok := targetFiles[name]; ok {
+			meta := targets.Targets[target]
+			hdr.Size = meta.Length
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			if err := r.copyTarget(tw, target, meta); err != nil {
+				return err
+			}
+			continue
+		}
+		b := files[name]
+		hdr.Size = int64(len(b))
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write(b); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// copyTarget copies the staged or committed target file at path to w,
+// returning ErrWrongTarget if it does not match meta.
+func (r *Repo) copyTarget(w io.Writer, path string, meta data.FileMeta) error {
+	copyFile := func(rd io.Reader) error {
+		mw, err := util.NewFileMetaWriter(meta.HashAlgorithms()...)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(io.MultiWriter(w, mw), io.LimitReader(rd, meta.Length)); err != nil {
+			return err
+		}
+		if n, _ := io.CopyN(ioutil.Discard, rd, 1); n > 0 {
+			return ErrWrongTarget{path, util.ErrWrongLength}
+		}
+		if err := util.FileMetaEqual(mw.FileMeta(), meta); err != nil {
+			return ErrWrongTarget{path, err}
+		}
+		return nil
+	}
+
+	err := r.local.WalkStagedTargets([]string{path}, func(_ string, rd io.Reader) error {
+		return copyFile(rd)
+	})
+	var notFound ErrFileNotFound
+	if !errors.As(err, &notFound) {
+		return err
+	}
+	store, ok := r.local.(CommittedTargetStore)
+	if !ok {
+		return err
+	}
+	rd, err := store.GetCommittedTarget(path, meta.Hashes)
+	if err != nil {
+		return err
+	}
+	defer rd.Close()
+	return copyFile(rd)
+}
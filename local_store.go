@@ -7,6 +7,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 
 	"github.com/flynn/go-tuf/data"
@@ -27,9 +28,12 @@ func MemoryStore(meta map[string]json.RawMessage, files map[string][]byte) Local
 }
 
 type memoryStore struct {
-	meta    map[string]json.RawMessage
-	files   map[string][]byte
-	signers map[string][]sign.Signer
+	meta     map[string]json.RawMessage
+	files    map[string][]byte
+	signers  map[string][]sign.Signer
+	expiries map[string][]KeyExpiry
+
+	deprecations map[string][]KeyDeprecation
 }
 
 func (m *memoryStore) GetMeta() (map[string]json.RawMessage, error) {
@@ -41,6 +45,13 @@ func (m *memoryStore) SetMeta(name string, meta json.RawMessage) error {
 	return nil
 }
 
+func (m *memoryStore) SetMetaBatch(meta map[string]json.RawMessage) error {
+	for name, b := range meta {
+		m.meta[name] = b
+	}
+	return nil
+}
+
 func (m *memoryStore) WalkStagedTargets(paths []string, targetsFn targetsWalkFunc) error {
 	if len(paths) == 0 {
 		for path, data := range m.files {
@@ -63,6 +74,18 @@ func (m *memoryStore) WalkStagedTargets(paths []string, targetsFn targetsWalkFun
 	return nil
 }
 
+func (m *memoryStore) StageTarget(path string, r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if m.files == nil {
+		m.files = make(map[string][]byte)
+	}
+	m.files[path] = data
+	return nil
+}
+
 func (m *memoryStore) Commit(map[string]json.RawMessage, bool, map[string]data.Hashes) error {
 	return nil
 }
@@ -76,10 +99,51 @@ func (m *memoryStore) SavePrivateKey(role string, key *sign.PrivateKey) error {
 	return nil
 }
 
+func (m *memoryStore) SaveKeyExpiry(role string, expiry KeyExpiry) error {
+	if m.expiries == nil {
+		m.expiries = make(map[string][]KeyExpiry)
+	}
+	m.expiries[role] = append(m.expiries[role], expiry)
+	return nil
+}
+
+func (m *memoryStore) GetKeyExpiries() (map[string][]KeyExpiry, error) {
+	return m.expiries, nil
+}
+
+func (m *memoryStore) SetKeyDeprecations(deprecations map[string][]KeyDeprecation) error {
+	m.deprecations = deprecations
+	return nil
+}
+
+func (m *memoryStore) GetKeyDeprecations() (map[string][]KeyDeprecation, error) {
+	deprecations := make(map[string][]KeyDeprecation, len(m.deprecations))
+	for role, d := range m.deprecations {
+		deprecations[role] = d
+	}
+	return deprecations, nil
+}
+
+func (m *memoryStore) ChangePassphrase(role string, oldPass, newPass []byte) error {
+	return ErrKeysNotEncrypted{role}
+}
+
 func (m *memoryStore) Clean() error {
 	return nil
 }
 
+func (m *memoryStore) Reset(removeKeys bool) error {
+	for _, name := range append(topLevelManifests, compressedManifests...) {
+		delete(m.meta, name)
+	}
+	if removeKeys {
+		m.signers = make(map[string][]sign.Signer)
+		m.expiries = nil
+		m.deprecations = nil
+	}
+	return nil
+}
+
 type persistedKeys struct {
 	Encrypted bool            `json:"encrypted"`
 	Data      json.RawMessage `json:"data"`
@@ -116,7 +180,7 @@ func (f *fileSystemStore) GetMeta() (map[string]json.RawMessage, error) {
 		_, err := os.Stat(path)
 		return os.IsNotExist(err)
 	}
-	for _, name := range topLevelManifests {
+	for _, name := range append(topLevelManifests, compressedManifests...) {
 		path := filepath.Join(f.stagedDir(), name)
 		if notExists(path) {
 			path = filepath.Join(f.repoDir(), name)
@@ -142,6 +206,114 @@ func (f *fileSystemStore) SetMeta(name string, meta json.RawMessage) error {
 	return nil
 }
 
+// SetMetaBatch writes each file to a temporary file before renaming them all
+// into place. If renaming any of them fails, those already renamed are
+// restored from backups of the files they replaced, or removed if there were
+// none, so the staged metadata is left unchanged unless restoring it also
+// fails.
+func (f *fileSystemStore) SetMetaBatch(meta map[string]json.RawMessage) error {
+	if err := f.createDirs(); err != nil {
+		return err
+	}
+	tmpPaths := make(map[string]string, len(meta))
+	backups := make(map[string]string)
+	defer func() {
+		for _, path := range tmpPaths {
+			os.Remove(path)
+		}
+		for _, path := range backups {
+			os.Remove(path)
+		}
+	}()
+	names := make([]string, 0, len(meta))
+	for name, b := range meta {
+		names = append(names, name)
+		path, err := f.writeTempFile(name, b)
+		if err != nil {
+			return err
+		}
+		tmpPaths[name] = path
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		staged := filepath.Join(f.stagedDir(), name)
+		if info, err := os.Stat(staged); err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		b, err := ioutil.ReadFile(staged)
+		if err != nil {
+			return err
+		}
+		path, err := f.writeTempFile(name, b)
+		if err != nil {
+			return err
+		}
+		backups[name] = path
+	}
+	renamed := make([]string, 0, len(names))
+	for _, name := range names {
+		if err := os.Rename(tmpPaths[name], filepath.Join(f.stagedDir(), name)); err != nil {
+			for _, name := range renamed {
+				staged := filepath.Join(f.stagedDir(), name)
+				if backup, ok := backups[name]; ok {
+					os.Rename(backup, staged)
+				} else {
+					os.Remove(staged)
+				}
+			}
+			return err
+		}
+		delete(tmpPaths, name)
+		renamed = append(renamed, name)
+	}
+	return nil
+}
+
+// writeTempFile writes b to a new temporary file in the store's directory,
+// returning its path.
+func (f *fileSystemStore) writeTempFile(name string, b []byte) (string, error) {
+	return createTempFile(f.dir, name, bytes.NewReader(b))
+}
+
+// createTempFile copies r to a new temporary file in dir whose name starts
+// with prefix, returning its path. The file is removed if an error occurs.
+func createTempFile(dir, prefix string, r io.Reader) (string, error) {
+	tmp, err := ioutil.TempFile(dir, prefix)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return tmp.Name(), nil
+}
+
+// atomicWriteFile writes data to path by writing it to a temporary file in
+// the same directory and renaming it over path, so that path is left
+// untouched if an error occurs.
+func atomicWriteFile(path string, data []byte) error {
+	return atomicCopyFile(path, bytes.NewReader(data))
+}
+
+// atomicCopyFile is like atomicWriteFile but copies the data from r.
+func atomicCopyFile(path string, r io.Reader) error {
+	tmp, err := createTempFile(filepath.Dir(path), "."+filepath.Base(path), r)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
 func (f *fileSystemStore) createDirs() error {
 	for _, dir := range []string{"keys", "repository", "staged/targets"} {
 		if err := os.MkdirAll(filepath.Join(f.dir, dir), 0755); err != nil {
@@ -203,6 +375,33 @@ func (f *fileSystemStore) WalkStagedTargets(paths []string, targetsFn targetsWal
 	return nil
 }
 
+func (f *fileSystemStore) StageTarget(path string, r io.Reader) error {
+	dst := filepath.Join(f.stagedDir(), "targets", filepath.FromSlash(path))
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+
+	// write the file atomically so a failed read does not leave a partially
+	// staged target
+	return atomicCopyFile(dst, r)
+}
+
+// GetCommittedTarget returns the target file at path in the repository
+// directory, which only has hash-prefixed copies of target files if
+// consistent snapshots are in use.
+func (f *fileSystemStore) GetCommittedTarget(path string, hashes data.Hashes) (io.ReadCloser, error) {
+	rel := "targets" + util.NormalizeTarget(path)
+	for _, p := range append([]string{rel}, util.HashedPaths(rel, hashes)...) {
+		file, err := os.Open(filepath.Join(f.repoDir(), filepath.FromSlash(p)))
+		if err == nil {
+			return file, nil
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return nil, ErrFileNotFound{filepath.Join(f.repoDir(), filepath.FromSlash(rel))}
+}
+
 func (f *fileSystemStore) createRepoFile(path string) (*os.File, error) {
 	dst := filepath.Join(f.repoDir(), path)
 	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
@@ -357,6 +556,113 @@ func (f *fileSystemStore) SavePrivateKey(role string, key *sign.PrivateKey) erro
 	return nil
 }
 
+// SaveKeyExpiry records the expiry in keys/expiries.json, which is not
+// encrypted as it contains no key material, so that expiries can be read
+// without a passphrase.
+func (f *fileSystemStore) SaveKeyExpiry(role string, expiry KeyExpiry) error {
+	if err := f.createDirs(); err != nil {
+		return err
+	}
+	expiries, err := f.GetKeyExpiries()
+	if err != nil {
+		return err
+	}
+	expiries[role] = append(expiries[role], expiry)
+	data, err := json.MarshalIndent(expiries, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	// write the file atomically so existing expiries are not lost
+	return atomicWriteFile(f.keyExpiriesPath(), append(data, '\n'))
+}
+
+func (f *fileSystemStore) GetKeyExpiries() (map[string][]KeyExpiry, error) {
+	expiries := make(map[string][]KeyExpiry)
+	b, err := ioutil.ReadFile(f.keyExpiriesPath())
+	if os.IsNotExist(err) {
+		return expiries, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &expiries); err != nil {
+		return nil, err
+	}
+	return expiries, nil
+}
+
+func (f *fileSystemStore) keyExpiriesPath() string {
+	return filepath.Join(f.dir, "keys", "expiries.json")
+}
+
+// SetKeyDeprecations records the deprecations in keys/deprecations.json,
+// which like keys/expiries.json is not encrypted.
+func (f *fileSystemStore) SetKeyDeprecations(deprecations map[string][]KeyDeprecation) error {
+	if err := f.createDirs(); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(deprecations, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	// write the file atomically so existing deprecations are not lost
+	return atomicWriteFile(f.keyDeprecationsPath(), append(data, '\n'))
+}
+
+func (f *fileSystemStore) GetKeyDeprecations() (map[string][]KeyDeprecation, error) {
+	deprecations := make(map[string][]KeyDeprecation)
+	b, err := ioutil.ReadFile(f.keyDeprecationsPath())
+	if os.IsNotExist(err) {
+		return deprecations, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &deprecations); err != nil {
+		return nil, err
+	}
+	return deprecations, nil
+}
+
+func (f *fileSystemStore) keyDeprecationsPath() string {
+	return filepath.Join(f.dir, "keys", "deprecations.json")
+}
+
+// ChangePassphrase decrypts the keys file for the given role using oldPass
+// and atomically replaces it with the keys encrypted using newPass, leaving
+// the keys file untouched if any error occurs.
+func (f *fileSystemStore) ChangePassphrase(role string, oldPass, newPass []byte) error {
+	b, err := ioutil.ReadFile(f.keysPath(role))
+	if err != nil {
+		return err
+	}
+	pk := &persistedKeys{}
+	if err := json.Unmarshal(b, pk); err != nil {
+		return err
+	}
+	if !pk.Encrypted {
+		return ErrKeysNotEncrypted{role}
+	}
+
+	plaintext, err := encrypted.Decrypt(pk.Data, oldPass)
+	if err != nil {
+		if err == encrypted.ErrDecryptionFailed {
+			return ErrWrongPassphrase{role}
+		}
+		return err
+	}
+	pk.Data, err = encrypted.Encrypt(plaintext, newPass)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(pk, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	return atomicWriteFile(f.keysPath(role), append(data, '\n'))
+}
+
 func (f *fileSystemStore) privateKeySigners(keys []*sign.PrivateKey) []sign.Signer {
 	res := make([]sign.Signer, len(keys))
 	for i, k := range keys {
@@ -418,3 +724,27 @@ func (f *fileSystemStore) Clean() error {
 	}
 	return os.MkdirAll(filepath.Join(f.stagedDir(), "targets"), 0755)
 }
+
+// Reset removes the staged and committed metadata, including the hashed
+// copies committed with consistent snapshots.
+func (f *fileSystemStore) Reset(removeKeys bool) error {
+	for _, name := range append(topLevelManifests, compressedManifests...) {
+		paths, err := filepath.Glob(filepath.Join(f.repoDir(), "*."+name))
+		if err != nil {
+			return err
+		}
+		paths = append(paths, filepath.Join(f.stagedDir(), name), filepath.Join(f.repoDir(), name))
+		for _, path := range paths {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	if removeKeys {
+		if err := os.RemoveAll(filepath.Join(f.dir, "keys")); err != nil {
+			return err
+		}
+		f.signers = make(map[string][]sign.Signer)
+	}
+	return nil
+}
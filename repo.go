@@ -2,14 +2,17 @@ package tuf
 
 import (
 	"bytes"
+	"compress/gzip"
 	"encoding/json"
 	"fmt"
 	"io"
 	"path"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/flynn/go-tuf/data"
+	"github.com/flynn/go-tuf/encrypted"
 	"github.com/flynn/go-tuf/sign"
 	"github.com/flynn/go-tuf/util"
 	"github.com/flynn/go-tuf/verify"
@@ -35,6 +38,12 @@ var snapshotManifests = []string{
 	"targets.json",
 }
 
+// compressedManifests are the gzip compressed copies of metadata which are
+// generated and listed in snapshot.json by Snapshot(CompressionTypeGzip).
+var compressedManifests = []string{
+	"targets.json.gz",
+}
+
 type targetsWalkFunc func(path string, target io.Reader) error
 
 type LocalStore interface {
@@ -52,10 +61,138 @@ type LocalStore interface {
 	Clean() error
 }
 
+// PassphraseStore is a LocalStore which can change the passphrase its keys
+// are encrypted with.
+//
+// If the LocalStore passed to NewRepo implements PassphraseStore, it is used
+// by ChangePassphrase.
+type PassphraseStore interface {
+	LocalStore
+
+	// ChangePassphrase re-encrypts the keys for the given role, which are
+	// currently encrypted with oldPass, using newPass.
+	ChangePassphrase(role string, oldPass, newPass []byte) error
+}
+
+// BatchStore is a LocalStore which can write several metadata files at
+// once, writing either all of them or none of them.
+//
+// If the LocalStore passed to NewRepo implements BatchStore, it is used by
+// Commit to write metadata changes accumulated since Stage was called.
+type BatchStore interface {
+	LocalStore
+
+	SetMetaBatch(map[string]json.RawMessage) error
+}
+
+// KeyExpiry is the expiry time of a key, as recorded when it was generated
+// (see Repo.KeyExpiries).
+type KeyExpiry struct {
+	KeyID   string    `json:"keyid"`
+	Expires time.Time `json:"expires"`
+}
+
+// KeyExpiryStore is a LocalStore which records the expiry time of each
+// generated key alongside the key.
+//
+// If the LocalStore passed to NewRepo implements KeyExpiryStore, the expires
+// time passed to GenKeyWithExpires (or the default used by GenKey) is
+// recorded as the expiry of the generated key, and reported by KeyExpiries.
+type KeyExpiryStore interface {
+	LocalStore
+
+	// SaveKeyExpiry records the expiry time of the given key of role.
+	SaveKeyExpiry(role string, expiry KeyExpiry) error
+
+	// GetKeyExpiries returns the recorded key expiries of each role.
+	GetKeyExpiries() (map[string][]KeyExpiry, error)
+}
+
+// KeyDeprecation is a key which is being rotated out of a role, and is
+// removed from the role once GraceUntil has passed (see Repo.DeprecateKey).
+type KeyDeprecation struct {
+	KeyID      string    `json:"keyid"`
+	GraceUntil time.Time `json:"grace_until"`
+}
+
+// KeyDeprecationStore is a LocalStore which records the keys being rotated
+// out of each role. The deprecations are local to the repository, and are not
+// published in root.json.
+//
+// If the LocalStore passed to NewRepo implements KeyDeprecationStore, it is
+// used by DeprecateKey and RemoveDeprecatedKeys.
+type KeyDeprecationStore interface {
+	LocalStore
+
+	// SetKeyDeprecations replaces the recorded key deprecations of each
+	// role.
+	SetKeyDeprecations(map[string][]KeyDeprecation) error
+
+	// GetKeyDeprecations returns the recorded key deprecations of each
+	// role.
+	GetKeyDeprecations() (map[string][]KeyDeprecation, error)
+}
+
+// TargetStore is a LocalStore which can stage target files read from an
+// io.Reader, rather than only target files staged outside of the Repo.
+//
+// If the LocalStore passed to NewRepo implements TargetStore, it is used by
+// AddTargetReader to stage the target.
+type TargetStore interface {
+	LocalStore
+
+	// StageTarget stages the target at path with the data read from r,
+	// replacing any target already staged at path.
+	StageTarget(path string, r io.Reader) error
+}
+
+// ResetStore is a LocalStore which can delete its metadata, and optionally
+// its keys.
+//
+// If the LocalStore passed to NewRepo implements ResetStore, it is used by
+// Reset.
+type ResetStore interface {
+	LocalStore
+
+	// Reset deletes the staged and committed metadata, and also the signing
+	// keys (and their recorded expiries and deprecations) if removeKeys is
+	// true. Target files are not deleted.
+	Reset(removeKeys bool) error
+}
+
+// CommittedTargetStore is a LocalStore which can read the target files it
+// has committed.
+//
+// If the LocalStore passed to NewRepo implements CommittedTargetStore, it is
+// used by Export to include target files which are no longer staged.
+type CommittedTargetStore interface {
+	LocalStore
+
+	// GetCommittedTarget returns the committed target file at path, which
+	// has the given hashes, or ErrFileNotFound if it has not been committed.
+	GetCommittedTarget(path string, hashes data.Hashes) (io.ReadCloser, error)
+}
+
 type Repo struct {
 	local          LocalStore
 	hashAlgorithms []string
 	meta           map[string]json.RawMessage
+
+	// expiry is the expiry window for each role set with SetExpiry
+	expiry map[string]time.Duration
+
+	// nextVersion is the version of the next metadata staged for each role
+	// set with SetVersion
+	nextVersion map[string]int
+
+	// compression is the compression used by SnapshotDefault (see
+	// SetDefaultCompression)
+	compression CompressionType
+
+	// pending is the set of metadata changed but not yet written to the
+	// local store, and is nil unless changes are being staged in memory
+	// (see Stage)
+	pending map[string]struct{}
 }
 
 func NewRepo(local LocalStore, hashAlgorithms ...string) (*Repo, error) {
@@ -69,6 +206,112 @@ func NewRepo(local LocalStore, hashAlgorithms ...string) (*Repo, error) {
 	return r, nil
 }
 
+// NewRepoWithExpiry is like NewRepo but sets the expiry window of each role
+// in expiry as if by SetExpiry, so that a repository's expiration policy can
+// be set in one place. Roles not in expiry use their default window.
+func NewRepoWithExpiry(local LocalStore, expiry map[string]time.Duration, hashAlgorithms ...string) (*Repo, error) {
+	r, err := NewRepo(local, hashAlgorithms...)
+	if err != nil {
+		return nil, err
+	}
+	for role, d := range expiry {
+		if err := r.SetExpiry(role, d); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// Stage makes subsequent changes to metadata (e.g. by AddTarget, Snapshot
+// and Timestamp) accumulate in memory instead of each being written to the
+// local store immediately. Commit then writes all the changed metadata at
+// once, before committing it, so that a failure part way through a series
+// of changes does not leave inconsistent metadata in the local store.
+//
+// Changes are only written if the staged metadata passes the checks made by
+// Commit, and are kept in memory if writing them fails so that Commit can be
+// retried. A failed write leaves the local store unchanged if it is a
+// BatchStore. Otherwise the previous contents of the files already written
+// are restored, but files which did not exist before are left in place.
+//
+// The repo stays in this mode once Stage has been called. Keys are still
+// written to the local store immediately.
+func (r *Repo) Stage() {
+	if r.pending != nil {
+		return
+	}
+	// copy the metadata so that changes are not visible through a local
+	// store which returns its own map from GetMeta
+	meta := make(map[string]json.RawMessage, len(r.meta))
+	for name, b := range r.meta {
+		meta[name] = b
+	}
+	r.meta = meta
+	r.pending = make(map[string]struct{})
+}
+
+// writeMeta stages the given metadata, writing it to the local store unless
+// changes are being staged in memory (see Stage).
+func (r *Repo) writeMeta(name string, b json.RawMessage) error {
+	r.meta[name] = b
+	if r.pending != nil {
+		r.pending[name] = struct{}{}
+		return nil
+	}
+	return r.local.SetMeta(name, b)
+}
+
+// writePending writes the metadata changed since Stage was called to the
+// local store, using a single batch if it is a BatchStore, and otherwise
+// writing each file in turn and restoring the previous contents of those
+// already written if a write fails. As LocalStore cannot delete metadata,
+// metadata written which did not previously exist is left in place in the
+// latter case.
+func (r *Repo) writePending() error {
+	if len(r.pending) == 0 {
+		return nil
+	}
+	meta := make(map[string]json.RawMessage, len(r.pending))
+	for name := range r.pending {
+		meta[name] = r.meta[name]
+	}
+	if batch, ok := r.local.(BatchStore); ok {
+		if err := batch.SetMetaBatch(meta); err != nil {
+			return err
+		}
+	} else if err := setMetaWithRollback(r.local, meta); err != nil {
+		return err
+	}
+	r.pending = make(map[string]struct{})
+	return nil
+}
+
+func setMetaWithRollback(local LocalStore, meta map[string]json.RawMessage) error {
+	current, err := local.GetMeta()
+	if err != nil {
+		return err
+	}
+	prev := make(map[string]json.RawMessage, len(meta))
+	for name := range meta {
+		if b, ok := current[name]; ok {
+			prev[name] = b
+		}
+	}
+	written := make([]string, 0, len(meta))
+	for name, b := range meta {
+		if err := local.SetMeta(name, b); err != nil {
+			for _, name := range written {
+				if b, ok := prev[name]; ok {
+					local.SetMeta(name, b)
+				}
+			}
+			return err
+		}
+		written = append(written, name)
+	}
+	return nil
+}
+
 func (r *Repo) Init(consistentSnapshot bool) error {
 	t, err := r.targets()
 	if err != nil {
@@ -173,11 +416,50 @@ func (r *Repo) timestamp() (*data.Timestamp, error) {
 	return timestamp, nil
 }
 
+// InitDefaultRoles generates a key for each top-level role, each with a
+// threshold of one, and returns the generated key IDs keyed by role. The
+// repository is then ready to have targets added.
+//
+// It returns ErrRoleHasKeys without generating any keys if any top-level
+// role already has keys.
+func (r *Repo) InitDefaultRoles() (map[string]string, error) {
+	root, err := r.root()
+	if err != nil {
+		return nil, err
+	}
+	roles := make([]string, len(topLevelManifests))
+	for i, name := range topLevelManifests {
+		roles[i] = strings.TrimSuffix(name, ".json")
+		if role, ok := root.Roles[roles[i]]; ok && len(role.KeyIDs) > 0 {
+			return nil, ErrRoleHasKeys{roles[i]}
+		}
+	}
+	keyIDs := make(map[string]string, len(roles))
+	for _, role := range roles {
+		id, err := r.GenKey(role)
+		if err != nil {
+			return nil, err
+		}
+		keyIDs[role] = id
+	}
+	return keyIDs, nil
+}
+
 func (r *Repo) GenKey(role string) (string, error) {
-	return r.GenKeyWithExpires(role, data.DefaultExpires("root"))
+	return r.GenKeyWithExpires(role, r.defaultExpires("root"))
 }
 
 func (r *Repo) GenKeyWithExpires(keyRole string, expires time.Time) (string, error) {
+	return r.GenKeyWithTypeAndExpires(keyRole, data.KeyTypeEd25519, expires)
+}
+
+// GenKeyWithType is like GenKey but generates a key of the given type (e.g.
+// data.KeyTypeECDSA_SHA2_P256) rather than an Ed25519 key.
+func (r *Repo) GenKeyWithType(role string, keyType data.KeyType) (string, error) {
+	return r.GenKeyWithTypeAndExpires(role, keyType, r.defaultExpires("root"))
+}
+
+func (r *Repo) GenKeyWithTypeAndExpires(keyRole string, keyType data.KeyType, expires time.Time) (string, error) {
 	if !verify.ValidRole(keyRole) {
 		return "", ErrInvalidRole{keyRole}
 	}
@@ -191,7 +473,7 @@ func (r *Repo) GenKeyWithExpires(keyRole string, expires time.Time) (string, err
 		return "", err
 	}
 
-	key, err := sign.GenerateEd25519Key()
+	key, err := sign.GenerateKey(keyType)
 	if err != nil {
 		return "", err
 	}
@@ -199,7 +481,117 @@ func (r *Repo) GenKeyWithExpires(keyRole string, expires time.Time) (string, err
 		return "", err
 	}
 	pk := key.PublicData()
+	if store, ok := r.local.(KeyExpiryStore); ok {
+		expiry := KeyExpiry{KeyID: pk.ID(), Expires: expires.Round(time.Second)}
+		if err := store.SaveKeyExpiry(keyRole, expiry); err != nil {
+			return "", err
+		}
+	}
+
+	return pk.ID(), r.addKey(root, keyRole, pk, expires)
+}
 
+// KeyExpiries returns the expiry time of each key of each role, as recorded
+// when the key was generated, so that key rotations can be planned. Only
+// keys which are still in the role in root.json are included, sorted by key
+// ID, and keys with no recorded expiry (e.g. keys added with
+// AddVerificationKey) are omitted.
+//
+// An empty map is returned if the local store is not a KeyExpiryStore.
+func (r *Repo) KeyExpiries() (map[string][]KeyExpiry, error) {
+	res := make(map[string][]KeyExpiry)
+	store, ok := r.local.(KeyExpiryStore)
+	if !ok {
+		return res, nil
+	}
+	recorded, err := store.GetKeyExpiries()
+	if err != nil {
+		return nil, err
+	}
+	db, err := r.db()
+	if err != nil {
+		return nil, err
+	}
+	for name, expiries := range recorded {
+		role := db.GetRole(name)
+		if role == nil {
+			continue
+		}
+		var valid []KeyExpiry
+		for _, expiry := range expiries {
+			if role.ValidKey(expiry.KeyID) {
+				valid = append(valid, expiry)
+			}
+		}
+		if len(valid) == 0 {
+			continue
+		}
+		sort.Slice(valid, func(i, j int) bool { return valid[i].KeyID < valid[j].KeyID })
+		res[name] = valid
+	}
+	return res, nil
+}
+
+// AddVerificationKey adds the given public key to the given role in
+// root.json without storing any private key, for keys which are held
+// externally and used to sign metadata with SignWithSigner.
+func (r *Repo) AddVerificationKey(role string, pk *data.Key) error {
+	return r.AddVerificationKeyWithExpires(role, pk, r.defaultExpires("root"))
+}
+
+func (r *Repo) AddVerificationKeyWithExpires(keyRole string, pk *data.Key, expires time.Time) error {
+	if !verify.ValidRole(keyRole) {
+		return ErrInvalidRole{keyRole}
+	}
+
+	if !validExpires(expires) {
+		return ErrInvalidExpires{expires}
+	}
+
+	if pk == nil {
+		return verify.ErrInvalidKey
+	}
+	v, ok := verify.Verifiers[pk.Type]
+	if !ok {
+		return sign.ErrUnknownKeyType{Type: pk.Type}
+	}
+	if !v.ValidKey(pk.Value.Public) {
+		return verify.ErrInvalidKey
+	}
+
+	root, err := r.root()
+	if err != nil {
+		return err
+	}
+	if role, ok := root.Roles[keyRole]; ok {
+		for _, id := range role.KeyIDs {
+			if id == pk.ID() {
+				return nil
+			}
+		}
+	}
+
+	return r.addKey(root, keyRole, pk, expires)
+}
+
+// AddRootKey adds the given public key to the root role, for example a key
+// generated in an HSM or during an offline root key ceremony. No private key
+// is stored, so root.json must then be signed with the key using
+// SignWithSigner.
+//
+// sign.ErrUnknownKeyType is returned if the key type is not supported, and
+// verify.ErrInvalidKey if the public key is not valid for its type.
+func (r *Repo) AddRootKey(key *data.Key) error {
+	return r.AddVerificationKey("root", key)
+}
+
+func (r *Repo) AddRootKeyWithExpires(key *data.Key, expires time.Time) error {
+	return r.AddVerificationKeyWithExpires("root", key, expires)
+}
+
+// addKey adds the public key to the given role and stages the updated
+// root.json.
+func (r *Repo) addKey(root *data.Root, keyRole string, pk *data.Key, expires time.Time) error {
 	role, ok := root.Roles[keyRole]
 	if !ok {
 		role = &data.Role{KeyIDs: []string{}, Threshold: 1}
@@ -211,7 +603,184 @@ func (r *Repo) GenKeyWithExpires(keyRole string, expires time.Time) (string, err
 	root.Expires = expires.Round(time.Second)
 	root.Version++
 
-	return pk.ID(), r.setMeta("root.json", root)
+	return r.setMeta("root.json", root)
+}
+
+// ChangePassphrase changes the passphrase used to encrypt the stored keys
+// for the given role from oldPass to newPass, preserving the keys and their
+// IDs.
+//
+// ErrWrongPassphrase is returned if oldPass is incorrect, in which case the
+// stored keys are left unchanged. The local store must implement
+// PassphraseStore.
+func (r *Repo) ChangePassphrase(role string, oldPass, newPass []byte) error {
+	if !verify.ValidRole(role) {
+		return ErrInvalidRole{role}
+	}
+	store, ok := r.local.(PassphraseStore)
+	if !ok {
+		return ErrPassphraseStoreUnsupported
+	}
+	return store.ChangePassphrase(role, oldPass, newPass)
+}
+
+// exportedKeysVersion is the format version of the keys written by
+// ExportKeys.
+const exportedKeysVersion = 1
+
+// exportedKeys is the envelope written by ExportKeys. Data contains the
+// stored private keys of each role, encrypted with the export passphrase.
+type exportedKeys struct {
+	Version int             `json:"version"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// ExportKeys writes the stored private keys of every top-level role to w,
+// encrypted using passphrase, so they can be backed up or moved to another
+// machine and restored with ImportKeys.
+//
+// ErrKeyNotExportable is returned if the local store has a signing key which
+// does not expose its private key.
+func (r *Repo) ExportKeys(w io.Writer, passphrase []byte) error {
+	keys := make(map[string][]*sign.PrivateKey, len(topLevelManifests))
+	for _, name := range topLevelManifests {
+		role := strings.TrimSuffix(name, ".json")
+		signers, err := r.local.GetSigningKeys(role)
+		if err != nil {
+			return err
+		}
+		for _, signer := range signers {
+			key, ok := sign.ExportPrivateKey(signer)
+			if !ok {
+				return ErrKeyNotExportable{role, signer.ID()}
+			}
+			keys[role] = append(keys[role], key)
+		}
+	}
+	b, err := encrypted.Marshal(keys, passphrase)
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(w).Encode(&exportedKeys{Version: exportedKeysVersion, Data: b})
+}
+
+// ImportKeys reads keys written by ExportKeys from r, decrypting them using
+// passphrase, and saves them in the local store for the same roles. Keys the
+// local store already has for a role are skipped, so the keys of a repo can
+// be restored without rotating them in root.json.
+func (r *Repo) ImportKeys(rd io.Reader, passphrase []byte) error {
+	exported := &exportedKeys{}
+	if err := json.NewDecoder(rd).Decode(exported); err != nil {
+		return err
+	}
+	if exported.Version != exportedKeysVersion {
+		return ErrUnsupportedKeysVersion{exported.Version}
+	}
+	var keys map[string][]*sign.PrivateKey
+	if err := encrypted.Unmarshal(exported.Data, &keys, passphrase); err != nil {
+		return err
+	}
+	for role, roleKeys := range keys {
+		if !verify.ValidRole(role) {
+			return ErrInvalidRole{role}
+		}
+		signers, err := r.local.GetSigningKeys(role)
+		if err != nil {
+			return err
+		}
+		existing := make(map[string]struct{}, len(signers))
+		for _, signer := range signers {
+			existing[signer.ID()] = struct{}{}
+		}
+		for _, key := range roleKeys {
+			if _, ok := existing[key.PublicData().ID()]; ok {
+				continue
+			}
+			if err := r.local.SavePrivateKey(role, key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// SetExpiry sets the expiry window for the given role, so that metadata for
+// the role staged by methods which don't take an explicit expires time (e.g.
+// Timestamp rather than TimestampWithExpires), and targets.json signed by
+// Sign, expires d from now instead of after the role's default window (see
+// data.DefaultExpires).
+//
+// A non-positive d restores the default window.
+func (r *Repo) SetExpiry(role string, d time.Duration) error {
+	if !verify.ValidRole(role) {
+		return ErrInvalidRole{role}
+	}
+	if d <= 0 {
+		delete(r.expiry, role)
+		return nil
+	}
+	if r.expiry == nil {
+		r.expiry = make(map[string]time.Duration)
+	}
+	r.expiry[role] = d
+	return nil
+}
+
+// SetVersion sets the version of the next metadata staged for the given
+// role (e.g. by Snapshot, Timestamp, AddTarget or GenKey), instead of the
+// current version plus one, for example to align versions with an external
+// release number or to recover after a bad publish. Versions set with
+// SetVersion are used once and are not saved in the local store.
+//
+// ErrInvalidVersion is returned unless version is greater than the version
+// of the role's currently staged metadata, as clients reject metadata whose
+// version is lower than the version they trust. Sign does not change the
+// version, as that would invalidate the existing signatures.
+func (r *Repo) SetVersion(role string, version int) error {
+	if !verify.ValidRole(role) {
+		return ErrInvalidRole{role}
+	}
+	current, err := r.metaVersion(role + ".json")
+	if err != nil {
+		return err
+	}
+	if version <= current {
+		return ErrInvalidVersion{role, version, current}
+	}
+	if r.nextVersion == nil {
+		r.nextVersion = make(map[string]int)
+	}
+	r.nextVersion[role] = version
+	return nil
+}
+
+// metaVersion returns the version of the given staged metadata, or zero if
+// it has not been staged.
+func (r *Repo) metaVersion(name string) (int, error) {
+	b, ok := r.meta[name]
+	if !ok {
+		return 0, nil
+	}
+	s := &data.Signed{}
+	if err := json.Unmarshal(b, s); err != nil {
+		return 0, err
+	}
+	v := &struct {
+		Version int `json:"version"`
+	}{}
+	if err := json.Unmarshal(s.Signed, v); err != nil {
+		return 0, err
+	}
+	return v.Version, nil
+}
+
+// defaultExpires returns the expires time for new metadata for the given
+// role, using the expiry window set with SetExpiry if any.
+func (r *Repo) defaultExpires(role string) time.Time {
+	if d, ok := r.expiry[role]; ok {
+		return time.Now().Add(d).UTC().Round(time.Second)
+	}
+	return data.DefaultExpires(role)
 }
 
 func validExpires(expires time.Time) bool {
@@ -239,7 +808,7 @@ func (r *Repo) RootKeys() ([]*data.Key, error) {
 }
 
 func (r *Repo) RevokeKey(role, id string) error {
-	return r.RevokeKeyWithExpires(role, id, data.DefaultExpires("root"))
+	return r.RevokeKeyWithExpires(role, id, r.defaultExpires("root"))
 }
 
 func (r *Repo) RevokeKeyWithExpires(keyRole, id string, expires time.Time) error {
@@ -260,9 +829,24 @@ func (r *Repo) RevokeKeyWithExpires(keyRole, id string, expires time.Time) error
 		return ErrKeyNotFound{keyRole, id}
 	}
 
+	if !removeKey(root, keyRole, id) {
+		return ErrKeyNotFound{keyRole, id}
+	}
+	root.Expires = expires.Round(time.Second)
+	root.Version++
+
+	if err := r.setMeta("root.json", root); err != nil {
+		return err
+	}
+	return r.undeprecateKey(keyRole, id)
+}
+
+// removeKey removes the key with the given ID from the role in root,
+// returning false if the role does not have the key.
+func removeKey(root *data.Root, keyRole, id string) bool {
 	role, ok := root.Roles[keyRole]
 	if !ok {
-		return ErrKeyNotFound{keyRole, id}
+		return false
 	}
 
 	keyIDs := make([]string, 0, len(role.KeyIDs))
@@ -273,11 +857,225 @@ func (r *Repo) RevokeKeyWithExpires(keyRole, id string, expires time.Time) error
 		keyIDs = append(keyIDs, keyID)
 	}
 	if len(keyIDs) == len(role.KeyIDs) {
-		return ErrKeyNotFound{keyRole, id}
+		return false
 	}
 	role.KeyIDs = keyIDs
 
 	delete(root.Keys, id)
+	root.Roles[keyRole] = role
+	return true
+}
+
+// DeprecateKey marks the given key to be removed from the role once
+// graceUntil has passed, allowing a soft rotation: the key is kept in
+// root.json, so clients continue to accept metadata signed by it, until
+// RemoveDeprecatedKeys is called after graceUntil. This gives time for the
+// role's metadata to be re-signed with its other keys, and for clients to
+// fetch it, before the key is removed.
+//
+// This delays revocation, so it should not be used for keys which may have
+// been compromised (use RevokeKey instead). Until the key is removed, an
+// attacker holding it can still sign metadata for the role which clients
+// accept. As the grace period is only recorded in the local store, clients
+// trust the key until they fetch a root.json without it.
+//
+// ErrKeyDeprecationStoreUnsupported is returned if the local store does not
+// implement KeyDeprecationStore, and ErrNotEnoughKeys if the role would be
+// left with fewer keys than its threshold once the key is removed.
+func (r *Repo) DeprecateKey(keyRole, id string, graceUntil time.Time) error {
+	if !verify.ValidRole(keyRole) {
+		return ErrInvalidRole{keyRole}
+	}
+
+	if !validExpires(graceUntil) {
+		return ErrInvalidExpires{graceUntil}
+	}
+
+	store, ok := r.local.(KeyDeprecationStore)
+	if !ok {
+		return ErrKeyDeprecationStoreUnsupported
+	}
+
+	root, err := r.root()
+	if err != nil {
+		return err
+	}
+
+	role, ok := root.Roles[keyRole]
+	if !ok || !roleHasKey(role, id) {
+		return ErrKeyNotFound{keyRole, id}
+	}
+
+	deprecations, err := store.GetKeyDeprecations()
+	if err != nil {
+		return err
+	}
+	var roleDeprecations []KeyDeprecation
+	for _, d := range deprecations[keyRole] {
+		if d.KeyID != id {
+			roleDeprecations = append(roleDeprecations, d)
+		}
+	}
+	roleDeprecations = append(roleDeprecations, KeyDeprecation{KeyID: id, GraceUntil: graceUntil.UTC().Round(time.Second)})
+	if remaining := trustedKeyCount(role, roleDeprecations); remaining < role.Threshold {
+		return ErrNotEnoughKeys{keyRole, remaining, role.Threshold}
+	}
+	deprecations[keyRole] = roleDeprecations
+
+	return store.SetKeyDeprecations(deprecations)
+}
+
+// RemoveDeprecatedKeys removes the keys whose grace period set by
+// DeprecateKey has passed from their roles in root.json, re-signing it if any
+// were removed.
+//
+// It does nothing if the local store does not implement KeyDeprecationStore.
+func (r *Repo) RemoveDeprecatedKeys() error {
+	return r.RemoveDeprecatedKeysWithExpires(r.defaultExpires("root"))
+}
+
+func (r *Repo) RemoveDeprecatedKeysWithExpires(expires time.Time) error {
+	if !validExpires(expires) {
+		return ErrInvalidExpires{expires}
+	}
+
+	store, ok := r.local.(KeyDeprecationStore)
+	if !ok {
+		return nil
+	}
+	deprecations, err := store.GetKeyDeprecations()
+	if err != nil {
+		return err
+	}
+
+	root, err := r.root()
+	if err != nil {
+		return err
+	}
+
+	removed := false
+	remaining := make(map[string][]KeyDeprecation)
+	for keyRole, roleDeprecations := range deprecations {
+		for _, d := range roleDeprecations {
+			if validExpires(d.GraceUntil) {
+				remaining[keyRole] = append(remaining[keyRole], d)
+				continue
+			}
+			if removeKey(root, keyRole, d.KeyID) {
+				removed = true
+			}
+		}
+	}
+
+	if removed {
+		root.Expires = expires.Round(time.Second)
+		root.Version++
+		if err := r.setMeta("root.json", root); err != nil {
+			return err
+		}
+	}
+	return store.SetKeyDeprecations(remaining)
+}
+
+// keyDeprecations returns the key deprecations of each role recorded by
+// DeprecateKey, which are empty if the local store does not implement
+// KeyDeprecationStore.
+func (r *Repo) keyDeprecations() (map[string][]KeyDeprecation, error) {
+	store, ok := r.local.(KeyDeprecationStore)
+	if !ok {
+		return nil, nil
+	}
+	return store.GetKeyDeprecations()
+}
+
+// undeprecateKey removes the deprecation of the given key of role recorded
+// by DeprecateKey, if any.
+func (r *Repo) undeprecateKey(keyRole, id string) error {
+	store, ok := r.local.(KeyDeprecationStore)
+	if !ok {
+		return nil
+	}
+	deprecations, err := store.GetKeyDeprecations()
+	if err != nil {
+		return err
+	}
+	var roleDeprecations []KeyDeprecation
+	for _, d := range deprecations[keyRole] {
+		if d.KeyID != id {
+			roleDeprecations = append(roleDeprecations, d)
+		}
+	}
+	if len(roleDeprecations) == len(deprecations[keyRole]) {
+		return nil
+	}
+	if len(roleDeprecations) == 0 {
+		delete(deprecations, keyRole)
+	} else {
+		deprecations[keyRole] = roleDeprecations
+	}
+	return store.SetKeyDeprecations(deprecations)
+}
+
+// trustedKeyCount returns the number of keys of role which are not
+// deprecated.
+func trustedKeyCount(role *data.Role, deprecations []KeyDeprecation) int {
+	count := len(role.KeyIDs)
+	for _, d := range deprecations {
+		if roleHasKey(role, d.KeyID) {
+			count--
+		}
+	}
+	return count
+}
+
+func roleHasKey(role *data.Role, id string) bool {
+	for _, keyID := range role.KeyIDs {
+		if keyID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// SetThreshold sets the number of signatures required to verify metadata for
+// the given role, re-signing root.json. It returns verify.ErrInvalidThreshold
+// if threshold is less than 1, and ErrNotEnoughKeys if the role has fewer
+// keys than threshold, not counting keys deprecated with DeprecateKey.
+func (r *Repo) SetThreshold(role string, threshold int) error {
+	return r.SetThresholdWithExpires(role, threshold, r.defaultExpires("root"))
+}
+
+func (r *Repo) SetThresholdWithExpires(keyRole string, threshold int, expires time.Time) error {
+	if !verify.ValidRole(keyRole) {
+		return ErrInvalidRole{keyRole}
+	}
+
+	if !validExpires(expires) {
+		return ErrInvalidExpires{expires}
+	}
+
+	if threshold < 1 {
+		return verify.ErrInvalidThreshold
+	}
+
+	root, err := r.root()
+	if err != nil {
+		return err
+	}
+
+	role, ok := root.Roles[keyRole]
+	if !ok {
+		return ErrNotEnoughKeys{keyRole, 0, threshold}
+	}
+	deprecations, err := r.keyDeprecations()
+	if err != nil {
+		return err
+	}
+	if trusted := trustedKeyCount(role, deprecations[keyRole]); trusted < threshold {
+		return ErrNotEnoughKeys{keyRole, trusted, threshold}
+	}
+	role.Threshold = threshold
+
 	root.Roles[keyRole] = role
 	root.Expires = expires.Round(time.Second)
 	root.Version++
@@ -285,11 +1083,38 @@ func (r *Repo) RevokeKeyWithExpires(keyRole, id string, expires time.Time) error
 	return r.setMeta("root.json", root)
 }
 
+// GetMeta returns a copy of the staged metadata, keyed by file name (e.g.
+// "root.json").
+func (r *Repo) GetMeta() map[string]json.RawMessage {
+	meta := make(map[string]json.RawMessage, len(r.meta))
+	for name, b := range r.meta {
+		meta[name] = b
+	}
+	return meta
+}
+
 func (r *Repo) setMeta(name string, meta interface{}) error {
-	keys, err := r.getSigningKeys(strings.TrimSuffix(name, ".json"))
+	role := strings.TrimSuffix(name, ".json")
+	keys, err := r.getSigningKeys(role)
 	if err != nil {
 		return err
 	}
+
+	// use the version set with SetVersion, if any
+	version, setVersion := r.nextVersion[role]
+	if setVersion {
+		switch m := meta.(type) {
+		case *data.Root:
+			m.Version = version
+		case *data.Targets:
+			m.Version = version
+		case *data.Snapshot:
+			m.Version = version
+		case *data.Timestamp:
+			m.Version = version
+		}
+	}
+
 	s, err := sign.Marshal(meta, keys...)
 	if err != nil {
 		return err
@@ -298,38 +1123,149 @@ func (r *Repo) setMeta(name string, meta interface{}) error {
 	if err != nil {
 		return err
 	}
-	r.meta[name] = b
-	return r.local.SetMeta(name, b)
+	if err := r.writeMeta(name, b); err != nil {
+		return err
+	}
+	if setVersion {
+		delete(r.nextVersion, role)
+	}
+	return nil
+}
+
+// Sign signs the given staged metadata (e.g. "targets.json") with all of the
+// role's local keys, keeping any existing signatures.
+//
+// If an expiry window has been set for targets with SetExpiry, signing
+// targets.json first stamps it with an expires time from that window, which
+// replaces its existing signatures as they no longer match. Its version is
+// not changed.
+func (r *Repo) Sign(name string) error {
+	role := strings.TrimSuffix(name, ".json")
+	if !verify.ValidRole(role) {
+		return ErrInvalidRole{role}
+	}
+
+	s, err := r.signedMeta(name)
+	if err != nil {
+		return err
+	}
+	if _, ok := r.expiry[role]; ok && role == "targets" {
+		t, err := r.targets()
+		if err != nil {
+			return err
+		}
+		t.Expires = r.defaultExpires(role)
+		if s, err = sign.Marshal(t); err != nil {
+			return err
+		}
+	}
+
+	keys, err := r.getSigningKeys(role)
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return ErrInsufficientKeys{name}
+	}
+	for _, k := range keys {
+		sign.Sign(s, k)
+	}
+
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return r.writeMeta(name, b)
+}
+
+// SignWith signs the given staged metadata (e.g. "targets.json") using only
+// the local keys with the given IDs, keeping any existing signatures, so
+// that the custodians of a role's keys can sign in turn until the role's
+// threshold is met (see ThresholdStatus).
+//
+// ErrKeyNotFound is returned, and no signatures are added, if any of the
+// keys is not one of the role's keys held in the local store (root.json may
+// also be signed by revoked keys, as in Sign).
+func (r *Repo) SignWith(name string, keyIDs ...string) error {
+	role := strings.TrimSuffix(name, ".json")
+	if !verify.ValidRole(role) {
+		return ErrInvalidRole{role}
+	}
+	if len(keyIDs) == 0 {
+		return ErrInsufficientKeys{name}
+	}
+
+	s, err := r.signedMeta(name)
+	if err != nil {
+		return err
+	}
+
+	keys, err := r.getSigningKeys(role)
+	if err != nil {
+		return err
+	}
+	available := make(map[string]sign.Signer, len(keys))
+	for _, k := range keys {
+		available[k.ID()] = k
+	}
+	signers := make([]sign.Signer, len(keyIDs))
+	for i, id := range keyIDs {
+		k, ok := available[id]
+		if !ok {
+			return ErrKeyNotFound{role, id}
+		}
+		signers[i] = k
+	}
+	for _, k := range signers {
+		if err := sign.Sign(s, k); err != nil {
+			return err
+		}
+	}
+
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return r.writeMeta(name, b)
 }
 
-func (r *Repo) Sign(name string) error {
+// SignWithSigner signs the given staged metadata (e.g. "root.json") using the
+// given signer rather than keys from the local store, allowing metadata to
+// be signed by keys held externally (e.g. in an HSM or on an offline
+// machine) which have been added to the role with AddVerificationKey.
+//
+// ErrKeyNotFound is returned if the signer's key is not one of the role's
+// keys, except for the root role which may also be signed by revoked keys
+// (see getSigningKeys).
+func (r *Repo) SignWithSigner(name string, signer sign.Signer) error {
 	role := strings.TrimSuffix(name, ".json")
 	if !verify.ValidRole(role) {
 		return ErrInvalidRole{role}
 	}
 
-	s, err := r.signedMeta(name)
-	if err != nil {
-		return err
+	if role != "root" {
+		db, err := r.db()
+		if err != nil {
+			return err
+		}
+		if roleData := db.GetRole(role); roleData == nil || !roleData.ValidKey(signer.ID()) {
+			return ErrKeyNotFound{role, signer.ID()}
+		}
 	}
 
-	keys, err := r.getSigningKeys(role)
+	s, err := r.signedMeta(name)
 	if err != nil {
 		return err
 	}
-	if len(keys) == 0 {
-		return ErrInsufficientKeys{name}
-	}
-	for _, k := range keys {
-		sign.Sign(s, k)
+	if err := sign.Sign(s, signer); err != nil {
+		return err
 	}
 
 	b, err := json.Marshal(s)
 	if err != nil {
 		return err
 	}
-	r.meta[name] = b
-	return r.local.SetMeta(name, b)
+	return r.writeMeta(name, b)
 }
 
 // getSigningKeys returns available signing keys.
@@ -366,6 +1302,46 @@ func (r *Repo) getSigningKeys(name string) ([]sign.Signer, error) {
 	return keys, nil
 }
 
+// SignedMeta returns the staged signed metadata of the given role (e.g.
+// "targets"), as it will be served once committed.
+func (r *Repo) SignedMeta(role string) (*data.Signed, error) {
+	if !verify.ValidRole(role) {
+		return nil, ErrInvalidRole{role}
+	}
+	return r.signedMeta(role + ".json")
+}
+
+// Signatures returns the signatures of the staged metadata of the given
+// role, for example to check that a threshold of the role's keys have
+// signed it before committing.
+func (r *Repo) Signatures(role string) ([]data.Signature, error) {
+	s, err := r.SignedMeta(role)
+	if err != nil {
+		return nil, err
+	}
+	return s.Signatures, nil
+}
+
+// ThresholdStatus returns the number of distinct keys of the given role
+// which have validly signed the role's staged metadata, and the number
+// needed to meet the role's threshold, so that signing by several parties
+// can be tracked and publishing held back until have >= need.
+func (r *Repo) ThresholdStatus(role string) (have, need int, err error) {
+	s, err := r.SignedMeta(role)
+	if err != nil {
+		return 0, 0, err
+	}
+	db, err := r.db()
+	if err != nil {
+		return 0, 0, err
+	}
+	have, err = db.CountSignatures(s, role)
+	if err != nil {
+		return 0, 0, err
+	}
+	return have, db.GetRole(role).Threshold, nil
+}
+
 func (r *Repo) signedMeta(name string) (*data.Signed, error) {
 	b, ok := r.meta[name]
 	if !ok {
@@ -392,7 +1368,7 @@ func (r *Repo) AddTarget(path string, custom json.RawMessage) error {
 }
 
 func (r *Repo) AddTargets(paths []string, custom json.RawMessage) error {
-	return r.AddTargetsWithExpires(paths, custom, data.DefaultExpires("targets"))
+	return r.AddTargetsWithExpires(paths, custom, r.defaultExpires("targets"))
 }
 
 func (r *Repo) AddTargetWithExpires(path string, custom json.RawMessage, expires time.Time) error {
@@ -437,12 +1413,173 @@ func (r *Repo) AddTargetsWithExpires(paths []string, custom json.RawMessage, exp
 	return r.setMeta("targets.json", t)
 }
 
+// AddTargetReader stages the target at path with the data read from rd and
+// adds it to targets.json, generating its length and hashes as the data is
+// staged so that it does not need to be written to a staged file first (e.g.
+// for streamed build outputs).
+//
+// The local store must implement TargetStore, otherwise
+// ErrTargetStoreUnsupported is returned.
+func (r *Repo) AddTargetReader(path string, rd io.Reader, custom json.RawMessage) error {
+	return r.AddTargetReaderWithExpires(path, rd, custom, r.defaultExpires("targets"))
+}
+
+func (r *Repo) AddTargetReaderWithExpires(path string, rd io.Reader, custom json.RawMessage, expires time.Time) error {
+	if !validExpires(expires) {
+		return ErrInvalidExpires{expires}
+	}
+	store, ok := r.local.(TargetStore)
+	if !ok {
+		return ErrTargetStoreUnsupported
+	}
+
+	t, err := r.targets()
+	if err != nil {
+		return err
+	}
+	w, err := util.NewFileMetaWriter(r.hashAlgorithms...)
+	if err != nil {
+		return err
+	}
+	path = util.NormalizeTarget(path)
+	if err := store.StageTarget(path, io.TeeReader(rd, w)); err != nil {
+		return err
+	}
+	meta := w.FileMeta()
+
+	// as with AddTargets, set custom metadata if given, otherwise maintain
+	// existing metadata if present
+	if len(custom) > 0 {
+		meta.Custom = &custom
+	} else if t, ok := t.Targets[path]; ok {
+		meta.Custom = t.Custom
+	}
+
+	t.Targets[path] = meta
+	t.Expires = expires.Round(time.Second)
+	t.Version++
+	return r.setMeta("targets.json", t)
+}
+
+// ReplaceTarget replaces the content of the existing target at path with the
+// data read from rd (see AddTargetReader), e.g. to publish a new build of
+// app-latest.bin, returning ErrUnknownTarget if targets.json does not list
+// the target. Existing custom metadata is kept if custom is nil.
+//
+// The new content is staged before targets.json is re-signed with the new
+// length and hashes, so if either step fails the staged targets.json still
+// lists the previous content. Committing to a FileSystemStore then copies
+// target files to the repository before targets.json and timestamp.json, so
+// clients never see the new metadata before the new content. With consistent
+// snapshots, the new content is published under its hashed path alongside
+// the previous content, so clients which are still using the previous
+// metadata can also still download the previous content.
+func (r *Repo) ReplaceTarget(path string, rd io.Reader, custom json.RawMessage) error {
+	return r.ReplaceTargetWithExpires(path, rd, custom, r.defaultExpires("targets"))
+}
+
+func (r *Repo) ReplaceTargetWithExpires(path string, rd io.Reader, custom json.RawMessage, expires time.Time) error {
+	t, err := r.targets()
+	if err != nil {
+		return err
+	}
+	path = util.NormalizeTarget(path)
+	if _, ok := t.Targets[path]; !ok {
+		return ErrUnknownTarget{path}
+	}
+	return r.AddTargetReaderWithExpires(path, rd, custom, expires)
+}
+
+// AddTargetMeta adds the target with the given path to targets.json using
+// the given length and hashes rather than reading the target file, for
+// when they are already known (e.g. from an earlier build step).
+//
+// The meta is trusted as given, other than checking that it has at least
+// one hash and a non-negative length, and the target file itself must still
+// be published to remote storage separately if it is not staged in the
+// local store.
+func (r *Repo) AddTargetMeta(path string, meta data.FileMeta, custom json.RawMessage) error {
+	return r.AddTargetMetaWithExpires(path, meta, custom, r.defaultExpires("targets"))
+}
+
+func (r *Repo) AddTargetMetaWithExpires(path string, meta data.FileMeta, custom json.RawMessage, expires time.Time) error {
+	if !validExpires(expires) {
+		return ErrInvalidExpires{expires}
+	}
+	path = util.NormalizeTarget(path)
+	if meta.Length < 0 {
+		return ErrInvalidTargetMeta{path, "negative length"}
+	}
+	if len(meta.Hashes) == 0 {
+		return ErrInvalidTargetMeta{path, "no hashes"}
+	}
+
+	t, err := r.targets()
+	if err != nil {
+		return err
+	}
+	hashes := make(data.Hashes, len(meta.Hashes))
+	for alg, h := range meta.Hashes {
+		hashes[alg] = h
+	}
+	meta.Hashes = hashes
+
+	// as with AddTargets, set custom metadata if given, otherwise maintain
+	// existing metadata if present
+	if len(custom) > 0 {
+		meta.Custom = &custom
+	} else if meta.Custom == nil {
+		if t, ok := t.Targets[path]; ok {
+			meta.Custom = t.Custom
+		}
+	}
+
+	t.Targets[path] = meta
+	t.Expires = expires.Round(time.Second)
+	t.Version++
+	return r.setMeta("targets.json", t)
+}
+
+// SetTargetCustom replaces the custom metadata of the target at path with
+// custom, or removes it if custom is nil, keeping the target's length and
+// hashes. This allows, for example, a published target to be promoted to a
+// different release channel without re-reading its data.
+//
+// ErrUnknownTarget is returned if targets.json does not list the target.
+func (r *Repo) SetTargetCustom(path string, custom json.RawMessage) error {
+	return r.SetTargetCustomWithExpires(path, custom, r.defaultExpires("targets"))
+}
+
+func (r *Repo) SetTargetCustomWithExpires(path string, custom json.RawMessage, expires time.Time) error {
+	if !validExpires(expires) {
+		return ErrInvalidExpires{expires}
+	}
+
+	t, err := r.targets()
+	if err != nil {
+		return err
+	}
+	path = util.NormalizeTarget(path)
+	meta, ok := t.Targets[path]
+	if !ok {
+		return ErrUnknownTarget{path}
+	}
+	meta.Custom = nil
+	if custom != nil {
+		meta.Custom = &custom
+	}
+	t.Targets[path] = meta
+	t.Expires = expires.Round(time.Second)
+	t.Version++
+	return r.setMeta("targets.json", t)
+}
+
 func (r *Repo) RemoveTarget(path string) error {
 	return r.RemoveTargets([]string{path})
 }
 
 func (r *Repo) RemoveTargets(paths []string) error {
-	return r.RemoveTargetsWithExpires(paths, data.DefaultExpires("targets"))
+	return r.RemoveTargetsWithExpires(paths, r.defaultExpires("targets"))
 }
 
 func (r *Repo) RemoveTargetWithExpires(path string, expires time.Time) error {
@@ -480,8 +1617,82 @@ func (r *Repo) RemoveTargetsWithExpires(paths []string, expires time.Time) error
 	return r.setMeta("targets.json", t)
 }
 
+// RemoveTargetsMatching removes all targets matching pattern, returning the
+// sorted paths of the removed targets.
+//
+// If pattern contains any of the glob characters "*?[" it is matched against
+// each target path using path.Match (so "/v1/*.txt" does not match
+// "/v1/a/b.txt"), otherwise it is treated as a path prefix (so "v1.2.0/"
+// removes everything under the v1.2.0 directory). ErrEmptyPattern is
+// returned if pattern is empty.
+func (r *Repo) RemoveTargetsMatching(pattern string) ([]string, error) {
+	return r.RemoveTargetsMatchingWithExpires(pattern, r.defaultExpires("targets"))
+}
+
+func (r *Repo) RemoveTargetsMatchingWithExpires(pattern string, expires time.Time) ([]string, error) {
+	if pattern == "" {
+		return nil, ErrEmptyPattern
+	}
+	t, err := r.targets()
+	if err != nil {
+		return nil, err
+	}
+	dir := strings.HasSuffix(pattern, "/")
+	pattern = util.NormalizeTarget(pattern)
+	if dir && pattern != "/" {
+		// keep the trailing slash removed by NormalizeTarget so that
+		// "v1/" does not match "/v10/foo.txt"
+		pattern += "/"
+	}
+	glob := strings.ContainsAny(pattern, "*?[")
+	var removed []string
+	for p := range t.Targets {
+		if glob {
+			matched, err := path.Match(pattern, p)
+			if err != nil {
+				return nil, err
+			}
+			if !matched {
+				continue
+			}
+		} else if !strings.HasPrefix(p, pattern) {
+			continue
+		}
+		removed = append(removed, p)
+	}
+	if len(removed) == 0 {
+		return nil, nil
+	}
+	sort.Strings(removed)
+	if err := r.RemoveTargetsWithExpires(removed, expires); err != nil {
+		return nil, err
+	}
+	return removed, nil
+}
+
+// SetDefaultCompression sets the compression used by SnapshotDefault, so
+// that a repository's snapshots (e.g. those made by automated refreshes)
+// consistently list compressed copies of metadata, or consistently do not.
+// The default is CompressionTypeNone. The setting is not saved in the local
+// store.
+func (r *Repo) SetDefaultCompression(t CompressionType) {
+	r.compression = t
+}
+
+// DefaultCompression returns the compression used by SnapshotDefault (see
+// SetDefaultCompression).
+func (r *Repo) DefaultCompression() CompressionType {
+	return r.compression
+}
+
+// SnapshotDefault is like Snapshot but uses the compression set with
+// SetDefaultCompression.
+func (r *Repo) SnapshotDefault() error {
+	return r.Snapshot(r.compression)
+}
+
 func (r *Repo) Snapshot(t CompressionType) error {
-	return r.SnapshotWithExpires(t, data.DefaultExpires("snapshot"))
+	return r.SnapshotWithExpires(t, r.defaultExpires("snapshot"))
 }
 
 func (r *Repo) SnapshotWithExpires(t CompressionType, expires time.Time) error {
@@ -497,13 +1708,22 @@ func (r *Repo) SnapshotWithExpires(t CompressionType, expires time.Time) error {
 	if err != nil {
 		return err
 	}
-	// TODO: generate compressed manifests
 	for _, name := range snapshotManifests {
 		if err := r.verifySignature(name, db); err != nil {
 			return err
 		}
 		var err error
-		snapshot.Meta[name], err = r.fileMeta(name)
+		snapshot.Meta[name], err = r.versionedFileMeta(name)
+		if err != nil {
+			return err
+		}
+	}
+	for _, name := range compressedManifests {
+		delete(snapshot.Meta, name)
+		if t != CompressionTypeGzip {
+			continue
+		}
+		snapshot.Meta[name], err = r.compressMeta(name)
 		if err != nil {
 			return err
 		}
@@ -513,11 +1733,52 @@ func (r *Repo) SnapshotWithExpires(t CompressionType, expires time.Time) error {
 	return r.setMeta("snapshot.json", snapshot)
 }
 
+// compressMeta writes the gzip compressed copy of the metadata with the given
+// compressed name (e.g. targets.json.gz), returning its file meta with the
+// version of the uncompressed metadata.
+func (r *Repo) compressMeta(name string) (data.FileMeta, error) {
+	uncompressed := strings.TrimSuffix(name, ".gz")
+	meta, err := r.versionedFileMeta(uncompressed)
+	if err != nil {
+		return data.FileMeta{}, err
+	}
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(r.meta[uncompressed]); err != nil {
+		return data.FileMeta{}, err
+	}
+	if err := gz.Close(); err != nil {
+		return data.FileMeta{}, err
+	}
+	if err := r.writeMeta(name, buf.Bytes()); err != nil {
+		return data.FileMeta{}, err
+	}
+	compressed, err := r.fileMeta(name)
+	if err != nil {
+		return data.FileMeta{}, err
+	}
+	compressed.Version = meta.Version
+	return compressed, nil
+}
+
 func (r *Repo) Timestamp() error {
-	return r.TimestampWithExpires(data.DefaultExpires("timestamp"))
+	return r.TimestampWithExpires(r.defaultExpires("timestamp"))
 }
 
 func (r *Repo) TimestampWithExpires(expires time.Time) error {
+	return r.timestampWithCustom(nil, expires)
+}
+
+// TimestampWithCustom is like Timestamp but includes the given custom data
+// in timestamp.json, for example a publish counter or build ID which lets
+// monitoring detect a stalled publisher. The data is covered by the
+// timestamp signature, and clients can read it with Client.TimestampCustom.
+// Custom data is not kept by later calls to Timestamp.
+func (r *Repo) TimestampWithCustom(custom json.RawMessage) error {
+	return r.timestampWithCustom(custom, r.defaultExpires("timestamp"))
+}
+
+func (r *Repo) timestampWithCustom(custom json.RawMessage, expires time.Time) error {
 	if !validExpires(expires) {
 		return ErrInvalidExpires{expires}
 	}
@@ -533,10 +1794,14 @@ func (r *Repo) TimestampWithExpires(expires time.Time) error {
 	if err != nil {
 		return err
 	}
-	timestamp.Meta["snapshot.json"], err = r.fileMeta("snapshot.json")
+	timestamp.Meta["snapshot.json"], err = r.versionedFileMeta("snapshot.json")
 	if err != nil {
 		return err
 	}
+	timestamp.Custom = nil
+	if custom != nil {
+		timestamp.Custom = &custom
+	}
 	timestamp.Expires = expires.Round(time.Second)
 	timestamp.Version++
 	return r.setMeta("timestamp.json", timestamp)
@@ -559,6 +1824,9 @@ func (r *Repo) fileHashes() (map[string]data.Hashes, error) {
 	}
 	addHashes("root.json", snapshot.Meta)
 	addHashes("targets.json", snapshot.Meta)
+	for _, name := range compressedManifests {
+		addHashes(name, snapshot.Meta)
+	}
 	addHashes("snapshot.json", timestamp.Meta)
 	t, err := r.targets()
 	if err != nil {
@@ -571,78 +1839,186 @@ func (r *Repo) fileHashes() (map[string]data.Hashes, error) {
 }
 
 func (r *Repo) Commit() error {
+	root, err := r.verifyMeta()
+	if err != nil {
+		return err
+	}
+
+	hashes, err := r.fileHashes()
+	if err != nil {
+		return err
+	}
+	if err := r.writePending(); err != nil {
+		return err
+	}
+	return r.local.Commit(r.meta, root.ConsistentSnapshot, hashes)
+}
+
+// verifyMeta checks that the staged metadata is complete, consistent and
+// correctly signed, returning the staged root metadata.
+func (r *Repo) verifyMeta() (*data.Root, error) {
 	// check we have all the metadata
 	for _, name := range topLevelManifests {
 		if _, ok := r.meta[name]; !ok {
-			return ErrMissingMetadata{name}
+			return nil, ErrMissingMetadata{name}
 		}
 	}
 
 	// check roles are valid
 	root, err := r.root()
 	if err != nil {
-		return err
+		return nil, err
 	}
 	for name, role := range root.Roles {
 		if len(role.KeyIDs) < role.Threshold {
-			return ErrNotEnoughKeys{name, len(role.KeyIDs), role.Threshold}
+			return nil, ErrNotEnoughKeys{name, len(role.KeyIDs), role.Threshold}
 		}
 	}
 
 	// verify hashes in snapshot.json are up to date
 	snapshot, err := r.snapshot()
 	if err != nil {
-		return err
+		return nil, err
 	}
 	for _, name := range snapshotManifests {
 		expected, ok := snapshot.Meta[name]
 		if !ok {
-			return fmt.Errorf("tuf: snapshot.json missing hash for %s", name)
+			return nil, fmt.Errorf("tuf: snapshot.json missing hash for %s", name)
 		}
 		actual, err := r.fileMeta(name)
 		if err != nil {
-			return err
+			return nil, err
+		}
+		if err := util.FileMetaEqual(actual, expected); err != nil {
+			return nil, fmt.Errorf("tuf: invalid %s in snapshot.json: %s", name, err)
+		}
+	}
+	for _, name := range compressedManifests {
+		expected, ok := snapshot.Meta[name]
+		if !ok {
+			continue
+		}
+		actual, err := r.fileMeta(name)
+		if err != nil {
+			return nil, err
 		}
 		if err := util.FileMetaEqual(actual, expected); err != nil {
-			return fmt.Errorf("tuf: invalid %s in snapshot.json: %s", name, err)
+			return nil, fmt.Errorf("tuf: invalid %s in snapshot.json: %s", name, err)
 		}
 	}
 
 	// verify hashes in timestamp.json are up to date
 	timestamp, err := r.timestamp()
 	if err != nil {
-		return err
+		return nil, err
 	}
 	snapshotMeta, err := r.fileMeta("snapshot.json")
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if err := util.FileMetaEqual(snapshotMeta, timestamp.Meta["snapshot.json"]); err != nil {
-		return fmt.Errorf("tuf: invalid snapshot.json in timestamp.json: %s", err)
+		return nil, fmt.Errorf("tuf: invalid snapshot.json in timestamp.json: %s", err)
 	}
 
 	// verify all signatures are correct
 	db, err := r.db()
 	if err != nil {
-		return err
+		return nil, err
 	}
 	for _, name := range topLevelManifests {
 		if err := r.verifySignature(name, db); err != nil {
+			return nil, err
+		}
+	}
+
+	return root, nil
+}
+
+// Verify checks the metadata in the repo, including any changes staged with
+// Stage, as a client would, so that problems can be found before the
+// metadata is published. It returns the first inconsistency found.
+//
+// As well as the checks made by Commit (that all the top-level metadata is
+// present and unexpired, that each role has enough keys and signatures, and
+// that the hashes in snapshot.json and timestamp.json match the metadata),
+// it checks that the versions recorded in snapshot.json and timestamp.json
+// match the metadata.
+func (r *Repo) Verify() error {
+	if _, err := r.verifyMeta(); err != nil {
+		return err
+	}
+
+	snapshot, err := r.snapshot()
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(snapshot.Meta))
+	for name := range snapshot.Meta {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := r.verifyVersion(name, snapshot.Meta[name], "snapshot.json"); err != nil {
 			return err
 		}
 	}
+	timestamp, err := r.timestamp()
+	if err != nil {
+		return err
+	}
+	return r.verifyVersion("snapshot.json", timestamp.Meta["snapshot.json"], "timestamp.json")
+}
 
-	hashes, err := r.fileHashes()
+// verifyVersion checks that the version of the given metadata matches the
+// version recorded for it in the metadata named by in, if there is one.
+func (r *Repo) verifyVersion(name string, expected data.FileMeta, in string) error {
+	if expected.Version == 0 {
+		return nil
+	}
+	// compressed metadata has the version of the uncompressed metadata
+	actual, err := r.versionedFileMeta(strings.TrimSuffix(name, ".gz"))
 	if err != nil {
 		return err
 	}
-	return r.local.Commit(r.meta, root.ConsistentSnapshot, hashes)
+	if actual.Version != expected.Version {
+		return fmt.Errorf("tuf: invalid %s in %s: expected version %d, got %d", name, in, expected.Version, actual.Version)
+	}
+	return nil
 }
 
 func (r *Repo) Clean() error {
 	return r.local.Clean()
 }
 
+// Reset deletes all the metadata from the local store, and also the signing
+// keys if removeKeys is true, so that the repository can be bootstrapped
+// again starting with Init. Unlike Clean, which only discards staged
+// changes, committed metadata is deleted too.
+//
+// Metadata changes accumulated since Stage was called and versions set with
+// SetVersion are discarded, while settings such as the expiry windows set
+// with SetExpiry are kept. The local store must implement ResetStore.
+func (r *Repo) Reset(removeKeys bool) error {
+	store, ok := r.local.(ResetStore)
+	if !ok {
+		return ErrResetStoreUnsupported
+	}
+	if err := store.Reset(removeKeys); err != nil {
+		return err
+	}
+	meta, err := r.local.GetMeta()
+	if err != nil {
+		return err
+	}
+	r.meta = meta
+	r.nextVersion = nil
+	if r.pending != nil {
+		r.pending = nil
+		r.Stage()
+	}
+	return nil
+}
+
 func (r *Repo) verifySignature(name string, db *verify.DB) error {
 	s, err := r.signedMeta(name)
 	if err != nil {
@@ -662,3 +2038,17 @@ func (r *Repo) fileMeta(name string) (data.FileMeta, error) {
 	}
 	return util.GenerateFileMeta(bytes.NewReader(b), r.hashAlgorithms...)
 }
+
+// versionedFileMeta returns the file meta of the given metadata including its
+// version, so clients can locate version-prefixed consistent snapshots.
+func (r *Repo) versionedFileMeta(name string) (data.FileMeta, error) {
+	meta, err := r.fileMeta(name)
+	if err != nil {
+		return data.FileMeta{}, err
+	}
+	meta.Version, err = r.metaVersion(name)
+	if err != nil {
+		return data.FileMeta{}, err
+	}
+	return meta, nil
+}
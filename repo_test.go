@@ -1,13 +1,21 @@
 package tuf
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
 	"testing"
+	"testing/iotest"
 	"time"
 
 	"github.com/flynn/go-tuf/data"
@@ -126,6 +134,29 @@ func genKey(c *C, r *Repo, role string) string {
 	return id
 }
 
+// genKeys generates a key for each of the top-level roles.
+func genKeys(c *C, r *Repo) {
+	for _, role := range []string{"root", "targets", "snapshot", "timestamp"} {
+		genKey(c, r, role)
+	}
+}
+
+// stageRepo generates a key for each of the top-level roles, then stages
+// targets.json with foo.txt, snapshot.json and timestamp.json.
+func stageRepo(c *C, r *Repo, compression CompressionType) {
+	genKeys(c, r)
+	c.Assert(r.AddTarget("foo.txt", nil), IsNil)
+	c.Assert(r.Snapshot(compression), IsNil)
+	c.Assert(r.Timestamp(), IsNil)
+}
+
+// assertExpires checks that expires is within a minute of d from now.
+func assertExpires(c *C, expires time.Time, d time.Duration) {
+	expected := time.Now().Add(d)
+	c.Assert(expires.After(expected.Add(-time.Minute)), Equals, true)
+	c.Assert(expires.Before(expected.Add(time.Minute)), Equals, true)
+}
+
 func (RepoSuite) TestGenKey(c *C) {
 	local := MemoryStore(make(map[string]json.RawMessage), nil)
 	r, err := NewRepo(local)
@@ -251,6 +282,125 @@ func (RepoSuite) TestGenKey(c *C) {
 	c.Assert(stagedRoot.Roles, DeepEquals, root.Roles)
 }
 
+func (RepoSuite) TestInitDefaultRoles(c *C) {
+	local := MemoryStore(make(map[string]json.RawMessage), map[string][]byte{"/foo.txt": []byte("foo")})
+	r, err := NewRepo(local)
+	c.Assert(err, IsNil)
+
+	// check a key is generated for each top-level role
+	ids, err := r.InitDefaultRoles()
+	c.Assert(err, IsNil)
+	c.Assert(ids, HasLen, 4)
+	root, err := r.root()
+	c.Assert(err, IsNil)
+	for _, name := range []string{"root", "targets", "snapshot", "timestamp"} {
+		role, ok := root.Roles[name]
+		c.Assert(ok, Equals, true)
+		c.Assert(role.KeyIDs, DeepEquals, []string{ids[name]})
+		c.Assert(role.Threshold, Equals, 1)
+	}
+
+	// check the repo can be committed once targets are added
+	c.Assert(r.AddTarget("foo.txt", nil), IsNil)
+	c.Assert(r.Snapshot(CompressionTypeNone), IsNil)
+	c.Assert(r.Timestamp(), IsNil)
+	c.Assert(r.Commit(), IsNil)
+
+	// check ErrRoleHasKeys is returned if any role has keys, without
+	// generating keys for the other roles
+	c.Assert(r.RevokeKey("timestamp", ids["timestamp"]), IsNil)
+	_, err = r.InitDefaultRoles()
+	c.Assert(err, DeepEquals, ErrRoleHasKeys{"root"})
+	root, err = r.root()
+	c.Assert(err, IsNil)
+	c.Assert(root.Roles["timestamp"].KeyIDs, HasLen, 0)
+}
+
+func (RepoSuite) TestKeyExpiries(c *C) {
+	for _, local := range []LocalStore{
+		MemoryStore(make(map[string]json.RawMessage), nil),
+		FileSystemStore(newTmpDir(c).path, nil),
+	} {
+		r, err := NewRepo(local)
+		c.Assert(err, IsNil)
+		expiries, err := r.KeyExpiries()
+		c.Assert(err, IsNil)
+		c.Assert(expiries, HasLen, 0)
+
+		// generate keys with mixed expiries
+		soon := time.Now().Add(24 * time.Hour).UTC().Round(time.Second)
+		later := time.Now().Add(365 * 24 * time.Hour).UTC().Round(time.Second)
+		rootID, err := r.GenKeyWithExpires("root", later)
+		c.Assert(err, IsNil)
+		targetsSoon, err := r.GenKeyWithExpires("targets", soon)
+		c.Assert(err, IsNil)
+		targetsLater, err := r.GenKeyWithExpires("targets", later)
+		c.Assert(err, IsNil)
+		defaultID := genKey(c, r, "snapshot")
+		revokedID := genKey(c, r, "timestamp")
+		genKey(c, r, "timestamp")
+		c.Assert(r.RevokeKey("timestamp", revokedID), IsNil)
+		c.Assert(r.AddVerificationKey("targets", newHSMSigner(c).PublicData()), IsNil)
+
+		// check the report, which excludes the revoked and external keys
+		expiries, err = r.KeyExpiries()
+		c.Assert(err, IsNil)
+		c.Assert(expiries, HasLen, 4)
+		c.Assert(expiries["root"], DeepEquals, []KeyExpiry{{rootID, later}})
+		expectedTargets := []KeyExpiry{{targetsSoon, soon}, {targetsLater, later}}
+		if targetsLater < targetsSoon {
+			expectedTargets[0], expectedTargets[1] = expectedTargets[1], expectedTargets[0]
+		}
+		c.Assert(expiries["targets"], DeepEquals, expectedTargets)
+		c.Assert(expiries["snapshot"], HasLen, 1)
+		c.Assert(expiries["snapshot"][0].KeyID, Equals, defaultID)
+		c.Assert(expiries["snapshot"][0].Expires.Sub(data.DefaultExpires("root")) < time.Minute, Equals, true)
+		c.Assert(expiries["timestamp"], HasLen, 1)
+		c.Assert(expiries["timestamp"][0].KeyID, Not(Equals), revokedID)
+
+		// check the expiries persist
+		r, err = NewRepo(local)
+		c.Assert(err, IsNil)
+		persisted, err := r.KeyExpiries()
+		c.Assert(err, IsNil)
+		c.Assert(persisted, DeepEquals, expiries)
+	}
+}
+
+func (RepoSuite) TestGenKeyWithType(c *C) {
+	tmp := newTmpDir(c)
+	local := FileSystemStore(tmp.path, nil)
+	r, err := NewRepo(local)
+	c.Assert(err, IsNil)
+
+	// generate a key of an unknown type
+	_, err = r.GenKeyWithType("root", "rsa")
+	c.Assert(err, Equals, sign.ErrUnknownKeyType{Type: "rsa"})
+
+	// generate ECDSA keys for every role
+	for _, role := range []string{"root", "targets", "snapshot", "timestamp"} {
+		id, err := r.GenKeyWithType(role, data.KeyTypeECDSA_SHA2_P256)
+		c.Assert(err, IsNil)
+		root, err := r.root()
+		c.Assert(err, IsNil)
+		c.Assert(root.Keys[id].Type, Equals, data.KeyTypeECDSA_SHA2_P256)
+
+		// check the persisted key produces signatures with the same ID
+		signers, err := local.GetSigningKeys(role)
+		c.Assert(err, IsNil)
+		c.Assert(signers, HasLen, 1)
+		c.Assert(signers[0].ID(), Equals, id)
+		c.Assert(signers[0].Type(), Equals, data.KeyTypeECDSA_SHA2_P256)
+	}
+
+	// check metadata signed with the ECDSA keys verifies
+	tmp.writeStagedTarget("foo.txt", "foo")
+	c.Assert(r.AddTarget("foo.txt", nil), IsNil)
+	c.Assert(r.Snapshot(CompressionTypeNone), IsNil)
+	c.Assert(r.Timestamp(), IsNil)
+	c.Assert(r.Commit(), IsNil)
+}
+
 func (RepoSuite) TestRevokeKey(c *C) {
 	local := MemoryStore(make(map[string]json.RawMessage), nil)
 	r, err := NewRepo(local)
@@ -299,6 +449,114 @@ func (RepoSuite) TestRevokeKey(c *C) {
 	c.Assert(targetsRole.KeyIDs[0], Not(Equals), id)
 }
 
+func (RepoSuite) TestDeprecateKey(c *C) {
+	local := MemoryStore(make(map[string]json.RawMessage), nil)
+	r, err := NewRepo(local)
+	c.Assert(err, IsNil)
+	graceUntil := time.Now().Add(time.Hour).UTC().Round(time.Second)
+
+	// deprecating a key for an unknown role returns ErrInvalidRole
+	c.Assert(r.DeprecateKey("foo", "", graceUntil), DeepEquals, ErrInvalidRole{"foo"})
+
+	// deprecating a key which doesn't exist returns ErrKeyNotFound
+	genKey(c, r, "root")
+	oldID := genKey(c, r, "targets")
+	c.Assert(r.DeprecateKey("targets", "nonexistent", graceUntil), DeepEquals, ErrKeyNotFound{"targets", "nonexistent"})
+
+	// a grace period which has already ended returns ErrInvalidExpires
+	past := time.Now().Add(-time.Hour)
+	c.Assert(r.DeprecateKey("targets", oldID, past), DeepEquals, ErrInvalidExpires{past})
+
+	// deprecating the only key returns ErrNotEnoughKeys
+	c.Assert(r.DeprecateKey("targets", oldID, graceUntil), DeepEquals, ErrNotEnoughKeys{"targets", 0, 1})
+
+	// check the deprecation is recorded in the local store, leaving
+	// root.json unchanged
+	newID := genKey(c, r, "targets")
+	rootJSON := r.GetMeta()["root.json"]
+	c.Assert(r.DeprecateKey("targets", oldID, graceUntil), IsNil)
+	c.Assert(r.GetMeta()["root.json"], DeepEquals, rootJSON)
+	deprecations, err := local.(KeyDeprecationStore).GetKeyDeprecations()
+	c.Assert(err, IsNil)
+	c.Assert(deprecations, DeepEquals, map[string][]KeyDeprecation{
+		"targets": {{KeyID: oldID, GraceUntil: graceUntil}},
+	})
+
+	// check the key is kept during the grace period
+	c.Assert(r.RemoveDeprecatedKeys(), IsNil)
+	c.Assert(r.GetMeta()["root.json"], DeepEquals, rootJSON)
+
+	// check the key is removed once the grace period has ended
+	deprecations["targets"][0].GraceUntil = past
+	c.Assert(local.(KeyDeprecationStore).SetKeyDeprecations(deprecations), IsNil)
+	root, err := r.root()
+	c.Assert(err, IsNil)
+	version := root.Version
+	c.Assert(r.RemoveDeprecatedKeys(), IsNil)
+	root, err = r.root()
+	c.Assert(err, IsNil)
+	c.Assert(root.Version, Equals, version+1)
+	c.Assert(root.Roles["targets"].KeyIDs, DeepEquals, []string{newID})
+	deprecations, err = local.(KeyDeprecationStore).GetKeyDeprecations()
+	c.Assert(err, IsNil)
+	c.Assert(deprecations, HasLen, 0)
+
+	// check revoking a deprecated key removes the deprecation
+	otherID := genKey(c, r, "targets")
+	c.Assert(r.DeprecateKey("targets", otherID, graceUntil), IsNil)
+	c.Assert(r.RevokeKey("targets", otherID), IsNil)
+	deprecations, err = local.(KeyDeprecationStore).GetKeyDeprecations()
+	c.Assert(err, IsNil)
+	c.Assert(deprecations, HasLen, 0)
+
+	// check a store which can't record deprecations is rejected
+	r, err = NewRepo(struct{ LocalStore }{local})
+	c.Assert(err, IsNil)
+	c.Assert(r.DeprecateKey("targets", newID, graceUntil), Equals, ErrKeyDeprecationStoreUnsupported)
+}
+
+func (RepoSuite) TestSetThreshold(c *C) {
+	local := MemoryStore(make(map[string]json.RawMessage), nil)
+	r, err := NewRepo(local)
+	c.Assert(err, IsNil)
+
+	// setting the threshold of an unknown role returns ErrInvalidRole
+	c.Assert(r.SetThreshold("foo", 1), DeepEquals, ErrInvalidRole{"foo"})
+
+	// setting the threshold of a role without keys returns ErrNotEnoughKeys
+	genKey(c, r, "root")
+	c.Assert(r.SetThreshold("targets", 1), DeepEquals, ErrNotEnoughKeys{"targets", 0, 1})
+
+	// setting a threshold higher than the number of keys returns
+	// ErrNotEnoughKeys
+	id := genKey(c, r, "targets")
+	genKey(c, r, "targets")
+	c.Assert(r.SetThreshold("targets", 3), DeepEquals, ErrNotEnoughKeys{"targets", 2, 3})
+
+	// setting a non-positive threshold returns ErrInvalidThreshold
+	c.Assert(r.SetThreshold("targets", 0), Equals, verify.ErrInvalidThreshold)
+
+	// check the threshold is set and root.json is re-signed with a new
+	// version
+	root, err := r.root()
+	c.Assert(err, IsNil)
+	version := root.Version
+	c.Assert(r.SetThreshold("targets", 2), IsNil)
+	root, err = r.root()
+	c.Assert(err, IsNil)
+	c.Assert(root.Roles["targets"].Threshold, Equals, 2)
+	c.Assert(root.Version, Equals, version+1)
+	db, err := r.db()
+	c.Assert(err, IsNil)
+	c.Assert(r.verifySignature("root.json", db), IsNil)
+	c.Assert(r.GetMeta()["root.json"], DeepEquals, local.(*memoryStore).meta["root.json"])
+
+	// check deprecated keys are not counted
+	c.Assert(r.SetThreshold("targets", 1), IsNil)
+	c.Assert(r.DeprecateKey("targets", id, time.Now().Add(time.Hour)), IsNil)
+	c.Assert(r.SetThreshold("targets", 2), DeepEquals, ErrNotEnoughKeys{"targets", 1, 2})
+}
+
 func (RepoSuite) TestSign(c *C) {
 	meta := map[string]json.RawMessage{"root.json": []byte(`{"signed":{},"signatures":[]}`)}
 	local := MemoryStore(meta, nil)
@@ -340,6 +598,254 @@ func (RepoSuite) TestSign(c *C) {
 	checkSigIDs(key.PublicData().ID(), newKey.PublicData().ID())
 }
 
+// hsmSigner is a stub for a signer whose private key is held externally (e.g.
+// in an HSM), which the repo never has access to.
+type hsmSigner struct {
+	key ed25519.PrivateKey
+}
+
+func newHSMSigner(c *C) *hsmSigner {
+	_, key, err := ed25519.GenerateKey(nil)
+	c.Assert(err, IsNil)
+	return &hsmSigner{key}
+}
+
+func (s *hsmSigner) PublicData() *data.Key {
+	return &data.Key{
+		Type:  data.KeyTypeEd25519,
+		Value: data.KeyValue{Public: []byte(s.key.Public().(ed25519.PublicKey))},
+	}
+}
+
+func (s *hsmSigner) ID() string               { return s.PublicData().ID() }
+func (s *hsmSigner) Type() string             { return data.KeyTypeEd25519 }
+func (s *hsmSigner) Public() crypto.PublicKey { return s.key.Public() }
+
+func (s *hsmSigner) Sign(rand io.Reader, msg []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return s.key.Sign(rand, msg, opts)
+}
+
+func (RepoSuite) TestThresholdStatus(c *C) {
+	files := map[string][]byte{"/foo.txt": []byte("foo")}
+	r, err := NewRepo(MemoryStore(make(map[string]json.RawMessage), files))
+	c.Assert(err, IsNil)
+
+	// add two external targets keys with a threshold of two
+	genKey(c, r, "root")
+	signers := []*hsmSigner{newHSMSigner(c), newHSMSigner(c)}
+	for _, signer := range signers {
+		c.Assert(r.AddVerificationKey("targets", signer.PublicData()), IsNil)
+	}
+	c.Assert(r.SetThreshold("targets", 2), IsNil)
+	c.Assert(r.AddTarget("foo.txt", nil), IsNil)
+
+	_, _, err = r.ThresholdStatus("foo")
+	c.Assert(err, Equals, ErrInvalidRole{"foo"})
+	_, _, err = r.ThresholdStatus("snapshot")
+	c.Assert(err, Equals, ErrMissingMetadata{"snapshot.json"})
+
+	// check the count increases as each key signs
+	have, need, err := r.ThresholdStatus("targets")
+	c.Assert(err, IsNil)
+	c.Assert(have, Equals, 0)
+	c.Assert(need, Equals, 2)
+	c.Assert(r.SignWithSigner("targets.json", signers[0]), IsNil)
+	have, need, err = r.ThresholdStatus("targets")
+	c.Assert(err, IsNil)
+	c.Assert(have, Equals, 1)
+	c.Assert(need, Equals, 2)
+
+	// check signing twice with the same key is counted once
+	c.Assert(r.SignWithSigner("targets.json", signers[0]), IsNil)
+	have, _, err = r.ThresholdStatus("targets")
+	c.Assert(err, IsNil)
+	c.Assert(have, Equals, 1)
+
+	c.Assert(r.SignWithSigner("targets.json", signers[1]), IsNil)
+	have, need, err = r.ThresholdStatus("targets")
+	c.Assert(err, IsNil)
+	c.Assert(have, Equals, 2)
+	c.Assert(need, Equals, 2)
+
+	// check the root.json signed with the local key meets its threshold
+	have, need, err = r.ThresholdStatus("root")
+	c.Assert(err, IsNil)
+	c.Assert(have, Equals, 1)
+	c.Assert(need, Equals, 1)
+}
+
+func (RepoSuite) TestSignWith(c *C) {
+	files := map[string][]byte{"/foo.txt": []byte("foo")}
+	r, err := NewRepo(MemoryStore(make(map[string]json.RawMessage), files))
+	c.Assert(err, IsNil)
+
+	// generate three targets keys with a threshold of two
+	for _, role := range []string{"root", "snapshot", "timestamp"} {
+		genKey(c, r, role)
+	}
+	ids := []string{genKey(c, r, "targets"), genKey(c, r, "targets"), genKey(c, r, "targets")}
+	c.Assert(r.SetThreshold("targets", 2), IsNil)
+	c.Assert(r.AddTarget("foo.txt", nil), IsNil)
+
+	// remove the signatures added with every key
+	s, err := r.SignedMeta("targets")
+	c.Assert(err, IsNil)
+	c.Assert(s.Signatures, HasLen, 3)
+	s.Signatures = nil
+	b, err := json.Marshal(s)
+	c.Assert(err, IsNil)
+	c.Assert(r.writeMeta("targets.json", b), IsNil)
+
+	// check keys not held for the role are rejected
+	snapshotKeys, err := r.local.GetSigningKeys("snapshot")
+	c.Assert(err, IsNil)
+	c.Assert(snapshotKeys, HasLen, 1)
+	c.Assert(r.SignWith("foo.json", ids[0]), Equals, ErrInvalidRole{"foo"})
+	c.Assert(r.SignWith("targets.json"), Equals, ErrInsufficientKeys{"targets.json"})
+	c.Assert(r.SignWith("targets.json", ids[0], "foo"), Equals, ErrKeyNotFound{"targets", "foo"})
+	c.Assert(r.SignWith("targets.json", snapshotKeys[0].ID()), Equals, ErrKeyNotFound{"targets", snapshotKeys[0].ID()})
+	have, need, err := r.ThresholdStatus("targets")
+	c.Assert(err, IsNil)
+	c.Assert(have, Equals, 0)
+	c.Assert(need, Equals, 2)
+
+	// check signatures are added one custodian at a time
+	c.Assert(r.SignWith("targets.json", ids[0]), IsNil)
+	sigs, err := r.Signatures("targets")
+	c.Assert(err, IsNil)
+	c.Assert(sigs, HasLen, 1)
+	c.Assert(sigs[0].KeyID, Equals, ids[0])
+	c.Assert(r.Snapshot(CompressionTypeNone), FitsTypeOf, ErrInsufficientSignatures{})
+
+	c.Assert(r.SignWith("targets.json", ids[2]), IsNil)
+	sigs, err = r.Signatures("targets")
+	c.Assert(err, IsNil)
+	c.Assert(sigs, HasLen, 2)
+	c.Assert(sigs[0].KeyID, Equals, ids[0])
+	c.Assert(sigs[1].KeyID, Equals, ids[2])
+	have, need, err = r.ThresholdStatus("targets")
+	c.Assert(err, IsNil)
+	c.Assert(have, Equals, 2)
+	c.Assert(need, Equals, 2)
+
+	// check the 2-of-3 signed targets.json can be committed
+	c.Assert(r.Snapshot(CompressionTypeNone), IsNil)
+	c.Assert(r.Timestamp(), IsNil)
+	c.Assert(r.Commit(), IsNil)
+}
+
+func (RepoSuite) TestSignWithSigner(c *C) {
+	files := map[string][]byte{"/foo.txt": []byte("foo")}
+	local := MemoryStore(make(map[string]json.RawMessage), files)
+	r, err := NewRepo(local)
+	c.Assert(err, IsNil)
+
+	// add an external root key and local keys for the other roles
+	hsm := newHSMSigner(c)
+	c.Assert(r.AddVerificationKey("foo", hsm.PublicData()), Equals, ErrInvalidRole{"foo"})
+	c.Assert(r.AddVerificationKey("root", hsm.PublicData()), IsNil)
+	c.Assert(r.AddVerificationKey("root", hsm.PublicData()), IsNil)
+	rootKeys, err := r.RootKeys()
+	c.Assert(err, IsNil)
+	c.Assert(rootKeys, HasLen, 1)
+	c.Assert(rootKeys[0].ID(), Equals, hsm.ID())
+	genKey(c, r, "targets")
+	genKey(c, r, "snapshot")
+	genKey(c, r, "timestamp")
+	c.Assert(r.AddTarget("foo.txt", nil), IsNil)
+
+	// root.json can't be snapshotted until the external key signs it
+	c.Assert(r.Snapshot(CompressionTypeNone), DeepEquals, ErrInsufficientSignatures{"root.json", verify.ErrNoSignatures})
+
+	// signing a role the key does not belong to fails
+	c.Assert(r.SignWithSigner("targets.json", hsm), Equals, ErrKeyNotFound{"targets", hsm.ID()})
+
+	// check the external signature is accepted like a local one
+	c.Assert(r.SignWithSigner("root.json", hsm), IsNil)
+	c.Assert(r.Snapshot(CompressionTypeNone), IsNil)
+	c.Assert(r.Timestamp(), IsNil)
+	c.Assert(r.Commit(), IsNil)
+	db, err := r.db()
+	c.Assert(err, IsNil)
+	c.Assert(r.verifySignature("root.json", db), IsNil)
+}
+
+func (RepoSuite) TestAddRootKey(c *C) {
+	local := MemoryStore(make(map[string]json.RawMessage), nil)
+	r, err := NewRepo(local)
+	c.Assert(err, IsNil)
+	localID := genKey(c, r, "root")
+
+	// check invalid keys are rejected
+	c.Assert(r.AddRootKey(nil), Equals, verify.ErrInvalidKey)
+	c.Assert(r.AddRootKey(&data.Key{Type: "foo"}), DeepEquals, sign.ErrUnknownKeyType{Type: "foo"})
+	invalid := &data.Key{Type: data.KeyTypeEd25519, Value: data.KeyValue{Public: []byte("foo")}}
+	c.Assert(r.AddRootKey(invalid), Equals, verify.ErrInvalidKey)
+
+	// check the key is added to the root role without a private key, and
+	// root.json is re-signed by the existing root key
+	root, err := r.root()
+	c.Assert(err, IsNil)
+	version := root.Version
+	hsm := newHSMSigner(c)
+	c.Assert(r.AddRootKey(hsm.PublicData()), IsNil)
+	root, err = r.root()
+	c.Assert(err, IsNil)
+	c.Assert(root.Version, Equals, version+1)
+	c.Assert(root.Roles["root"].KeyIDs, DeepEquals, []string{localID, hsm.ID()})
+	c.Assert(root.Keys[hsm.ID()], DeepEquals, hsm.PublicData())
+	signers, err := local.GetSigningKeys("root")
+	c.Assert(err, IsNil)
+	c.Assert(signers, HasLen, 1)
+	sigs, err := r.Signatures("root")
+	c.Assert(err, IsNil)
+	c.Assert(sigs, HasLen, 1)
+	c.Assert(sigs[0].KeyID, Equals, localID)
+
+	// check root.json can be signed with the external key
+	c.Assert(r.SignWithSigner("root.json", hsm), IsNil)
+	sigs, err = r.Signatures("root")
+	c.Assert(err, IsNil)
+	c.Assert(sigs, HasLen, 2)
+}
+
+func (RepoSuite) TestSignedMeta(c *C) {
+	files := map[string][]byte{"/foo.txt": []byte("foo")}
+	local := MemoryStore(make(map[string]json.RawMessage), files)
+	r, err := NewRepo(local)
+	c.Assert(err, IsNil)
+
+	_, err = r.SignedMeta("foo")
+	c.Assert(err, Equals, ErrInvalidRole{"foo"})
+	_, err = r.Signatures("targets")
+	c.Assert(err, Equals, ErrMissingMetadata{"targets.json"})
+
+	// check the signed metadata is that in the local store
+	genKey(c, r, "root")
+	targetsKeys := []string{genKey(c, r, "targets"), genKey(c, r, "targets")}
+	c.Assert(r.AddTarget("foo.txt", nil), IsNil)
+	meta, err := local.GetMeta()
+	c.Assert(err, IsNil)
+	expected := &data.Signed{}
+	c.Assert(json.Unmarshal(meta["targets.json"], expected), IsNil)
+	signed, err := r.SignedMeta("targets")
+	c.Assert(err, IsNil)
+	c.Assert(signed, DeepEquals, expected)
+
+	// check there is a signature from each targets key
+	sigs, err := r.Signatures("targets")
+	c.Assert(err, IsNil)
+	c.Assert(sigs, HasLen, 2)
+	sigIDs := make([]string, len(sigs))
+	for i, sig := range sigs {
+		c.Assert(sig.Method, Equals, data.KeyTypeEd25519)
+		sigIDs[i] = sig.KeyID
+	}
+	sort.Strings(sigIDs)
+	sort.Strings(targetsKeys)
+	c.Assert(sigIDs, DeepEquals, targetsKeys)
+}
+
 func (RepoSuite) TestCommit(c *C) {
 	files := map[string][]byte{"/foo.txt": []byte("foo"), "/bar.txt": []byte("bar")}
 	local := MemoryStore(make(map[string]json.RawMessage), files)
@@ -480,6 +986,115 @@ func (t *tmpDir) readFile(path string) []byte {
 	return data
 }
 
+// failingStore is a LocalStore which fails to write the given metadata, and
+// which does not implement BatchStore.
+type failingStore struct {
+	LocalStore
+	fail string
+}
+
+func (f failingStore) SetMeta(name string, meta json.RawMessage) error {
+	if name == f.fail {
+		return errors.New("write failed")
+	}
+	return f.LocalStore.SetMeta(name, meta)
+}
+
+func (RepoSuite) TestStage(c *C) {
+	files := map[string][]byte{"/foo.txt": []byte("foo"), "/bar.txt": []byte("bar")}
+	meta := make(map[string]json.RawMessage)
+	local := MemoryStore(meta, files)
+	r, err := NewRepo(local)
+	c.Assert(err, IsNil)
+	genKey(c, r, "root")
+	genKey(c, r, "targets")
+	genKey(c, r, "snapshot")
+	genKey(c, r, "timestamp")
+	c.Assert(r.AddTarget("foo.txt", nil), IsNil)
+	c.Assert(r.Snapshot(CompressionTypeNone), IsNil)
+	c.Assert(r.Timestamp(), IsNil)
+	c.Assert(r.Commit(), IsNil)
+	committed := make(map[string]json.RawMessage, len(meta))
+	for name, b := range meta {
+		committed[name] = b
+	}
+
+	// check changes are not written until they are committed
+	r.Stage()
+	c.Assert(r.AddTarget("bar.txt", nil), IsNil)
+	c.Assert(r.Snapshot(CompressionTypeNone), IsNil)
+	c.Assert(meta, DeepEquals, committed)
+	c.Assert(r.Commit(), ErrorMatches, "tuf: invalid snapshot.json in timestamp.json: .*")
+	c.Assert(meta, DeepEquals, committed)
+	c.Assert(r.Timestamp(), IsNil)
+	c.Assert(meta, DeepEquals, committed)
+	c.Assert(r.Commit(), IsNil)
+	c.Assert(meta, DeepEquals, r.meta)
+	targets, err := r.Targets()
+	c.Assert(err, IsNil)
+	c.Assert(targets, HasLen, 2)
+
+	// check changes are rolled back if writing them fails with a store
+	// which does not support batches
+	r, err = NewRepo(failingStore{local, "timestamp.json"})
+	c.Assert(err, IsNil)
+	r.Stage()
+	c.Assert(r.RemoveTarget("bar.txt"), IsNil)
+	c.Assert(r.Snapshot(CompressionTypeNone), IsNil)
+	c.Assert(r.Timestamp(), IsNil)
+	committed = make(map[string]json.RawMessage, len(meta))
+	for name, b := range meta {
+		committed[name] = b
+	}
+	c.Assert(r.Commit(), ErrorMatches, "write failed")
+	c.Assert(meta, DeepEquals, committed)
+
+	// check the changes are written once the store succeeds
+	r.local = local
+	c.Assert(r.Commit(), IsNil)
+	c.Assert(meta, DeepEquals, r.meta)
+}
+
+func (RepoSuite) TestVerify(c *C) {
+	files := map[string][]byte{"/foo.txt": []byte("foo"), "/bar.txt": []byte("bar")}
+	r, err := NewRepo(MemoryStore(make(map[string]json.RawMessage), files))
+	c.Assert(err, IsNil)
+
+	// an incomplete repo fails as it does in Commit
+	c.Assert(r.Verify(), DeepEquals, ErrMissingMetadata{"root.json"})
+
+	// a complete repo passes
+	stageRepo(c, r, CompressionTypeGzip)
+	c.Assert(r.Verify(), IsNil)
+
+	// a stale hash in snapshot.json fails
+	c.Assert(r.AddTarget("bar.txt", nil), IsNil)
+	c.Assert(r.Verify(), DeepEquals, errors.New("tuf: invalid targets.json in snapshot.json: wrong length"))
+
+	// a wrong version in snapshot.json fails, even though the hashes match
+	c.Assert(r.Snapshot(CompressionTypeNone), IsNil)
+	snapshot, err := r.snapshot()
+	c.Assert(err, IsNil)
+	meta := snapshot.Meta["targets.json"]
+	meta.Version++
+	snapshot.Meta["targets.json"] = meta
+	c.Assert(r.setMeta("snapshot.json", snapshot), IsNil)
+	c.Assert(r.Timestamp(), IsNil)
+	c.Assert(r.Commit(), IsNil)
+	c.Assert(r.Verify(), DeepEquals, fmt.Errorf("tuf: invalid targets.json in snapshot.json: expected version %d, got %d", meta.Version, meta.Version-1))
+
+	// a wrong version in timestamp.json fails
+	c.Assert(r.Snapshot(CompressionTypeNone), IsNil)
+	c.Assert(r.Timestamp(), IsNil)
+	timestamp, err := r.timestamp()
+	c.Assert(err, IsNil)
+	meta = timestamp.Meta["snapshot.json"]
+	meta.Version = 100
+	timestamp.Meta["snapshot.json"] = meta
+	c.Assert(r.setMeta("timestamp.json", timestamp), IsNil)
+	c.Assert(r.Verify(), ErrorMatches, "tuf: invalid snapshot.json in timestamp.json: expected version 100, got .*")
+}
+
 func (RepoSuite) TestCommitFileSystem(c *C) {
 	tmp := newTmpDir(c)
 	local := FileSystemStore(tmp.path, nil)
@@ -564,6 +1179,57 @@ func (RepoSuite) TestCommitFileSystem(c *C) {
 	tmp.assertEmpty("staged")
 }
 
+func (RepoSuite) TestExportCommittedTargets(c *C) {
+	tmp := newTmpDir(c)
+	local := FileSystemStore(tmp.path, nil)
+	r, err := NewRepo(local)
+	c.Assert(err, IsNil)
+	c.Assert(r.Init(true), IsNil)
+	genKeys(c, r)
+	tmp.writeStagedTarget("foo.txt", "foo")
+	c.Assert(r.AddTarget("foo.txt", nil), IsNil)
+	c.Assert(r.Snapshot(CompressionTypeNone), IsNil)
+	c.Assert(r.Timestamp(), IsNil)
+	c.Assert(r.Commit(), IsNil)
+	tmp.assertEmpty("staged")
+
+	// check the committed target is exported under its hashed paths
+	export := func() (map[string]string, error) {
+		var buf bytes.Buffer
+		if err := r.Export(&buf); err != nil {
+			return nil, err
+		}
+		files := make(map[string]string)
+		tr := tar.NewReader(&buf)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				return files, nil
+			}
+			c.Assert(err, IsNil)
+			b, err := ioutil.ReadAll(tr)
+			c.Assert(err, IsNil)
+			files[hdr.Name] = string(b)
+		}
+	}
+	files, err := export()
+	c.Assert(err, IsNil)
+	t, err := r.targets()
+	c.Assert(err, IsNil)
+	paths := util.HashedPaths("targets/foo.txt", t.Targets["/foo.txt"].Hashes)
+	c.Assert(paths, HasLen, 1)
+	c.Assert(files[paths[0]], Equals, "foo")
+	_, ok := files["targets/foo.txt"]
+	c.Assert(ok, Equals, false)
+	_, ok = files[ExportManifest]
+	c.Assert(ok, Equals, true)
+
+	// check a modified target file is not exported
+	c.Assert(ioutil.WriteFile(filepath.Join(tmp.path, "repository", filepath.FromSlash(paths[0])), []byte("bar"), 0644), IsNil)
+	_, err = export()
+	c.Assert(err, FitsTypeOf, ErrWrongTarget{})
+}
+
 func (RepoSuite) TestConsistentSnapshot(c *C) {
 	tmp := newTmpDir(c)
 	local := FileSystemStore(tmp.path, nil)
@@ -621,6 +1287,175 @@ func (RepoSuite) TestConsistentSnapshot(c *C) {
 	}
 }
 
+func (RepoSuite) TestCompressedSnapshot(c *C) {
+	tmp := newTmpDir(c)
+	local := FileSystemStore(tmp.path, nil)
+	r, err := NewRepo(local, "sha512", "sha256")
+	c.Assert(err, IsNil)
+
+	genKey(c, r, "root")
+	genKey(c, r, "targets")
+	genKey(c, r, "snapshot")
+	genKey(c, r, "timestamp")
+	tmp.writeStagedTarget("foo.txt", "foo")
+	c.Assert(r.AddTarget("foo.txt", nil), IsNil)
+	c.Assert(r.Snapshot(CompressionTypeGzip), IsNil)
+	c.Assert(r.Timestamp(), IsNil)
+	c.Assert(r.Commit(), IsNil)
+
+	// check targets.json.gz is listed in snapshot.json with the version of
+	// targets.json, and decompresses to targets.json
+	snapshot, err := r.snapshot()
+	c.Assert(err, IsNil)
+	meta, ok := snapshot.Meta["targets.json.gz"]
+	c.Assert(ok, Equals, true)
+	c.Assert(meta.Version, Equals, snapshot.Meta["targets.json"].Version)
+	gz, err := gzip.NewReader(bytes.NewReader(tmp.readFile("repository/targets.json.gz")))
+	c.Assert(err, IsNil)
+	targetsJSON, err := ioutil.ReadAll(gz)
+	c.Assert(err, IsNil)
+	c.Assert(targetsJSON, DeepEquals, tmp.readFile("repository/targets.json"))
+
+	// check the compressed metadata is loaded by a new repo
+	r, err = NewRepo(local, "sha512", "sha256")
+	c.Assert(err, IsNil)
+	c.Assert(r.Commit(), IsNil)
+
+	// check a modified targets.json.gz fails to commit
+	c.Assert(local.SetMeta("targets.json.gz", []byte("foo")), IsNil)
+	r, err = NewRepo(local, "sha512", "sha256")
+	c.Assert(err, IsNil)
+	c.Assert(r.Commit(), ErrorMatches, "tuf: invalid targets.json.gz in snapshot.json: .*")
+
+	// check snapshotting without compression removes targets.json.gz from
+	// snapshot.json
+	c.Assert(r.Snapshot(CompressionTypeNone), IsNil)
+	c.Assert(r.Timestamp(), IsNil)
+	c.Assert(r.Commit(), IsNil)
+	snapshot, err = r.snapshot()
+	c.Assert(err, IsNil)
+	_, ok = snapshot.Meta["targets.json.gz"]
+	c.Assert(ok, Equals, false)
+}
+
+func (RepoSuite) TestExportImportKeys(c *C) {
+	files := map[string][]byte{"/foo.txt": []byte("foo")}
+	local := MemoryStore(make(map[string]json.RawMessage), files)
+	r, err := NewRepo(local)
+	c.Assert(err, IsNil)
+	keyIDs, err := r.InitDefaultRoles()
+	c.Assert(err, IsNil)
+	c.Assert(r.AddTarget("foo.txt", nil), IsNil)
+	c.Assert(r.Snapshot(CompressionTypeNone), IsNil)
+	c.Assert(r.Timestamp(), IsNil)
+	c.Assert(r.Commit(), IsNil)
+
+	var buf bytes.Buffer
+	pass := []byte("s3cr3t")
+	c.Assert(r.ExportKeys(&buf, pass), IsNil)
+	exported := buf.Bytes()
+
+	// create a repo with the same metadata but no keys
+	meta, err := local.GetMeta()
+	c.Assert(err, IsNil)
+	copied := make(map[string]json.RawMessage, len(meta))
+	for name, b := range meta {
+		copied[name] = b
+	}
+	restored := MemoryStore(copied, files)
+	r, err = NewRepo(restored)
+	c.Assert(err, IsNil)
+	c.Assert(r.Sign("timestamp.json"), DeepEquals, ErrInsufficientKeys{"timestamp.json"})
+
+	// check the wrong passphrase fails without importing any keys
+	c.Assert(r.ImportKeys(bytes.NewReader(exported), []byte("wrong")), Equals, encrypted.ErrDecryptionFailed)
+	signers, err := restored.GetSigningKeys("timestamp")
+	c.Assert(err, IsNil)
+	c.Assert(signers, HasLen, 0)
+
+	// check the imported keys have the same IDs and roles, and can sign
+	c.Assert(r.ImportKeys(bytes.NewReader(exported), pass), IsNil)
+	for role, id := range keyIDs {
+		signers, err := restored.GetSigningKeys(role)
+		c.Assert(err, IsNil)
+		c.Assert(signers, HasLen, 1)
+		c.Assert(signers[0].ID(), Equals, id)
+	}
+	c.Assert(r.Timestamp(), IsNil)
+	c.Assert(r.Commit(), IsNil)
+
+	// check importing again does not duplicate keys
+	c.Assert(r.ImportKeys(bytes.NewReader(exported), pass), IsNil)
+	signers, err = restored.GetSigningKeys("timestamp")
+	c.Assert(err, IsNil)
+	c.Assert(signers, HasLen, 1)
+
+	// check an unknown format version is rejected
+	unknown := bytes.Replace(exported, []byte(`"version":1`), []byte(`"version":2`), 1)
+	c.Assert(r.ImportKeys(bytes.NewReader(unknown), pass), DeepEquals, ErrUnsupportedKeysVersion{2})
+}
+
+func (RepoSuite) TestTimestampWithCustom(c *C) {
+	files := map[string][]byte{"/foo.txt": []byte("foo")}
+	local := MemoryStore(make(map[string]json.RawMessage), files)
+	r, err := NewRepo(local)
+	c.Assert(err, IsNil)
+	_, err = r.InitDefaultRoles()
+	c.Assert(err, IsNil)
+	c.Assert(r.AddTarget("foo.txt", nil), IsNil)
+	c.Assert(r.Snapshot(CompressionTypeNone), IsNil)
+
+	custom := json.RawMessage(`{"build":"1234"}`)
+	c.Assert(r.TimestampWithCustom(custom), IsNil)
+	c.Assert(r.Commit(), IsNil)
+	timestamp, err := r.timestamp()
+	c.Assert(err, IsNil)
+	c.Assert(timestamp.Custom, NotNil)
+	c.Assert(*timestamp.Custom, DeepEquals, custom)
+
+	// check the custom data is not kept by Timestamp
+	c.Assert(r.Timestamp(), IsNil)
+	timestamp, err = r.timestamp()
+	c.Assert(err, IsNil)
+	c.Assert(timestamp.Custom, IsNil)
+}
+
+func (RepoSuite) TestSetTargetCustom(c *C) {
+	files := map[string][]byte{"/foo.txt": []byte("foo")}
+	local := MemoryStore(make(map[string]json.RawMessage), files)
+	r, err := NewRepo(local)
+	c.Assert(err, IsNil)
+	_, err = r.InitDefaultRoles()
+	c.Assert(err, IsNil)
+	c.Assert(r.AddTarget("foo.txt", json.RawMessage(`{"channel":"beta"}`)), IsNil)
+	before, err := r.targets()
+	c.Assert(err, IsNil)
+
+	// check the custom metadata is replaced without reading the target,
+	// keeping its length and hashes
+	delete(files, "/foo.txt")
+	stable := json.RawMessage(`{"channel":"stable"}`)
+	c.Assert(r.SetTargetCustom("foo.txt", stable), IsNil)
+	after, err := r.targets()
+	c.Assert(err, IsNil)
+	c.Assert(after.Version, Equals, before.Version+1)
+	meta := after.Targets["/foo.txt"]
+	c.Assert(meta.Length, Equals, before.Targets["/foo.txt"].Length)
+	c.Assert(meta.Hashes, DeepEquals, before.Targets["/foo.txt"].Hashes)
+	c.Assert(*meta.Custom, DeepEquals, stable)
+	c.Assert(r.Snapshot(CompressionTypeNone), IsNil)
+	c.Assert(r.Timestamp(), IsNil)
+	c.Assert(r.Commit(), IsNil)
+
+	// check nil removes the custom metadata
+	c.Assert(r.SetTargetCustom("/foo.txt", nil), IsNil)
+	after, err = r.targets()
+	c.Assert(err, IsNil)
+	c.Assert(after.Targets["/foo.txt"].Custom, IsNil)
+
+	c.Assert(r.SetTargetCustom("bar.txt", stable), Equals, ErrUnknownTarget{"/bar.txt"})
+}
+
 func (RepoSuite) TestExpiresAndVersion(c *C) {
 	files := map[string][]byte{"/foo.txt": []byte("foo")}
 	local := MemoryStore(make(map[string]json.RawMessage), files)
@@ -706,6 +1541,161 @@ func (RepoSuite) TestExpiresAndVersion(c *C) {
 	c.Assert(timestamp.Version, Equals, 2)
 }
 
+func (RepoSuite) TestSetExpiry(c *C) {
+	files := map[string][]byte{"/foo.txt": []byte("foo")}
+	local := MemoryStore(make(map[string]json.RawMessage), files)
+	r, err := NewRepo(local)
+	c.Assert(err, IsNil)
+
+	c.Assert(r.SetExpiry("foo", time.Hour), Equals, ErrInvalidRole{"foo"})
+	c.Assert(r.SetExpiry("timestamp", time.Hour), IsNil)
+	c.Assert(r.SetExpiry("snapshot", 2*time.Hour), IsNil)
+	c.Assert(r.SetExpiry("targets", 3*time.Hour), IsNil)
+	c.Assert(r.SetExpiry("root", 4*time.Hour), IsNil)
+
+	// check the expiry windows are used by the methods which don't take an
+	// expires time
+	stageRepo(c, r, CompressionTypeNone)
+	root, err := r.root()
+	c.Assert(err, IsNil)
+	assertExpires(c, root.Expires, 4*time.Hour)
+	targets, err := r.targets()
+	c.Assert(err, IsNil)
+	assertExpires(c, targets.Expires, 3*time.Hour)
+	snapshot, err := r.snapshot()
+	c.Assert(err, IsNil)
+	assertExpires(c, snapshot.Expires, 2*time.Hour)
+	timestamp, err := r.timestamp()
+	c.Assert(err, IsNil)
+	assertExpires(c, timestamp.Expires, time.Hour)
+
+	// check Sign stamps targets.json with the expiry window, replacing the
+	// existing signature
+	c.Assert(r.AddTargetWithExpires("foo.txt", nil, time.Now().Add(48*time.Hour)), IsNil)
+	c.Assert(r.Sign("targets.json"), IsNil)
+	targets, err = r.targets()
+	c.Assert(err, IsNil)
+	assertExpires(c, targets.Expires, 3*time.Hour)
+	s, err := r.signedMeta("targets.json")
+	c.Assert(err, IsNil)
+	c.Assert(s.Signatures, HasLen, 1)
+
+	// check explicit expires times take precedence
+	expires := time.Now().Add(48 * time.Hour)
+	c.Assert(r.TimestampWithExpires(expires), IsNil)
+	timestamp, err = r.timestamp()
+	c.Assert(err, IsNil)
+	c.Assert(timestamp.Expires.Unix(), Equals, expires.Round(time.Second).Unix())
+
+	// check a non-positive window restores the default
+	c.Assert(r.SetExpiry("timestamp", 0), IsNil)
+	c.Assert(r.Timestamp(), IsNil)
+	timestamp, err = r.timestamp()
+	c.Assert(err, IsNil)
+	assertExpires(c, timestamp.Expires, 24*time.Hour)
+}
+
+func (RepoSuite) TestDefaultCompression(c *C) {
+	files := map[string][]byte{"/foo.txt": []byte("foo")}
+	local := MemoryStore(make(map[string]json.RawMessage), files)
+	r, err := NewRepo(local)
+	c.Assert(err, IsNil)
+	genKeys(c, r)
+	c.Assert(r.AddTarget("foo.txt", nil), IsNil)
+	assertCompressed := func(compressed bool) {
+		snapshot, err := r.snapshot()
+		c.Assert(err, IsNil)
+		_, ok := snapshot.Meta["targets.json.gz"]
+		c.Assert(ok, Equals, compressed)
+	}
+
+	// check snapshots are uncompressed by default
+	c.Assert(r.DefaultCompression(), Equals, CompressionTypeNone)
+	c.Assert(r.SnapshotDefault(), IsNil)
+	assertCompressed(false)
+
+	// check the default compression is applied until it is changed
+	r.SetDefaultCompression(CompressionTypeGzip)
+	c.Assert(r.DefaultCompression(), Equals, CompressionTypeGzip)
+	for i := 0; i < 2; i++ {
+		c.Assert(r.SnapshotDefault(), IsNil)
+		assertCompressed(true)
+	}
+	c.Assert(r.Timestamp(), IsNil)
+	c.Assert(r.Commit(), IsNil)
+	r.SetDefaultCompression(CompressionTypeNone)
+	c.Assert(r.SnapshotDefault(), IsNil)
+	assertCompressed(false)
+}
+
+func (RepoSuite) TestSetVersion(c *C) {
+	files := map[string][]byte{"/foo.txt": []byte("foo")}
+	local := MemoryStore(make(map[string]json.RawMessage), files)
+	r, err := NewRepo(local)
+	c.Assert(err, IsNil)
+	stageRepo(c, r, CompressionTypeNone)
+
+	// check invalid roles and versions are rejected
+	c.Assert(r.SetVersion("foo", 10), Equals, ErrInvalidRole{"foo"})
+	c.Assert(r.SetVersion("snapshot", 1), Equals, ErrInvalidVersion{"snapshot", 1, 1})
+	c.Assert(r.SetVersion("snapshot", 0), Equals, ErrInvalidVersion{"snapshot", 0, 1})
+
+	// check the versions are used by the next changes, and then
+	// incremented as usual
+	c.Assert(r.SetVersion("targets", 20), IsNil)
+	c.Assert(r.SetVersion("snapshot", 10), IsNil)
+	c.Assert(r.SetVersion("timestamp", 30), IsNil)
+	c.Assert(r.AddTarget("foo.txt", nil), IsNil)
+	c.Assert(r.Snapshot(CompressionTypeNone), IsNil)
+	c.Assert(r.Timestamp(), IsNil)
+	c.Assert(r.Snapshot(CompressionTypeNone), IsNil)
+	c.Assert(r.Timestamp(), IsNil)
+	targets, err := r.targets()
+	c.Assert(err, IsNil)
+	c.Assert(targets.Version, Equals, 20)
+	snapshot, err := r.snapshot()
+	c.Assert(err, IsNil)
+	c.Assert(snapshot.Version, Equals, 11)
+	c.Assert(snapshot.Meta["targets.json"].Version, Equals, 20)
+	timestamp, err := r.timestamp()
+	c.Assert(err, IsNil)
+	c.Assert(timestamp.Version, Equals, 31)
+	c.Assert(timestamp.Meta["snapshot.json"].Version, Equals, 11)
+	c.Assert(r.Commit(), IsNil)
+
+	// check a lower version is rejected once a version has been staged
+	c.Assert(r.SetVersion("timestamp", 31), Equals, ErrInvalidVersion{"timestamp", 31, 31})
+}
+
+func (RepoSuite) TestNewRepoWithExpiry(c *C) {
+	files := map[string][]byte{"/foo.txt": []byte("foo")}
+	local := MemoryStore(make(map[string]json.RawMessage), files)
+	_, err := NewRepoWithExpiry(local, map[string]time.Duration{"foo": time.Hour})
+	c.Assert(err, Equals, ErrInvalidRole{"foo"})
+	r, err := NewRepoWithExpiry(local, map[string]time.Duration{
+		"timestamp": time.Hour,
+		"snapshot":  2 * time.Hour,
+		"targets":   3 * time.Hour,
+	})
+	c.Assert(err, IsNil)
+
+	// check the configured windows are used, and the default window for
+	// root.json
+	stageRepo(c, r, CompressionTypeNone)
+	root, err := r.root()
+	c.Assert(err, IsNil)
+	assertExpires(c, root.Expires, data.DefaultExpires("root").Sub(time.Now()))
+	targets, err := r.targets()
+	c.Assert(err, IsNil)
+	assertExpires(c, targets.Expires, 3*time.Hour)
+	snapshot, err := r.snapshot()
+	c.Assert(err, IsNil)
+	assertExpires(c, snapshot.Expires, 2*time.Hour)
+	timestamp, err := r.timestamp()
+	c.Assert(err, IsNil)
+	assertExpires(c, timestamp.Expires, time.Hour)
+}
+
 func (RepoSuite) TestHashAlgorithm(c *C) {
 	files := map[string][]byte{"/foo.txt": []byte("foo")}
 	local := MemoryStore(make(map[string]json.RawMessage), files)
@@ -817,6 +1807,44 @@ func (RepoSuite) TestKeyPersistence(c *C) {
 	assertKeys("targets", false, []*sign.PrivateKey{key})
 }
 
+func (RepoSuite) TestChangePassphrase(c *C) {
+	tmp := newTmpDir(c)
+	oldPass, newPass := []byte("s3cr3t"), []byte("n3w-s3cr3t")
+	r, err := NewRepo(FileSystemStore(tmp.path, testPassphraseFunc(oldPass)))
+	c.Assert(err, IsNil)
+	id := genKey(c, r, "root")
+
+	// changing the passphrase of an unknown role fails
+	c.Assert(r.ChangePassphrase("foo", oldPass, newPass), Equals, ErrInvalidRole{"foo"})
+
+	// changing the passphrase with the wrong passphrase fails and leaves
+	// the keys file untouched
+	keysJSON := tmp.readFile("keys/root.json")
+	c.Assert(r.ChangePassphrase("root", []byte("wrong"), newPass), Equals, ErrWrongPassphrase{"root"})
+	c.Assert(tmp.readFile("keys/root.json"), DeepEquals, keysJSON)
+
+	// check the keys can only be loaded with the new passphrase, and have
+	// the same ID
+	c.Assert(r.ChangePassphrase("root", oldPass, newPass), IsNil)
+	_, err = FileSystemStore(tmp.path, testPassphraseFunc(oldPass)).GetSigningKeys("root")
+	c.Assert(err, NotNil)
+	signers, err := FileSystemStore(tmp.path, testPassphraseFunc(newPass)).GetSigningKeys("root")
+	c.Assert(err, IsNil)
+	c.Assert(signers, HasLen, 1)
+	c.Assert(signers[0].ID(), Equals, id)
+
+	// changing the passphrase of unencrypted keys fails
+	insecure, err := NewRepo(FileSystemStore(newTmpDir(c).path, nil))
+	c.Assert(err, IsNil)
+	genKey(c, insecure, "root")
+	c.Assert(insecure.ChangePassphrase("root", nil, newPass), Equals, ErrKeysNotEncrypted{"root"})
+
+	// changing the passphrase fails if the store does not support it
+	r, err = NewRepo(&failingStore{LocalStore: MemoryStore(make(map[string]json.RawMessage), nil)})
+	c.Assert(err, IsNil)
+	c.Assert(r.ChangePassphrase("root", oldPass, newPass), Equals, ErrPassphraseStoreUnsupported)
+}
+
 func (RepoSuite) TestManageMultipleTargets(c *C) {
 	tmp := newTmpDir(c)
 	local := FileSystemStore(tmp.path, nil)
@@ -881,6 +1909,67 @@ func (RepoSuite) TestManageMultipleTargets(c *C) {
 	c.Assert(t.Targets, HasLen, 0)
 }
 
+func (RepoSuite) TestRemoveTargetsMatching(c *C) {
+	files := map[string][]byte{
+		"/v1/foo.txt":     []byte("foo"),
+		"/v1/bar.bin":     []byte("bar"),
+		"/v1/sub/baz.txt": []byte("baz"),
+		"/v10/foo.txt":    []byte("foo"),
+		"/v2/foo.txt":     []byte("foo"),
+		"/v2/sub/qux.txt": []byte("qux"),
+		"/other/quux.txt": []byte("quux"),
+	}
+	local := MemoryStore(make(map[string]json.RawMessage), files)
+	r, err := NewRepo(local)
+	c.Assert(err, IsNil)
+	genKey(c, r, "targets")
+	c.Assert(r.AddTargets(nil, nil), IsNil)
+
+	assertTargets := func(paths ...string) {
+		t, err := r.targets()
+		c.Assert(err, IsNil)
+		c.Assert(t.Targets, HasLen, len(paths))
+		for _, p := range paths {
+			_, ok := t.Targets[p]
+			c.Assert(ok, Equals, true, Commentf("missing %s", p))
+		}
+	}
+	targetsVersion := func() int {
+		t, err := r.targets()
+		c.Assert(err, IsNil)
+		return t.Version
+	}
+
+	// an empty pattern is rejected
+	_, err = r.RemoveTargetsMatching("")
+	c.Assert(err, Equals, ErrEmptyPattern)
+
+	// a pattern matching nothing does not change targets.json
+	version := targetsVersion()
+	removed, err := r.RemoveTargetsMatching("v3/")
+	c.Assert(err, IsNil)
+	c.Assert(removed, HasLen, 0)
+	c.Assert(targetsVersion(), Equals, version)
+
+	// a directory prefix removes the whole subtree in one version
+	removed, err = r.RemoveTargetsMatching("v1/")
+	c.Assert(err, IsNil)
+	c.Assert(removed, DeepEquals, []string{"/v1/bar.bin", "/v1/foo.txt", "/v1/sub/baz.txt"})
+	c.Assert(targetsVersion(), Equals, version+1)
+	assertTargets("/v10/foo.txt", "/v2/foo.txt", "/v2/sub/qux.txt", "/other/quux.txt")
+
+	// a glob does not match across directories
+	removed, err = r.RemoveTargetsMatching("/*/foo.txt")
+	c.Assert(err, IsNil)
+	c.Assert(removed, DeepEquals, []string{"/v10/foo.txt", "/v2/foo.txt"})
+	assertTargets("/v2/sub/qux.txt", "/other/quux.txt")
+
+	// a malformed glob returns an error
+	_, err = r.RemoveTargetsMatching("[")
+	c.Assert(err, Equals, path.ErrBadPattern)
+	assertTargets("/v2/sub/qux.txt", "/other/quux.txt")
+}
+
 func (RepoSuite) TestCustomTargetMetadata(c *C) {
 	files := map[string][]byte{
 		"/foo.txt": []byte("foo"),
@@ -917,3 +2006,273 @@ func (RepoSuite) TestCustomTargetMetadata(c *C) {
 	assertCustomMeta("bar.txt", nil)
 	assertCustomMeta("foo.txt", &custom)
 }
+
+func (RepoSuite) TestReplaceTarget(c *C) {
+	tmp := newTmpDir(c)
+	local := FileSystemStore(tmp.path, nil)
+	r, err := NewRepo(local)
+	c.Assert(err, IsNil)
+	c.Assert(r.Init(true), IsNil)
+	genKey(c, r, "root")
+	genKey(c, r, "targets")
+	genKey(c, r, "snapshot")
+	genKey(c, r, "timestamp")
+	commit := func() {
+		c.Assert(r.Snapshot(CompressionTypeNone), IsNil)
+		c.Assert(r.Timestamp(), IsNil)
+		c.Assert(r.Commit(), IsNil)
+	}
+
+	// check an unknown target cannot be replaced
+	c.Assert(r.ReplaceTarget("app-latest.bin", bytes.NewReader([]byte("v1")), nil), Equals, ErrUnknownTarget{"/app-latest.bin"})
+	tmp.assertNotExist("staged/targets/app-latest.bin")
+
+	custom := json.RawMessage(`{"version":"1.0"}`)
+	c.Assert(r.AddTargetReader("app-latest.bin", bytes.NewReader([]byte("v1")), custom), IsNil)
+	commit()
+	targets, err := r.Targets()
+	c.Assert(err, IsNil)
+	v1 := targets["/app-latest.bin"]
+
+	// check the target meta is replaced, keeping the custom metadata
+	c.Assert(r.ReplaceTarget("app-latest.bin", bytes.NewReader([]byte("v2")), nil), IsNil)
+	targets, err = r.Targets()
+	c.Assert(err, IsNil)
+	c.Assert(targets, HasLen, 1)
+	expected, err := util.GenerateFileMeta(bytes.NewReader([]byte("v2")))
+	c.Assert(err, IsNil)
+	expected.Custom = &custom
+	c.Assert(targets["/app-latest.bin"], DeepEquals, expected)
+
+	// check both versions are published under their hashed paths
+	commit()
+	for content, meta := range map[string]data.FileMeta{"v1": v1, "v2": expected} {
+		for _, path := range util.HashedPaths("repository/targets/app-latest.bin", meta.Hashes) {
+			tmp.assertFileContent(path, content)
+		}
+	}
+}
+
+func (RepoSuite) TestAddTargetMeta(c *C) {
+	files := map[string][]byte{"/foo.txt": []byte("foo")}
+	local := MemoryStore(make(map[string]json.RawMessage), files)
+	r, err := NewRepo(local)
+	c.Assert(err, IsNil)
+	genKey(c, r, "targets")
+
+	// check invalid meta is rejected
+	c.Assert(r.AddTargetMeta("big.bin", data.FileMeta{Length: 1}, nil), Equals, ErrInvalidTargetMeta{"/big.bin", "no hashes"})
+	meta, err := util.GenerateFileMeta(bytes.NewReader([]byte("big")), "sha256")
+	c.Assert(err, IsNil)
+	invalid := meta
+	invalid.Length = -1
+	c.Assert(r.AddTargetMeta("big.bin", invalid, nil), Equals, ErrInvalidTargetMeta{"/big.bin", "negative length"})
+
+	// check a target which is not in the store can be added
+	custom := json.RawMessage(`{"foo":"bar"}`)
+	c.Assert(r.AddTargetMeta("big.bin", meta, custom), IsNil)
+	targets, err := r.Targets()
+	c.Assert(err, IsNil)
+	expected := meta
+	expected.Custom = &custom
+	c.Assert(targets["/big.bin"], DeepEquals, expected)
+
+	// check existing custom metadata is kept if none is given
+	c.Assert(r.AddTargetMeta("/big.bin", meta, nil), IsNil)
+	targets, err = r.Targets()
+	c.Assert(err, IsNil)
+	c.Assert(targets["/big.bin"], DeepEquals, expected)
+
+	// check the meta matches that generated by AddTarget
+	fooMeta, err := util.GenerateFileMeta(bytes.NewReader(files["/foo.txt"]))
+	c.Assert(err, IsNil)
+	c.Assert(r.AddTargetMeta("foo.txt", fooMeta, nil), IsNil)
+	targets, err = r.Targets()
+	c.Assert(err, IsNil)
+	c.Assert(r.AddTarget("foo.txt", nil), IsNil)
+	generated, err := r.Targets()
+	c.Assert(err, IsNil)
+	c.Assert(targets["/foo.txt"], DeepEquals, generated["/foo.txt"])
+}
+
+func (RepoSuite) TestAddTargetReader(c *C) {
+	tmp := newTmpDir(c)
+	local := FileSystemStore(tmp.path, nil)
+	r, err := NewRepo(local)
+	c.Assert(err, IsNil)
+	c.Assert(r.Init(false), IsNil)
+	genKey(c, r, "root")
+	genKey(c, r, "targets")
+	genKey(c, r, "snapshot")
+	genKey(c, r, "timestamp")
+
+	// check the target is staged and its meta generated from the reader
+	custom := json.RawMessage(`{"foo":"bar"}`)
+	c.Assert(r.AddTargetReader("path/to/foo.txt", bytes.NewReader([]byte("foo")), custom), IsNil)
+	tmp.assertFileContent("staged/targets/path/to/foo.txt", "foo")
+	targets, err := r.Targets()
+	c.Assert(err, IsNil)
+	expected, err := util.GenerateFileMeta(bytes.NewReader([]byte("foo")))
+	c.Assert(err, IsNil)
+	expected.Custom = &custom
+	c.Assert(targets["/path/to/foo.txt"], DeepEquals, expected)
+
+	// check the meta matches that generated by AddTarget
+	c.Assert(r.AddTarget("path/to/foo.txt", nil), IsNil)
+	generated, err := r.Targets()
+	c.Assert(err, IsNil)
+	c.Assert(generated["/path/to/foo.txt"], DeepEquals, expected)
+
+	// check a failed read neither stages the target nor changes targets.json
+	errRead := errors.New("read failed")
+	rd := io.MultiReader(bytes.NewReader([]byte("ba")), iotest.ErrReader(errRead))
+	c.Assert(r.AddTargetReader("bar.txt", rd, nil), Equals, errRead)
+	tmp.assertNotExist("staged/targets/bar.txt")
+	staged, err := ioutil.ReadDir(tmp.stagedTargetPath(""))
+	c.Assert(err, IsNil)
+	c.Assert(staged, HasLen, 1)
+	c.Assert(staged[0].Name(), Equals, "path")
+	targets, err = r.Targets()
+	c.Assert(err, IsNil)
+	c.Assert(targets, HasLen, 1)
+
+	// check committing publishes the target
+	c.Assert(r.Snapshot(CompressionTypeNone), IsNil)
+	c.Assert(r.Timestamp(), IsNil)
+	c.Assert(r.Commit(), IsNil)
+	tmp.assertFileContent("repository/targets/path/to/foo.txt", "foo")
+
+	// check a store which cannot stage targets is rejected
+	r, err = NewRepo(&failingStore{LocalStore: MemoryStore(make(map[string]json.RawMessage), nil)})
+	c.Assert(err, IsNil)
+	genKey(c, r, "targets")
+	c.Assert(r.AddTargetReader("foo.txt", bytes.NewReader([]byte("foo")), nil), Equals, ErrTargetStoreUnsupported)
+}
+
+func (RepoSuite) TestReset(c *C) {
+	local := MemoryStore(make(map[string]json.RawMessage), map[string][]byte{"/foo.txt": []byte("foo")})
+	r, err := NewRepo(local)
+	c.Assert(err, IsNil)
+	bootstrap := func() {
+		c.Assert(r.Init(false), IsNil)
+		stageRepo(c, r, CompressionTypeGzip)
+		c.Assert(r.Commit(), IsNil)
+	}
+	bootstrap()
+	c.Assert(r.SetVersion("targets", 10), IsNil)
+
+	// check reset keeping the keys deletes all the metadata
+	c.Assert(r.Reset(false), IsNil)
+	meta, err := local.GetMeta()
+	c.Assert(err, IsNil)
+	c.Assert(meta, HasLen, 0)
+	targets, err := r.Targets()
+	c.Assert(err, IsNil)
+	c.Assert(targets, HasLen, 0)
+	keys, err := local.GetSigningKeys("targets")
+	c.Assert(err, IsNil)
+	c.Assert(keys, HasLen, 1)
+
+	// check reset removing the keys also deletes them
+	c.Assert(r.Reset(true), IsNil)
+	for _, role := range []string{"root", "targets", "snapshot", "timestamp"} {
+		keys, err := local.GetSigningKeys(role)
+		c.Assert(err, IsNil)
+		c.Assert(keys, HasLen, 0)
+	}
+
+	// check the repo can be bootstrapped again, with the version set
+	// before the reset discarded
+	bootstrap()
+	targetsMeta, err := r.targets()
+	c.Assert(err, IsNil)
+	c.Assert(targetsMeta.Version, Equals, 1)
+	c.Assert(targetsMeta.Targets, HasLen, 1)
+
+	// check staged changes are discarded
+	r.Stage()
+	c.Assert(r.RemoveTarget("foo.txt"), IsNil)
+	c.Assert(r.Reset(true), IsNil)
+	bootstrap()
+	meta, err = local.GetMeta()
+	c.Assert(err, IsNil)
+	c.Assert(meta, HasLen, 5)
+
+	// check a store which cannot be reset
+	r, err = NewRepo(&failingStore{LocalStore: MemoryStore(make(map[string]json.RawMessage), nil)})
+	c.Assert(err, IsNil)
+	c.Assert(r.Reset(true), Equals, ErrResetStoreUnsupported)
+}
+
+func (RepoSuite) TestResetFileSystem(c *C) {
+	tmp := newTmpDir(c)
+	local := FileSystemStore(tmp.path, nil)
+	r, err := NewRepo(local)
+	c.Assert(err, IsNil)
+	bootstrap := func() {
+		c.Assert(r.Init(true), IsNil)
+		stageRepo(c, r, CompressionTypeNone)
+		c.Assert(r.Commit(), IsNil)
+	}
+	tmp.writeStagedTarget("foo.txt", "foo")
+	bootstrap()
+	snapshot, err := r.snapshot()
+	c.Assert(err, IsNil)
+	tmp.assertHashedFilesExist("repository/root.json", snapshot.Meta["root.json"].Hashes)
+	targets, err := r.Targets()
+	c.Assert(err, IsNil)
+	targetHashes := targets["/foo.txt"].Hashes
+	root, err := r.root()
+	c.Assert(err, IsNil)
+	rootVersion := root.Version
+
+	// check reset keeping the keys deletes the committed metadata,
+	// including the hashed copies, but not the targets
+	c.Assert(r.Reset(false), IsNil)
+	for _, name := range topLevelManifests {
+		tmp.assertNotExist(filepath.Join("repository", name))
+	}
+	tmp.assertHashedFilesNotExist("repository/root.json", snapshot.Meta["root.json"].Hashes)
+	tmp.assertHashedFilesNotExist("repository/targets.json", snapshot.Meta["targets.json"].Hashes)
+	tmp.assertHashedFilesExist("repository/targets/foo.txt", targetHashes)
+	tmp.assertExists("keys/targets.json")
+	c.Assert(r.Clean(), Equals, ErrNewRepository)
+
+	// check reset removing the keys also deletes them, and that the repo
+	// can be bootstrapped again
+	c.Assert(r.Reset(true), IsNil)
+	tmp.assertNotExist("keys")
+	tmp.writeStagedTarget("foo.txt", "foo")
+	bootstrap()
+	tmp.assertExists("repository/root.json")
+	root, err = r.root()
+	c.Assert(err, IsNil)
+	c.Assert(root.Version, Equals, rootVersion)
+	keys, err := local.GetSigningKeys("targets")
+	c.Assert(err, IsNil)
+	c.Assert(keys, HasLen, 1)
+}
+
+func (RepoSuite) TestSetMetaBatchRollback(c *C) {
+	tmp := newTmpDir(c)
+	local := FileSystemStore(tmp.path, nil).(BatchStore)
+	c.Assert(local.SetMeta("root.json", []byte("old")), IsNil)
+
+	// make renaming timestamp.json, the last file renamed, fail
+	c.Assert(os.MkdirAll(filepath.Join(tmp.path, "staged", "timestamp.json", "dir"), 0755), IsNil)
+	err := local.SetMetaBatch(map[string]json.RawMessage{
+		"root.json":      []byte("new"),
+		"snapshot.json":  []byte("new"),
+		"timestamp.json": []byte("new"),
+	})
+	c.Assert(err, NotNil)
+
+	// check the replaced file is restored and the new file is removed
+	tmp.assertFileContent("staged/root.json", "old")
+	tmp.assertNotExist("staged/snapshot.json")
+	files, err := ioutil.ReadDir(tmp.path)
+	c.Assert(err, IsNil)
+	for _, f := range files {
+		c.Assert(f.IsDir(), Equals, true, Commentf("temporary file %s left behind", f.Name()))
+	}
+}
@@ -1,7 +1,14 @@
 package sign
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"math/big"
 	"sync"
 
 	"github.com/flynn/go-tuf/data"
@@ -26,9 +33,63 @@ func (k *PrivateKey) PublicData() *data.Key {
 }
 
 func (k *PrivateKey) Signer() Signer {
+	if k.Type == data.KeyTypeECDSA_SHA2_P256 {
+		x, y := elliptic.Unmarshal(elliptic.P256(), k.Value.Public)
+		return &ecdsaSigner{PrivateKey: &ecdsa.PrivateKey{
+			PublicKey: ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y},
+			D:         new(big.Int).SetBytes(k.Value.Private),
+		}}
+	}
 	return &ed25519Signer{PrivateKey: ed25519.PrivateKey(k.Value.Private)}
 }
 
+// ExportPrivateKey returns the private key used by a Signer returned by
+// PrivateKey.Signer, or false if the signer does not expose its private key
+// (e.g. a signer backed by a hardware security module).
+func ExportPrivateKey(s Signer) (*PrivateKey, bool) {
+	switch s := s.(type) {
+	case *ed25519Signer:
+		return &PrivateKey{
+			Type: data.KeyTypeEd25519,
+			Value: PrivateKeyValue{
+				Public:  s.publicData().Value.Public,
+				Private: data.HexBytes(s.PrivateKey),
+			},
+		}, true
+	case *ecdsaSigner:
+		return &PrivateKey{
+			Type: data.KeyTypeECDSA_SHA2_P256,
+			Value: PrivateKeyValue{
+				Public:  s.publicData().Value.Public,
+				Private: data.HexBytes(s.D.Bytes()),
+			},
+		}, true
+	}
+	return nil, false
+}
+
+// ErrUnknownKeyType is returned by GenerateKey for unsupported key types.
+type ErrUnknownKeyType struct {
+	Type string
+}
+
+func (e ErrUnknownKeyType) Error() string {
+	return fmt.Sprintf("tuf: unknown key type %q", e.Type)
+}
+
+// GenerateKey generates a private key of the given type, which must be
+// either data.KeyTypeEd25519 or data.KeyTypeECDSA_SHA2_P256.
+func GenerateKey(keyType data.KeyType) (*PrivateKey, error) {
+	switch keyType {
+	case data.KeyTypeEd25519:
+		return GenerateEd25519Key()
+	case data.KeyTypeECDSA_SHA2_P256:
+		return GenerateECDSAP256Key()
+	default:
+		return nil, ErrUnknownKeyType{string(keyType)}
+	}
+}
+
 func GenerateEd25519Key() (*PrivateKey, error) {
 	public, private, err := ed25519.GenerateKey(rand.Reader)
 	if err != nil {
@@ -67,3 +128,48 @@ func (s *ed25519Signer) publicData() *data.Key {
 func (s *ed25519Signer) Type() string {
 	return data.KeyTypeEd25519
 }
+
+func GenerateECDSAP256Key() (*PrivateKey, error) {
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &PrivateKey{
+		Type: data.KeyTypeECDSA_SHA2_P256,
+		Value: PrivateKeyValue{
+			Public:  data.HexBytes(elliptic.Marshal(elliptic.P256(), k.X, k.Y)),
+			Private: data.HexBytes(k.D.Bytes()),
+		},
+	}, nil
+}
+
+type ecdsaSigner struct {
+	*ecdsa.PrivateKey
+
+	id     string
+	idOnce sync.Once
+}
+
+var _ Signer = &ecdsaSigner{}
+
+func (s *ecdsaSigner) ID() string {
+	s.idOnce.Do(func() { s.id = s.publicData().ID() })
+	return s.id
+}
+
+func (s *ecdsaSigner) publicData() *data.Key {
+	return &data.Key{
+		Type:  data.KeyTypeECDSA_SHA2_P256,
+		Value: data.KeyValue{Public: elliptic.Marshal(elliptic.P256(), s.X, s.Y)},
+	}
+}
+
+// Sign signs the SHA-256 hash of msg, returning an ASN.1 encoded signature.
+func (s *ecdsaSigner) Sign(rand io.Reader, msg []byte, opts crypto.SignerOpts) ([]byte, error) {
+	hash := sha256.Sum256(msg)
+	return s.PrivateKey.Sign(rand, hash[:], crypto.SHA256)
+}
+
+func (s *ecdsaSigner) Type() string {
+	return data.KeyTypeECDSA_SHA2_P256
+}
@@ -9,8 +9,8 @@ import (
 	"fmt"
 	"hash"
 	"io"
-	"io/ioutil"
 	"path"
+	"sync"
 
 	"github.com/flynn/go-tuf/data"
 )
@@ -74,33 +74,92 @@ func FileMetaEqual(actual data.FileMeta, expected data.FileMeta) error {
 
 const defaultHashAlgorithm = "sha512"
 
+var (
+	hashFuncsMtx sync.RWMutex
+	hashFuncs    = map[string]func() hash.Hash{
+		"sha256": sha256.New,
+		"sha512": sha512.New,
+	}
+)
+
+// RegisterHash makes the hash algorithm with the given name (as used in the
+// hashes of file metadata) available to GenerateFileMeta, replacing any
+// algorithm previously registered with that name. sha256 and sha512 are
+// registered by default.
+func RegisterHash(name string, h func() hash.Hash) {
+	hashFuncsMtx.Lock()
+	defer hashFuncsMtx.Unlock()
+	hashFuncs[name] = h
+}
+
+func hashFunc(name string) (func() hash.Hash, bool) {
+	hashFuncsMtx.RLock()
+	defer hashFuncsMtx.RUnlock()
+	h, ok := hashFuncs[name]
+	return h, ok
+}
+
+// GenerateFileMeta reads r and returns its length and hashes using each of
+// the given registered hash algorithms (see RegisterHash), defaulting to
+// sha512.
 func GenerateFileMeta(r io.Reader, hashAlgorithms ...string) (data.FileMeta, error) {
+	w, err := NewFileMetaWriter(hashAlgorithms...)
+	if err != nil {
+		return data.FileMeta{}, err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		return data.FileMeta{}, err
+	}
+	return w.FileMeta(), nil
+}
+
+// FileMetaWriter is an io.Writer which generates the file meta of the data
+// written to it, for when the data is not available as an io.Reader.
+type FileMetaWriter struct {
+	length int64
+	hashes map[string]hash.Hash
+}
+
+// NewFileMetaWriter returns a FileMetaWriter which generates hashes using
+// each of the given registered hash algorithms as in GenerateFileMeta.
+func NewFileMetaWriter(hashAlgorithms ...string) (*FileMetaWriter, error) {
 	if len(hashAlgorithms) == 0 {
 		hashAlgorithms = []string{defaultHashAlgorithm}
 	}
 	hashes := make(map[string]hash.Hash, len(hashAlgorithms))
 	for _, hashAlgorithm := range hashAlgorithms {
-		var h hash.Hash
-		switch hashAlgorithm {
-		case "sha256":
-			h = sha256.New()
-		case "sha512":
-			h = sha512.New()
-		default:
-			return data.FileMeta{}, ErrUnknownHashAlgorithm{hashAlgorithm}
+		newHash, ok := hashFunc(hashAlgorithm)
+		if !ok {
+			return nil, ErrUnknownHashAlgorithm{hashAlgorithm}
 		}
-		hashes[hashAlgorithm] = h
-		r = io.TeeReader(r, h)
+		hashes[hashAlgorithm] = newHash()
 	}
-	n, err := io.Copy(ioutil.Discard, r)
-	if err != nil {
-		return data.FileMeta{}, err
+	return &FileMetaWriter{hashes: hashes}, nil
+}
+
+func (w *FileMetaWriter) Write(p []byte) (int, error) {
+	for _, h := range w.hashes {
+		h.Write(p)
+	}
+	w.length += int64(len(p))
+	return len(p), nil
+}
+
+// Reset discards the data written so far.
+func (w *FileMetaWriter) Reset() {
+	for _, h := range w.hashes {
+		h.Reset()
 	}
-	m := data.FileMeta{Length: n, Hashes: make(data.Hashes, len(hashes))}
-	for hashAlgorithm, h := range hashes {
+	w.length = 0
+}
+
+// FileMeta returns the file meta of the data written so far.
+func (w *FileMetaWriter) FileMeta() data.FileMeta {
+	m := data.FileMeta{Length: w.length, Hashes: make(data.Hashes, len(w.hashes))}
+	for hashAlgorithm, h := range w.hashes {
 		m.Hashes[hashAlgorithm] = h.Sum(nil)
 	}
-	return m, nil
+	return m
 }
 
 func NormalizeTarget(p string) string {
@@ -2,6 +2,7 @@ package util
 
 import (
 	"bytes"
+	"crypto/sha512"
 	"encoding/hex"
 	"testing"
 
@@ -50,6 +51,21 @@ func (UtilSuite) TestGenerateFileMetaExplicit(c *C) {
 	}
 }
 
+func (UtilSuite) TestRegisterHash(c *C) {
+	_, err := GenerateFileMeta(bytes.NewReader([]byte("foo")), "sha384")
+	c.Assert(err, Equals, ErrUnknownHashAlgorithm{"sha384"})
+
+	RegisterHash("sha384", sha512.New384)
+	meta, err := GenerateFileMeta(bytes.NewReader([]byte("foo")), "sha384", "sha512")
+	c.Assert(err, IsNil)
+	c.Assert(meta.Hashes, HasLen, 2)
+	c.Assert(meta.Hashes["sha384"].String(), Equals, "98c11ffdfdd540676b1a137cb1a22b2a70350c9a44171d6b1180c6be5cbb2ee3f79d532c8a1dd9ef2e8e08e752a3babb")
+
+	// only the algorithms in the expected meta are compared
+	expected := data.FileMeta{Length: 3, Hashes: data.Hashes{"sha384": meta.Hashes["sha384"]}}
+	c.Assert(FileMetaEqual(meta, expected), IsNil)
+}
+
 func (UtilSuite) TestFileMetaEqual(c *C) {
 	type test struct {
 		name string
@@ -0,0 +1,52 @@
+package verify
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock provides the current time used to check whether metadata has
+// expired.
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+// RealClock is a Clock which returns the system time.
+var RealClock Clock = realClock{}
+
+// FakeClock is a Clock which returns a fixed time until it is changed with
+// Set or Advance, and is intended for deterministic testing of expiry. It is
+// safe for concurrent use.
+type FakeClock struct {
+	mtx sync.Mutex
+	now time.Time
+}
+
+// NewFakeClock returns a FakeClock set to now.
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.now
+}
+
+// Set sets the time returned by c.
+func (c *FakeClock) Set(now time.Time) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.now = now
+}
+
+// Advance moves the time returned by c forward by d.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.now = c.now.Add(d)
+}
@@ -17,6 +17,7 @@ func (r *Role) ValidKey(id string) bool {
 type DB struct {
 	roles map[string]*Role
 	keys  map[string]*data.Key
+	clock Clock
 }
 
 func NewDB() *DB {
@@ -26,6 +27,11 @@ func NewDB() *DB {
 	}
 }
 
+// SetClock sets the clock used to check whether metadata has expired.
+func (db *DB) SetClock(c Clock) {
+	db.clock = c
+}
+
 func (db *DB) AddKey(id string, k *data.Key) error {
 	v, ok := Verifiers[k.Type]
 	if !ok {
@@ -27,7 +27,7 @@ func (db *DB) Verify(s *data.Signed, role string, minVersion int) error {
 	if strings.ToLower(sm.Type) != strings.ToLower(role) {
 		return ErrWrongMetaType
 	}
-	if IsExpired(sm.Expires) {
+	if db.isExpired(sm.Expires) {
 		return ErrExpired{sm.Expires}
 	}
 	if sm.Version < minVersion {
@@ -37,31 +37,83 @@ func (db *DB) Verify(s *data.Signed, role string, minVersion int) error {
 	return nil
 }
 
+// IsExpired reports whether metadata expiring at t has expired, and is used
+// by DBs which have not had a clock set with SetClock.
+//
+// Deprecated: use DB.SetClock instead. IsExpired will be removed in a future
+// release.
 var IsExpired = func(t time.Time) bool {
 	return t.Sub(time.Now()) <= 0
 }
 
+// isExpired reports whether metadata expiring at t has expired according to
+// the DB's clock, falling back to IsExpired if no clock is set.
+func (db *DB) isExpired(t time.Time) bool {
+	if db.clock == nil {
+		return IsExpired(t)
+	}
+	return t.Sub(db.clock.Now()) <= 0
+}
+
 func (db *DB) VerifySignatures(s *data.Signed, role string) error {
 	if len(s.Signatures) == 0 {
 		return ErrNoSignatures
 	}
 
+	valid, unknownMethods, err := db.verifiedKeys(s, role)
+	if err != nil {
+		return err
+	}
+	if unknownMethods == len(s.Signatures) {
+		return ErrUnknownSignatureMethod
+	}
+	if len(valid) < db.GetRole(role).Threshold {
+		return ErrRoleThreshold
+	}
+
+	return nil
+}
+
+// CountSignatures returns the number of distinct keys of the given role
+// which have validly signed s, i.e. the number of signatures which count
+// towards the role's threshold. As in VerifySignatures, an error is returned
+// if any signature by one of the role's keys is invalid.
+func (db *DB) CountSignatures(s *data.Signed, role string) (int, error) {
+	valid, _, err := db.verifiedKeys(s, role)
+	if err != nil {
+		return 0, err
+	}
+	return len(valid), nil
+}
+
+// verifiedKeys verifies the signatures of s by keys of the given role,
+// returning the distinct key IDs of the verified signatures and the number
+// of signatures with an unknown method.
+func (db *DB) verifiedKeys(s *data.Signed, role string) (map[string]struct{}, int, error) {
 	roleData := db.GetRole(role)
 	if roleData == nil {
-		return ErrUnknownRole
+		return nil, 0, ErrUnknownRole
 	}
 
 	var decoded map[string]interface{}
 	if err := json.Unmarshal(s.Signed, &decoded); err != nil {
-		return err
+		return nil, 0, err
 	}
 	msg, err := cjson.Marshal(decoded)
 	if err != nil {
-		return err
+		return nil, 0, err
 	}
 
+	// valid contains the distinct key IDs of verified signatures, which are
+	// the only signatures counted towards the threshold (signatures with an
+	// unknown method are never counted)
 	valid := make(map[string]struct{})
+	unknownMethods := 0
 	for _, sig := range s.Signatures {
+		if _, ok := Verifiers[sig.Method]; !ok {
+			unknownMethods++
+			continue
+		}
 		if !roleData.ValidKey(sig.KeyID) {
 			continue
 		}
@@ -69,17 +121,16 @@ func (db *DB) VerifySignatures(s *data.Signed, role string) error {
 		if key == nil {
 			continue
 		}
+		if sig.Method != key.Type {
+			return nil, 0, ErrWrongMethod
+		}
 
 		if err := Verifiers[key.Type].Verify(key.Value.Public, msg, sig.Signature); err != nil {
-			return err
+			return nil, 0, err
 		}
 		valid[sig.KeyID] = struct{}{}
 	}
-	if len(valid) < roleData.Threshold {
-		return ErrRoleThreshold
-	}
-
-	return nil
+	return valid, unknownMethods, nil
 }
 
 func Unmarshal(b []byte, v interface{}, role string, minVersion int, db *DB) error {
@@ -59,11 +59,13 @@ func (VerifySuite) Test(c *C) {
 		exp   *time.Time
 		typ   string
 		role  string
+		clock Clock
 		err   error
 		mut   func(*test)
 	}
 
 	expiredTime := time.Now().Add(-time.Hour)
+	validTime := time.Now().Add(time.Hour)
 	minVer := 10
 	tests := []test{
 		{
@@ -150,6 +152,36 @@ func (VerifySuite) Test(c *C) {
 			},
 			err: ErrRoleThreshold,
 		},
+		{
+			name: "unknown signature method",
+			mut:  func(t *test) { t.s.Signatures[0].Method = "xxxxxxx" },
+			err:  ErrUnknownSignatureMethod,
+		},
+		{
+			name: "unknown signature method below threshold",
+			mut: func(t *test) {
+				k, _ := sign.GenerateEd25519Key()
+				sign.Sign(t.s, k.Signer())
+				t.s.Signatures[1].Method = "xxxxxxx"
+				t.keys = append(t.keys, k.PublicData())
+				t.roles["root"].KeyIDs = append(t.roles["root"].KeyIDs, k.PublicData().ID())
+				t.roles["root"].Threshold = 2
+			},
+			err: ErrRoleThreshold,
+		},
+		{
+			name: "unknown signature method with valid signature",
+			mut: func(t *test) {
+				sig := t.s.Signatures[0]
+				sig.Method = "xxxxxxx"
+				t.s.Signatures = append(t.s.Signatures, sig)
+			},
+		},
+		{
+			name: "signature method does not match key type",
+			mut:  func(t *test) { t.s.Signatures[0].Method = data.KeyTypeECDSA_SHA2_P256 },
+			err:  ErrWrongMethod,
+		},
 		{
 			name: "wrong type",
 			typ:  "bar",
@@ -165,6 +197,17 @@ func (VerifySuite) Test(c *C) {
 			exp:  &expiredTime,
 			err:  ErrExpired{expiredTime},
 		},
+		{
+			name:  "expired according to clock",
+			exp:   &validTime,
+			clock: NewFakeClock(validTime.Add(time.Second)),
+			err:   ErrExpired{validTime},
+		},
+		{
+			name:  "not expired according to clock",
+			exp:   &expiredTime,
+			clock: NewFakeClock(expiredTime.Add(-time.Second)),
+		},
 		{
 			name: "valid ecdsa signature",
 			mut: func(t *test) {
@@ -221,6 +264,9 @@ func (VerifySuite) Test(c *C) {
 		}
 
 		db := NewDB()
+		if t.clock != nil {
+			db.SetClock(t.clock)
+		}
 		for _, k := range t.keys {
 			err := db.AddKey(k.ID(), k)
 			c.Assert(err, IsNil)